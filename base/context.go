@@ -21,13 +21,28 @@ import (
 	"log"
 	"os"
 	"os/user"
+	"strings"
+	"time"
 )
 
+// DefaultClusterName is the cluster name used unless --cluster is specified.
+const DefaultClusterName = "cockroach"
+
 // Base context defaults.
 const (
 	defaultCerts  = "certs"
 	defaultPort   = 8080
 	defaultRegion = ""
+	defaultImage  = "cockroachdb/cockroach"
+	// Anyone can reach the cockroach port.
+	defaultAllowedCIDRs = "0.0.0.0/0"
+	// With the default replication factor of 3, fewer nodes lose quorum.
+	defaultMinNodes    = 3
+	defaultNodeTimeout = 5 * time.Minute
+	defaultStateDir    = "${HOME}/.cockroach-prod"
+	// Load balancer creation can take a few minutes on GCE.
+	defaultOperationTimeout = 10 * time.Minute
+	defaultAPIRetryTimeout  = 2 * time.Minute
 	// GCEProject defaults to "cockroach-${USER}"
 	defaultGCETokenPath = "${HOME}/.docker/machine/gce_token"
 )
@@ -36,16 +51,45 @@ const (
 type Context struct {
 	// Certificates directory.
 	Certs string
+	// Directory for local state, eg: init progress.
+	StateDir string
+	// Run nodes in insecure mode, without certificates.
+	Insecure bool
 	// Port for cockroach nodes to listen on.
 	Port int64
+	// Cluster name, used as a prefix for node and cloud resource names.
+	Cluster string
 	// Region to run in.
 	Region string
+	// Zone to run in, within the region. Empty for the driver default.
+	Zone string
+	// Comma-separated list of CIDRs allowed to reach the cockroach port.
+	AllowedCIDRs string
+	// Cockroach docker image for new nodes, optionally with a tag or digest.
+	Image string
+	// Minimum number of nodes to keep when removing nodes.
+	MinNodes int
+	// How long to wait for a node to become healthy.
+	NodeTimeout time.Duration
+	// How long to wait for a cloud operation (eg: creating a resource) to complete.
+	OperationTimeout time.Duration
+	// How long to retry cloud API calls failing with retryable errors (eg: throttling).
+	APIRetryTimeout time.Duration
+	// Size in GB of the data volume created for new nodes. If zero, data is
+	// stored on the instance disk.
+	VolumeSize int64
+	// Type of the data volume. Driver-specific, empty for the driver default.
+	VolumeType string
 
 	// Driver-specific flags.
 	// Project name for Google Compute Engine.
 	GCEProject string
 	// OAuth token path for Google Compute Engine.
 	GCETokenPath string
+	// Inventory file of pre-provisioned hosts for the ssh driver.
+	SSHInventory string
+	// Access token for DigitalOcean. If empty, $DIGITALOCEAN_ACCESS_TOKEN is used.
+	DOAccessToken string
 }
 
 // NewContext returns a context with initialized values.
@@ -58,8 +102,16 @@ func NewContext() *Context {
 // InitDefaults sets up the default values for a context.
 func (ctx *Context) InitDefaults() {
 	ctx.Certs = defaultCerts
+	ctx.StateDir = os.ExpandEnv(defaultStateDir)
 	ctx.Port = defaultPort
+	ctx.Cluster = DefaultClusterName
 	ctx.Region = defaultRegion
+	ctx.AllowedCIDRs = defaultAllowedCIDRs
+	ctx.Image = defaultImage
+	ctx.MinNodes = defaultMinNodes
+	ctx.NodeTimeout = defaultNodeTimeout
+	ctx.OperationTimeout = defaultOperationTimeout
+	ctx.APIRetryTimeout = defaultAPIRetryTimeout
 
 	user, err := user.Current()
 	if err != nil {
@@ -69,3 +121,14 @@ func (ctx *Context) InitDefaults() {
 
 	ctx.GCETokenPath = os.ExpandEnv(defaultGCETokenPath)
 }
+
+// AllowedCIDRList returns the allowed CIDRs as a list.
+func (ctx *Context) AllowedCIDRList() []string {
+	var ret []string
+	for _, cidr := range strings.Split(ctx.AllowedCIDRs, ",") {
+		if cidr = strings.TrimSpace(cidr); cidr != "" {
+			ret = append(ret, cidr)
+		}
+	}
+	return ret
+}
@@ -0,0 +1,107 @@
+// Copyright 2015 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+//
+// Author: Marc Berhault (marc@cockroachlabs.com)
+
+package base
+
+import "fmt"
+
+// ErrorKind categorizes command failures. Each kind has its own exit code.
+type ErrorKind int
+
+// Error kinds. The exit code is the kind value.
+const (
+	// UnknownError is anything not covered below, eg: local certificate files.
+	UnknownError ErrorKind = iota + 1
+	// ValidationError is a bad command line, flag, or cluster state.
+	ValidationError
+	// CredentialsError is a failure to load or refresh cloud credentials.
+	CredentialsError
+	// CloudAPIError is a failed call to the cloud provider.
+	CloudAPIError
+	// DockerMachineError is a failed docker-machine command.
+	DockerMachineError
+	// DockerError is a failed docker command or an unhealthy cockroach container.
+	DockerError
+	// InterruptedError is a command stopped by an interrupt (Ctrl-C).
+	InterruptedError
+)
+
+var errorKindNames = map[ErrorKind]string{
+	UnknownError:       "unknown",
+	ValidationError:    "validation",
+	CredentialsError:   "credentials",
+	CloudAPIError:      "cloud API",
+	DockerMachineError: "docker-machine",
+	DockerError:        "docker",
+	InterruptedError:   "interrupted",
+}
+
+func (k ErrorKind) String() string {
+	if name, ok := errorKindNames[k]; ok {
+		return name
+	}
+	return errorKindNames[UnknownError]
+}
+
+// ExitCode returns the process exit code for this kind of error.
+func (k ErrorKind) ExitCode() int {
+	if _, ok := errorKindNames[k]; ok {
+		return int(k)
+	}
+	return int(UnknownError)
+}
+
+// Error is a categorized error. Step describes what was being done.
+type Error struct {
+	Kind ErrorKind
+	Step string
+	Err  error
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %v", e.Step, e.Err)
+}
+
+// NewError wraps err with the given kind and step, the step being a format
+// string. If err is already an *Error, its kind is kept since it is more
+// specific, and the step is prepended to its step.
+func NewError(kind ErrorKind, err error, format string, args ...interface{}) error {
+	step := fmt.Sprintf(format, args...)
+	if e, ok := err.(*Error); ok {
+		return &Error{Kind: e.Kind, Step: step + ": " + e.Step, Err: e.Err}
+	}
+	return &Error{Kind: kind, Step: step, Err: err}
+}
+
+// ValidationErrorf returns a validation error with the formatted message.
+func ValidationErrorf(format string, args ...interface{}) error {
+	return &Error{Kind: ValidationError, Step: "validation", Err: fmt.Errorf(format, args...)}
+}
+
+// Interrupted wraps err as an InterruptedError. Unlike NewError, the kind of
+// err is replaced: failures caused by the interrupt are not meaningful.
+func Interrupted(err error) error {
+	return &Error{Kind: InterruptedError, Step: "interrupted", Err: err}
+}
+
+// GetErrorKind returns the kind of err, UnknownError if it is not an *Error.
+func GetErrorKind(err error) ErrorKind {
+	if e, ok := err.(*Error); ok {
+		return e.Kind
+	}
+	return UnknownError
+}
@@ -0,0 +1,125 @@
+// Copyright 2015 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+//
+// Author: Marc Berhault (marc@cockroachlabs.com)
+
+package base
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/cockroachdb/cockroach/util"
+	"gopkg.in/yaml.v1"
+)
+
+// ClusterSpec describes the desired shape of a cluster. It is read from a YAML
+// or JSON file. Empty fields leave the corresponding Context value alone.
+type ClusterSpec struct {
+	// Name is the cluster name, see Context.Cluster.
+	Name string `json:"name" yaml:"name"`
+	// Cloud is the platform driver, eg: aws or gce.
+	Cloud  string `json:"cloud" yaml:"cloud"`
+	Region string `json:"region" yaml:"region"`
+	// Zones within the region. Only a single zone is currently supported.
+	Zones []string `json:"zones" yaml:"zones"`
+	// Nodes is the number of cockroach nodes.
+	Nodes int    `json:"nodes" yaml:"nodes"`
+	Image string `json:"image" yaml:"image"`
+	Port  int64  `json:"port" yaml:"port"`
+	// Volume describes the persistent data volume of new nodes.
+	Volume struct {
+		Size int64  `json:"size" yaml:"size"`
+		Type string `json:"type" yaml:"type"`
+	} `json:"volume" yaml:"volume"`
+	// AllowedCIDRs can reach the cockroach port.
+	AllowedCIDRs []string `json:"allowed_cidrs" yaml:"allowed_cidrs"`
+	// GCEProject is the Google Compute Engine project.
+	GCEProject string `json:"gce_project" yaml:"gce_project"`
+	// SSHInventory is the inventory file of the ssh driver.
+	SSHInventory string `json:"ssh_inventory" yaml:"ssh_inventory"`
+}
+
+// LoadClusterSpec reads and validates the spec file. Files ending in .json
+// are parsed as JSON, all others as YAML.
+func LoadClusterSpec(path string) (*ClusterSpec, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	spec := &ClusterSpec{}
+	if strings.ToLower(filepath.Ext(path)) == ".json" {
+		err = json.Unmarshal(contents, spec)
+	} else {
+		err = yaml.Unmarshal(contents, spec)
+	}
+	if err != nil {
+		return nil, util.Errorf("could not parse %s: %v", path, err)
+	}
+
+	if err := spec.validate(); err != nil {
+		return nil, util.Errorf("invalid spec %s: %v", path, err)
+	}
+	return spec, nil
+}
+
+func (spec *ClusterSpec) validate() error {
+	if spec.Cloud == "" || spec.Region == "" {
+		return util.Errorf("cloud and region must be specified")
+	}
+	if spec.Nodes < 1 {
+		return util.Errorf("nodes must be > 0, got %d", spec.Nodes)
+	}
+	if len(spec.Zones) > 1 {
+		return util.Errorf("only a single zone is supported, got %v", spec.Zones)
+	}
+	if spec.Port < 0 || spec.Volume.Size < 0 {
+		return util.Errorf("port and volume size must not be negative")
+	}
+	return nil
+}
+
+// ApplyTo sets the Context fields specified in the spec. Fields for which
+// isFlagSet returns true (given the flag name) were set on the command line
+// and are left alone.
+func (spec *ClusterSpec) ApplyTo(ctx *Context, isFlagSet func(name string) bool) {
+	setString := func(flagName string, field *string, value string) {
+		if value != "" && !isFlagSet(flagName) {
+			*field = value
+		}
+	}
+	setString("cluster", &ctx.Cluster, spec.Name)
+	if spec.Cloud != "" && spec.Region != "" {
+		setString("region", &ctx.Region, spec.Cloud+":"+spec.Region)
+	}
+	if len(spec.Zones) > 0 {
+		setString("zone", &ctx.Zone, spec.Zones[0])
+	}
+	setString("image", &ctx.Image, spec.Image)
+	setString("volume-type", &ctx.VolumeType, spec.Volume.Type)
+	setString("allowed-cidrs", &ctx.AllowedCIDRs, strings.Join(spec.AllowedCIDRs, ","))
+	setString("gce-project", &ctx.GCEProject, spec.GCEProject)
+	setString("ssh-inventory", &ctx.SSHInventory, spec.SSHInventory)
+
+	if spec.Port != 0 && !isFlagSet("port") {
+		ctx.Port = spec.Port
+	}
+	if spec.Volume.Size != 0 && !isFlagSet("volume-size") {
+		ctx.VolumeSize = spec.Volume.Size
+	}
+}
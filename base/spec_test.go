@@ -0,0 +1,116 @@
+// Copyright 2015 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+//
+// Author: Marc Berhault (marc@cockroachlabs.com)
+
+package base
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestClusterSpecValidate(t *testing.T) {
+	testCases := []struct {
+		spec  ClusterSpec
+		valid bool
+	}{
+		{ClusterSpec{Cloud: "aws", Region: "us-east-1", Nodes: 3}, true},
+		{ClusterSpec{Cloud: "aws", Region: "us-east-1", Nodes: 1, Zones: []string{"us-east-1a"}}, true},
+		{ClusterSpec{Region: "us-east-1", Nodes: 3}, false},
+		{ClusterSpec{Cloud: "aws", Nodes: 3}, false},
+		{ClusterSpec{Cloud: "aws", Region: "us-east-1"}, false},
+		{ClusterSpec{Cloud: "aws", Region: "us-east-1", Nodes: -1}, false},
+		{ClusterSpec{Cloud: "aws", Region: "us-east-1", Nodes: 3, Zones: []string{"us-east-1a", "us-east-1b"}}, false},
+		{ClusterSpec{Cloud: "aws", Region: "us-east-1", Nodes: 3, Port: -1}, false},
+	}
+
+	for i, tc := range testCases {
+		err := tc.spec.validate()
+		if tc.valid && err != nil {
+			t.Errorf("%d: expected valid spec, got %v", i, err)
+		} else if !tc.valid && err == nil {
+			t.Errorf("%d: expected invalid spec", i)
+		}
+	}
+}
+
+func TestClusterSpecApplyTo(t *testing.T) {
+	spec := &ClusterSpec{
+		Name:         "prod",
+		Cloud:        "gce",
+		Region:       "us-central1",
+		Zones:        []string{"us-central1-b"},
+		Nodes:        5,
+		Image:        "cockroachdb/cockroach:beta",
+		Port:         26257,
+		AllowedCIDRs: []string{"10.0.0.0/8", "192.168.0.0/16"},
+		GCEProject:   "my-project",
+	}
+	spec.Volume.Size = 100
+	spec.Volume.Type = "pd-ssd"
+
+	testCases := []struct {
+		// Flags set on the command line.
+		flags  []string
+		expect func(ctx *Context)
+	}{
+		{nil, func(ctx *Context) {
+			ctx.Cluster = "prod"
+			ctx.Region = "gce:us-central1"
+			ctx.Zone = "us-central1-b"
+			ctx.Image = "cockroachdb/cockroach:beta"
+			ctx.Port = 26257
+			ctx.AllowedCIDRs = "10.0.0.0/8,192.168.0.0/16"
+			ctx.GCEProject = "my-project"
+			ctx.VolumeSize = 100
+			ctx.VolumeType = "pd-ssd"
+		}},
+		// Flags win over the spec.
+		{[]string{"cluster", "region", "zone", "image", "port", "allowed-cidrs", "gce-project",
+			"volume-size", "volume-type"}, func(ctx *Context) {}},
+		{[]string{"port", "image"}, func(ctx *Context) {
+			ctx.Cluster = "prod"
+			ctx.Region = "gce:us-central1"
+			ctx.Zone = "us-central1-b"
+			ctx.AllowedCIDRs = "10.0.0.0/8,192.168.0.0/16"
+			ctx.GCEProject = "my-project"
+			ctx.VolumeSize = 100
+			ctx.VolumeType = "pd-ssd"
+		}},
+	}
+
+	for i, tc := range testCases {
+		flags := map[string]bool{}
+		for _, f := range tc.flags {
+			flags[f] = true
+		}
+		ctx := NewContext()
+		expected := NewContext()
+		tc.expect(expected)
+
+		spec.ApplyTo(ctx, func(name string) bool { return flags[name] })
+		if !reflect.DeepEqual(ctx, expected) {
+			t.Errorf("%d: expected context\n%+v\ngot\n%+v", i, expected, ctx)
+		}
+	}
+
+	// Empty spec fields leave the context alone.
+	ctx := NewContext()
+	(&ClusterSpec{}).ApplyTo(ctx, func(string) bool { return false })
+	if expected := NewContext(); !reflect.DeepEqual(ctx, expected) {
+		t.Errorf("expected context\n%+v\ngot\n%+v", expected, ctx)
+	}
+}
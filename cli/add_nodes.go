@@ -20,88 +20,180 @@ package cli
 import (
 	"strconv"
 
+	"github.com/cockroachdb/cockroach-prod/base"
 	"github.com/cockroachdb/cockroach-prod/docker"
 	"github.com/cockroachdb/cockroach-prod/drivers"
-	"github.com/cockroachdb/cockroach/util"
 	"github.com/cockroachdb/cockroach/util/log"
 	"github.com/spf13/cobra"
+	"golang.org/x/net/context"
 )
 
 var addNodesCmd = &cobra.Command{
 	Use:   "add-nodes N",
 	Short: "add new nodes\n",
 	Long: `
-Add N new nodes to an existing cluster
+Add N new nodes to an existing cluster. Up to --parallelism nodes are created at
+the same time. All nodes are attempted even if some fail, and a summary is printed
+at the end.
 `,
-	Run: runAddNodes,
+	Run: runE(runAddNodes),
 }
 
-func runAddNodes(cmd *cobra.Command, args []string) {
+func runAddNodes(ctx context.Context, cmd *cobra.Command, args []string) error {
 	if len(args) != 1 {
 		cmd.Usage()
-		return
+		return base.ValidationErrorf("expected a single argument, got %d", len(args))
 	}
 	numNodes, err := strconv.Atoi(args[0])
 	if err != nil || numNodes < 1 {
-		log.Errorf("argument %s must be an integer > 0", args)
-		return
+		return base.ValidationErrorf("argument %s must be an integer > 0", args[0])
+	}
+	if err := validateParallelism(); err != nil {
+		return err
 	}
 
 	driver, err := NewDriver(Context)
 	if err != nil {
-		log.Errorf("could not create driver: %v", err)
-		return
+		return err
 	}
 
-	for i := 1; i <= numNodes; i++ {
-		log.Infof("adding node %d of %d", i, numNodes)
-		err := AddOneNode(driver)
-		if err != nil {
-			log.Errorf("problem adding node: %v", err)
-			return
-		}
+	ctx, lock, err := acquireLock(ctx, driver, cmd, args)
+	if err != nil {
+		return err
 	}
+	defer lock.release()
+
+	rb := &rollback{}
+	return rb.finish(ctx, addNodes(ctx, driver, numNodes, rb))
 }
 
-// AddOneNode is a helper to add a single node. Called repeatedly.
-func AddOneNode(driver drivers.Driver) error {
-	nodes, err := docker.ListCockroachNodes()
+// reserveNodeNames returns the names of 'count' new nodes, following the
+// largest index of the existing nodes. The cluster lock keeps other
+// invocations from using the same names.
+func reserveNodeNames(nodes []string, count int) ([]string, error) {
+	largestIndex, err := docker.GetLargestNodeIndex(Context.Cluster, nodes)
 	if err != nil {
-		return util.Errorf("failed to get list of existing cockroach nodes: %v", err)
+		return nil, base.NewError(base.DockerMachineError, err, "parsing existing node list")
 	}
-	if len(nodes) == 0 {
-		return util.Errorf("no existing cockroach nodes detected, does the cluster exist?")
+
+	names := make([]string, count)
+	for i := range names {
+		names[i] = docker.MakeNodeName(Context.Cluster, largestIndex+1+i)
 	}
+	return names, nil
+}
 
-	largestIndex, err := docker.GetLargestNodeIndex(nodes)
+// addNodes adds 'count' nodes, up to --parallelism at a time. Failures do not
+// stop the other nodes: a summary is printed once all are done.
+func addNodes(ctx context.Context, driver drivers.Driver, count int, rb *rollback) error {
+	nodes, err := docker.ListCockroachNodes(Context.Cluster)
+	if err != nil {
+		return base.NewError(base.DockerMachineError, err, "listing existing cockroach nodes")
+	}
+	if len(nodes) == 0 {
+		return base.ValidationErrorf("no existing cockroach nodes detected, does the cluster exist?")
+	}
+	nodeNames, err := reserveNodeNames(nodes, count)
 	if err != nil {
-		return util.Errorf("problem parsing existing node list: %v", err)
+		return err
+	}
+	image, err := newNodeImage(nodes)
+	if err != nil {
+		return err
 	}
 
-	nodeName := docker.MakeNodeName(largestIndex + 1)
+	log.Infof("adding nodes %v running %s", nodeNames, image.image)
+	errs := runOnNodes(ctx, nodeNames, false, func(ctx context.Context, nodeName string) error {
+		return AddOneNode(ctx, driver, nodeName, image, rb)
+	})
+	return reportNodeResults("added", nodeNames, errs)
+}
 
-	// Create node.
-	err = docker.CreateMachine(driver, nodeName)
+// newNodeImage returns the image new nodes run: the image of the existing
+// nodes, or the most recent one during an upgrade. New nodes record the same
+// previous image so that rolling back the upgrade includes them.
+// The image from the context is used if no node has a cockroach container.
+func newNodeImage(nodes []string) (nodeImage, error) {
+	images, err := readNodeImages(nodes)
+	if err != nil {
+		return nodeImage{}, base.NewError(base.DockerError, err, "reading node images")
+	}
+	last, err := findClusterUpgrade(nodes, images)
 	if err != nil {
-		return util.Errorf("could not create machine %s: %v", nodeName, err)
+		return nodeImage{}, base.NewError(base.ValidationError, err, "finding the image run by the cluster")
+	}
+	if last.current == "" {
+		return nodeImage{image: Context.Image}, nil
+	}
+	return nodeImage{last.current, last.previous}, nil
+}
+
+// AddOneNode creates the named node and starts cockroach on it with 'image'.
+// Removing the node is recorded in 'rb' before the machine is created, and
+// dropped once the node is ready: interrupting other nodes keeps this one.
+func AddOneNode(ctx context.Context, driver drivers.Driver, nodeName string, image nodeImage,
+	rb *rollback) error {
+	// Create node. An interrupted create may leave a partial machine behind,
+	// so the rollback is recorded first.
+	removeStep := rb.add("remove machine "+nodeName, func(ctx context.Context) error {
+		return removeMachine(ctx, driver, nodeName)
+	})
+	err := docker.CreateMachine(ctx, driver, nodeName)
+	if err != nil {
+		return base.NewError(base.DockerMachineError, err, "creating machine %s", nodeName)
 	}
 
 	// Lookup node info.
 	nodeConfig, err := driver.GetNodeConfig(nodeName)
 	if err != nil {
-		return util.Errorf("could not get node config for %s: %v", nodeName, err)
+		return base.NewError(base.CloudAPIError, err, "getting node config for %s", nodeName)
+	}
+
+	// Do "prepare node" logic.
+	err = driver.PrepareNode(ctx, nodeName, nodeConfig, true)
+	if err != nil {
+		return base.NewError(base.CloudAPIError, err, "running PrepareNode steps for %s", nodeName)
+	}
+
+	// Install node certificates.
+	err = installNodeCerts(ctx, nodeName, nodeConfig)
+	if err != nil {
+		return err
 	}
 
 	// Do "start node" logic.
-	err = driver.StartNode(nodeName, nodeConfig)
+	err = driver.StartNode(ctx, nodeName, nodeConfig)
 	if err != nil {
-		return util.Errorf("could not run StartNode steps for %s: %v", nodeName, err)
+		return base.NewError(base.CloudAPIError, err, "running StartNode steps for %s", nodeName)
 	}
 
 	// Start the cockroach node.
-	err = docker.RunDockerStart(driver, nodeName, nodeConfig)
+	err = docker.RunDockerStartImage(ctx, driver, nodeName, nodeConfig, image.image, image.previous)
+	if err != nil {
+		return base.NewError(base.DockerError, err, "starting cockroach node %s", nodeName)
+	}
+
+	// Wait for it to be up.
+	err = docker.WaitForNodeReady(ctx, driver, nodeName, nodeConfig, Context.NodeTimeout)
+	if err != nil {
+		return base.NewError(base.DockerError, err, "waiting for cockroach node %s", nodeName)
+	}
+	rb.drop(removeStep)
+	return nil
+}
+
+// removeMachine removes the node's machine, then runs the driver steps for
+// removed nodes (eg: deleting its data volume).
+func removeMachine(ctx context.Context, driver drivers.Driver, nodeName string) error {
+	err := docker.RemoveMachine(ctx, nodeName)
+	if err != nil {
+		return base.NewError(base.DockerMachineError, err, "removing machine %s", nodeName)
+	}
+	log.Infof("removed machine %s", nodeName)
+
+	err = driver.AfterNodeRemoved(ctx, nodeName)
 	if err != nil {
-		return util.Errorf("could not initialize first cockroach node %s: %v", nodeName, err)
+		return base.NewError(base.CloudAPIError, err, "running AfterNodeRemoved steps for %s", nodeName)
 	}
 	return nil
 }
@@ -0,0 +1,77 @@
+// Copyright 2015 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+//
+// Author: Marc Berhault (marc@cockroachlabs.com)
+
+package cli
+
+import (
+	"testing"
+
+	"github.com/cockroachdb/cockroach-prod/base"
+	"golang.org/x/net/context"
+)
+
+func TestAddOneNode(t *testing.T) {
+	c := newTestCluster(t)
+	defer c.close()
+	c.init()
+
+	node := c.nodeName(1)
+	rb := &rollback{}
+	if err := AddOneNode(context.Background(), c.driver, node, nodeImage{image: Context.Image}, rb); err != nil {
+		t.Fatalf("adding node %s failed: %v", node, err)
+	}
+	if !c.isRunning(node) {
+		t.Errorf("node %s is not running", node)
+	}
+	if len(rb.steps) != 0 {
+		t.Errorf("expected no rollback steps once the node is ready, got %d", len(rb.steps))
+	}
+}
+
+// TestAddOneNodeFailures injects a failure at each step of adding a node, and
+// checks that removing the node is left in the rollback.
+func TestAddOneNodeFailures(t *testing.T) {
+	testCases := []stepFailure{
+		{"Machines.Create", base.DockerMachineError},
+		{"GetNodeConfig", base.CloudAPIError},
+		{"PrepareNode", base.CloudAPIError},
+		{"Machines.Copy", base.DockerMachineError},
+		{"StartNode", base.CloudAPIError},
+		{"Containers.Start", base.DockerError},
+		{"", base.DockerError},
+	}
+
+	for _, tc := range testCases {
+		func() {
+			c := newTestCluster(t)
+			defer c.close()
+			c.init()
+
+			c.inject(tc)
+			rb := &rollback{}
+			err := AddOneNode(context.Background(), c.driver, c.nodeName(1), nodeImage{image: Context.Image}, rb)
+			c.checkFailure(tc, err)
+			if len(rb.steps) != 1 {
+				t.Errorf("%s: expected the node removal in the rollback, got %d steps", tc, len(rb.steps))
+			}
+			c.clear(tc)
+			if !c.isRunning(c.nodeName(0)) {
+				t.Errorf("%s: first node is not running", tc)
+			}
+		}()
+	}
+}
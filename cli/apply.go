@@ -0,0 +1,276 @@
+// Copyright 2015 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+//
+// Author: Marc Berhault (marc@cockroachlabs.com)
+
+package cli
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/cockroachdb/cockroach-prod/base"
+	"github.com/cockroachdb/cockroach-prod/docker"
+	"github.com/cockroachdb/cockroach-prod/drivers"
+	"github.com/cockroachdb/cockroach/util/log"
+	"github.com/spf13/cobra"
+	"golang.org/x/net/context"
+)
+
+var (
+	applySpecFile string
+	applyDryRun   bool
+)
+
+var applyCmd = &cobra.Command{
+	Use:   "apply -f <spec file>",
+	Short: "converge the cluster to a spec file",
+	Long: `
+Converge the cluster to the YAML or JSON spec file. The spec describes the
+cluster name, cloud, region and zone, number of nodes, image, port, data volume settings and allowed
+CIDRs. Flags override values from the file.
+
+The spec is compared against the existing nodes and load balancer setup. The
+cluster is initialized if it does not exist, the load balancer is created if
+missing, stopped nodes are started, and nodes are added or removed to match the
+node count. The most recently added nodes are removed first.
+Use --dry-run to only print the changes.
+
+Example spec:
+
+  name: staging
+  cloud: aws
+  region: us-east-1
+  zones: [us-east-1b]
+  nodes: 5
+  image: cockroachdb/cockroach:beta-20150915
+  port: 26257
+  volume:
+    size: 100
+    type: gp2
+  allowed_cidrs: [10.0.0.0/8]
+`,
+	Run: runE(runApply),
+}
+
+// applyPlan lists the changes needed to converge the cluster.
+type applyPlan struct {
+	initCluster        bool
+	resumeInit         bool
+	setupLoadBalancer  bool
+	createLoadBalancer bool
+	start              []string
+	create             int
+	remove             []string
+}
+
+func (p applyPlan) empty() bool {
+	return !p.initCluster && !p.resumeInit && !p.setupLoadBalancer &&
+		len(p.start) == 0 && p.create == 0 && len(p.remove) == 0
+}
+
+func (p applyPlan) String() string {
+	if p.empty() {
+		return "cluster matches spec, nothing to do"
+	}
+	var lines []string
+	if p.initCluster {
+		lines = append(lines, "initialize cluster with 1 node")
+	}
+	if p.resumeInit {
+		lines = append(lines, "resume interrupted init")
+	}
+	if p.setupLoadBalancer {
+		lines = append(lines, "set up load balancer and firewall")
+	}
+	if len(p.start) > 0 {
+		lines = append(lines, fmt.Sprintf("start nodes: %s", strings.Join(p.start, ", ")))
+	}
+	if p.create > 0 {
+		lines = append(lines, fmt.Sprintf("add %d nodes", p.create))
+	}
+	if len(p.remove) > 0 {
+		lines = append(lines, fmt.Sprintf("remove nodes: %s", strings.Join(p.remove, ", ")))
+	}
+	return "  " + strings.Join(lines, "\n  ")
+}
+
+func runApply(ctx context.Context, cmd *cobra.Command, args []string) error {
+	if len(args) != 0 || applySpecFile == "" {
+		cmd.Usage()
+		return base.ValidationErrorf("a spec file must be specified with -f, and no arguments")
+	}
+	if err := validateParallelism(); err != nil {
+		return err
+	}
+
+	spec, err := base.LoadClusterSpec(applySpecFile)
+	if err != nil {
+		return base.NewError(base.ValidationError, err, "loading spec %s", applySpecFile)
+	}
+	spec.ApplyTo(Context, func(name string) bool {
+		f := cmd.Flags().Lookup(name)
+		return f != nil && f.Changed
+	})
+
+	driver, err := NewDriver(Context)
+	if err != nil {
+		return err
+	}
+
+	// The plan is built while holding the lock, so a concurrent command cannot
+	// change the cluster between planning and execution.
+	ctx, lock, err := acquireLock(ctx, driver, cmd, args)
+	if err != nil {
+		return err
+	}
+	defer lock.release()
+
+	nodes, err := docker.ListCockroachNodes(Context.Cluster)
+	if err != nil {
+		return base.NewError(base.DockerMachineError, err, "listing existing cockroach nodes")
+	}
+
+	progress, err := loadInitProgress()
+	if err != nil {
+		return base.NewError(base.UnknownError, err, "loading init progress from %s", initProgressPath())
+	}
+
+	// Compare the spec with what exists.
+	plan := applyPlan{}
+	if len(nodes) == 0 {
+		plan.initCluster = true
+		plan.create = spec.Nodes - 1
+		progress = &initProgress{Node: docker.MakeNodeName(Context.Cluster, 0)}
+	} else {
+		plan.resumeInit = progress != nil && !progress.isComplete()
+		status := driver.GetStatus()
+		plan.createLoadBalancer = status.LoadBalancerAddress == ""
+		plan.setupLoadBalancer = plan.createLoadBalancer || status.Firewall == "" ||
+			(status.AllowedCIDRs != nil && !drivers.SameCIDRs(status.AllowedCIDRs, Context.AllowedCIDRList()))
+
+		// Nodes must be running to be removed cleanly, so we start all of them.
+		for _, nodeName := range nodes {
+			state, err := docker.GetMachineState(nodeName)
+			if err != nil {
+				return base.NewError(base.DockerMachineError, err, "getting machine state for %s", nodeName)
+			}
+			if state != "Running" {
+				plan.start = append(plan.start, nodeName)
+			}
+		}
+
+		if spec.Nodes > len(nodes) {
+			plan.create = spec.Nodes - len(nodes)
+		} else if spec.Nodes < len(nodes) {
+			if spec.Nodes < Context.MinNodes {
+				return base.ValidationErrorf("spec has %d nodes, less than --min-nodes=%d", spec.Nodes, Context.MinNodes)
+			}
+			plan.remove, err = newestNodes(nodes, len(nodes)-spec.Nodes)
+			if err != nil {
+				return base.NewError(base.DockerMachineError, err, "parsing existing node list")
+			}
+		}
+	}
+
+	fmt.Printf("Changes to converge to %s:\n%s\n", applySpecFile, plan)
+	if applyDryRun || plan.empty() {
+		return nil
+	}
+
+	rb := &rollback{}
+	return rb.finish(ctx, executePlan(ctx, driver, plan, nodes, progress, rb))
+}
+
+// executePlan makes the changes in 'plan'. Undoing the resources it creates is
+// recorded in 'rb'.
+func executePlan(ctx context.Context, driver drivers.Driver, plan applyPlan, nodes []string,
+	progress *initProgress, rb *rollback) error {
+	if plan.initCluster || plan.resumeInit {
+		log.Info("initializing cluster")
+		if err := runInitSteps(ctx, driver, progress, rb); err != nil {
+			return err
+		}
+	}
+
+	if plan.setupLoadBalancer {
+		log.Info("setting up load balancer")
+		// Only resources created by this run are torn down on interrupt. An
+		// existing load balancer only has its firewall rules converged.
+		var teardownStep *rollbackStep
+		if plan.createLoadBalancer {
+			teardownStep = rb.add("tear down cluster resources", driver.Teardown)
+		}
+		if err := driver.AfterFirstNode(ctx); err != nil {
+			return base.NewError(base.CloudAPIError, err, "running AfterFirstNode steps")
+		}
+		if teardownStep != nil {
+			rb.drop(teardownStep)
+		}
+	}
+
+	for _, nodeName := range plan.start {
+		log.Infof("starting node %s", nodeName)
+		if err := StartOneNode(ctx, driver, nodeName); err != nil {
+			return err
+		}
+	}
+
+	if plan.create > 0 {
+		if err := addNodes(ctx, driver, plan.create, rb); err != nil {
+			return err
+		}
+	}
+
+	if len(plan.remove) > 0 {
+		remaining, err := remainingNodes(nodes, plan.remove)
+		if err != nil {
+			return err
+		}
+		for _, nodeName := range plan.remove {
+			if err := RemoveOneNode(ctx, driver, nodeName, remaining); err != nil {
+				return base.NewError(base.UnknownError, err, "removing node %s", nodeName)
+			}
+		}
+	}
+	return nil
+}
+
+// newestNodes returns the 'count' nodes with the largest indices.
+func newestNodes(nodes []string, count int) ([]string, error) {
+	indices := map[string]int{}
+	for _, nodeName := range nodes {
+		index, err := docker.GetNodeIndex(Context.Cluster, nodeName)
+		if err != nil {
+			return nil, err
+		}
+		indices[nodeName] = index
+	}
+
+	sorted := append([]string(nil), nodes...)
+	sort.Sort(byNodeIndexDesc{sorted, indices})
+	return sorted[:count], nil
+}
+
+// byNodeIndexDesc sorts node names by decreasing index.
+type byNodeIndexDesc struct {
+	names   []string
+	indices map[string]int
+}
+
+func (b byNodeIndexDesc) Len() int           { return len(b.names) }
+func (b byNodeIndexDesc) Swap(i, j int)      { b.names[i], b.names[j] = b.names[j], b.names[i] }
+func (b byNodeIndexDesc) Less(i, j int) bool { return b.indices[b.names[i]] > b.indices[b.names[j]] }
@@ -0,0 +1,69 @@
+// Copyright 2015 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+//
+// Author: Marc Berhault (marc@cockroachlabs.com)
+
+package cli
+
+import (
+	"github.com/cockroachdb/cockroach-prod/base"
+	"github.com/cockroachdb/cockroach-prod/docker"
+	"github.com/cockroachdb/cockroach-prod/drivers"
+	"github.com/cockroachdb/cockroach-prod/security"
+	"github.com/cockroachdb/cockroach/util/log"
+	"golang.org/x/net/context"
+)
+
+// installNodeCerts issues certificates for the node from the CA in the certs
+// directory and copies them to the machine. The node certificate is valid for
+// the node's internal address, its hostname, and the load balancer address.
+// Does nothing in insecure mode.
+func installNodeCerts(ctx context.Context, nodeName string, nodeConfig *drivers.HostConfig) error {
+	if Context.Insecure {
+		return nil
+	}
+
+	ca, err := security.LoadCA(Context.Certs)
+	if err != nil {
+		return base.NewError(base.UnknownError, err, "loading CA from %s", Context.Certs)
+	}
+	return installNodeCertsFromCA(ctx, ca, nodeName, nodeConfig)
+}
+
+// installNodeCertsFromCA issues certificates for the node from the given CA
+// and copies them to the machine.
+func installNodeCertsFromCA(ctx context.Context, ca *security.CA, nodeName string,
+	nodeConfig *drivers.HostConfig) error {
+	hosts := []string{
+		nodeConfig.Driver.IPAddress(),
+		nodeName,
+		nodeConfig.Driver.GossipAddress(),
+		// Nodes gossip with themselves through localhost.
+		"localhost",
+		"127.0.0.1",
+	}
+	log.Infof("creating certificates for node %s: %v", nodeName, hosts)
+	err := ca.CreateNodeCerts(Context.Certs, nodeName, hosts)
+	if err != nil {
+		return base.NewError(base.UnknownError, err, "creating certificates for %s", nodeName)
+	}
+
+	err = docker.CopyToMachine(ctx, nodeName, security.NodeCertFiles(Context.Certs, nodeName),
+		nodeConfig.Driver.CertsDir())
+	if err != nil {
+		return base.NewError(base.DockerMachineError, err, "copying certificates to %s", nodeName)
+	}
+	return nil
+}
@@ -21,15 +21,21 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"regexp"
 	"strings"
 	"text/tabwriter"
 
 	"github.com/cockroachdb/cockroach-prod/base"
 	"github.com/cockroachdb/cockroach-prod/drivers"
 	"github.com/cockroachdb/cockroach-prod/drivers/amazon"
+	"github.com/cockroachdb/cockroach-prod/drivers/azure"
+	"github.com/cockroachdb/cockroach-prod/drivers/digitalocean"
 	"github.com/cockroachdb/cockroach-prod/drivers/google"
+	"github.com/cockroachdb/cockroach-prod/drivers/local"
+	"github.com/cockroachdb/cockroach-prod/drivers/ssh"
 	"github.com/cockroachdb/cockroach/util"
 	"github.com/spf13/cobra"
+	"golang.org/x/net/context"
 )
 
 // Context contains basic configuration settings.
@@ -50,31 +56,70 @@ to precede any additional arguments,
 	},
 }
 
+// Cloud resource names are derived from the cluster name and must fit in
+// the provider limits (eg: 32 characters for AWS load balancers).
+const maxClusterNameLength = 20
+
+var clusterNameRegexp = regexp.MustCompile(fmt.Sprintf(`^[a-z][a-z0-9-]{0,%d}$`, maxClusterNameLength-1))
+
+// driverFactories maps the driver prefix of --region to the driver constructor.
+// Tests may register additional drivers, eg: drivers/fake.
+var driverFactories = map[string]func(context *base.Context, region string) drivers.Driver{
+	"aws": func(context *base.Context, region string) drivers.Driver {
+		return amazon.NewDriver(context, region)
+	},
+	"azure": func(context *base.Context, region string) drivers.Driver {
+		return azure.NewDriver(context, region)
+	},
+	"do": func(context *base.Context, region string) drivers.Driver {
+		return digitalocean.NewDriver(context, region)
+	},
+	"gce": func(context *base.Context, region string) drivers.Driver {
+		return google.NewDriver(context, region)
+	},
+	"local": func(context *base.Context, region string) drivers.Driver {
+		return local.NewDriver(context, region)
+	},
+	"ssh": func(context *base.Context, region string) drivers.Driver {
+		return ssh.NewDriver(context, region)
+	},
+}
+
 // NewDriver creates a new driver based on the passed-in Context
 // and initializes it.
 // This sets up authentication and should be called before
 // driver-specific docker-machine commands.
 func NewDriver(context *base.Context) (drivers.Driver, error) {
+	if !clusterNameRegexp.MatchString(context.Cluster) {
+		return nil, base.ValidationErrorf("invalid cluster name %q: must be at most %d lower-case letters, "+
+			"digits or dashes, starting with a letter", context.Cluster, maxClusterNameLength)
+	}
+
+	// Each cluster has its own CA: named clusters default to "certs-<cluster>".
+	// The default cluster keeps the original default directory.
+	if f := cobraCommand.PersistentFlags().Lookup("certs"); f != nil && !f.Changed &&
+		context.Certs == f.DefValue && context.Cluster != base.DefaultClusterName {
+		context.Certs = f.DefValue + "-" + context.Cluster
+	}
+
 	tokens := strings.SplitN(context.Region, ":", 2)
 	if len(tokens) != 2 {
-		return nil, util.Errorf("invalid region syntax, expected <driver>:<region name>, got: %q", context.Region)
+		return nil, base.ValidationErrorf("invalid region syntax, expected <driver>:<region name>, got: %q",
+			context.Region)
 	}
 
-	var driver drivers.Driver
-
 	provider := tokens[0]
 	region := tokens[1]
-	switch provider {
-	case "aws":
-		driver = amazon.NewDriver(context, region)
-	case "gce":
-		driver = google.NewDriver(context, region)
-	default:
-		return nil, util.Errorf("unknown driver: %s", driver)
+	newDriver, ok := driverFactories[provider]
+	if !ok {
+		return nil, base.ValidationErrorf("unknown driver: %s", provider)
 	}
+	driver := newDriver(context, region)
 
-	err := driver.Init()
-	return driver, err
+	if err := driver.Init(); err != nil {
+		return nil, base.NewError(base.CloudAPIError, err, "initializing %s driver", provider)
+	}
+	return driver, nil
 }
 
 var versionCmd = &cobra.Command{
@@ -104,14 +149,24 @@ func init() {
 	cobraCommand.AddCommand(
 		// Cluster setup.
 		initCmd,
+		applyCmd,
 		addNodesCmd,
+		removeNodesCmd,
+		destroyCmd,
 
 		// Start and stop.
 		startCmd,
 		stopCmd,
+		rollingRestartCmd,
+		upgradeCmd,
+
+		// Certificates.
+		rotateCertsCmd,
+		createClientCertCmd,
 
 		// Status commands.
 		statusCmd,
+		unlockCmd,
 
 		// Misc commands.
 		listParamsCmd,
@@ -119,8 +174,32 @@ func init() {
 	)
 }
 
-// Run ...
+// cmdErr is the error returned by the last command run through runE.
+var cmdErr error
+
+// runE adapts a command returning an error to cobra's Run, which does not
+// return one. The error is returned by Run.
+// The command context is cancelled on interrupt, and the resulting error is
+// reported as an InterruptedError.
+func runE(f func(context.Context, *cobra.Command, []string) error) func(*cobra.Command, []string) {
+	return func(cmd *cobra.Command, args []string) {
+		ctx, stop := interruptContext()
+		defer stop()
+		err := f(ctx, cmd, args)
+		if err != nil && ctx.Err() != nil {
+			err = base.Interrupted(err)
+		}
+		cmdErr = err
+	}
+}
+
+// Run executes the command specified by args. The returned error is a
+// *base.Error describing the failing step.
 func Run(args []string) error {
+	cmdErr = nil
 	cobraCommand.SetArgs(args)
-	return cobraCommand.Execute()
+	if err := cobraCommand.Execute(); err != nil {
+		return base.NewError(base.ValidationError, err, "parsing command line")
+	}
+	return cmdErr
 }
@@ -0,0 +1,141 @@
+// Copyright 2015 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+//
+// Author: Marc Berhault (marc@cockroachlabs.com)
+
+package cli
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/cockroachdb/cockroach-prod/base"
+	"github.com/cockroachdb/cockroach-prod/docker"
+	"github.com/cockroachdb/cockroach-prod/drivers"
+	"github.com/cockroachdb/cockroach-prod/drivers/fake"
+	"golang.org/x/net/context"
+)
+
+// errInjected is the failure injected in the fakes.
+var errInjected = errors.New("injected failure")
+
+// stepFailure describes a failure injected at one step of a command: a call
+// to a fake (see fake.Recorder.FailOn), or a node failing its health check if
+// method is empty.
+type stepFailure struct {
+	method string
+	kind   base.ErrorKind
+}
+
+func (f stepFailure) String() string {
+	if f.method == "" {
+		return "health check"
+	}
+	return f.method
+}
+
+// testCluster runs cli commands against the fake driver. The state and certs
+// directories are in a temporary directory.
+type testCluster struct {
+	t      *testing.T
+	dir    string
+	driver *fake.Driver
+	saved  base.Context
+}
+
+func newTestCluster(t *testing.T) *testCluster {
+	dir, err := ioutil.TempDir("", "cockroach-prod-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &testCluster{t: t, dir: dir, saved: *Context}
+	Context.Region = "fake:test"
+	Context.StateDir = filepath.Join(dir, "state")
+	Context.Certs = filepath.Join(dir, "certs")
+	// Nodes get a single health check.
+	Context.NodeTimeout = 0
+	c.driver = fake.NewDriver(Context, "test")
+	driverFactories["fake"] = func(*base.Context, string) drivers.Driver {
+		return c.driver
+	}
+	return c
+}
+
+func (c *testCluster) close() {
+	*Context = c.saved
+	delete(driverFactories, "fake")
+	initResume = false
+	if err := os.RemoveAll(c.dir); err != nil {
+		c.t.Error(err)
+	}
+}
+
+// nodeName returns the name of the node with the given index.
+func (c *testCluster) nodeName(id int) string {
+	return docker.MakeNodeName(Context.Cluster, id)
+}
+
+// init runs init, which must succeed.
+func (c *testCluster) init() {
+	if err := runInit(context.Background(), initCmd, nil); err != nil {
+		c.t.Fatalf("init failed: %v", err)
+	}
+}
+
+// inject makes the given step fail for all nodes.
+func (c *testCluster) inject(f stepFailure) {
+	if f.method != "" {
+		c.driver.FailOn(f.method, "", errInjected)
+		return
+	}
+	c.driver.Machines.RunFunc = func(name, command string) ([]string, error) {
+		if strings.HasPrefix(command, "curl ") {
+			return nil, errInjected
+		}
+		return []string{}, nil
+	}
+}
+
+// clear removes the failure injected by inject.
+func (c *testCluster) clear(f stepFailure) {
+	c.driver.FailOn(f.method, "", nil)
+	c.driver.Machines.RunFunc = nil
+}
+
+// checkFailure checks that err is the result of the injected failure.
+func (c *testCluster) checkFailure(f stepFailure, err error) {
+	if err == nil {
+		c.t.Errorf("%s: expected an error", f)
+		return
+	}
+	if kind := base.GetErrorKind(err); kind != f.kind {
+		c.t.Errorf("%s: expected a %s error, got %s: %v", f, f.kind, kind, err)
+	}
+}
+
+// isRunning returns true if the node's machine and cockroach container are
+// running, and the node is in the load balancer.
+func (c *testCluster) isRunning(nodeName string) bool {
+	state, err := c.driver.Machines.State(nodeName)
+	if err != nil || state != machineRunning {
+		return false
+	}
+	inService, err := c.driver.IsNodeInService(context.Background(), nodeName, nil)
+	return err == nil && inService && c.driver.Containers.IsRunning(nodeName)
+}
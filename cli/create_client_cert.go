@@ -0,0 +1,84 @@
+// Copyright 2015 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+//
+// Author: Marc Berhault (marc@cockroachlabs.com)
+
+package cli
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+
+	"github.com/cockroachdb/cockroach-prod/base"
+	"github.com/cockroachdb/cockroach-prod/security"
+	"github.com/spf13/cobra"
+	"golang.org/x/net/context"
+)
+
+var userNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9_][a-zA-Z0-9_.-]*$`)
+
+var createClientCertCmd = &cobra.Command{
+	Use:   "create-client-cert <user>",
+	Short: "create a client certificate\n",
+	Long: `
+Create a client certificate and key for the given user, signed by the CA in the
+certs directory. They are written to <certs>/clients/<user> along with the CA
+certificate. Prints a connection URL using the load balancer address.
+`,
+	Run: runE(runCreateClientCert),
+}
+
+func runCreateClientCert(ctx context.Context, cmd *cobra.Command, args []string) error {
+	if len(args) != 1 {
+		cmd.Usage()
+		return base.ValidationErrorf("expected a single user name, got %d arguments", len(args))
+	}
+	user := args[0]
+	if !userNameRegexp.MatchString(user) {
+		return base.ValidationErrorf("invalid user name %q", user)
+	}
+	if Context.Insecure {
+		return base.ValidationErrorf("certificates are not used in insecure mode")
+	}
+
+	driver, err := NewDriver(Context)
+	if err != nil {
+		return err
+	}
+
+	lbAddress, err := driver.LoadBalancerAddress()
+	if err != nil {
+		return base.NewError(base.CloudAPIError, err, "getting load balancer address")
+	}
+
+	ca, err := security.LoadCA(Context.Certs)
+	if err != nil {
+		return base.NewError(base.UnknownError, err, "loading CA from %s", Context.Certs)
+	}
+
+	dir, err := ca.CreateClientBundle(Context.Certs, user)
+	if err != nil {
+		return base.NewError(base.UnknownError, err, "creating client certificate for %s", user)
+	}
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return base.NewError(base.UnknownError, err, "getting absolute path for %s", dir)
+	}
+
+	fmt.Printf("Client certificate and key for %s: %s\n", user, absDir)
+	fmt.Printf("Connection URL: https://%s@%s:%d/?certs=%s\n", user, lbAddress, Context.Port, absDir)
+	return nil
+}
@@ -0,0 +1,100 @@
+// Copyright 2015 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+//
+// Author: Marc Berhault (marc@cockroachlabs.com)
+
+package cli
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/cockroachdb/cockroach-prod/base"
+	"github.com/cockroachdb/cockroach-prod/docker"
+	"github.com/spf13/cobra"
+	"golang.org/x/net/context"
+)
+
+var destroyYes bool
+
+var destroyCmd = &cobra.Command{
+	Use:   "destroy",
+	Short: "destroy the cluster\n",
+	Long: `
+Destroy the cockroach cluster. This deletes the load balancer and other cloud
+resources created by init, then removes all cockroach nodes and their data
+volumes. All data is lost.
+
+The cluster name must be typed to confirm, unless --yes is specified.
+`,
+	Run: runE(runDestroy),
+}
+
+func runDestroy(ctx context.Context, cmd *cobra.Command, args []string) error {
+	driver, err := NewDriver(Context)
+	if err != nil {
+		return err
+	}
+
+	if !destroyYes {
+		if err := confirmDestroy(); err != nil {
+			return err
+		}
+	}
+
+	ctx, lock, err := acquireLock(ctx, driver, cmd, args)
+	if err != nil {
+		return err
+	}
+	defer lock.release()
+
+	nodes, err := docker.ListCockroachNodes(Context.Cluster)
+	if err != nil {
+		return base.NewError(base.DockerMachineError, err, "listing existing cockroach nodes")
+	}
+
+	// The load balancer references the instances, delete it first.
+	err = driver.Teardown(ctx)
+	if err != nil {
+		return base.NewError(base.CloudAPIError, err, "running Teardown steps")
+	}
+
+	for _, nodeName := range nodes {
+		if err := removeMachine(ctx, driver, nodeName); err != nil {
+			return err
+		}
+	}
+
+	if err := removeInitProgress(); err != nil {
+		return base.NewError(base.UnknownError, err, "removing init progress %s", initProgressPath())
+	}
+	return nil
+}
+
+// confirmDestroy asks the user to type the cluster name.
+func confirmDestroy() error {
+	fmt.Printf("This deletes all nodes and data of cluster %s in region %s.\n", Context.Cluster, Context.Region)
+	fmt.Printf("Type the cluster name to confirm: ")
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && answer == "" {
+		return base.ValidationErrorf("destroy not confirmed: %v, use --yes to skip confirmation", err)
+	}
+	if strings.TrimSpace(answer) != Context.Cluster {
+		return base.ValidationErrorf("destroy not confirmed")
+	}
+	return nil
+}
@@ -22,6 +22,7 @@ import (
 	"reflect"
 
 	"github.com/cockroachdb/cockroach-prod/base"
+	"github.com/spf13/cobra"
 	"github.com/spf13/pflag"
 )
 
@@ -56,13 +57,44 @@ func initFlags(ctx *base.Context) {
 	})
 
 	cobraCommand.PersistentFlags().StringVar(&ctx.Certs, "certs", ctx.Certs, "certificates directory. Generated CA and node "+
-		"certs and keys are stored there.")
+		"certs and keys are stored there. Defaults to certs-<cluster> for clusters other than the default.")
+
+	cobraCommand.PersistentFlags().StringVar(&ctx.StateDir, "state-dir", ctx.StateDir, "directory for local "+
+		"state, such as the progress of init.")
+
+	cobraCommand.PersistentFlags().BoolVar(&ctx.Insecure, "insecure", ctx.Insecure, "run cockroach nodes in insecure "+
+		"mode. No certificates are generated or used.")
 
 	cobraCommand.PersistentFlags().Int64Var(&ctx.Port, "port", ctx.Port, "cockroach node and load balancer port.")
 
+	cobraCommand.PersistentFlags().StringVar(&ctx.Cluster, "cluster", ctx.Cluster, "cluster name. Used as a prefix "+
+		"for node and cloud resource names, allowing multiple clusters in the same account and region.")
+
 	// Region to run in. This takes a driver attribute.
 	cobraCommand.PersistentFlags().StringVar(&ctx.Region, "region", ctx.Region, "region to run in. Specify a platform driver "+
-		"and region. AWS EC2: aws:us-east-1, Google Compute Engine: gce:us-central1.")
+		"and region. AWS EC2: aws:us-east-1, Azure: azure:westus, DigitalOcean: do:nyc3, Google Compute Engine: "+
+		"gce:us-central1, local docker: local:<docker network>, pre-provisioned hosts: ssh:<name>.")
+
+	cobraCommand.PersistentFlags().StringVar(&ctx.Zone, "zone", ctx.Zone, "zone to run in, within the region. "+
+		"AWS EC2: us-east-1a (default: a), Google Compute Engine: us-central1-f (default: <region>-a).")
+
+	cobraCommand.PersistentFlags().StringVar(&ctx.AllowedCIDRs, "allowed-cidrs", ctx.AllowedCIDRs, "comma-separated "+
+		"list of CIDRs allowed to reach the cockroach port through the firewall.")
+
+	cobraCommand.PersistentFlags().StringVar(&ctx.Image, "image", ctx.Image, "cockroach docker image for new "+
+		"nodes. Append :<tag> or @<digest> to pin a version. Existing nodes keep their image, see \"upgrade\".")
+
+	cobraCommand.PersistentFlags().DurationVar(&ctx.OperationTimeout, "operation-timeout", ctx.OperationTimeout,
+		"how long to wait for a cloud operation, eg: creating a load balancer, to complete.")
+
+	cobraCommand.PersistentFlags().DurationVar(&ctx.APIRetryTimeout, "api-retry-timeout", ctx.APIRetryTimeout,
+		"how long to retry cloud API calls failing with throttling or server errors.")
+
+	cobraCommand.PersistentFlags().Int64Var(&ctx.VolumeSize, "volume-size", ctx.VolumeSize, "size in GB of the "+
+		"persistent data volume attached to new nodes. If 0, data is stored on the instance disk.")
+
+	cobraCommand.PersistentFlags().StringVar(&ctx.VolumeType, "volume-type", ctx.VolumeType, "type of the data volume. "+
+		"AWS EC2: standard, gp2 (default) or io1. Google Compute Engine: pd-standard (default) or pd-ssd.")
 
 	// Driver-specific flags.
 	cobraCommand.PersistentFlags().StringVar(&ctx.GCEProject, "gce-project", ctx.GCEProject, "project name for Google Compute "+
@@ -70,6 +102,59 @@ func initFlags(ctx *base.Context) {
 
 	cobraCommand.PersistentFlags().StringVar(&ctx.GCETokenPath, "gce-auth-token", ctx.GCETokenPath, "path to the OAuth "+
 		"token for Google Compute Engine.")
+
+	cobraCommand.PersistentFlags().StringVar(&ctx.SSHInventory, "ssh-inventory", ctx.SSHInventory, "inventory file "+
+		"of pre-provisioned hosts for the ssh driver, in YAML.")
+
+	cobraCommand.PersistentFlags().StringVar(&ctx.DOAccessToken, "do-access-token", ctx.DOAccessToken, "access token "+
+		"for DigitalOcean. Defaults to $DIGITALOCEAN_ACCESS_TOKEN.")
+
+	// Command-specific flags.
+	for _, cmd := range []*cobra.Command{removeNodesCmd, applyCmd} {
+		cmd.Flags().IntVar(&ctx.MinNodes, "min-nodes", ctx.MinNodes, "minimum number of nodes "+
+			"to keep in the cluster when removing nodes.")
+	}
+	for _, cmd := range []*cobra.Command{initCmd, addNodesCmd, startCmd, removeNodesCmd, rollingRestartCmd,
+		upgradeCmd, applyCmd} {
+		cmd.Flags().DurationVar(&ctx.NodeTimeout, "node-timeout", ctx.NodeTimeout, "how long to wait "+
+			"for a node to become healthy and be put in service by the load balancer.")
+	}
+
+	upgradeCmd.Flags().StringVar(&upgradeTo, "to", "", "tag or digest of the cockroach image to upgrade to.")
+	upgradeCmd.Flags().BoolVar(&upgradeRollback, "rollback", false, "revert each node to the image it ran "+
+		"before the last upgrade.")
+
+	rotateCertsCmd.Flags().BoolVar(&rotateCA, "ca", false, "rotate the CA as well as the node certificates.")
+	rotateCertsCmd.Flags().BoolVar(&showCertExpiry, "show-expiry", false, "only print certificate expiration "+
+		"dates.")
+
+	removeNodesCmd.Flags().BoolVar(&forceRemoveNodes, "force", false, "remove nodes even if fewer than "+
+		"--min-nodes would remain.")
+
+	initCmd.Flags().BoolVar(&initResume, "resume", false, "resume a previously interrupted init at the first "+
+		"incomplete step.")
+
+	applyCmd.Flags().StringVarP(&applySpecFile, "file", "f", "", "cluster spec file, in YAML or JSON.")
+	applyCmd.Flags().BoolVar(&applyDryRun, "dry-run", false, "only print the changes needed to converge.")
+
+	// Commands operating on multiple nodes.
+	addNodesCmd.Flags().IntVar(&nodeParallelism, "parallelism", 4, "maximum number of nodes created "+
+		"at the same time.")
+	applyCmd.Flags().IntVar(&nodeParallelism, "parallelism", 4, "maximum number of nodes created "+
+		"at the same time.")
+	startCmd.Flags().IntVar(&nodeParallelism, "parallelism", 4, "maximum number of nodes started "+
+		"at the same time.")
+	stopCmd.Flags().IntVar(&nodeParallelism, "parallelism", 4, "maximum number of nodes stopped "+
+		"at the same time.")
+	startCmd.Flags().BoolVar(&failFast, "fail-fast", false, "do not start more nodes after the first failure.")
+	stopCmd.Flags().BoolVar(&failFast, "fail-fast", false, "do not stop more nodes after the first failure.")
+
+	statusCmd.Flags().StringVar(&statusFormat, "format", statusFormatTable, "output format: table, json or yaml.")
+
+	destroyCmd.Flags().BoolVar(&destroyYes, "yes", false, "do not ask for confirmation.")
+
+	unlockCmd.Flags().BoolVar(&forceUnlock, "force", false, "remove the cluster lock even if it has "+
+		"not expired.")
 }
 
 func init() {
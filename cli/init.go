@@ -18,77 +18,265 @@
 package cli
 
 import (
+	"github.com/cockroachdb/cockroach-prod/base"
 	"github.com/cockroachdb/cockroach-prod/docker"
+	"github.com/cockroachdb/cockroach-prod/drivers"
+	"github.com/cockroachdb/cockroach-prod/security"
 	"github.com/cockroachdb/cockroach/util/log"
 	"github.com/spf13/cobra"
+	"golang.org/x/net/context"
 )
 
+var initResume bool
+
 var initCmd = &cobra.Command{
 	Use:   "init",
 	Short: "initialize a cockroach cluster",
 	Long: `
 Initialize a cockroach cluster. This initializes and starts the first node.
+Unless --insecure is specified, a CA is created in the certs directory and used
+to sign certificates for all nodes.
+
+Progress is recorded in the state directory. If init fails part way, fix the
+problem and run init --resume to continue at the first incomplete step.
 `,
-	Run: runInit,
+	Run: runE(runInit),
+}
+
+// initState is passed to each init step.
+type initState struct {
+	driver   drivers.Driver
+	nodeName string
+	config   *drivers.HostConfig
+	// Undo steps for resources created by this invocation.
+	rb *rollback
+}
+
+// nodeConfig looks up the node config the first time it is needed. It is
+// only available once the machine and load balancer exist.
+func (s *initState) nodeConfig() (*drivers.HostConfig, error) {
+	if s.config != nil {
+		return s.config, nil
+	}
+	config, err := s.driver.GetNodeConfig(s.nodeName)
+	if err != nil {
+		return nil, base.NewError(base.CloudAPIError, err, "getting node config for %s", s.nodeName)
+	}
+	s.config = config
+	return config, nil
+}
+
+// initStep is a single idempotent step of init. Completed steps are recorded
+// in the init progress and skipped when resuming.
+type initStep struct {
+	name string
+	run  func(context.Context, *initState) error
+}
+
+var initSteps = []initStep{
+	{"create-ca", initCreateCA},
+	{"create-machine", initCreateMachine},
+	{"after-first-node", initAfterFirstNode},
+	{"prepare-node", initPrepareNode},
+	{"cockroach-init", initCockroachStore},
+	{"start-node", initStartNode},
+	{"start-cockroach", initStartCockroach},
 }
 
-func runInit(cmd *cobra.Command, args []string) {
+func runInit(ctx context.Context, cmd *cobra.Command, args []string) error {
 	driver, err := NewDriver(Context)
 	if err != nil {
-		log.Errorf("could not create driver: %v", err)
-		return
+		return err
+	}
+
+	ctx, lock, err := acquireLock(ctx, driver, cmd, args)
+	if err != nil {
+		return err
+	}
+	defer lock.release()
+
+	nodes, err := docker.ListCockroachNodes(Context.Cluster)
+	if err != nil {
+		return base.NewError(base.DockerMachineError, err, "listing existing cockroach nodes")
+	}
+
+	progress, err := loadInitProgress()
+	if err != nil {
+		return base.NewError(base.UnknownError, err, "loading init progress from %s", initProgressPath())
+	}
+
+	if !initResume {
+		if len(nodes) != 0 {
+			if progress != nil && !progress.isComplete() {
+				return base.ValidationErrorf("a previous init did not complete, run init --resume to continue it")
+			}
+			return base.ValidationErrorf("init called but docker-machine has %d existing cockroach nodes: %v",
+				len(nodes), nodes)
+		}
+		progress = &initProgress{Node: docker.MakeNodeName(Context.Cluster, 0)}
+	} else if progress == nil {
+		return base.ValidationErrorf("no init progress recorded in %s, nothing to resume", initProgressPath())
+	}
+
+	if progress.isComplete() {
+		log.Infof("init of cluster %s already complete", Context.Cluster)
+		return nil
+	}
+	rb := &rollback{}
+	return rb.finish(ctx, runInitSteps(ctx, driver, progress, rb))
+}
+
+// runInitSteps runs the init steps not yet recorded as completed in 'progress'.
+// This creates the first node, sets up the load balancer, and initializes and
+// starts cockroach on the node. Undoing the created resources is recorded in
+// 'rb', along with resetting the progress to what it was before.
+func runInitSteps(ctx context.Context, driver drivers.Driver, progress *initProgress, rb *rollback) error {
+	completed := len(progress.Completed)
+	rb.add("reset init progress", func(context.Context) error {
+		return progress.reset(completed)
+	})
+
+	state := &initState{driver: driver, nodeName: progress.Node, rb: rb}
+	for _, step := range initSteps {
+		if progress.isDone(step.name) {
+			log.Infof("init step %s already done, skipping", step.name)
+			continue
+		}
+		log.Infof("running init step %s", step.name)
+		if err := step.run(ctx, state); err != nil {
+			return base.NewError(base.UnknownError, err, "init step %s", step.name)
+		}
+		if err := progress.markDone(step.name); err != nil {
+			return base.NewError(base.UnknownError, err, "saving init progress to %s", initProgressPath())
+		}
+	}
+	return nil
+}
+
+// initCreateCA creates the CA used to sign node certificates.
+func initCreateCA(ctx context.Context, s *initState) error {
+	if Context.Insecure {
+		return nil
+	}
+	_, err := security.LoadOrCreateCA(Context.Certs)
+	if err != nil {
+		return base.NewError(base.UnknownError, err, "creating CA in %s", Context.Certs)
+	}
+	return nil
+}
+
+// initCreateMachine creates the first node. A machine left over from an
+// interrupted attempt may be half-provisioned: nothing has run on it yet, so
+// we remove it and start over.
+func initCreateMachine(ctx context.Context, s *initState) error {
+	machines, err := docker.ListMachines()
+	if err != nil {
+		return base.NewError(base.DockerMachineError, err, "listing machines")
+	}
+	for _, m := range machines {
+		if m == s.nodeName {
+			log.Infof("removing machine %s left over from a previous attempt", s.nodeName)
+			if err := docker.RemoveMachine(ctx, s.nodeName); err != nil {
+				return base.NewError(base.DockerMachineError, err, "removing machine %s", s.nodeName)
+			}
+		}
 	}
 
-	nodes, err := docker.ListCockroachNodes()
+	// An interrupted create may leave a partial machine behind, so the rollback
+	// is recorded first.
+	s.rb.add("remove machine "+s.nodeName, func(ctx context.Context) error {
+		return removeMachine(ctx, s.driver, s.nodeName)
+	})
+	err = docker.CreateMachine(ctx, s.driver, s.nodeName)
 	if err != nil {
-		log.Errorf("failed to get list of existing cockroach nodes: %v", err)
-		return
+		return base.NewError(base.DockerMachineError, err, "creating machine %s", s.nodeName)
 	}
-	if len(nodes) != 0 {
-		log.Errorf("init called but docker-machine has %d existing cockroach nodes: %v", len(nodes), nodes)
-		return
+	return nil
+}
+
+// initAfterFirstNode runs driver steps after first-node creation.
+func initAfterFirstNode(ctx context.Context, s *initState) error {
+	s.rb.add("tear down cluster resources", s.driver.Teardown)
+	err := s.driver.AfterFirstNode(ctx)
+	if err != nil {
+		return base.NewError(base.CloudAPIError, err, "running AfterFirstNode steps")
 	}
+	return nil
+}
 
-	nodeName := docker.MakeNodeName(0)
+// initPrepareNode does "prepare node" logic and installs node certificates.
+func initPrepareNode(ctx context.Context, s *initState) error {
+	nodeConfig, err := s.nodeConfig()
+	if err != nil {
+		return err
+	}
 
-	// Create first node.
-	err = docker.CreateMachine(driver, nodeName)
+	err = s.driver.PrepareNode(ctx, s.nodeName, nodeConfig, true)
 	if err != nil {
-		log.Errorf("could not create machine %s: %v", nodeName, err)
-		return
+		return base.NewError(base.CloudAPIError, err, "running PrepareNode steps for %s", s.nodeName)
 	}
 
-	// Run driver steps after first-node creation.
-	err = driver.AfterFirstNode()
+	// PrepareNode may have attached a data volume, changing the data directory.
+	s.config = nil
+	nodeConfig, err = s.nodeConfig()
 	if err != nil {
-		log.Errorf("could not run AfterFirstNode steps for: %v", err)
-		return
+		return err
 	}
+	return installNodeCerts(ctx, s.nodeName, nodeConfig)
+}
 
-	// Lookup node info.
-	nodeConfig, err := driver.GetNodeConfig(nodeName)
+// initCockroachStore initializes the cockroach store, unless it already is.
+func initCockroachStore(ctx context.Context, s *initState) error {
+	nodeConfig, err := s.nodeConfig()
 	if err != nil {
-		log.Errorf("could not get node config for %s: %v", nodeName, err)
-		return
+		return err
 	}
 
-	// Initialize cockroach node.
-	err = docker.RunDockerInit(driver, nodeName, nodeConfig)
+	initialized, err := docker.IsStoreInitialized(ctx, s.nodeName, nodeConfig)
+	if err != nil {
+		return base.NewError(base.DockerMachineError, err, "checking store on %s", s.nodeName)
+	}
+	if initialized {
+		log.Infof("store on %s already initialized, skipping cockroach init", s.nodeName)
+		return nil
+	}
+
+	err = docker.RunDockerInit(ctx, s.driver, s.nodeName, nodeConfig)
+	if err != nil {
+		return base.NewError(base.DockerError, err, "initializing first cockroach node %s", s.nodeName)
+	}
+	return nil
+}
+
+// initStartNode does "start node" logic.
+func initStartNode(ctx context.Context, s *initState) error {
+	nodeConfig, err := s.nodeConfig()
+	if err != nil {
+		return err
+	}
+
+	err = s.driver.StartNode(ctx, s.nodeName, nodeConfig)
+	if err != nil {
+		return base.NewError(base.CloudAPIError, err, "running StartNode steps for %s", s.nodeName)
+	}
+	return nil
+}
+
+// initStartCockroach starts the cockroach node and waits for it to be up.
+func initStartCockroach(ctx context.Context, s *initState) error {
+	nodeConfig, err := s.nodeConfig()
 	if err != nil {
-		log.Errorf("could not initialize first cockroach node %s: %v", nodeName, err)
-		return
+		return err
 	}
 
-	// Do "start node" logic.
-	err = driver.StartNode(nodeName, nodeConfig)
+	err = docker.RunDockerStart(ctx, s.driver, s.nodeName, nodeConfig)
 	if err != nil {
-		log.Errorf("could not run StartNode steps for %s: %v", nodeName, err)
-		return
+		return base.NewError(base.DockerError, err, "starting first cockroach node %s", s.nodeName)
 	}
 
-	// Start the cockroach node.
-	err = docker.RunDockerStart(driver, nodeName, nodeConfig)
+	err = docker.WaitForNodeReady(ctx, s.driver, s.nodeName, nodeConfig, Context.NodeTimeout)
 	if err != nil {
-		log.Errorf("could not initialize first cockroach node %s: %v", nodeName, err)
+		return base.NewError(base.DockerError, err, "waiting for first cockroach node %s", s.nodeName)
 	}
+	return nil
 }
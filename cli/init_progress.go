@@ -0,0 +1,140 @@
+// Copyright 2015 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+//
+// Author: Marc Berhault (marc@cockroachlabs.com)
+
+package cli
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+const initProgressFile = "init.json"
+
+// initProgress records the init steps completed for a cluster. It is
+// stored in <state dir>/<cluster>/init.json.
+type initProgress struct {
+	Node      string   `json:"node"`
+	Completed []string `json:"completed"`
+}
+
+func initProgressPath() string {
+	return filepath.Join(Context.StateDir, Context.Cluster, initProgressFile)
+}
+
+// loadInitProgress reads the init progress of the cluster.
+// Returns nil if none was recorded.
+func loadInitProgress() (*initProgress, error) {
+	contents, err := ioutil.ReadFile(initProgressPath())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	progress := &initProgress{}
+	if err := json.Unmarshal(contents, progress); err != nil {
+		return nil, err
+	}
+	return progress, nil
+}
+
+// removeInitProgress deletes the recorded init progress, if any.
+func removeInitProgress() error {
+	err := os.Remove(initProgressPath())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (p *initProgress) isDone(step string) bool {
+	for _, s := range p.Completed {
+		if s == step {
+			return true
+		}
+	}
+	return false
+}
+
+// isComplete returns true if all init steps are done.
+func (p *initProgress) isComplete() bool {
+	for _, step := range initSteps {
+		if !p.isDone(step.name) {
+			return false
+		}
+	}
+	return true
+}
+
+// markDone records the step as completed and saves the progress.
+func (p *initProgress) markDone(step string) error {
+	p.Completed = append(p.Completed, step)
+	return p.save()
+}
+
+// reset forgets all but the first 'completed' steps and saves the progress.
+// The progress is removed if no steps remain.
+func (p *initProgress) reset(completed int) error {
+	p.Completed = p.Completed[:completed]
+	if completed == 0 {
+		return removeInitProgress()
+	}
+	return p.save()
+}
+
+func (p *initProgress) save() error {
+	path := initProgressPath()
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	contents, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeStateFile(path, contents)
+}
+
+// writeStateFile replaces the contents of a file in the state directory. The
+// contents are written to a temporary file renamed over the file, so that a
+// crash does not leave a partially written file behind.
+func writeStateFile(path string, contents []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(contents); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
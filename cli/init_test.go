@@ -0,0 +1,89 @@
+// Copyright 2015 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+//
+// Author: Marc Berhault (marc@cockroachlabs.com)
+
+package cli
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/cockroachdb/cockroach-prod/base"
+	"golang.org/x/net/context"
+)
+
+func TestInit(t *testing.T) {
+	c := newTestCluster(t)
+	defer c.close()
+
+	c.init()
+	node := c.nodeName(0)
+	if !c.isRunning(node) {
+		t.Errorf("node %s is not running", node)
+	}
+	if !c.driver.Containers.IsInitialized(node) {
+		t.Errorf("store on node %s is not initialized", node)
+	}
+	if files := c.driver.Machines.Files(node, "/certs"); len(files) == 0 {
+		t.Errorf("no certificates copied to node %s", node)
+	}
+
+	if err := runInit(context.Background(), initCmd, nil); base.GetErrorKind(err) != base.ValidationError {
+		t.Errorf("expected a validation error running init again, got %v", err)
+	}
+}
+
+// TestInitFailures injects a failure at each init step, then checks that
+// init --resume completes the cluster.
+func TestInitFailures(t *testing.T) {
+	testCases := []struct {
+		stepFailure
+		step string
+	}{
+		{stepFailure{"Machines.Create", base.DockerMachineError}, "create-machine"},
+		{stepFailure{"AfterFirstNode", base.CloudAPIError}, "after-first-node"},
+		{stepFailure{"GetNodeConfig", base.CloudAPIError}, "prepare-node"},
+		{stepFailure{"PrepareNode", base.CloudAPIError}, "prepare-node"},
+		{stepFailure{"Machines.Copy", base.DockerMachineError}, "prepare-node"},
+		{stepFailure{"Containers.Init", base.DockerError}, "cockroach-init"},
+		{stepFailure{"StartNode", base.CloudAPIError}, "start-node"},
+		{stepFailure{"Containers.Start", base.DockerError}, "start-cockroach"},
+		{stepFailure{"", base.DockerError}, "start-cockroach"},
+	}
+
+	for _, tc := range testCases {
+		func() {
+			c := newTestCluster(t)
+			defer c.close()
+
+			c.inject(tc.stepFailure)
+			err := runInit(context.Background(), initCmd, nil)
+			c.checkFailure(tc.stepFailure, err)
+			if err != nil && !strings.Contains(err.Error(), "init step "+tc.step) {
+				t.Errorf("%s: expected failure in step %s, got %v", tc.stepFailure, tc.step, err)
+			}
+
+			c.clear(tc.stepFailure)
+			initResume = true
+			if err := runInit(context.Background(), initCmd, nil); err != nil {
+				t.Errorf("%s: init --resume failed: %v", tc.stepFailure, err)
+			}
+			if node := c.nodeName(0); !c.isRunning(node) || !c.driver.Containers.IsInitialized(node) {
+				t.Errorf("%s: node %s not running after init --resume", tc.stepFailure, node)
+			}
+		}()
+	}
+}
@@ -0,0 +1,116 @@
+// Copyright 2015 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+//
+// Author: Marc Berhault (marc@cockroachlabs.com)
+
+package cli
+
+import (
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+
+	"github.com/cockroachdb/cockroach/util"
+	"github.com/cockroachdb/cockroach/util/log"
+	"golang.org/x/net/context"
+)
+
+// interruptContext returns a context cancelled on the first interrupt (Ctrl-C).
+// The returned function stops listening for interrupts and must be called.
+func interruptContext() (context.Context, func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt)
+	go func() {
+		select {
+		case <-sigCh:
+			log.Errorf("interrupted, stopping the current step")
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, func() {
+		signal.Stop(sigCh)
+		cancel()
+	}
+}
+
+// rollback records how to undo the resources created by the current command,
+// to clean up after an interrupt.
+// It is safe for concurrent use.
+type rollback struct {
+	mu    sync.Mutex
+	steps []*rollbackStep
+}
+
+type rollbackStep struct {
+	desc string
+	undo func(ctx context.Context) error
+}
+
+// add records an undo step. 'desc' describes the step in logs and errors.
+// The returned step can be passed to drop.
+func (r *rollback) add(desc string, undo func(ctx context.Context) error) *rollbackStep {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	step := &rollbackStep{desc, undo}
+	r.steps = append(r.steps, step)
+	return step
+}
+
+// drop removes an undo step recorded by add, once the change it undoes is
+// complete and should be kept.
+func (r *rollback) drop(step *rollbackStep) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i, s := range r.steps {
+		if s == step {
+			r.steps = append(r.steps[:i], r.steps[i+1:]...)
+			return
+		}
+	}
+}
+
+// finish returns the command error. If the command was interrupted (ctx is
+// cancelled), the recorded steps are undone first, most recent first.
+// Steps that fail are listed in the returned error so they can be cleaned up
+// manually. Interrupting again stops the rollback.
+func (r *rollback) finish(ctx context.Context, err error) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err == nil || ctx.Err() == nil || len(r.steps) == 0 {
+		return err
+	}
+
+	log.Infof("rolling back changes made by this command, interrupt again to stop")
+	undoCtx, stop := interruptContext()
+	defer stop()
+
+	var failed []string
+	for i := len(r.steps) - 1; i >= 0; i-- {
+		step := r.steps[i]
+		log.Infof("rollback: %s", step.desc)
+		if undoErr := step.undo(undoCtx); undoErr != nil {
+			log.Errorf("rollback: %s failed: %v", step.desc, undoErr)
+			failed = append(failed, step.desc)
+		}
+	}
+	if len(failed) > 0 {
+		return util.Errorf("%v; rollback incomplete, clean up manually: %s", err, strings.Join(failed, ", "))
+	}
+	log.Infof("rollback complete")
+	return err
+}
@@ -0,0 +1,314 @@
+// Copyright 2015 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+//
+// Author: Marc Berhault (marc@cockroachlabs.com)
+
+package cli
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cockroachdb/cockroach-prod/base"
+	"github.com/cockroachdb/cockroach-prod/drivers"
+	"github.com/cockroachdb/cockroach/util/log"
+	"github.com/spf13/cobra"
+	"golang.org/x/net/context"
+)
+
+const (
+	// The lock is renewed while the command runs. The lease is how long the
+	// cluster stays locked after a command crashed.
+	lockLease         = 5 * time.Minute
+	lockRenewInterval = time.Minute
+	localLockFile     = "lock.json"
+	// The holder is stored in cloud tags, it is truncated to leave room for
+	// the rest of the lock.
+	maxLockHolderLength = 64
+)
+
+// lockStore reads and writes the cluster lock. Implemented by the drivers
+// (lock stored in the cloud) and by localLockStore.
+// Writes are conditional on the version returned by the last read.
+type lockStore interface {
+	ReadLock() (*drivers.Lock, string, error)
+	WriteLock(lock *drivers.Lock, version string) error
+}
+
+// localLockStore stores the lock in <state dir>/<cluster>/lock.json. It is
+// used when the driver cannot store the lock, eg: during init.
+// The version is the file contents. Only the creation of the file is
+// atomic: processes updating an existing lock file at the same time may
+// both succeed, which requires the lock to have expired.
+type localLockStore struct{}
+
+func localLockPath() string {
+	return filepath.Join(Context.StateDir, Context.Cluster, localLockFile)
+}
+
+func (localLockStore) ReadLock() (*drivers.Lock, string, error) {
+	contents, err := ioutil.ReadFile(localLockPath())
+	if os.IsNotExist(err) {
+		return nil, "", nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	lock, err := drivers.DecodeLock(string(contents))
+	return lock, string(contents), err
+}
+
+func (localLockStore) WriteLock(lock *drivers.Lock, version string) error {
+	path := localLockPath()
+	contents, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		if version != "" {
+			return drivers.ErrLockChanged
+		}
+	} else if err != nil {
+		return err
+	} else if string(contents) != version {
+		return drivers.ErrLockChanged
+	}
+
+	if lock == nil {
+		err := os.Remove(path)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	value, err := drivers.EncodeLock(lock)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	if version != "" {
+		return writeStateFile(path, []byte(value))
+	}
+	// Linking fails if the file exists: only one process creates the lock.
+	tmp := path + ".new." + strconv.Itoa(os.Getpid())
+	if err := writeStateFile(tmp, []byte(value)); err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	if err := os.Link(tmp, path); err != nil {
+		if os.IsExist(err) {
+			return drivers.ErrLockChanged
+		}
+		return err
+	}
+	return nil
+}
+
+// clusterLock is a cluster lock held by this process.
+type clusterLock struct {
+	store lockStore
+	lock  drivers.Lock
+	// cancel aborts the command if the lock is lost.
+	cancel  func()
+	stopper chan struct{}
+	stopped chan struct{}
+}
+
+// lockHolder identifies this process.
+func lockHolder() string {
+	userName := "unknown"
+	if u, err := user.Current(); err == nil {
+		userName = u.Username
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	pid := fmt.Sprintf(":%d", os.Getpid())
+	holder := userName + "@" + host
+	if len(holder)+len(pid) > maxLockHolderLength {
+		holder = holder[:maxLockHolderLength-len(pid)]
+	}
+	return holder + pid
+}
+
+// acquireLock takes the cluster lock for the duration of a mutating command.
+// The lock is stored in the cloud if the driver can, in a local file otherwise.
+// It is renewed in the background until release is called. The returned
+// context is cancelled if the lock is lost, eg: after failing to renew it
+// before it expired, and must be used by the command.
+func acquireLock(ctx context.Context, driver drivers.Driver, cmd *cobra.Command,
+	args []string) (context.Context, *clusterLock, error) {
+	var store lockStore = driver
+	kind := base.CloudAPIError
+	existing, version, err := store.ReadLock()
+	if err == drivers.ErrNoLockStore {
+		log.Infof("cluster lock cannot be stored in the cloud yet, using %s", localLockPath())
+		store = localLockStore{}
+		kind = base.UnknownError
+		existing, version, err = store.ReadLock()
+	}
+	if err != nil {
+		return nil, nil, base.NewError(kind, err, "reading cluster lock")
+	}
+	if existing == nil && kind == base.CloudAPIError {
+		// A command started before the cloud resource existed (eg: init) holds
+		// the lock in the local file.
+		existing, _, err = localLockStore{}.ReadLock()
+		if err != nil {
+			return nil, nil, base.NewError(base.UnknownError, err, "reading cluster lock %s", localLockPath())
+		}
+	}
+	if existing != nil {
+		if !existing.IsExpired() {
+			return nil, nil, base.ValidationErrorf("cluster %s is locked by %s. If the lock is stale, "+
+				"remove it with \"unlock --force\"", Context.Cluster, existing)
+		}
+		log.Infof("taking over expired cluster lock held by %s", existing)
+	}
+
+	l := &clusterLock{
+		store: store,
+		lock: drivers.Lock{
+			Holder:  lockHolder(),
+			Command: strings.TrimSpace(cmd.Name() + " " + strings.Join(args, " ")),
+			Expires: time.Now().Add(lockLease),
+		},
+		stopper: make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	lock := l.lock
+	err = store.WriteLock(&lock, version)
+	if err == drivers.ErrLockChanged {
+		// Someone else wrote the lock since we read it. Writes may also be
+		// reported as conflicting when retried after succeeding.
+		current, _, readErr := store.ReadLock()
+		if readErr != nil {
+			return nil, nil, base.NewError(kind, readErr, "reading cluster lock")
+		}
+		if current == nil || current.Holder != l.lock.Holder {
+			return nil, nil, base.ValidationErrorf("cluster %s was locked concurrently by %s", Context.Cluster, current)
+		}
+		err = nil
+	}
+	if err != nil {
+		return nil, nil, base.NewError(kind, err, "writing cluster lock")
+	}
+
+	log.Infof("acquired cluster lock: %s", &l.lock)
+	ctx, l.cancel = context.WithCancel(ctx)
+	go l.renew()
+	return ctx, l, nil
+}
+
+// errLockLost is returned when renewing the lock finds that it is no longer
+// held by this process.
+type errLockLost struct {
+	current *drivers.Lock
+}
+
+func (e errLockLost) Error() string {
+	if e.current == nil {
+		return "cluster lock was removed"
+	}
+	return fmt.Sprintf("cluster lock was taken over by %s", e.current)
+}
+
+// extend checks that the lock is still held by this process and extends its
+// lease.
+func (l *clusterLock) extend() error {
+	current, version, err := l.store.ReadLock()
+	if err != nil {
+		return err
+	}
+	if current == nil || current.Holder != l.lock.Holder {
+		return errLockLost{current}
+	}
+	lock := l.lock
+	lock.Expires = time.Now().Add(lockLease)
+	if err := l.store.WriteLock(&lock, version); err != nil {
+		return err
+	}
+	l.lock.Expires = lock.Expires
+	return nil
+}
+
+// renew extends the lock lease periodically until release is called. The
+// command is aborted if the lock was lost, or if it could not be renewed
+// before the lease runs out. Failed renewals are retried at the next tick.
+func (l *clusterLock) renew() {
+	defer close(l.stopped)
+	ticker := time.NewTicker(lockRenewInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.stopper:
+			return
+		case <-ticker.C:
+			err := l.extend()
+			if err == nil {
+				continue
+			}
+			if err == drivers.ErrNoLockStore {
+				// The resource holding the lock was deleted, eg: by destroy.
+				log.Infof("cluster lock store was deleted, no longer renewing the lock")
+				return
+			}
+			if _, ok := err.(errLockLost); ok {
+				log.Errorf("%v, aborting", err)
+				l.cancel()
+				return
+			}
+			if time.Now().Add(lockRenewInterval).After(l.lock.Expires) {
+				log.Errorf("could not renew cluster lock before it expires, aborting: %v", err)
+				l.cancel()
+				return
+			}
+			log.Warningf("could not renew cluster lock, will retry: %v", err)
+		}
+	}
+}
+
+// release stops renewing the lock and clears it, unless it has been taken
+// over by someone else in the meantime.
+func (l *clusterLock) release() {
+	close(l.stopper)
+	<-l.stopped
+	l.cancel()
+
+	current, version, err := l.store.ReadLock()
+	if err == drivers.ErrNoLockStore {
+		// The resource holding the lock was deleted, eg: by destroy.
+		return
+	}
+	if err != nil {
+		log.Errorf("could not read cluster lock to release it: %v", err)
+		return
+	}
+	if current == nil || current.Holder != l.lock.Holder {
+		log.Warningf("cluster lock was taken over by %s, not releasing it", current)
+		return
+	}
+	if err := l.store.WriteLock(nil, version); err != nil {
+		log.Errorf("could not release cluster lock: %v", err)
+		return
+	}
+	log.Info("released cluster lock")
+}
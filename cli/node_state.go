@@ -0,0 +1,109 @@
+// Copyright 2015 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+//
+// Author: Marc Berhault (marc@cockroachlabs.com)
+
+package cli
+
+import (
+	"fmt"
+
+	"github.com/cockroachdb/cockroach-prod/docker"
+	"github.com/cockroachdb/cockroach-prod/drivers"
+	"github.com/cockroachdb/cockroach/util"
+	"github.com/cockroachdb/cockroach/util/log"
+)
+
+// docker-machine states we act on. See libmachine/state for the full list.
+const (
+	machineRunning = "Running"
+	machineStopped = "Stopped"
+)
+
+// nodeState is the state of a node's machine as reported by docker-machine,
+// of its cloud instance as reported by the driver, and of its cockroach
+// container.
+type nodeState struct {
+	machine  string
+	instance drivers.InstanceState
+	// cockroachRunning is only looked up on running machines.
+	cockroachRunning bool
+}
+
+func (s nodeState) String() string {
+	str := fmt.Sprintf("machine %s, instance %s", valueOrNone(s.machine), s.instance)
+	if s.machine == machineRunning {
+		if s.cockroachRunning {
+			str += ", cockroach running"
+		} else {
+			str += ", cockroach not running"
+		}
+	}
+	return str
+}
+
+// getNodeState looks up the state of the node's machine and instance. Lookup
+// failures are logged and leave the state unknown, letting the operation
+// itself report the problem.
+func getNodeState(driver drivers.Driver, nodeName string, config *drivers.HostConfig) nodeState {
+	state := nodeState{instance: drivers.InstanceUnknown}
+
+	machine, err := docker.GetMachineState(nodeName)
+	if err != nil {
+		log.Errorf("could not get machine state for %s: %v", nodeName, err)
+	}
+	state.machine = machine
+
+	state.instance, err = driver.GetInstanceState(nodeName, config)
+	if err != nil {
+		log.Errorf("could not get instance state for %s: %v", nodeName, err)
+	}
+
+	if state.machine == machineRunning {
+		state.cockroachRunning, err = docker.IsDockerCockroachRunning(nodeName)
+		if err != nil {
+			log.Errorf("could not get cockroach container state for %s: %v", nodeName, err)
+		}
+	}
+	return state
+}
+
+// checkStart returns a nodeSkipped error if the node and its cockroach
+// container are already running, or an error if it cannot be started.
+func checkStart(state nodeState) error {
+	switch {
+	case state.instance == drivers.InstanceMissing:
+		return util.Errorf("cannot start node: instance no longer exists (%s)", state)
+	case state.instance == drivers.InstancePending:
+		return util.Errorf("cannot start node: instance is starting or stopping, try again later (%s)", state)
+	case state.machine == machineRunning && state.instance == drivers.InstanceRunning && state.cockroachRunning:
+		return nodeSkipped("already running (" + state.String() + ")")
+	}
+	return nil
+}
+
+// checkStop returns a nodeSkipped error if the node is already stopped, or an
+// error if it cannot be stopped.
+func checkStop(state nodeState) error {
+	switch {
+	case state.instance == drivers.InstanceMissing:
+		return nodeSkipped("instance no longer exists (" + state.String() + ")")
+	case state.instance == drivers.InstancePending:
+		return util.Errorf("cannot stop node: instance is starting or stopping, try again later (%s)", state)
+	case state.machine == machineStopped && state.instance == drivers.InstanceStopped:
+		return nodeSkipped("already stopped (" + state.String() + ")")
+	}
+	return nil
+}
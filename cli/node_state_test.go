@@ -0,0 +1,71 @@
+// Copyright 2015 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+//
+// Author: Marc Berhault (marc@cockroachlabs.com)
+
+package cli
+
+import (
+	"testing"
+
+	"github.com/cockroachdb/cockroach-prod/drivers"
+)
+
+// stateResult is the expected result of checkStart or checkStop.
+type stateResult int
+
+const (
+	proceed stateResult = iota
+	skip
+	fail
+)
+
+func checkResult(err error) stateResult {
+	if err == nil {
+		return proceed
+	}
+	if _, ok := err.(nodeSkipped); ok {
+		return skip
+	}
+	return fail
+}
+
+func TestCheckStartStop(t *testing.T) {
+	testCases := []struct {
+		state       nodeState
+		start, stop stateResult
+	}{
+		{nodeState{machineRunning, drivers.InstanceRunning, true}, skip, proceed},
+		// The cockroach container exited on a running machine.
+		{nodeState{machineRunning, drivers.InstanceRunning, false}, proceed, proceed},
+		{nodeState{machineStopped, drivers.InstanceStopped, false}, proceed, skip},
+		// Machine and instance disagree: the operation fixes them up.
+		{nodeState{machineStopped, drivers.InstanceRunning, false}, proceed, proceed},
+		{nodeState{machineRunning, drivers.InstanceStopped, false}, proceed, proceed},
+		{nodeState{"Error", drivers.InstanceUnknown, false}, proceed, proceed},
+		{nodeState{"", drivers.InstanceUnknown, false}, proceed, proceed},
+		{nodeState{machineRunning, drivers.InstancePending, false}, fail, fail},
+		{nodeState{"", drivers.InstanceMissing, false}, fail, skip},
+	}
+
+	for i, tc := range testCases {
+		if r := checkResult(checkStart(tc.state)); r != tc.start {
+			t.Errorf("%d: checkStart(%s): expected %d, got %d", i, tc.state, tc.start, r)
+		}
+		if r := checkResult(checkStop(tc.state)); r != tc.stop {
+			t.Errorf("%d: checkStop(%s): expected %d, got %d", i, tc.state, tc.stop, r)
+		}
+	}
+}
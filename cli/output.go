@@ -0,0 +1,84 @@
+// Copyright 2015 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+//
+// Author: Marc Berhault (marc@cockroachlabs.com)
+
+package cli
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/cockroachdb/cockroach-prod/docker"
+	"github.com/cockroachdb/cockroach-prod/drivers"
+	"golang.org/x/net/context"
+)
+
+// outputMu serializes lines written by prefixWriters.
+var outputMu sync.Mutex
+
+// prefixWriter writes complete lines to w, each starting with prefix, so that
+// the output of concurrent commands can be told apart.
+type prefixWriter struct {
+	w      io.Writer
+	prefix string
+	buf    []byte
+}
+
+func (p *prefixWriter) Write(b []byte) (int, error) {
+	p.buf = append(p.buf, b...)
+	for {
+		i := bytes.IndexByte(p.buf, '\n')
+		if i < 0 {
+			return len(b), nil
+		}
+		if err := p.writeLine(p.buf[:i+1]); err != nil {
+			return 0, err
+		}
+		p.buf = p.buf[i+1:]
+	}
+}
+
+func (p *prefixWriter) writeLine(line []byte) error {
+	outputMu.Lock()
+	defer outputMu.Unlock()
+	_, err := p.w.Write(append([]byte(p.prefix), line...))
+	return err
+}
+
+// flush writes any incomplete last line.
+func (p *prefixWriter) flush() {
+	if len(p.buf) > 0 {
+		_ = p.writeLine(append(p.buf, '\n'))
+		p.buf = nil
+	}
+}
+
+// withNodeOutput returns a context sending the output of commands run for the
+// node to stdout and stderr, prefixed with the node name. Driver and docker
+// log lines logged through the context get the same prefix. The returned
+// function flushes the output.
+func withNodeOutput(ctx context.Context, nodeName string) (context.Context, func()) {
+	prefix := "[" + nodeName + "] "
+	stdout := &prefixWriter{w: os.Stdout, prefix: prefix}
+	stderr := &prefixWriter{w: os.Stderr, prefix: prefix}
+	ctx = drivers.WithLogPrefix(ctx, prefix)
+	return docker.WithOutput(ctx, stdout, stderr), func() {
+		stdout.flush()
+		stderr.flush()
+	}
+}
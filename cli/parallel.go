@@ -0,0 +1,150 @@
+// Copyright 2015 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+//
+// Author: Marc Berhault (marc@cockroachlabs.com)
+
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"text/tabwriter"
+
+	"github.com/cockroachdb/cockroach-prod/base"
+	"github.com/cockroachdb/cockroach/util/log"
+	"golang.org/x/net/context"
+)
+
+var (
+	// nodeParallelism is the maximum number of nodes operated on at the same
+	// time by add-nodes, apply, start and stop.
+	nodeParallelism int
+	// failFast stops start and stop from starting work on more nodes after the
+	// first failure.
+	failFast bool
+)
+
+// errNodeNotStarted is the result of nodes not tried because of an earlier
+// failure with --fail-fast, or because the command was interrupted.
+var errNodeNotStarted = errors.New("not started")
+
+// nodeSkipped is returned for nodes that did not need the operation, eg:
+// starting a running node. It is not a failure.
+type nodeSkipped string
+
+func (s nodeSkipped) Error() string {
+	return string(s)
+}
+
+func validateParallelism() error {
+	if nodeParallelism < 1 {
+		return base.ValidationErrorf("--parallelism must be > 0, got %d", nodeParallelism)
+	}
+	return nil
+}
+
+// runOnNodes runs fn for every node, up to --parallelism at a time. The output
+// of commands run for a node is prefixed with its name. A failure does not stop
+// the other nodes unless stopOnError is set, in which case the remaining nodes
+// are not started. fn returns a nodeSkipped error for nodes that do not need
+// the operation. Returns the result for each node.
+func runOnNodes(ctx context.Context, nodeNames []string, stopOnError bool,
+	fn func(ctx context.Context, nodeName string) error) []error {
+	errs := make([]error, len(nodeNames))
+	sem := make(chan struct{}, nodeParallelism)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	failed := false
+
+	for i, nodeName := range nodeNames {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			errs[i] = errNodeNotStarted
+			continue
+		}
+		mu.Lock()
+		stop := stopOnError && failed
+		mu.Unlock()
+		if stop || ctx.Err() != nil {
+			<-sem
+			errs[i] = errNodeNotStarted
+			continue
+		}
+
+		wg.Add(1)
+		go func(i int, nodeName string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			nodeCtx, flush := withNodeOutput(ctx, nodeName)
+			defer flush()
+
+			err := fn(nodeCtx, nodeName)
+			if reason, ok := err.(nodeSkipped); ok {
+				log.Infof("skipping %s: %s", nodeName, reason)
+			} else if err != nil {
+				log.Errorf("%s: %v", nodeName, err)
+				mu.Lock()
+				failed = true
+				mu.Unlock()
+			}
+			errs[i] = err
+		}(i, nodeName)
+	}
+	wg.Wait()
+	return errs
+}
+
+// reportNodeResults prints the result for each node, using 'done' to describe
+// successes, eg: "started". If any node failed or was not started, an error
+// wrapping the first failure is returned. Skipped nodes are not failures.
+func reportNodeResults(done string, nodeNames []string, errs []error) error {
+	var firstErr error
+	failed, notStarted := 0, 0
+	w := tabwriter.NewWriter(os.Stdout, 2, 1, 2, ' ', 0)
+	fmt.Fprintf(w, "Node\tResult\n")
+	for i, nodeName := range nodeNames {
+		if reason, ok := errs[i].(nodeSkipped); ok {
+			fmt.Fprintf(w, "%s\tskipped: %s\n", nodeName, reason)
+			continue
+		}
+		switch errs[i] {
+		case nil:
+			fmt.Fprintf(w, "%s\t%s\n", nodeName, done)
+		case errNodeNotStarted:
+			fmt.Fprintf(w, "%s\tnot started\n", nodeName)
+			notStarted++
+		default:
+			fmt.Fprintf(w, "%s\tfailed: %v\n", nodeName, errs[i])
+			failed++
+			if firstErr == nil {
+				firstErr = errs[i]
+			}
+		}
+	}
+	_ = w.Flush()
+
+	if failed == 0 && notStarted == 0 {
+		return nil
+	}
+	if firstErr == nil {
+		// Only nodes not started: the command was interrupted.
+		firstErr = errNodeNotStarted
+	}
+	return base.NewError(base.UnknownError, firstErr, "%d of %d nodes failed, %d not started",
+		failed, len(nodeNames), notStarted)
+}
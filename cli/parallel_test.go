@@ -0,0 +1,68 @@
+// Copyright 2015 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+//
+// Author: Marc Berhault (marc@cockroachlabs.com)
+
+package cli
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/cockroachdb/cockroach-prod/base"
+	"github.com/cockroachdb/cockroach-prod/docker"
+)
+
+func TestReportNodeResults(t *testing.T) {
+	errDocker := base.NewError(base.DockerError, errors.New("boom"), "starting node")
+	errAPI := base.NewError(base.CloudAPIError, errors.New("throttled"), "starting node")
+
+	testCases := []struct {
+		errs []error
+		// Expected error kind, zero for no error.
+		kind base.ErrorKind
+	}{
+		{[]error{nil, nil}, 0},
+		{[]error{nil, nodeSkipped("already running")}, 0},
+		{[]error{nodeSkipped("already running"), nodeSkipped("already running")}, 0},
+		{[]error{nil, errDocker}, base.DockerError},
+		// The first failure determines the kind.
+		{[]error{errAPI, errDocker}, base.CloudAPIError},
+		{[]error{errNodeNotStarted, errDocker}, base.DockerError},
+		// Nodes not started are failures.
+		{[]error{nil, errNodeNotStarted}, base.UnknownError},
+		// Unclassified errors.
+		{[]error{errors.New("unknown"), nil}, base.UnknownError},
+	}
+
+	for i, tc := range testCases {
+		nodes := make([]string, len(tc.errs))
+		for j := range nodes {
+			nodes[j] = docker.MakeNodeName(Context.Cluster, j)
+		}
+		err := reportNodeResults("started", nodes, tc.errs)
+		if tc.kind == 0 {
+			if err != nil {
+				t.Errorf("%d: expected success, got %v", i, err)
+			}
+			continue
+		}
+		if err == nil {
+			t.Errorf("%d: expected a %s error", i, tc.kind)
+		} else if kind := base.GetErrorKind(err); kind != tc.kind {
+			t.Errorf("%d: expected a %s error, got %s: %v", i, tc.kind, kind, err)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+// Copyright 2015 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+//
+// Author: Marc Berhault (marc@cockroachlabs.com)
+
+package cli
+
+import (
+	"github.com/cockroachdb/cockroach-prod/base"
+	"github.com/cockroachdb/cockroach-prod/docker"
+	"github.com/cockroachdb/cockroach-prod/drivers"
+	"github.com/cockroachdb/cockroach/util/log"
+	"github.com/spf13/cobra"
+	"golang.org/x/net/context"
+)
+
+var forceRemoveNodes bool
+
+var removeNodesCmd = &cobra.Command{
+	Use:   "remove-nodes <node> [<node> ... <node>]",
+	Short: "remove nodes",
+	Long: `
+Remove the specified nodes from the cluster. Each node is taken out of the load
+balancer and its cockroach process stopped. Once the remaining nodes are healthy,
+the instance is deleted.
+Refuses to leave fewer than --min-nodes nodes unless --force is specified.
+`,
+	Run: runE(runRemoveNodes),
+}
+
+func runRemoveNodes(ctx context.Context, cmd *cobra.Command, args []string) error {
+	if len(args) == 0 {
+		cmd.Usage()
+		return base.ValidationErrorf("no nodes specified")
+	}
+
+	driver, err := NewDriver(Context)
+	if err != nil {
+		return err
+	}
+
+	ctx, lock, err := acquireLock(ctx, driver, cmd, args)
+	if err != nil {
+		return err
+	}
+	defer lock.release()
+
+	nodes, err := docker.ListCockroachNodes(Context.Cluster)
+	if err != nil {
+		return base.NewError(base.DockerMachineError, err, "listing existing cockroach nodes")
+	}
+
+	remaining, err := remainingNodes(nodes, args)
+	if err != nil {
+		return err
+	}
+	if len(remaining) < Context.MinNodes && !forceRemoveNodes {
+		return base.ValidationErrorf("removing %d nodes would leave %d, less than --min-nodes=%d. "+
+			"Use --force to override", len(nodes)-len(remaining), len(remaining), Context.MinNodes)
+	}
+
+	for _, nodeName := range args {
+		err := RemoveOneNode(ctx, driver, nodeName, remaining)
+		if err != nil {
+			return base.NewError(base.UnknownError, err, "removing node %s", nodeName)
+		}
+	}
+	return nil
+}
+
+// remainingNodes returns the nodes left after removing 'toRemove' from 'nodes'.
+// Errors out if any node in 'toRemove' does not exist or is listed twice.
+func remainingNodes(nodes []string, toRemove []string) ([]string, error) {
+	removed := map[string]bool{}
+	for _, nodeName := range toRemove {
+		if removed[nodeName] {
+			return nil, base.ValidationErrorf("node %s specified more than once", nodeName)
+		}
+		removed[nodeName] = true
+	}
+
+	var remaining []string
+	for _, nodeName := range nodes {
+		if removed[nodeName] {
+			delete(removed, nodeName)
+		} else {
+			remaining = append(remaining, nodeName)
+		}
+	}
+	for nodeName := range removed {
+		return nil, base.ValidationErrorf("node %s is not an existing cockroach node", nodeName)
+	}
+	return remaining, nil
+}
+
+// RemoveOneNode takes a node out of the load balancer, stops cockroach, and
+// waits for all nodes in 'remaining' to be healthy before deleting the machine.
+func RemoveOneNode(ctx context.Context, driver drivers.Driver, nodeName string, remaining []string) error {
+	// Lookup node info.
+	nodeConfig, err := driver.GetNodeConfig(nodeName)
+	if err != nil {
+		return base.NewError(base.CloudAPIError, err, "getting node config for %s", nodeName)
+	}
+
+	// Do "stop node" logic.
+	err = driver.StopNode(ctx, nodeName, nodeConfig)
+	if err != nil {
+		return base.NewError(base.CloudAPIError, err, "running StopNode steps for %s", nodeName)
+	}
+
+	// Stop the cockroach node.
+	err = docker.StopDockerCockroach(ctx, nodeName)
+	if err != nil {
+		return base.NewError(base.DockerError, err, "stopping cockroach node %s", nodeName)
+	}
+
+	// Make sure the cluster is fine without it.
+	for _, otherName := range remaining {
+		otherConfig, err := driver.GetNodeConfig(otherName)
+		if err != nil {
+			return base.NewError(base.CloudAPIError, err, "getting node config for %s", otherName)
+		}
+		err = docker.WaitForNodeStatus(ctx, driver, otherName, otherConfig, Context.NodeTimeout)
+		if err != nil {
+			return base.NewError(base.DockerError, err, "waiting for remaining node %s, not removing %s",
+				otherName, nodeName)
+		}
+	}
+
+	// Delete the machine and its data volume.
+	if err := removeMachine(ctx, driver, nodeName); err != nil {
+		return err
+	}
+	log.Infof("removed node %s", nodeName)
+	return nil
+}
@@ -0,0 +1,162 @@
+// Copyright 2015 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+//
+// Author: Marc Berhault (marc@cockroachlabs.com)
+
+package cli
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/cockroachdb/cockroach-prod/base"
+	"github.com/cockroachdb/cockroach-prod/docker"
+	"github.com/cockroachdb/cockroach-prod/drivers"
+	"github.com/cockroachdb/cockroach/util/log"
+	"github.com/spf13/cobra"
+	"golang.org/x/net/context"
+)
+
+const inServicePollInterval = 5 * time.Second
+
+var rollingRestartCmd = &cobra.Command{
+	Use:   "rolling-restart [<node> ... <node>]",
+	Short: "restart nodes one at a time",
+	Long: `
+Restart the cockroach process on the specified nodes, or all if blank, one node at
+a time. Each node must be healthy and in service in the load balancer before the
+next one is restarted. The rollout is aborted if a node is not healthy within
+--node-timeout.
+`,
+	Run: runE(runRollingRestart),
+}
+
+func runRollingRestart(ctx context.Context, cmd *cobra.Command, args []string) error {
+	driver, err := NewDriver(Context)
+	if err != nil {
+		return err
+	}
+
+	ctx, lock, err := acquireLock(ctx, driver, cmd, args)
+	if err != nil {
+		return err
+	}
+	defer lock.release()
+
+	nodes, err := docker.ListCockroachNodes(Context.Cluster)
+	if err != nil {
+		return base.NewError(base.DockerMachineError, err, "listing existing cockroach nodes")
+	}
+	if len(nodes) == 0 {
+		return base.ValidationErrorf("no existing cockroach nodes detected, does the cluster exist?")
+	}
+	if len(args) != 0 {
+		// Check all names before stopping any node.
+		existing := map[string]bool{}
+		for _, nodeName := range nodes {
+			existing[nodeName] = true
+		}
+		for _, nodeName := range args {
+			if !existing[nodeName] {
+				return base.ValidationErrorf("%s is not a node of cluster %s, existing nodes: %v",
+					nodeName, Context.Cluster, nodes)
+			}
+		}
+		nodes = args
+	}
+
+	for i, nodeName := range nodes {
+		log.Infof("restarting node %s (%d of %d)", nodeName, i+1, len(nodes))
+		err := RestartOneNode(ctx, driver, nodeName, "", "")
+		if err != nil {
+			return base.NewError(base.UnknownError, err,
+				"restarting node %s, aborted rolling restart with %d of %d nodes done", nodeName, i, len(nodes))
+		}
+	}
+	return nil
+}
+
+// RestartOneNode takes the node out of the load balancer, restarts the
+// cockroach container and puts the node back in the load balancer.
+// The container is started from 'image' recording 'previousImage', or the
+// node's current image if empty.
+// Returns once the node is healthy and in service, or errors out
+// after Context.NodeTimeout.
+func RestartOneNode(ctx context.Context, driver drivers.Driver, nodeName string, image, previousImage string) error {
+	// Lookup node info.
+	nodeConfig, err := driver.GetNodeConfig(nodeName)
+	if err != nil {
+		return base.NewError(base.CloudAPIError, err, "getting node config for %s", nodeName)
+	}
+
+	// Do "stop node" logic.
+	err = driver.StopNode(ctx, nodeName, nodeConfig)
+	if err != nil {
+		return base.NewError(base.CloudAPIError, err, "running StopNode steps for %s", nodeName)
+	}
+
+	// Restart the cockroach node.
+	err = docker.RestartDockerCockroach(ctx, driver, nodeName, nodeConfig, image, previousImage)
+	if err != nil {
+		// Put the node back in the load balancer: its health checks take it out
+		// of service if cockroach is not running.
+		if startErr := driver.StartNode(ctx, nodeName, nodeConfig); startErr != nil {
+			log.Errorf("could not put node %s back in the load balancer: %v", nodeName, startErr)
+		}
+		return base.NewError(base.DockerError, err, "restarting cockroach node %s", nodeName)
+	}
+
+	// Do "start node" logic.
+	err = driver.StartNode(ctx, nodeName, nodeConfig)
+	if err != nil {
+		return base.NewError(base.CloudAPIError, err, "running StartNode steps for %s", nodeName)
+	}
+
+	return waitForNodeInService(ctx, driver, nodeName, nodeConfig, Context.NodeTimeout)
+}
+
+// waitForNodeInService waits for the node to answer on /_status/ and for the
+// load balancer to report it in service.
+func waitForNodeInService(ctx context.Context, driver drivers.Driver, nodeName string,
+	nodeConfig *drivers.HostConfig, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	err := docker.WaitForNodeReady(ctx, driver, nodeName, nodeConfig, timeout)
+	if err != nil {
+		return base.NewError(base.DockerError, err, "waiting for cockroach node %s", nodeName)
+	}
+
+	log.Infof("waiting for node %s to be in service in the load balancer", nodeName)
+	// The load balancer is checked at least once, even if the timeout expired.
+	remaining := deadline.Sub(time.Now())
+	if remaining <= 0 {
+		remaining = time.Nanosecond
+	}
+	opts := drivers.RetryOptions{
+		InitialBackoff: inServicePollInterval,
+		MaxBackoff:     inServicePollInterval,
+		Timeout:        remaining,
+		// Load balancer errors are retried until the timeout.
+		Retryable: func(error) bool { return true },
+	}
+	err = drivers.Poll(ctx, opts, fmt.Sprintf("load balancer status of node %s", nodeName),
+		func() (bool, error) {
+			return driver.IsNodeInService(ctx, nodeName, nodeConfig)
+		})
+	if err != nil {
+		return base.NewError(base.CloudAPIError, err, "waiting for node %s to be in service", nodeName)
+	}
+	log.Infof("node %s is in service", nodeName)
+	return nil
+}
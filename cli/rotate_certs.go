@@ -0,0 +1,196 @@
+// Copyright 2015 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+//
+// Author: Marc Berhault (marc@cockroachlabs.com)
+
+package cli
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+	"time"
+
+	"github.com/cockroachdb/cockroach-prod/base"
+	"github.com/cockroachdb/cockroach-prod/docker"
+	"github.com/cockroachdb/cockroach-prod/drivers"
+	"github.com/cockroachdb/cockroach-prod/security"
+	"github.com/cockroachdb/cockroach/util/log"
+	"github.com/spf13/cobra"
+	"golang.org/x/net/context"
+)
+
+var (
+	rotateCA       bool
+	showCertExpiry bool
+)
+
+var rotateCertsCmd = &cobra.Command{
+	Use:   "rotate-certs",
+	Short: "rotate node certificates",
+	Long: `
+Issue new certificates for all nodes from the CA in the certs directory, copy
+them to the nodes, and restart nodes one at a time.
+
+With --ca, the CA is rotated as well. Nodes are restarted three times: first to
+trust both the current and the new CA, then to use certificates signed by the new
+CA, and finally to stop trusting the old CA. If interrupted, run it again with
+--ca to resume the rollover. Client certificates signed by the old CA stop working
+at the end of the rollover.
+
+The expiration dates of the current certificates are printed first.
+`,
+	Run: runE(runRotateCerts),
+}
+
+func runRotateCerts(ctx context.Context, cmd *cobra.Command, args []string) error {
+	if len(args) != 0 {
+		cmd.Usage()
+		return base.ValidationErrorf("unexpected arguments: %v", args)
+	}
+	if Context.Insecure {
+		return base.ValidationErrorf("certificates are not used in insecure mode")
+	}
+
+	nodes, err := docker.ListCockroachNodes(Context.Cluster)
+	if err != nil {
+		return base.NewError(base.DockerMachineError, err, "listing existing cockroach nodes")
+	}
+	if len(nodes) == 0 {
+		return base.ValidationErrorf("no existing cockroach nodes detected, does the cluster exist?")
+	}
+
+	printCertExpiry(nodes)
+	if showCertExpiry {
+		return nil
+	}
+
+	driver, err := NewDriver(Context)
+	if err != nil {
+		return err
+	}
+
+	ctx, lock, err := acquireLock(ctx, driver, cmd, args)
+	if err != nil {
+		return err
+	}
+	defer lock.release()
+
+	state, err := security.GetCARolloverState(Context.Certs)
+	if err != nil {
+		return base.NewError(base.UnknownError, err, "determining CA rollover state")
+	}
+
+	if !rotateCA {
+		if state != security.NoCARollover {
+			return base.ValidationErrorf("a CA rollover is in progress, run rotate-certs --ca to complete it")
+		}
+		if err := rotateNodeCerts(ctx, driver, nodes, false); err != nil {
+			return err
+		}
+		printCertExpiry(nodes)
+		return nil
+	}
+
+	if state == security.NoCARollover {
+		log.Info("CA rollover: creating new CA")
+		if err := security.CreateNextCA(Context.Certs); err != nil {
+			return base.NewError(base.UnknownError, err, "creating new CA")
+		}
+		state = security.NextCACreated
+	}
+
+	if state == security.NextCACreated {
+		log.Info("CA rollover: trusting the new CA on all nodes")
+		if err := rotateNodeCerts(ctx, driver, nodes, false); err != nil {
+			return base.NewError(base.UnknownError, err, "trusting the new CA")
+		}
+		state = security.NextCAPromoting
+	}
+
+	if state == security.NextCAPromoting {
+		if err := security.PromoteNextCA(Context.Certs); err != nil {
+			return base.NewError(base.UnknownError, err, "promoting new CA")
+		}
+	}
+
+	log.Info("CA rollover: issuing node certificates from the new CA")
+	if err := rotateNodeCerts(ctx, driver, nodes, false); err != nil {
+		return base.NewError(base.UnknownError, err, "issuing node certificates from the new CA")
+	}
+
+	log.Info("CA rollover: removing the old CA from all nodes")
+	if err := rotateNodeCerts(ctx, driver, nodes, true); err != nil {
+		return base.NewError(base.UnknownError, err, "removing the old CA from all nodes")
+	}
+	if err := security.RemoveOldCA(Context.Certs); err != nil {
+		return base.NewError(base.UnknownError, err, "removing old CA")
+	}
+	log.Info("CA rollover complete")
+	printCertExpiry(nodes)
+	return nil
+}
+
+// rotateNodeCerts issues new certificates for each node and restarts the nodes
+// one at a time. If currentCAOnly is true, nodes only trust the current CA.
+func rotateNodeCerts(ctx context.Context, driver drivers.Driver, nodes []string, currentCAOnly bool) error {
+	ca, err := security.LoadCA(Context.Certs)
+	if err != nil {
+		return base.NewError(base.UnknownError, err, "loading CA from %s", Context.Certs)
+	}
+	if currentCAOnly {
+		ca.Trusted = nil
+	}
+
+	for i, nodeName := range nodes {
+		log.Infof("rotating certificates on node %s (%d of %d)", nodeName, i+1, len(nodes))
+		nodeConfig, err := driver.GetNodeConfig(nodeName)
+		if err != nil {
+			return base.NewError(base.CloudAPIError, err, "getting node config for %s", nodeName)
+		}
+		if err := installNodeCertsFromCA(ctx, ca, nodeName, nodeConfig); err != nil {
+			return err
+		}
+		if err := RestartOneNode(ctx, driver, nodeName, "", ""); err != nil {
+			return base.NewError(base.UnknownError, err, "restarting node %s, aborted with %d of %d nodes done",
+				nodeName, i, len(nodes))
+		}
+	}
+	return nil
+}
+
+// printCertExpiry prints the expiration dates of the CA certificates and of
+// the certificates issued to each node.
+func printCertExpiry(nodes []string) {
+	files := security.CACertFiles(Context.Certs)
+	for _, nodeName := range nodes {
+		files = append(files, filepath.Join(security.NodeCertsDir(Context.Certs, nodeName), "node.server.crt"))
+	}
+
+	w := &tabwriter.Writer{}
+	w.Init(os.Stdout, 2, 1, 2, ' ', 0)
+	fmt.Fprintf(w, "Certificate\tExpires\n")
+	for _, f := range files {
+		expiry, err := security.CertificateExpiry(f)
+		if err != nil {
+			fmt.Fprintf(w, "%s\tproblem: %v\n", f, err)
+			continue
+		}
+		fmt.Fprintf(w, "%s\t%s (in %d days)\n", f, expiry.Format(time.RFC3339),
+			int(expiry.Sub(time.Now()).Hours()/24))
+	}
+	_ = w.Flush()
+}
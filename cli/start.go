@@ -18,9 +18,11 @@
 package cli
 
 import (
+	"github.com/cockroachdb/cockroach-prod/base"
 	"github.com/cockroachdb/cockroach-prod/docker"
-	"github.com/cockroachdb/cockroach/util/log"
+	"github.com/cockroachdb/cockroach-prod/drivers"
 	"github.com/spf13/cobra"
+	"golang.org/x/net/context"
 )
 
 var startCmd = &cobra.Command{
@@ -28,59 +30,106 @@ var startCmd = &cobra.Command{
 	Short: "start nodes",
 	Long: `
 Start specified nodes, or all if blank. They must have been previously added and stopped.
+Nodes already running are skipped, nodes whose cockroach container exited are
+restarted. Up to --parallelism nodes are started at the same time.
+All nodes are attempted even if some fail, unless --fail-fast is set, and a summary is
+printed at the end.
 `,
-	Run: runStart,
+	Run: runE(runStart),
 }
 
-func runStart(cmd *cobra.Command, args []string) {
+func runStart(ctx context.Context, cmd *cobra.Command, args []string) error {
+	if err := validateParallelism(); err != nil {
+		return err
+	}
+
 	driver, err := NewDriver(Context)
 	if err != nil {
-		log.Errorf("could not create driver: %v", err)
-		return
+		return err
 	}
 
+	ctx, lock, err := acquireLock(ctx, driver, cmd, args)
+	if err != nil {
+		return err
+	}
+	defer lock.release()
+
 	var nodes []string
 	if len(args) == 0 {
-		// TODO(marc): only get nodes in state "Stopped".
-		nodes, err = docker.ListCockroachNodes()
+		nodes, err = docker.ListCockroachNodes(Context.Cluster)
 		if err != nil {
-			log.Errorf("failed to get list of existing cockroach nodes: %v", err)
-			return
+			return base.NewError(base.DockerMachineError, err, "listing existing cockroach nodes")
 		}
 		if len(nodes) == 0 {
-			log.Errorf("no existing cockroach nodes detected, does the cluster exist?")
-			return
+			return base.ValidationErrorf("no existing cockroach nodes detected, does the cluster exist?")
 		}
 	} else {
 		// We let docker-machine dump errors if nodes do not exist.
 		nodes = args
 	}
 
-	for _, nodeName := range nodes {
-		// Start machine.
-		err = docker.StartMachine(nodeName)
-		if err != nil {
-			log.Errorf("could not start machine %s: %v", nodeName, err)
-		}
-
-		// Lookup node info.
+	errs := runOnNodes(ctx, nodes, failFast, func(ctx context.Context, nodeName string) error {
 		nodeConfig, err := driver.GetNodeConfig(nodeName)
 		if err != nil {
-			log.Errorf("could not get node config for %s: %v", nodeName, err)
-			return
+			return base.NewError(base.CloudAPIError, err, "getting node config for %s", nodeName)
+		}
+		if err := checkStart(getNodeState(driver, nodeName, nodeConfig)); err != nil {
+			return err
 		}
+		return StartOneNode(ctx, driver, nodeName)
+	})
+	return reportNodeResults("started", nodes, errs)
+}
+
+// StartOneNode starts the machine and the cockroach node on it, and waits for
+// it to be up. If the machine is already running, only the cockroach node is
+// started (eg: the container exited).
+func StartOneNode(ctx context.Context, driver drivers.Driver, nodeName string) error {
+	// Failing to get the state leaves starting the machine to report the problem.
+	state, err := docker.GetMachineState(nodeName)
+	if err != nil {
+		drivers.LogErrorf(ctx, "could not get machine state for %s: %v", nodeName, err)
+	}
+	running := state == machineRunning
 
-		// Do "start node" logic.
-		err = driver.StartNode(nodeName, nodeConfig)
+	// Start machine.
+	if !running {
+		err = docker.StartMachine(ctx, nodeName)
 		if err != nil {
-			log.Errorf("could not run StartNode steps for %s: %v", nodeName, err)
-			return
+			return base.NewError(base.DockerMachineError, err, "starting machine %s", nodeName)
 		}
+	}
+
+	// Lookup node info.
+	nodeConfig, err := driver.GetNodeConfig(nodeName)
+	if err != nil {
+		return base.NewError(base.CloudAPIError, err, "getting node config for %s", nodeName)
+	}
 
-		// Start the cockroach node.
-		err = docker.RunDockerStart(driver, nodeName, nodeConfig)
+	// Do "prepare node" logic. A running machine was prepared when it started.
+	if !running {
+		err = driver.PrepareNode(ctx, nodeName, nodeConfig, false)
 		if err != nil {
-			log.Errorf("could not start cockroach node %s: %v", nodeName, err)
+			return base.NewError(base.CloudAPIError, err, "running PrepareNode steps for %s", nodeName)
 		}
 	}
+
+	// Do "start node" logic.
+	err = driver.StartNode(ctx, nodeName, nodeConfig)
+	if err != nil {
+		return base.NewError(base.CloudAPIError, err, "running StartNode steps for %s", nodeName)
+	}
+
+	// Start the cockroach node.
+	err = docker.RunDockerStart(ctx, driver, nodeName, nodeConfig)
+	if err != nil {
+		return base.NewError(base.DockerError, err, "starting cockroach node %s", nodeName)
+	}
+
+	// Wait for it to be up.
+	err = docker.WaitForNodeReady(ctx, driver, nodeName, nodeConfig, Context.NodeTimeout)
+	if err != nil {
+		return base.NewError(base.DockerError, err, "waiting for cockroach node %s", nodeName)
+	}
+	return nil
 }
@@ -0,0 +1,103 @@
+// Copyright 2015 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+//
+// Author: Marc Berhault (marc@cockroachlabs.com)
+
+package cli
+
+import (
+	"testing"
+
+	"github.com/cockroachdb/cockroach-prod/base"
+	"golang.org/x/net/context"
+)
+
+// TestStartFailures stops the cluster, injects a failure at each step of
+// starting a node, and checks that start fails with the expected error kind.
+func TestStartFailures(t *testing.T) {
+	testCases := []stepFailure{
+		{"Machines.Start", base.DockerMachineError},
+		{"GetNodeConfig", base.CloudAPIError},
+		{"PrepareNode", base.CloudAPIError},
+		{"StartNode", base.CloudAPIError},
+		{"Containers.Start", base.DockerError},
+		{"", base.DockerError},
+	}
+
+	for _, tc := range testCases {
+		func() {
+			c := newTestCluster(t)
+			defer c.close()
+			c.init()
+			if err := runStop(context.Background(), stopCmd, nil); err != nil {
+				t.Fatalf("stop failed: %v", err)
+			}
+
+			c.inject(tc)
+			c.checkFailure(tc, runStart(context.Background(), startCmd, nil))
+		}()
+	}
+}
+
+func TestStartStop(t *testing.T) {
+	c := newTestCluster(t)
+	defer c.close()
+	c.init()
+	node := c.nodeName(0)
+
+	if err := runStop(context.Background(), stopCmd, nil); err != nil {
+		t.Fatalf("stop failed: %v", err)
+	}
+	if c.isRunning(node) {
+		t.Errorf("node %s is still running after stop", node)
+	}
+	// Stopped nodes are skipped.
+	if err := runStop(context.Background(), stopCmd, nil); err != nil {
+		t.Errorf("stopping a stopped cluster failed: %v", err)
+	}
+
+	if err := runStart(context.Background(), startCmd, nil); err != nil {
+		t.Fatalf("start failed: %v", err)
+	}
+	if !c.isRunning(node) {
+		t.Errorf("node %s is not running after start", node)
+	}
+	// Running nodes are skipped.
+	if err := runStart(context.Background(), startCmd, nil); err != nil {
+		t.Errorf("starting a running cluster failed: %v", err)
+	}
+}
+
+// TestStartExitedContainer checks that start restarts the cockroach container
+// of a node whose machine is still running.
+func TestStartExitedContainer(t *testing.T) {
+	c := newTestCluster(t)
+	defer c.close()
+	c.init()
+	node := c.nodeName(0)
+
+	if err := c.driver.Containers.Stop(context.Background(), node); err != nil {
+		t.Fatal(err)
+	}
+	if c.isRunning(node) {
+		t.Fatalf("node %s is still running after stopping its container", node)
+	}
+	if err := runStart(context.Background(), startCmd, nil); err != nil {
+		t.Fatalf("start failed: %v", err)
+	}
+	if !c.isRunning(node) {
+		t.Errorf("node %s is not running after start", node)
+	}
+}
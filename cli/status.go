@@ -18,58 +18,172 @@
 package cli
 
 import (
+	"encoding/json"
 	"fmt"
 	"os"
-	"os/exec"
+	"strings"
+	"text/tabwriter"
 
+	"github.com/cockroachdb/cockroach-prod/base"
 	"github.com/cockroachdb/cockroach-prod/docker"
+	"github.com/cockroachdb/cockroach-prod/drivers"
+	"github.com/cockroachdb/cockroach/util"
 	"github.com/cockroachdb/cockroach/util/log"
 	"github.com/spf13/cobra"
+	"golang.org/x/net/context"
+	"gopkg.in/yaml.v1"
 )
 
+const (
+	statusFormatTable = "table"
+	statusFormatJSON  = "json"
+	statusFormatYAML  = "yaml"
+)
+
+var statusFormat string
+
 var statusCmd = &cobra.Command{
 	Use:   "status",
-	Short: "show status\n",
+	Short: "show status",
 	Long: `
-Show status.
+Show the status of the load balancer, firewall and all nodes.
+
+Use --format=json or --format=yaml for machine-readable output.
 `,
-	Run: runStatus,
+	Run: runE(runStatus),
 }
 
-func runStatus(cmd *cobra.Command, args []string) {
-	// Check dependencies first.
-	if err := docker.CheckDockerMachine(); err != nil {
-		log.Errorf("docker-machine is not properly installed: %v", err)
-		return
+func runStatus(ctx context.Context, cmd *cobra.Command, args []string) error {
+	switch statusFormat {
+	case statusFormatTable, statusFormatJSON, statusFormatYAML:
+	default:
+		return base.ValidationErrorf("unknown --format %q, must be one of %s, %s, %s",
+			statusFormat, statusFormatTable, statusFormatJSON, statusFormatYAML)
+	}
+
+	// Initialize driver: this refreshes oauth.
+	driver, err := NewDriver(Context)
+	if err != nil {
+		return err
+	}
+
+	// Check dependencies.
+	if driver.DockerMachineDriver() != "" {
+		if err := docker.CheckDockerMachine(); err != nil {
+			return base.NewError(base.DockerMachineError, err, "checking docker-machine installation")
+		}
+		log.Info("docker-machine binary found")
 	}
-	log.Info("docker-machine binary found")
 
 	if err := docker.CheckDocker(); err != nil {
-		log.Errorf("docker is not properly installed: %v", err)
-		return
+		return base.NewError(base.DockerError, err, "checking docker installation")
 	}
 	log.Info("docker binary found")
 
-	// Initialize driver: this refreshes oauth.
-	driver, err := NewDriver(Context)
+	nodes, err := docker.ListCockroachNodes(Context.Cluster)
 	if err != nil {
-		log.Errorf("could not create driver: %v", err)
-		return
+		return base.NewError(base.DockerMachineError, err, "listing existing cockroach nodes")
 	}
 
-	// Print docker-machine status.
-	fmt.Println("######## docker-machine ########")
-	c := exec.Command("docker-machine", "ls")
-	c.Stdin = os.Stdin
-	c.Stdout = os.Stdout
-	c.Stderr = os.Stderr
-	err = c.Run()
+	status := driver.GetStatus()
+	status.Nodes = []*drivers.NodeStatus{}
+	for _, nodeName := range nodes {
+		status.Nodes = append(status.Nodes, getNodeStatus(ctx, driver, nodeName))
+	}
+
+	if err := printStatus(status, statusFormat); err != nil {
+		return base.NewError(base.UnknownError, err, "printing status")
+	}
+	return nil
+}
+
+// getNodeStatus gathers the status of a single node. Errors are recorded in
+// the returned status.
+func getNodeStatus(ctx context.Context, driver drivers.Driver, nodeName string) *drivers.NodeStatus {
+	status := &drivers.NodeStatus{Name: nodeName}
 
+	state, err := docker.GetMachineState(nodeName)
 	if err != nil {
-		log.Error(err)
+		status.Errors = append(status.Errors, fmt.Sprintf("docker-machine: %v", err))
 	}
+	status.MachineState = state
 
-	// Get driver-specific status.
-	fmt.Printf("\n######### %s ########\n", driver.DockerMachineDriver())
-	driver.PrintStatus()
+	cfg, err := driver.GetNodeConfig(nodeName)
+	if err != nil {
+		status.Errors = append(status.Errors, fmt.Sprintf("node config: %v", err))
+		return status
+	}
+	driver.GetNodeStatus(nodeName, cfg, status)
+
+	// Only query cockroach on machines that are up.
+	if state == "Running" {
+		if err := docker.CheckNodeStatus(ctx, driver, nodeName, cfg); err != nil {
+			status.Errors = append(status.Errors, fmt.Sprintf("status endpoint: %v", err))
+		} else {
+			status.Healthy = true
+		}
+	}
+	return status
+}
+
+// printStatus writes the cluster status to stdout in the requested format.
+func printStatus(status *drivers.ClusterStatus, format string) error {
+	switch format {
+	case statusFormatJSON:
+		out, err := json.MarshalIndent(status, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(out))
+		return nil
+	case statusFormatYAML:
+		out, err := yaml.Marshal(status)
+		if err != nil {
+			return err
+		}
+		fmt.Print(string(out))
+		return nil
+	case statusFormatTable:
+		printStatusTable(status)
+		return nil
+	}
+	return util.Errorf("unknown format %q", format)
+}
+
+// printStatusTable prints the cluster status in human-readable form.
+func printStatusTable(status *drivers.ClusterStatus) {
+	fmt.Printf("Driver:        %s\n", status.Driver)
+	fmt.Printf("Region:        %s\n", status.Region)
+	fmt.Printf("Load balancer: %s\n", valueOrNone(status.LoadBalancerAddress))
+	fmt.Printf("Firewall:      %s\n", valueOrNone(status.Firewall))
+	if status.AllowedCIDRs != nil {
+		fmt.Printf("Allowed CIDRs: %s\n", valueOrNone(strings.Join(status.AllowedCIDRs, ",")))
+	}
+	for _, e := range status.Errors {
+		fmt.Printf("Error:         %s\n", e)
+	}
+	fmt.Println()
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "NODE\tID\tMACHINE\tSTATE\tZONE\tINTERNAL IP\tEXTERNAL IP\tIN LB\tIN SERVICE\tHEALTHY")
+	for _, n := range status.Nodes {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%t\t%t\t%t\n",
+			n.Name, valueOrNone(n.InstanceID), valueOrNone(n.MachineState),
+			valueOrNone(n.InstanceState), valueOrNone(n.Zone),
+			valueOrNone(n.InternalIP), valueOrNone(n.ExternalIP), n.InLoadBalancer, n.InService, n.Healthy)
+	}
+	_ = w.Flush()
+
+	for _, n := range status.Nodes {
+		if len(n.Errors) > 0 {
+			fmt.Printf("\n%s errors:\n  %s\n", n.Name, strings.Join(n.Errors, "\n  "))
+		}
+	}
+}
+
+func valueOrNone(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
 }
@@ -18,9 +18,11 @@
 package cli
 
 import (
+	"github.com/cockroachdb/cockroach-prod/base"
 	"github.com/cockroachdb/cockroach-prod/docker"
-	"github.com/cockroachdb/cockroach/util/log"
+	"github.com/cockroachdb/cockroach-prod/drivers"
 	"github.com/spf13/cobra"
+	"golang.org/x/net/context"
 )
 
 var stopCmd = &cobra.Command{
@@ -28,53 +30,69 @@ var stopCmd = &cobra.Command{
 	Short: "stop nodes\n",
 	Long: `
 Stop specified nodes, or all if blank. This stops the actual cloud instances.
+Nodes already stopped are skipped. Up to --parallelism nodes are stopped at the same time.
+All nodes are attempted even if some fail, unless --fail-fast is set, and a summary is
+printed at the end.
 `,
-	Run: runStop,
+	Run: runE(runStop),
 }
 
-func runStop(cmd *cobra.Command, args []string) {
+func runStop(ctx context.Context, cmd *cobra.Command, args []string) error {
+	if err := validateParallelism(); err != nil {
+		return err
+	}
+
 	driver, err := NewDriver(Context)
 	if err != nil {
-		log.Errorf("could not create driver: %v", err)
-		return
+		return err
 	}
 
+	ctx, lock, err := acquireLock(ctx, driver, cmd, args)
+	if err != nil {
+		return err
+	}
+	defer lock.release()
+
 	var nodes []string
 	if len(args) == 0 {
-		// TODO(marc): only get nodes in state "Running".
-		nodes, err = docker.ListCockroachNodes()
+		nodes, err = docker.ListCockroachNodes(Context.Cluster)
 		if err != nil {
-			log.Errorf("failed to get list of existing cockroach nodes: %v", err)
-			return
+			return base.NewError(base.DockerMachineError, err, "listing existing cockroach nodes")
 		}
 		if len(nodes) == 0 {
-			log.Errorf("no existing cockroach nodes detected, does the cluster exist?")
-			return
+			return base.ValidationErrorf("no existing cockroach nodes detected, does the cluster exist?")
 		}
 	} else {
 		// We let docker-machine dump errors if nodes do not exist.
 		nodes = args
 	}
 
-	for _, nodeName := range nodes {
-		// Lookup node info.
+	errs := runOnNodes(ctx, nodes, failFast, func(ctx context.Context, nodeName string) error {
 		nodeConfig, err := driver.GetNodeConfig(nodeName)
 		if err != nil {
-			log.Errorf("could not get node config for %s: %v", nodeName, err)
-			return
+			return base.NewError(base.CloudAPIError, err, "getting node config for %s", nodeName)
 		}
-
-		// Do "stop node" logic.
-		err = driver.StopNode(nodeName, nodeConfig)
-		if err != nil {
-			log.Errorf("could not run StopNode steps for %s: %v", nodeName, err)
-			return
+		if err := checkStop(getNodeState(driver, nodeName, nodeConfig)); err != nil {
+			return err
 		}
+		return StopOneNode(ctx, driver, nodeName, nodeConfig)
+	})
+	return reportNodeResults("stopped", nodes, errs)
+}
 
-		// Stop the machine.
-		err = docker.StopMachine(nodeName)
-		if err != nil {
-			log.Errorf("could not stop machine %s: %v", nodeName, err)
-		}
+// StopOneNode runs the driver "stop node" steps and stops the machine.
+func StopOneNode(ctx context.Context, driver drivers.Driver, nodeName string,
+	nodeConfig *drivers.HostConfig) error {
+	// Do "stop node" logic.
+	err := driver.StopNode(ctx, nodeName, nodeConfig)
+	if err != nil {
+		return base.NewError(base.CloudAPIError, err, "running StopNode steps for %s", nodeName)
+	}
+
+	// Stop the machine.
+	err = docker.StopMachine(ctx, nodeName)
+	if err != nil {
+		return base.NewError(base.DockerMachineError, err, "stopping machine %s", nodeName)
 	}
+	return nil
 }
@@ -0,0 +1,55 @@
+// Copyright 2015 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+//
+// Author: Marc Berhault (marc@cockroachlabs.com)
+
+package cli
+
+import (
+	"testing"
+
+	"github.com/cockroachdb/cockroach-prod/base"
+	"golang.org/x/net/context"
+)
+
+// TestStopFailures injects a failure at each step of stopping a node, then
+// checks that stop completes once the failure is cleared.
+func TestStopFailures(t *testing.T) {
+	testCases := []stepFailure{
+		{"GetNodeConfig", base.CloudAPIError},
+		{"StopNode", base.CloudAPIError},
+		{"Machines.Stop", base.DockerMachineError},
+	}
+
+	for _, tc := range testCases {
+		func() {
+			c := newTestCluster(t)
+			defer c.close()
+			c.init()
+
+			c.inject(tc)
+			c.checkFailure(tc, runStop(context.Background(), stopCmd, nil))
+
+			c.clear(tc)
+			if err := runStop(context.Background(), stopCmd, nil); err != nil {
+				t.Errorf("%s: stop failed after clearing the failure: %v", tc, err)
+			}
+			node := c.nodeName(0)
+			if state, err := c.driver.Machines.State(node); err != nil || state != machineStopped {
+				t.Errorf("%s: expected machine %s to be stopped, got %q (%v)", tc, node, state, err)
+			}
+		}()
+	}
+}
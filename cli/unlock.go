@@ -0,0 +1,84 @@
+// Copyright 2015 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+//
+// Author: Marc Berhault (marc@cockroachlabs.com)
+
+package cli
+
+import (
+	"github.com/cockroachdb/cockroach-prod/base"
+	"github.com/cockroachdb/cockroach-prod/drivers"
+	"github.com/cockroachdb/cockroach/util/log"
+	"github.com/spf13/cobra"
+	"golang.org/x/net/context"
+)
+
+var forceUnlock bool
+
+var unlockCmd = &cobra.Command{
+	Use:   "unlock",
+	Short: "remove the cluster lock\n",
+	Long: `
+Remove the cluster lock held by mutating commands. Only expired locks are removed
+unless --force is specified. Only use --force if the command holding the lock is
+no longer running.
+`,
+	Run: runE(runUnlock),
+}
+
+func runUnlock(ctx context.Context, cmd *cobra.Command, args []string) error {
+	if len(args) != 0 {
+		cmd.Usage()
+		return base.ValidationErrorf("unexpected arguments: %v", args)
+	}
+
+	driver, err := NewDriver(Context)
+	if err != nil {
+		return err
+	}
+
+	err = clearLock(driver, "cloud")
+	if err == drivers.ErrNoLockStore {
+		err = nil
+	}
+	if err != nil {
+		return base.NewError(base.CloudAPIError, err, "removing cluster lock")
+	}
+	if err := clearLock(localLockStore{}, localLockPath()); err != nil {
+		return base.NewError(base.UnknownError, err, "removing cluster lock %s", localLockPath())
+	}
+	return nil
+}
+
+// clearLock removes the lock from 'store' if it has expired or --force is set.
+func clearLock(store lockStore, location string) error {
+	lock, version, err := store.ReadLock()
+	if err != nil {
+		return err
+	}
+	if lock == nil {
+		log.Infof("no cluster lock in %s", location)
+		return nil
+	}
+	if !lock.IsExpired() && !forceUnlock {
+		return base.ValidationErrorf("cluster lock in %s is held by %s and has not expired, use --force "+
+			"to remove it anyway", location, lock)
+	}
+	if err := store.WriteLock(nil, version); err != nil {
+		return err
+	}
+	log.Infof("removed cluster lock in %s held by %s", location, lock)
+	return nil
+}
@@ -0,0 +1,162 @@
+// Copyright 2015 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+//
+// Author: Marc Berhault (marc@cockroachlabs.com)
+
+package cli
+
+import (
+	"strings"
+
+	"github.com/cockroachdb/cockroach-prod/base"
+	"github.com/cockroachdb/cockroach-prod/docker"
+	"github.com/cockroachdb/cockroach/util/log"
+	"github.com/spf13/cobra"
+	"golang.org/x/net/context"
+)
+
+var (
+	upgradeTo       string
+	upgradeRollback bool
+)
+
+var upgradeCmd = &cobra.Command{
+	Use:   "upgrade (--to=<tag> | --rollback)",
+	Short: "upgrade the cockroach image on all nodes\n",
+	Long: `
+Upgrade all nodes to the cockroach image with the specified tag or digest.
+The image is pulled on every node first, then nodes are switched over one at a
+time. Each node must be healthy and in service in the load balancer before the
+next one is upgraded.
+The image each node ran before the upgrade is recorded on its cockroach container.
+An interrupted upgrade can be resumed by running it again. With --rollback, the
+nodes not running the recorded image are reverted to it.
+`,
+	Run: runE(runUpgrade),
+}
+
+func runUpgrade(ctx context.Context, cmd *cobra.Command, args []string) error {
+	if len(args) != 0 || (upgradeTo == "") != upgradeRollback {
+		cmd.Usage()
+		return base.ValidationErrorf("exactly one of --to and --rollback must be specified, with no arguments")
+	}
+
+	driver, err := NewDriver(Context)
+	if err != nil {
+		return err
+	}
+
+	ctx, lock, err := acquireLock(ctx, driver, cmd, args)
+	if err != nil {
+		return err
+	}
+	defer lock.release()
+
+	nodes, err := docker.ListCockroachNodes(Context.Cluster)
+	if err != nil {
+		return base.NewError(base.DockerMachineError, err, "listing existing cockroach nodes")
+	}
+	if len(nodes) == 0 {
+		return base.ValidationErrorf("no existing cockroach nodes detected, does the cluster exist?")
+	}
+
+	// Figure out what each node is running.
+	images, err := readNodeImages(nodes)
+	if err != nil {
+		return base.NewError(base.DockerError, err, "reading node images")
+	}
+	last, err := findClusterUpgrade(nodes, images)
+	if err != nil {
+		return base.NewError(base.ValidationError, err, "finding the last upgrade")
+	}
+
+	// Figure out where the cluster is going, and what the switched nodes
+	// record as their previous image.
+	var target, previous string
+	if upgradeRollback {
+		if last.previous == "" {
+			return base.ValidationErrorf("no upgrade recorded on the cockroach containers, nothing to roll back")
+		}
+		// Rolled back nodes record no previous image: rolling back again does
+		// not redo the upgrade.
+		target = last.previous
+	} else {
+		current := last.current
+		if current == "" {
+			current = Context.Image
+		}
+		target = imageWithTag(current, upgradeTo)
+		previous = current
+		if !last.complete {
+			// A previous upgrade did not complete, it can only be resumed.
+			if target != last.current {
+				return base.ValidationErrorf("upgrade from %s to %s did not complete, resume it "+
+					"or roll it back first", last.previous, last.current)
+			}
+			log.Infof("resuming upgrade from %s to %s", last.previous, last.current)
+			previous = last.previous
+		}
+	}
+
+	var pending []string
+	for _, nodeName := range nodes {
+		if images[nodeName].image == target {
+			log.Infof("node %s already running %s, skipping", nodeName, target)
+			continue
+		}
+		pending = append(pending, nodeName)
+	}
+
+	// Pull images on all nodes before touching any of them.
+	for _, nodeName := range pending {
+		err := docker.PullDockerImage(ctx, nodeName, target)
+		if err != nil {
+			return base.NewError(base.DockerError, err, "pulling image %s on node %s", target, nodeName)
+		}
+	}
+
+	for i, nodeName := range pending {
+		log.Infof("switching node %s from %s to %s (%d of %d)",
+			nodeName, images[nodeName].image, target, i+1, len(pending))
+		err := RestartOneNode(ctx, driver, nodeName, target, previous)
+		if err != nil {
+			return base.NewError(base.UnknownError, err, "upgrading node %s, aborted upgrade with %d of %d nodes done",
+				nodeName, i, len(pending))
+		}
+		images[nodeName] = nodeImage{target, previous}
+	}
+
+	for _, nodeName := range nodes {
+		log.Infof("node %s is running %s", nodeName, images[nodeName].image)
+	}
+	return nil
+}
+
+// imageWithTag replaces the tag or digest of the image with 'tag'.
+// 'tag' is treated as a digest if it contains a colon (eg: sha256:<hex>).
+func imageWithTag(image, tag string) string {
+	repo := image
+	if i := strings.Index(repo, "@"); i >= 0 {
+		repo = repo[:i]
+	}
+	// Registry hosts may have a port, only look at the last path component.
+	if i := strings.LastIndex(repo, ":"); i > strings.LastIndex(repo, "/") {
+		repo = repo[:i]
+	}
+	if strings.Contains(tag, ":") {
+		return repo + "@" + tag
+	}
+	return repo + ":" + tag
+}
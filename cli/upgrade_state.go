@@ -0,0 +1,112 @@
+// Copyright 2015 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+//
+// Author: Marc Berhault (marc@cockroachlabs.com)
+
+package cli
+
+import (
+	"sort"
+
+	"github.com/cockroachdb/cockroach-prod/docker"
+	"github.com/cockroachdb/cockroach/util"
+)
+
+// nodeImage is the image of a node's cockroach container, and the image the
+// node ran before the last upgrade as recorded on the container.
+type nodeImage struct {
+	image    string
+	previous string
+}
+
+// readNodeImages returns the images of the cockroach container of each node.
+// Nodes without a cockroach container have empty images.
+func readNodeImages(nodes []string) (map[string]nodeImage, error) {
+	images := map[string]nodeImage{}
+	for _, nodeName := range nodes {
+		image, previous, err := docker.GetDockerCockroachImage(nodeName)
+		if err != nil {
+			return nil, util.Errorf("getting cockroach image for node %s: %v", nodeName, err)
+		}
+		images[nodeName] = nodeImage{image, previous}
+	}
+	return images, nil
+}
+
+// clusterUpgrade is the last upgrade of the cluster, as recorded on the
+// cockroach containers. It does not depend on local state, so any
+// workstation can resume or roll back an upgrade.
+type clusterUpgrade struct {
+	// current is the most recent image run by the nodes, empty if no node has
+	// a cockroach container.
+	current string
+	// previous is the image the cluster ran before it was upgraded to current,
+	// empty if unknown.
+	previous string
+	// complete is false if some nodes still run the previous image.
+	complete bool
+}
+
+// findClusterUpgrade works out the last upgrade from the node images.
+// Upgraded nodes record the image they replaced. If the nodes run two images,
+// the nodes running the newer one record the older one.
+func findClusterUpgrade(nodes []string, images map[string]nodeImage) (clusterUpgrade, error) {
+	// previousByImage holds the distinct recorded images of the nodes running
+	// each image.
+	previousByImage := map[string]map[string]bool{}
+	for _, nodeName := range nodes {
+		img := images[nodeName]
+		if img.image == "" {
+			continue
+		}
+		if previousByImage[img.image] == nil {
+			previousByImage[img.image] = map[string]bool{}
+		}
+		previousByImage[img.image][img.previous] = true
+	}
+
+	var running []string
+	for image := range previousByImage {
+		running = append(running, image)
+	}
+	sort.Strings(running)
+
+	// recorded returns the image recorded by all nodes running 'image', or
+	// empty if they differ.
+	recorded := func(image string) string {
+		if len(previousByImage[image]) != 1 {
+			return ""
+		}
+		for previous := range previousByImage[image] {
+			return previous
+		}
+		return ""
+	}
+
+	switch len(running) {
+	case 0:
+		return clusterUpgrade{complete: true}, nil
+	case 1:
+		return clusterUpgrade{current: running[0], previous: recorded(running[0]), complete: true}, nil
+	case 2:
+		for i, image := range running {
+			other := running[1-i]
+			if recorded(image) == other {
+				return clusterUpgrade{current: image, previous: other, complete: false}, nil
+			}
+		}
+	}
+	return clusterUpgrade{}, util.Errorf("nodes run images %v which do not come from a single upgrade", running)
+}
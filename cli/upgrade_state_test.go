@@ -0,0 +1,74 @@
+// Copyright 2015 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+//
+// Author: Marc Berhault (marc@cockroachlabs.com)
+
+package cli
+
+import "testing"
+
+func TestFindClusterUpgrade(t *testing.T) {
+	const (
+		v1 = "cockroachdb/cockroach:v1"
+		v2 = "cockroachdb/cockroach:v2"
+		v3 = "cockroachdb/cockroach:v3"
+	)
+	testCases := []struct {
+		images   []nodeImage
+		expected clusterUpgrade
+		valid    bool
+	}{
+		// No cockroach containers.
+		{[]nodeImage{{"", ""}}, clusterUpgrade{complete: true}, true},
+		// Never upgraded.
+		{[]nodeImage{{v1, ""}, {v1, ""}}, clusterUpgrade{v1, "", true}, true},
+		// Completed upgrade.
+		{[]nodeImage{{v2, v1}, {v2, v1}}, clusterUpgrade{v2, v1, true}, true},
+		// Nodes disagree on the previous image.
+		{[]nodeImage{{v2, v1}, {v2, ""}}, clusterUpgrade{v2, "", true}, true},
+		// Interrupted upgrade, in either node order.
+		{[]nodeImage{{v2, v1}, {v1, ""}}, clusterUpgrade{v2, v1, false}, true},
+		{[]nodeImage{{v1, ""}, {v3, v1}, {"", ""}}, clusterUpgrade{v3, v1, false}, true},
+		// Interrupted second upgrade.
+		{[]nodeImage{{v3, v2}, {v2, v1}}, clusterUpgrade{v3, v2, false}, true},
+		// Interrupted rollback: rolled back nodes record no previous image.
+		{[]nodeImage{{v1, ""}, {v1, ""}, {v2, v1}}, clusterUpgrade{v2, v1, false}, true},
+		// Unrelated images.
+		{[]nodeImage{{v1, ""}, {v2, ""}}, clusterUpgrade{}, false},
+		{[]nodeImage{{v1, ""}, {v2, v1}, {v3, v2}}, clusterUpgrade{}, false},
+	}
+
+	for i, tc := range testCases {
+		var nodes []string
+		images := map[string]nodeImage{}
+		for j, image := range tc.images {
+			nodeName := string('a' + rune(j))
+			nodes = append(nodes, nodeName)
+			images[nodeName] = image
+		}
+		last, err := findClusterUpgrade(nodes, images)
+		if !tc.valid {
+			if err == nil {
+				t.Errorf("%d: expected an error, got %+v", i, last)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%d: unexpected error: %v", i, err)
+		} else if last != tc.expected {
+			t.Errorf("%d: expected %+v, got %+v", i, tc.expected, last)
+		}
+	}
+}
@@ -0,0 +1,243 @@
+// Copyright 2015 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+//
+// Author: Marc Berhault (marc@cockroachlabs.com)
+
+package docker
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"github.com/cockroachdb/cockroach-prod/drivers"
+	"github.com/cockroachdb/cockroach/util"
+	"golang.org/x/net/context"
+)
+
+// Containers runs the cockroach container on machines. The default runs
+// docker against each machine's docker daemon.
+type Containers interface {
+	// Init initializes the cockroach store on the node.
+	Init(ctx context.Context, driver drivers.Driver, nodeName string, settings *drivers.HostConfig) error
+	// Start removes any existing cockroach container and starts a new one
+	// running image. previousImage is recorded on the container.
+	Start(ctx context.Context, driver drivers.Driver, nodeName string, settings *drivers.HostConfig,
+		image, previousImage string) error
+	// Image returns the image of the cockroach container and the image it
+	// replaced, if known. Both are empty if there is no cockroach container.
+	Image(nodeName string) (string, string, error)
+	// Pull pulls the image on the node.
+	Pull(ctx context.Context, nodeName string, image string) error
+	// Stop gracefully stops the cockroach container.
+	Stop(ctx context.Context, nodeName string) error
+	// Logs prints the last lines of the cockroach container logs.
+	Logs(ctx context.Context, nodeName string) error
+	// Exited returns true if the cockroach container exists and is not running.
+	Exited(nodeName string) (bool, error)
+}
+
+// containers is the Containers implementation in use.
+var containers Containers = dockerContainers{}
+
+// SetContainers replaces the docker based Containers.
+func SetContainers(c Containers) {
+	containers = c
+}
+
+// dockerContainers implements Containers by running docker.
+type dockerContainers struct{}
+
+func (dockerContainers) Init(ctx context.Context, driver drivers.Driver, nodeName string,
+	settings *drivers.HostConfig) error {
+	return runDocker(ctx, nodeName,
+		"run",
+		"--rm",
+		"-v", fmt.Sprintf("%s:/data", settings.Driver.DataDir()),
+		driver.Context().Image,
+		"init",
+		"--stores=ssd=/data",
+	)
+}
+
+func (dockerContainers) Start(ctx context.Context, driver drivers.Driver, nodeName string,
+	settings *drivers.HostConfig, image, previousImage string) error {
+	// The container may not exist, ignore errors.
+	_ = removeDockerCockroach(ctx, nodeName)
+
+	port := driver.Context().Port
+	args := []string{
+		"run",
+		"-d",
+		"--name", machines.ContainerName(nodeName),
+		"--label", fmt.Sprintf("%s=%s", previousImageLabel, previousImage),
+		"-v", fmt.Sprintf("%s:/data", settings.Driver.DataDir()),
+	}
+	args = append(args, machines.NetworkArgs(nodeName, settings, port)...)
+	if !driver.Context().Insecure {
+		args = append(args, "-v", fmt.Sprintf("%s:/certs", settings.Driver.CertsDir()))
+	}
+	args = append(args,
+		image,
+		"start",
+	)
+	if driver.Context().Insecure {
+		args = append(args, "--insecure")
+	} else {
+		args = append(args, "--certs=/certs")
+	}
+	// TODO(marc): remove localhost once we serve /_status/ before
+	// joining the gossip network.
+	gossip := fmt.Sprintf("localhost:%d,http-lb=%s:%d", port, settings.Driver.GossipAddress(), port)
+	if seeder, ok := settings.Driver.(drivers.GossipSeeder); ok && len(seeder.GossipSeeds()) > 0 {
+		gossip = fmt.Sprintf("localhost:%d", port)
+		for _, seed := range seeder.GossipSeeds() {
+			gossip += fmt.Sprintf(",%s:%d", seed, port)
+		}
+	}
+	args = append(args,
+		"--stores=ssd=/data",
+		// --addr must be an address reachable by other nodes.
+		fmt.Sprintf("--addr=%s:%d", settings.Driver.IPAddress(), port),
+		"--gossip="+gossip,
+	)
+	return runDocker(ctx, nodeName, args...)
+}
+
+func (dockerContainers) Image(nodeName string) (string, string, error) {
+	args, err := GetDockerFlags(nodeName)
+	if err != nil {
+		return "", "", err
+	}
+	args = append(args, "inspect",
+		"--format", fmt.Sprintf(`{{.Config.Image}} {{index .Config.Labels "%s"}}`, previousImageLabel),
+		machines.ContainerName(nodeName))
+
+	var stderr bytes.Buffer
+	cmd := exec.Command("docker", args...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if strings.Contains(stderr.String(), "No such") {
+			return "", "", nil
+		}
+		return "", "", util.Errorf("%v: %s", err, stderr.String())
+	}
+
+	fields := strings.Fields(string(out))
+	if len(fields) == 0 {
+		return "", "", util.Errorf("unexpected docker inspect output: %q", out)
+	}
+	image, previousImage := fields[0], ""
+	if len(fields) > 1 && fields[1] != dockerNoValue {
+		previousImage = fields[1]
+	}
+	return image, previousImage, nil
+}
+
+func (dockerContainers) Pull(ctx context.Context, nodeName string, image string) error {
+	return runDocker(ctx, nodeName, "pull", image)
+}
+
+// Stop gives the process dockerStopTimeout to shut down before killing it.
+func (dockerContainers) Stop(ctx context.Context, nodeName string) error {
+	ids, err := cockroachContainers(nodeName)
+	if err != nil {
+		return err
+	}
+	if len(ids) == 0 {
+		return util.Errorf("no cockroach container found on %s", nodeName)
+	}
+	args := []string{"stop", fmt.Sprintf("--time=%d", int(dockerStopTimeout.Seconds()))}
+	return runDocker(ctx, nodeName, append(args, ids...)...)
+}
+
+func (dockerContainers) Logs(ctx context.Context, nodeName string) error {
+	return runDocker(ctx, nodeName, "logs", fmt.Sprintf("--tail=%d", dockerLogsTailLines),
+		machines.ContainerName(nodeName))
+}
+
+func (dockerContainers) Exited(nodeName string) (bool, error) {
+	args, err := GetDockerFlags(nodeName)
+	if err != nil {
+		return false, err
+	}
+	args = append(args, "inspect", "--format", "{{.State.Running}}", machines.ContainerName(nodeName))
+
+	var stderr bytes.Buffer
+	cmd := exec.Command("docker", args...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if strings.Contains(stderr.String(), "No such") {
+			return false, nil
+		}
+		return false, util.Errorf("%v: %s", err, stderr.String())
+	}
+	return strings.TrimSpace(string(out)) == "false", nil
+}
+
+// removeDockerCockroach removes the cockroach containers, killing them if running.
+func removeDockerCockroach(ctx context.Context, nodeName string) error {
+	ids, err := cockroachContainers(nodeName)
+	if err != nil || len(ids) == 0 {
+		return err
+	}
+	args, err := GetDockerFlags(nodeName)
+	if err != nil {
+		return err
+	}
+	args = append(append(args, "rm", "-f"), ids...)
+	return runCommand(ctx, exec.Command("docker", args...))
+}
+
+// cockroachContainers returns the IDs of the cockroach containers on the node:
+// the named container if it exists. Earlier versions started cockroach without
+// a container name: on machines running a single node, containers of the
+// cockroach image are returned instead.
+func cockroachContainers(nodeName string) ([]string, error) {
+	args, err := GetDockerFlags(nodeName)
+	if err != nil {
+		return nil, err
+	}
+	args = append(args, "ps", "-a", "--no-trunc", "--format", "{{.ID}} {{.Names}} {{.Image}}")
+
+	var stderr bytes.Buffer
+	cmd := exec.Command("docker", args...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, util.Errorf("%v: %s", err, stderr.String())
+	}
+
+	name := machines.ContainerName(nodeName)
+	var legacy []string
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			continue
+		}
+		id, names, image := fields[0], fields[1], fields[2]
+		if names == name {
+			return []string{id}, nil
+		}
+		if name == cockroachContainerName &&
+			(image == legacyCockroachImage || strings.HasPrefix(image, legacyCockroachImage+":")) {
+			legacy = append(legacy, id)
+		}
+	}
+	return legacy, nil
+}
@@ -22,14 +22,29 @@ import (
 	"os"
 	"os/exec"
 	"strings"
+	"time"
 
 	"github.com/cockroachdb/cockroach-prod/drivers"
 	"github.com/cockroachdb/cockroach/util"
-	"github.com/cockroachdb/cockroach/util/log"
+	"golang.org/x/net/context"
 )
 
 const (
 	dockerVersionStringPrefix = "Docker version "
+	// Name of the cockroach container on each docker-machine.
+	cockroachContainerName = "cockroach"
+	// Image of the unnamed cockroach containers started by earlier versions.
+	legacyCockroachImage = "cockroachdb/cockroach"
+	// How long "docker stop" waits for cockroach to exit before killing it.
+	dockerStopTimeout = 30 * time.Second
+	// Container label holding the image the node ran before the current one.
+	previousImageLabel = "cockroach-prod.previous-image"
+	// Number of log lines shown for a failed container.
+	dockerLogsTailLines = 100
+	// Printed by "docker inspect" templates for missing map keys.
+	dockerNoValue = "<no value>"
+	// File created in the data directory by "cockroach init".
+	storeMarkerFile = "CURRENT"
 )
 
 // CheckDocker verifies that docker-machine is installed and runnable.
@@ -48,57 +63,112 @@ func CheckDocker() error {
 	return nil
 }
 
-// RunDockerInit initializes the first node.
-func RunDockerInit(driver drivers.Driver, nodeName string, settings *drivers.HostConfig) error {
-	dockerArgs, err := GetDockerFlags(nodeName)
+// runDocker runs docker against the given machine's docker daemon.
+func runDocker(ctx context.Context, nodeName string, dockerArgs ...string) error {
+	args, err := GetDockerFlags(nodeName)
 	if err != nil {
 		return err
 	}
-	args := dockerArgs
-	args = append(args,
-		"run",
-		"--rm",
-		"-v", fmt.Sprintf("%s:/data", settings.Driver.DataDir()),
-		"cockroachdb/cockroach",
-		"init",
-		"--stores=ssd=/data",
-	)
-	log.Infof("running: docker %s", strings.Join(args, " "))
-	cmd := exec.Command("docker", args...)
-	cmd.Stdin = os.Stdin
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	return cmd.Run()
+	args = append(args, dockerArgs...)
+	drivers.LogInfof(ctx, "running: docker %s", strings.Join(args, " "))
+	return runInteractive(ctx, exec.Command("docker", args...))
+}
+
+// RunDockerInit initializes the first node.
+func RunDockerInit(ctx context.Context, driver drivers.Driver, nodeName string,
+	settings *drivers.HostConfig) error {
+	return containers.Init(ctx, driver, nodeName, settings)
+}
+
+// IsStoreInitialized returns true if the data directory on the node contains
+// an initialized store.
+func IsStoreInitialized(ctx context.Context, nodeName string, settings *drivers.HostConfig) (bool, error) {
+	const initialized = "initialized"
+	out, err := RunOnMachine(ctx, nodeName, fmt.Sprintf("if sudo test -e %s/%s; then echo %s; fi",
+		settings.Driver.DataDir(), storeMarkerFile, initialized))
+	if err != nil {
+		return false, err
+	}
+	return len(out) > 0 && strings.TrimSpace(out[0]) == initialized, nil
 }
 
 // RunDockerStart starts the cockroach binary.
-func RunDockerStart(driver drivers.Driver, nodeName string, settings *drivers.HostConfig) error {
-	dockerArgs, err := GetDockerFlags(nodeName)
+// The node keeps running the image of its existing cockroach container if any
+// (eg: left over from before the machine was stopped), otherwise the image
+// from the context is used.
+func RunDockerStart(ctx context.Context, driver drivers.Driver, nodeName string,
+	settings *drivers.HostConfig) error {
+	image, previousImage, err := GetDockerCockroachImage(nodeName)
 	if err != nil {
 		return err
 	}
-	port := driver.Context().Port
-	args := dockerArgs
-	args = append(args,
-		"run",
-		"-d",
-		"-v", fmt.Sprintf("%s:/data", settings.Driver.DataDir()),
-		"-p", fmt.Sprintf("%d:%d", port, port),
-		"--net", "host",
-		"cockroachdb/cockroach",
-		"start",
-		"--insecure",
-		"--stores=ssd=/data",
-		// --addr must be an address reachable by other nodes.
-		fmt.Sprintf("--addr=%s:%d", settings.Driver.IPAddress(), port),
-		// TODO(marc): remove localhost once we serve /_status/ before
-		// joining the gossip network.
-		fmt.Sprintf("--gossip=localhost:%d,http-lb=%s:%d", port, settings.Driver.GossipAddress(), port),
-	)
-	log.Infof("running: docker %s", strings.Join(args, " "))
-	cmd := exec.Command("docker", args...)
-	cmd.Stdin = os.Stdin
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	return cmd.Run()
+	if image == "" {
+		image = driver.Context().Image
+	}
+	return runDockerStart(ctx, driver, nodeName, settings, image, previousImage)
+}
+
+// RunDockerStartImage starts the cockroach binary using the specified image.
+// 'previousImage' is recorded on the container as the image the node ran
+// before the last upgrade, empty if none.
+func RunDockerStartImage(ctx context.Context, driver drivers.Driver, nodeName string,
+	settings *drivers.HostConfig, image, previousImage string) error {
+	return runDockerStart(ctx, driver, nodeName, settings, image, previousImage)
+}
+
+// runDockerStart removes any existing cockroach container and starts a new one.
+func runDockerStart(ctx context.Context, driver drivers.Driver, nodeName string, settings *drivers.HostConfig,
+	image, previousImage string) error {
+	return containers.Start(ctx, driver, nodeName, settings, image, previousImage)
+}
+
+// GetDockerCockroachImage returns the image of the cockroach container and the
+// image it replaced, if known. Both are empty if there is no cockroach container.
+func GetDockerCockroachImage(nodeName string) (string, string, error) {
+	return containers.Image(nodeName)
+}
+
+// IsDockerCockroachRunning returns true if the cockroach container exists and
+// is running.
+func IsDockerCockroachRunning(nodeName string) (bool, error) {
+	image, _, err := GetDockerCockroachImage(nodeName)
+	if err != nil || image == "" {
+		return false, err
+	}
+	exited, err := containers.Exited(nodeName)
+	if err != nil {
+		return false, err
+	}
+	return !exited, nil
+}
+
+// PullDockerImage pulls the image on the given machine.
+func PullDockerImage(ctx context.Context, nodeName string, image string) error {
+	return containers.Pull(ctx, nodeName, image)
+}
+
+// StopDockerCockroach gracefully stops the cockroach container. The process
+// is given dockerStopTimeout to shut down before being killed.
+func StopDockerCockroach(ctx context.Context, nodeName string) error {
+	return containers.Stop(ctx, nodeName)
+}
+
+// PrintDockerCockroachLogs prints the last lines of the cockroach container logs.
+func PrintDockerCockroachLogs(ctx context.Context, nodeName string) error {
+	return containers.Logs(ctx, nodeName)
+}
+
+// RestartDockerCockroach gracefully stops the cockroach container and starts a
+// new one. The new container picks up any changes to the cockroach flags.
+// If image is empty, the node keeps running its current image. Otherwise,
+// 'previousImage' is recorded on the new container.
+func RestartDockerCockroach(ctx context.Context, driver drivers.Driver, nodeName string,
+	settings *drivers.HostConfig, image, previousImage string) error {
+	if err := StopDockerCockroach(ctx, nodeName); err != nil {
+		return err
+	}
+	if image == "" {
+		return RunDockerStart(ctx, driver, nodeName, settings)
+	}
+	return RunDockerStartImage(ctx, driver, nodeName, settings, image, previousImage)
 }
@@ -0,0 +1,102 @@
+// Copyright 2015 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+//
+// Author: Marc Berhault (marc@cockroachlabs.com)
+
+package docker
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/cockroachdb/cockroach-prod/drivers"
+	"github.com/cockroachdb/cockroach/util"
+	"github.com/cockroachdb/cockroach/util/log"
+	"golang.org/x/net/context"
+)
+
+const (
+	statusPath         = "/_status/"
+	statusPollInterval = 2 * time.Second
+	// Timeout for a single status request.
+	statusRequestTimeout = 5 * time.Second
+)
+
+// CheckNodeStatus queries the /_status/ endpoint of the cockroach node.
+// The request is issued from the machine itself since the address cockroach
+// listens on is usually not reachable from outside the cloud network.
+// Returns nil if the node answered.
+func CheckNodeStatus(ctx context.Context, driver drivers.Driver, nodeName string,
+	settings *drivers.HostConfig) error {
+	curl := fmt.Sprintf("curl --silent --fail --max-time %d", int(statusRequestTimeout.Seconds()))
+	scheme := "http"
+	if !driver.Context().Insecure {
+		scheme = "https"
+		curl += fmt.Sprintf(" --cacert %s/ca.crt", settings.Driver.CertsDir())
+	}
+	url := fmt.Sprintf("%s://%s:%d%s", scheme, settings.Driver.IPAddress(), driver.Context().Port, statusPath)
+	_, err := RunOnMachine(ctx, nodeName, curl+" "+url)
+	return err
+}
+
+// WaitForNodeStatus polls the /_status/ endpoint of the cockroach node
+// until it answers, the timeout expires, or the cockroach container exits.
+func WaitForNodeStatus(ctx context.Context, driver drivers.Driver, nodeName string,
+	settings *drivers.HostConfig, timeout time.Duration) error {
+	drivers.LogInfof(ctx, "waiting for node %s to report healthy", nodeName)
+	deadline := time.Now().Add(timeout)
+	for {
+		err := CheckNodeStatus(ctx, driver, nodeName, settings)
+		if err == nil {
+			drivers.LogInfof(ctx, "node %s is healthy", nodeName)
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return util.Errorf("node %s not healthy after %s: %v", nodeName, timeout, err)
+		}
+		// Do not wait for the timeout if cockroach crashed.
+		exited, exitedErr := containers.Exited(nodeName)
+		if exitedErr != nil && log.V(1) {
+			drivers.LogInfof(ctx, "could not get cockroach container state for node %s: %v", nodeName, exitedErr)
+		}
+		if exited {
+			return util.Errorf("cockroach container on node %s exited: %v", nodeName, err)
+		}
+		if log.V(1) {
+			drivers.LogInfof(ctx, "node %s not healthy yet: %v", nodeName, err)
+		}
+		select {
+		case <-time.After(statusPollInterval):
+		case <-ctx.Done():
+			return util.Errorf("waiting for node %s: %v", nodeName, ctx.Err())
+		}
+	}
+}
+
+// WaitForNodeReady waits for a freshly started cockroach node to answer on
+// /_status/. If it does not within the timeout, the cockroach container
+// logs are printed and an error is returned.
+func WaitForNodeReady(ctx context.Context, driver drivers.Driver, nodeName string,
+	settings *drivers.HostConfig, timeout time.Duration) error {
+	err := WaitForNodeStatus(ctx, driver, nodeName, settings, timeout)
+	if err == nil {
+		return nil
+	}
+	drivers.LogErrorf(ctx, "node %s is not ready, cockroach container logs follow", nodeName)
+	if logErr := PrintDockerCockroachLogs(ctx, nodeName); logErr != nil {
+		drivers.LogErrorf(ctx, "could not fetch cockroach container logs for %s: %v", nodeName, logErr)
+	}
+	return err
+}
@@ -18,8 +18,9 @@
 package docker
 
 import (
-	"encoding/json"
+	"bytes"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"regexp"
@@ -29,23 +30,24 @@ import (
 	"github.com/cockroachdb/cockroach-prod/drivers"
 	"github.com/cockroachdb/cockroach/util"
 	"github.com/cockroachdb/cockroach/util/log"
-	"github.com/ghemawat/stream"
+	"golang.org/x/net/context"
 )
 
 const (
 	dockerMachineVersionStringPrefix = "docker-machine version "
 	dockerMachineBinary              = "docker-machine"
 	dockerMachineStoragePath         = "${HOME}/.docker/machine"
-	cockroachNodeName                = `cockroach-%d`
+	cockroachNodeName                = `%s-%d`
 )
 
-var (
-	cockroachNodeRegexp = regexp.MustCompile(`^cockroach-([0-9]+)$`)
-)
+// nodeRegexp returns the regexp matching node names in the given cluster.
+func nodeRegexp(cluster string) *regexp.Regexp {
+	return regexp.MustCompile(`^` + regexp.QuoteMeta(cluster) + `-([0-9]+)$`)
+}
 
-// MakeNodeName generates a cockroach node name for the given ID.
-func MakeNodeName(id int) string {
-	return fmt.Sprintf(cockroachNodeName, id)
+// MakeNodeName generates a cockroach node name for the given cluster and ID.
+func MakeNodeName(cluster string, id int) string {
+	return fmt.Sprintf(cockroachNodeName, cluster, id)
 }
 
 // CheckDockerMachine verifies that docker-machine is installed and
@@ -67,38 +69,49 @@ func CheckDockerMachine() error {
 
 // ListMachines returns a list of machine names.
 func ListMachines() ([]string, error) {
-	return stream.Contents(stream.Command(dockerMachineBinary, "ls", "-q"))
+	return machines.List()
 }
 
-// ListCockroachNodes returns a list of machines that are cockroach nodes.
+// ListCockroachNodes returns a list of machines that are cockroach nodes
+// in the given cluster.
 // We could use stream with grep, but let's minimize our dependencies.
 // docker-machine is also terrible at proper exit codes.
-func ListCockroachNodes() ([]string, error) {
+func ListCockroachNodes(cluster string) ([]string, error) {
 	machines, err := ListMachines()
 	if err != nil {
 		return nil, err
 	}
+	nodeRE := nodeRegexp(cluster)
 	ret := []string{}
 	for _, mach := range machines {
-		if cockroachNodeRegexp.MatchString(mach) {
+		if nodeRE.MatchString(mach) {
 			ret = append(ret, mach)
 		}
 	}
 	return ret, nil
 }
 
+// GetNodeIndex returns the index of the given cockroach node name.
+func GetNodeIndex(cluster string, nodeName string) (int, error) {
+	match := nodeRegexp(cluster).FindStringSubmatch(nodeName)
+	if match == nil || len(match) != 2 {
+		return -1, util.Errorf("invalid cockroach node name: %s", nodeName)
+	}
+	index, err := strconv.Atoi(match[1])
+	if err != nil {
+		return -1, util.Errorf("invalid cockroach node name: %s", nodeName)
+	}
+	return index, nil
+}
+
 // GetLargestNodeIndex takes a list of node names and returns the largest
 // node index seen. Returns 0 if no nodes are passed. Fails on parsing errors.
-func GetLargestNodeIndex(nodes []string) (int, error) {
+func GetLargestNodeIndex(cluster string, nodes []string) (int, error) {
 	var largest int
 	for _, nodeName := range nodes {
-		match := cockroachNodeRegexp.FindStringSubmatch(nodeName)
-		if match == nil || len(match) != 2 {
-			return -1, util.Errorf("invalid cockroach node name: %s", nodeName)
-		}
-		index, err := strconv.Atoi(match[1])
+		index, err := GetNodeIndex(cluster, nodeName)
 		if err != nil {
-			return -1, util.Errorf("invalid cockroach node name: %s", nodeName)
+			return -1, err
 		}
 		if index > largest {
 			largest = index
@@ -107,70 +120,146 @@ func GetLargestNodeIndex(nodes []string) (int, error) {
 	return largest, nil
 }
 
-// GetHostConfig gets the machine config from docker-machine.
+// GetHostConfig gets the machine config.
 // It takes an initialized driver.HostConfig struct with the Driver
 // field initialized to the driver-specific type.
 // The passed-in object is filled in with the contents of the config.
 func GetHostConfig(name string, config *drivers.HostConfig) error {
-	contents, err := stream.Contents(stream.Command(dockerMachineBinary, "inspect", name))
-	if err != nil {
-		return err
-	}
-
-	return json.Unmarshal([]byte(strings.Join(contents, "\n")), config)
+	return machines.Inspect(name, config)
 }
 
 // GetDockerFlags returns the list of flags we need to pass to docker to
 // talk to the given machine's docker daemon.
-// We expect a single line, but then split that line into individual flags.
 func GetDockerFlags(name string) ([]string, error) {
-	contents, err := stream.Contents(stream.Command(dockerMachineBinary, "config", name))
-	if err != nil {
-		return nil, err
+	return machines.DockerFlags(name)
+}
+
+// RunDocker runs docker against the local docker daemon and returns its
+// output lines.
+func RunDocker(ctx context.Context, args ...string) ([]string, error) {
+	if log.V(1) {
+		drivers.LogInfof(ctx, "running: docker %s", strings.Join(args, " "))
+	}
+	return RunOutput(ctx, exec.Command("docker", args...))
+}
+
+// RunOutput runs cmd and returns its output lines, killing it if ctx is
+// cancelled. The error includes stderr.
+func RunOutput(ctx context.Context, cmd *exec.Cmd) ([]string, error) {
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := runCommand(ctx, cmd); err != nil {
+		return nil, util.Errorf("%v: %s", err, strings.TrimSpace(stderr.String()))
 	}
+	output := strings.TrimRight(stdout.String(), "\n")
+	if output == "" {
+		return []string{}, nil
+	}
+	return strings.Split(output, "\n"), nil
+}
 
-	if len(contents) != 1 {
-		return nil, util.Errorf("expected a single output line, got: %v", contents)
+// runCommand runs cmd, killing it if ctx is cancelled before it exits.
+func runCommand(ctx context.Context, cmd *exec.Cmd) error {
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		_ = cmd.Process.Kill()
+		<-done
+		return util.Errorf("%s: %v", cmd.Args[0], ctx.Err())
 	}
-	return strings.Split(contents[0], " "), nil
 }
 
-// CreateMachine creates a new docker machine using the passed-in driver
-// and name.
-func CreateMachine(driver drivers.Driver, name string) error {
-	log.Infof("creating docker-machine %s", name)
+// outputKey is the context key for the command output set by WithOutput.
+type outputKey struct{}
 
-	args := []string{
-		"create",
-		"--driver", driver.DockerMachineDriver(),
+type output struct {
+	stdout, stderr io.Writer
+}
+
+// WithOutput returns a context sending the output of commands run with it to
+// the given writers instead of the standard streams. Commands do not read
+// from stdin.
+func WithOutput(ctx context.Context, stdout, stderr io.Writer) context.Context {
+	return context.WithValue(ctx, outputKey{}, output{stdout, stderr})
+}
+
+// runInteractive runs cmd with the standard streams attached, or the writers
+// set by WithOutput.
+func runInteractive(ctx context.Context, cmd *exec.Cmd) error {
+	if out, ok := ctx.Value(outputKey{}).(output); ok {
+		cmd.Stdout = out.stdout
+		cmd.Stderr = out.stderr
+	} else {
+		cmd.Stdin = os.Stdin
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
 	}
-	args = append(args, driver.DockerMachineCreateArgs()...)
-	args = append(args, name)
+	return runCommand(ctx, cmd)
+}
 
-	log.Infof("running: %s %s", dockerMachineBinary, strings.Join(args, " "))
-	cmd := exec.Command(dockerMachineBinary, args...)
-	cmd.Stdin = os.Stdin
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	return cmd.Run()
+// CreateMachine creates a new machine using the passed-in driver and name.
+func CreateMachine(ctx context.Context, driver drivers.Driver, name string) error {
+	return machines.Create(ctx, driver, name)
 }
 
-// StartMachine invokes "docker-machine start" on the given machine name.
-func StartMachine(name string) error {
-	log.Infof("starting docker machine %s", name)
-	cmd := exec.Command(dockerMachineBinary, "start", name)
-	cmd.Stdin = os.Stdin
-	cmd.Stderr = os.Stderr
-	cmd.Stdout = os.Stdout
-	return cmd.Run()
+// StartMachine starts the given machine.
+func StartMachine(ctx context.Context, name string) error {
+	return machines.Start(ctx, name)
 }
 
-// StopMachine invokes "docker-machine stop" on the given machine name.
-func StopMachine(name string) error {
-	log.Infof("stopping docker machine %s", name)
-	cmd := exec.Command(dockerMachineBinary, "stop", name)
-	cmd.Stdin = os.Stdin
-	cmd.Stderr = os.Stderr
-	cmd.Stdout = os.Stdout
-	return cmd.Run()
+// StopMachine stops the given machine.
+func StopMachine(ctx context.Context, name string) error {
+	return machines.Stop(ctx, name)
+}
+
+// RemoveMachine removes the given machine.
+// This deletes the cloud instance as well as the local machine config.
+func RemoveMachine(ctx context.Context, name string) error {
+	return machines.Remove(ctx, name)
+}
+
+// GetMachineState returns the machine state (eg: Running, Stopped, Error).
+func GetMachineState(name string) (string, error) {
+	return machines.State(name)
+}
+
+// RunOnMachine runs a shell command on the given machine and returns its
+// output lines.
+func RunOnMachine(ctx context.Context, name string, command string) ([]string, error) {
+	if log.V(1) {
+		drivers.LogInfof(ctx, "running on %s: %s", name, command)
+	}
+	return machines.Run(ctx, name, command)
+}
+
+// MountVolume mounts the block device at mountPoint on the given machine,
+// formatting it first if it has no filesystem. Attached devices may take a
+// little while to show up, so we wait for it first.
+func MountVolume(ctx context.Context, name, device, mountPoint string) error {
+	drivers.LogInfof(ctx, "mounting %s at %s on %s", device, mountPoint, name)
+	script := fmt.Sprintf("for i in $(seq 60); do [ -e %[1]s ] && break; sleep 1; done && "+
+		"(sudo blkid %[1]s || sudo mkfs.ext4 -q %[1]s) && "+
+		"sudo mkdir -p %[2]s && "+
+		"(mountpoint -q %[2]s || sudo mount %[1]s %[2]s)", device, mountPoint)
+	_, err := RunOnMachine(ctx, name, script)
+	return err
+}
+
+// CopyToMachine copies local files into remoteDir on the given machine.
+// remoteDir is created if needed and is only accessible by the machine user.
+func CopyToMachine(ctx context.Context, name string, files []string, remoteDir string) error {
+	_, err := RunOnMachine(ctx, name, fmt.Sprintf("mkdir -p %[1]s && chmod 700 %[1]s", remoteDir))
+	if err != nil {
+		return err
+	}
+	return machines.Copy(ctx, name, files, remoteDir)
 }
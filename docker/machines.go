@@ -0,0 +1,186 @@
+// Copyright 2015 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+//
+// Author: Marc Berhault (marc@cockroachlabs.com)
+
+package docker
+
+import (
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"github.com/cockroachdb/cockroach-prod/drivers"
+	"github.com/cockroachdb/cockroach/util"
+	"github.com/ghemawat/stream"
+	"golang.org/x/net/context"
+)
+
+// Machines manages the machines cockroach nodes run on, and the cockroach
+// container on each machine. The default uses docker-machine. Drivers not
+// based on docker-machine install their own with SetMachines.
+type Machines interface {
+	// List returns the names of all machines.
+	List() ([]string, error)
+	// Inspect fills in config with the machine config.
+	Inspect(name string, config *drivers.HostConfig) error
+	// State returns the machine state (eg: Running, Stopped, Error).
+	State(name string) (string, error)
+	// DockerFlags returns the flags passed to docker to talk to the machine's
+	// docker daemon.
+	DockerFlags(name string) ([]string, error)
+
+	// Create creates a new machine using the passed-in driver.
+	Create(ctx context.Context, driver drivers.Driver, name string) error
+	// Start starts an existing machine.
+	Start(ctx context.Context, name string) error
+	// Stop stops a running machine.
+	Stop(ctx context.Context, name string) error
+	// Remove deletes the machine.
+	Remove(ctx context.Context, name string) error
+
+	// Run runs a shell command on the machine and returns its output lines.
+	Run(ctx context.Context, name string, command string) ([]string, error)
+	// Copy copies local files into an existing directory on the machine.
+	Copy(ctx context.Context, name string, files []string, remoteDir string) error
+
+	// ContainerName returns the name of the cockroach container on the machine.
+	ContainerName(name string) string
+	// NetworkArgs returns the "docker run" flags giving the cockroach
+	// container the node address and port.
+	NetworkArgs(name string, settings *drivers.HostConfig, port int64) []string
+}
+
+// machines is the Machines implementation in use.
+var machines Machines = dockerMachines{}
+
+// DockerMachines returns the docker-machine based Machines, for drivers
+// changing only part of its behavior.
+func DockerMachines() Machines {
+	return dockerMachines{}
+}
+
+// SetMachines replaces the docker-machine based Machines.
+func SetMachines(m Machines) {
+	machines = m
+}
+
+// dockerMachines implements Machines using docker-machine.
+type dockerMachines struct{}
+
+func (dockerMachines) List() ([]string, error) {
+	return stream.Contents(stream.Command(dockerMachineBinary, "ls", "-q"))
+}
+
+func (dockerMachines) Inspect(name string, config *drivers.HostConfig) error {
+	contents, err := stream.Contents(stream.Command(dockerMachineBinary, "inspect", name))
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal([]byte(strings.Join(contents, "\n")), config)
+}
+
+func (dockerMachines) State(name string) (string, error) {
+	contents, err := stream.Contents(stream.Command(dockerMachineBinary, "status", name))
+	if err != nil {
+		return "", err
+	}
+	if len(contents) != 1 {
+		return "", util.Errorf("expected a single output line, got: %v", contents)
+	}
+	return strings.TrimSpace(contents[0]), nil
+}
+
+// DockerFlags expects a single line from "docker-machine config", then splits
+// that line into individual flags.
+func (dockerMachines) DockerFlags(name string) ([]string, error) {
+	contents, err := stream.Contents(stream.Command(dockerMachineBinary, "config", name))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(contents) != 1 {
+		return nil, util.Errorf("expected a single output line, got: %v", contents)
+	}
+	return strings.Split(contents[0], " "), nil
+}
+
+func (dockerMachines) Create(ctx context.Context, driver drivers.Driver, name string) error {
+	drivers.LogInfof(ctx, "creating docker-machine %s", name)
+
+	driverArgs, err := driver.DockerMachineCreateArgs(name)
+	if err != nil {
+		return err
+	}
+	args := []string{
+		"create",
+		"--driver", driver.DockerMachineDriver(),
+	}
+	args = append(args, driverArgs...)
+	args = append(args, name)
+
+	drivers.LogInfof(ctx, "running: %s %s", dockerMachineBinary, strings.Join(args, " "))
+	return runInteractive(ctx, exec.Command(dockerMachineBinary, args...))
+}
+
+func (dockerMachines) Start(ctx context.Context, name string) error {
+	drivers.LogInfof(ctx, "starting docker machine %s", name)
+	return runInteractive(ctx, exec.Command(dockerMachineBinary, "start", name))
+}
+
+func (dockerMachines) Stop(ctx context.Context, name string) error {
+	drivers.LogInfof(ctx, "stopping docker machine %s", name)
+	return runInteractive(ctx, exec.Command(dockerMachineBinary, "stop", name))
+}
+
+// Remove deletes the cloud instance as well as the local machine config.
+func (dockerMachines) Remove(ctx context.Context, name string) error {
+	drivers.LogInfof(ctx, "removing docker machine %s", name)
+	return runInteractive(ctx, exec.Command(dockerMachineBinary, "rm", name))
+}
+
+// Run runs the command through "docker-machine ssh".
+func (dockerMachines) Run(ctx context.Context, name string, command string) ([]string, error) {
+	return RunOutput(ctx, exec.Command(dockerMachineBinary, "ssh", name, command))
+}
+
+// Copy copies the files through "docker-machine scp".
+func (dockerMachines) Copy(ctx context.Context, name string, files []string, remoteDir string) error {
+	for _, f := range files {
+		drivers.LogInfof(ctx, "copying %s to %s:%s", f, name, remoteDir)
+		cmd := exec.Command(dockerMachineBinary, "scp", f, fmt.Sprintf("%s:%s/", name, remoteDir))
+		if err := runInteractive(ctx, cmd); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ContainerName returns the name of the cockroach container, the only one on
+// each machine.
+func (dockerMachines) ContainerName(name string) string {
+	return cockroachContainerName
+}
+
+// NetworkArgs runs the cockroach container on the machine network, with the
+// cockroach port published.
+func (dockerMachines) NetworkArgs(name string, settings *drivers.HostConfig, port int64) []string {
+	return []string{
+		"-p", fmt.Sprintf("%d:%d", port, port),
+		"--net", "host",
+	}
+}
@@ -19,26 +19,35 @@ package amazon
 
 import (
 	"fmt"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/cockroachdb/cockroach-prod/base"
 	"github.com/cockroachdb/cockroach-prod/docker"
 	"github.com/cockroachdb/cockroach-prod/drivers"
 	"github.com/cockroachdb/cockroach/util"
 	"github.com/cockroachdb/cockroach/util/log"
+	"golang.org/x/net/context"
 )
 
 const (
 	dockerMachineDriverName = "amazonec2"
+	amazonCertsDir          = "/home/ubuntu/certs"
 	amazonDataDir           = "/home/ubuntu/data"
+	amazonVolumeMountPoint  = "/mnt/data"
 	defaultZone             = "a"
+	// The DynamoDB table holding the cluster lock is named <prefix><cluster name>.
+	lockTablePrefix = "cockroach-prod-lock-"
 )
 
 // Amazon implements a driver for AWS.
 // This is not synchronized: be careful.
 type Amazon struct {
-	context *base.Context
-	region  string
-	zone    string
+	context    *base.Context
+	region     string
+	zone       string
+	apiOptions APIOptions
 
 	keyID string
 	key   string
@@ -57,13 +66,24 @@ type config struct {
 
 	// non docker-machine fields:
 	LoadBalancerAddress string `json:"-"`
+	// Set if the node has a data volume.
+	volumeMountPoint string
 }
 
-// DataDir returns the data directory.
+// DataDir returns the data directory: the data volume if the node has one,
+// the instance disk otherwise.
 func (cfg *config) DataDir() string {
+	if cfg.volumeMountPoint != "" {
+		return cfg.volumeMountPoint
+	}
 	return amazonDataDir
 }
 
+// CertsDir returns the certificates directory.
+func (cfg *config) CertsDir() string {
+	return amazonCertsDir
+}
+
 // IPAddress returns the IP address we will listen on.
 func (cfg *config) IPAddress() string {
 	return cfg.PrivateIPAddress
@@ -75,13 +95,42 @@ func (cfg *config) GossipAddress() string {
 }
 
 // NewDriver returns an initialized Amazon driver.
+// The zone is the suffix of the availability zone, eg: "a" for us-east-1a.
 // TODO(marc): we should keep initialized services (eg: elb, ec2).
 func NewDriver(context *base.Context, region string) *Amazon {
+	zone := defaultZone
+	if context.Zone != "" {
+		zone = strings.TrimPrefix(context.Zone, region)
+	}
 	return &Amazon{
 		context: context,
 		region:  region,
-		zone:    defaultZone,
+		zone:    zone,
+		apiOptions: APIOptions{
+			Retry: drivers.APIRetryOptions(context, isRetryable),
+			Poll:  drivers.OperationPollOptions(context, isRetryable),
+		},
+	}
+}
+
+// elbName returns the name of the cluster's load balancer.
+func (a *Amazon) elbName() string {
+	return a.context.Cluster + elbNameSuffix
+}
+
+// lockTableName returns the name of the DynamoDB table holding the cluster lock.
+func (a *Amazon) lockTableName() string {
+	return lockTablePrefix + a.context.Cluster
+}
+
+// securityGroupName returns the name of the security group docker-machine
+// creates for the cluster's instances. The default cluster keeps using the
+// docker-machine default so that existing clusters are still found.
+func (a *Amazon) securityGroupName() string {
+	if a.context.Cluster == base.DefaultClusterName {
+		return defaultSecurityGroupName
 	}
+	return a.context.Cluster + "-" + defaultSecurityGroupName
 }
 
 // Context returns the base context.
@@ -96,15 +145,19 @@ func (a *Amazon) DockerMachineDriver() string {
 
 // Init looks for AWS credentials.
 func (a *Amazon) Init() error {
+	if a.context.Zone != "" && a.region+a.zone != a.context.Zone {
+		return base.ValidationErrorf("zone %s is not in region %s", a.context.Zone, a.region)
+	}
+
 	var err error
 	a.keyID, a.key, err = LoadAWSCredentials()
 	if err != nil {
-		return util.Errorf("unable to load AWS credentials: %v", err)
+		return base.NewError(base.CredentialsError, err, "loading AWS credentials")
 	}
 	log.Infof("loaded AWS key: %s", a.keyID)
 
 	// Find default VPC.
-	a.vpcID, err = FindDefaultVPC(a.region)
+	a.vpcID, err = FindDefaultVPC(context.Background(), a.apiOptions, a.region)
 	if err != nil {
 		return util.Errorf("could not find default VPC ID in region %s: %v", a.region, err)
 	}
@@ -116,38 +169,107 @@ func (a *Amazon) Init() error {
 // DockerMachineCreateArgs returns the list of driver-specific arguments
 // to pass to 'docker-machine create'
 // TODO(marc): there are many other flags, see 'docker-machine help create'
-func (a *Amazon) DockerMachineCreateArgs() []string {
+func (a *Amazon) DockerMachineCreateArgs(name string) ([]string, error) {
 	return []string{
 		"--amazonec2-access-key", a.keyID,
 		"--amazonec2-secret-key", a.key,
 		"--amazonec2-region", a.region,
 		"--amazonec2-vpc-id", a.vpcID,
 		"--amazonec2-zone", a.zone,
-	}
+		"--amazonec2-security-group", a.securityGroupName(),
+	}, nil
 }
 
-// PrintStatus prints the load balancer address to stdout.
+// GetStatus looks up the load balancer and security group.
 // Do not call the "getOrInit*" methods here, we only want to look things up.
-func (a *Amazon) PrintStatus() {
-	fmt.Println("Region:", a.region)
+func (a *Amazon) GetStatus() *drivers.ClusterStatus {
+	status := &drivers.ClusterStatus{
+		Driver: dockerMachineDriverName,
+		Region: a.region,
+	}
+
+	dnsName, err := FindCockroachELB(context.Background(), a.apiOptions, a.region, a.elbName())
+	if err != nil {
+		status.Errors = append(status.Errors, fmt.Sprintf("load balancer: %v", err))
+	} else if dnsName != "" {
+		status.LoadBalancerAddress = fmt.Sprintf("%s:%d", dnsName, a.context.Port)
+	}
 
-	dnsName, err := FindCockroachELB(a.region)
+	securityGroupID, err := FindSecurityGroup(context.Background(), a.apiOptions, a.region, a.securityGroupName())
 	if err != nil {
-		fmt.Println("Load balancer: problem:", err)
-	} else if dnsName == "" {
-		fmt.Println("Load balancer: not found (you need to initialize the cluster)")
+		status.Errors = append(status.Errors, fmt.Sprintf("security group: %v", err))
 	} else {
-		fmt.Printf("Load balancer: %s:%d\n", dnsName, a.context.Port)
+		status.Firewall = securityGroupID
+		cidrs, err := ListCockroachSecurityGroupIngress(context.Background(), a.apiOptions, a.region, a.context.Port,
+			securityGroupID)
+		if err != nil {
+			status.Errors = append(status.Errors, fmt.Sprintf("security group rules: %v", err))
+		} else {
+			status.AllowedCIDRs = cidrs
+		}
 	}
+	return status
+}
+
+// GetNodeStatus looks up the instance and its load balancer membership.
+func (a *Amazon) GetNodeStatus(name string, cfg *drivers.HostConfig, status *drivers.NodeStatus) {
+	instanceID := cfg.Driver.(*config).InstanceID
+	status.InstanceID = instanceID
 
-	securityGroupID, err := FindSecurityGroup(a.region)
+	instance, err := DescribeInstance(context.Background(), a.apiOptions, a.region, instanceID)
 	if err != nil {
-		fmt.Println("Security group: problem:", err)
-	} else if securityGroupID == "" {
-		fmt.Println("Security group: not found (you need to initialize the cluster)")
+		status.Errors = append(status.Errors, fmt.Sprintf("instance: %v", err))
 	} else {
-		fmt.Println("Security group:", securityGroupID)
+		status.InstanceState = stringValue(instance.State.Name)
+		status.InternalIP = stringValue(instance.PrivateIPAddress)
+		status.ExternalIP = stringValue(instance.PublicIPAddress)
+		status.Zone = stringValue(instance.Placement.AvailabilityZone)
+	}
+
+	status.InLoadBalancer, err = IsNodeInELB(context.Background(), a.apiOptions, a.region, a.elbName(), instanceID)
+	if err != nil {
+		status.Errors = append(status.Errors, fmt.Sprintf("load balancer: %v", err))
+	}
+	if status.InLoadBalancer {
+		status.InService, err = IsNodeInServiceInELB(context.Background(), a.apiOptions, a.region, a.elbName(), instanceID)
+		if err != nil {
+			status.Errors = append(status.Errors, fmt.Sprintf("load balancer health: %v", err))
+		}
+	}
+}
+
+// GetInstanceState looks up the EC2 instance state.
+func (a *Amazon) GetInstanceState(name string, cfg *drivers.HostConfig) (drivers.InstanceState, error) {
+	instance, err := DescribeInstance(context.Background(), a.apiOptions, a.region, cfg.Driver.(*config).InstanceID)
+	if IsAWSErrorCode(err, "InvalidInstanceID.NotFound") {
+		return drivers.InstanceMissing, nil
 	}
+	if err != nil {
+		return drivers.InstanceUnknown, err
+	}
+	switch stringValue(instance.State.Name) {
+	case "running":
+		return drivers.InstanceRunning, nil
+	case "stopped":
+		return drivers.InstanceStopped, nil
+	case "pending", "stopping":
+		return drivers.InstancePending, nil
+	case "shutting-down", "terminated":
+		return drivers.InstanceMissing, nil
+	}
+	return drivers.InstanceUnknown, nil
+}
+
+// LoadBalancerAddress returns the DNS name of the load balancer.
+func (a *Amazon) LoadBalancerAddress() (string, error) {
+	dnsName, err := FindCockroachELB(context.Background(), a.apiOptions, a.region, a.elbName())
+	if err != nil {
+		return "", err
+	}
+	if dnsName == "" {
+		return "", util.Errorf("load balancer %s not found", a.elbName())
+	}
+	return dnsName, nil
 }
 
 // GetNodeConfig takes a node name and reads its docker-machine config.
@@ -164,40 +286,119 @@ func (a *Amazon) GetNodeConfig(name string) (*drivers.HostConfig, error) {
 	}
 
 	// Add the load balancer address.
-	dnsName, err := FindCockroachELB(a.region)
+	dnsName, err := FindCockroachELB(context.Background(), a.apiOptions, a.region, a.elbName())
 	if err != nil || dnsName == "" {
 		return nil, util.Errorf("could not find load balancer: %v", err)
 	}
 	cfg.Driver.(*config).LoadBalancerAddress = dnsName
 
+	// Use the data volume if there is one.
+	volume, err := FindVolume(context.Background(), a.apiOptions, a.region, name)
+	if err != nil {
+		return nil, util.Errorf("could not lookup data volume: %v", err)
+	}
+	if volume != nil {
+		cfg.Driver.(*config).volumeMountPoint = amazonVolumeMountPoint
+	}
+
 	return cfg, err
 }
 
 // AfterFirstNode runs any steps needed after the first node was created.
-// This tweaks the security group to allow cockroach ports and creates
-// the load balancer.
-func (a *Amazon) AfterFirstNode() error {
-	securityGroupID, err := FindSecurityGroup(a.region)
+// This tweaks the security group to allow cockroach ports from the allowed
+// CIDRs only, and creates the load balancer and the lock table.
+func (a *Amazon) AfterFirstNode(ctx context.Context) error {
+	securityGroupID, err := FindSecurityGroup(ctx, a.apiOptions, a.region, a.securityGroupName())
 	if err != nil {
 		return err
 	}
 
-	log.Info("adding security group rule")
-	err = AddCockroachSecurityGroupIngress(a.region, a.context.Port, securityGroupID)
+	allowed := map[string]bool{}
+	for _, cidr := range a.context.AllowedCIDRList() {
+		allowed[cidr] = true
+		drivers.LogInfof(ctx, "adding security group rule for %s", cidr)
+		err = AddCockroachSecurityGroupIngress(ctx, a.apiOptions, a.region, a.context.Port, securityGroupID, cidr)
+		if err != nil {
+			return util.Errorf("failed to add security group rule for %s: %v", cidr, err)
+		}
+	}
+
+	existing, err := ListCockroachSecurityGroupIngress(ctx, a.apiOptions, a.region, a.context.Port, securityGroupID)
+	if err != nil {
+		return util.Errorf("failed to list security group rules: %v", err)
+	}
+	for _, cidr := range existing {
+		if allowed[cidr] {
+			continue
+		}
+		if err := a.revokeCockroachIngress(ctx, securityGroupID, cidr); err != nil {
+			return err
+		}
+	}
+
+	_, err = FindOrCreateLoadBalancer(ctx, a.apiOptions, a.region, a.elbName(), a.context.Port, a.zone, securityGroupID)
+	if err != nil {
+		return err
+	}
+	return CreateLockTable(ctx, a.apiOptions, a.region, a.lockTableName())
+}
+
+// PrepareNode attaches and mounts the node's EBS data volume. If a freshly
+// created node does not have one and a volume size is set, the volume is
+// created first. Otherwise, the node uses the instance disk.
+func (a *Amazon) PrepareNode(ctx context.Context, name string, cfg *drivers.HostConfig, created bool) error {
+	driverCfg := cfg.Driver.(*config)
+	volume, err := FindVolume(ctx, a.apiOptions, a.region, name)
+	if err != nil {
+		return util.Errorf("failed to lookup data volume: %v", err)
+	}
+
+	if volume == nil {
+		if !created || a.context.VolumeSize == 0 {
+			return nil
+		}
+		drivers.LogInfof(ctx, "creating %dGB data volume for node %s", a.context.VolumeSize, name)
+		volume, err = CreateVolume(ctx, a.apiOptions, a.region, a.zone, name, a.context.VolumeSize, a.context.VolumeType)
+		if err != nil {
+			return util.Errorf("failed to create data volume: %v", err)
+		}
+		drivers.LogInfof(ctx, "created data volume %s", *volume.VolumeID)
+	}
+
+	if !isAttachedTo(volume, driverCfg.InstanceID) {
+		drivers.LogInfof(ctx, "attaching data volume %s to node %s", *volume.VolumeID, name)
+		err = AttachVolume(ctx, a.apiOptions, a.region, *volume.VolumeID, driverCfg.InstanceID)
+		if err != nil {
+			return util.Errorf("failed to attach data volume %s: %v", *volume.VolumeID, err)
+		}
+	}
+
+	err = docker.MountVolume(ctx, name, volumeLocalDevice, amazonVolumeMountPoint)
 	if err != nil {
-		return util.Errorf("failed to add security group rule: %v", err)
+		return util.Errorf("failed to mount data volume %s: %v", *volume.VolumeID, err)
 	}
+	driverCfg.volumeMountPoint = amazonVolumeMountPoint
+	return nil
+}
 
-	_, err = FindOrCreateLoadBalancer(a.region, a.context.Port, a.zone, securityGroupID)
-	return err
+// AfterNodeRemoved deletes the node's data volume, if any.
+func (a *Amazon) AfterNodeRemoved(ctx context.Context, name string) error {
+	deleted, err := DeleteVolume(ctx, a.apiOptions, a.region, name)
+	if err != nil {
+		return util.Errorf("failed to delete data volume for %s: %v", name, err)
+	}
+	if deleted {
+		drivers.LogInfof(ctx, "deleted data volume %s", volumeName(name))
+	}
+	return nil
 }
 
 // StartNode adds the node to the load balancer.
 // ELB takes forever checking a stopped and started node,
 // so we have to remove it at stopping time, and re-register it start time.
-func (a *Amazon) StartNode(name string, cfg *drivers.HostConfig) error {
-	log.Infof("adding node %s to load balancer", name)
-	err := AddNodeToELB(a.region, cfg.Driver.(*config).InstanceID)
+func (a *Amazon) StartNode(ctx context.Context, name string, cfg *drivers.HostConfig) error {
+	drivers.LogInfof(ctx, "adding node %s to load balancer", name)
+	err := AddNodeToELB(ctx, a.apiOptions, a.region, a.elbName(), cfg.Driver.(*config).InstanceID)
 	if err != nil {
 		return util.Errorf("failed to add node %s (%+v) to load balancer: %v", name, cfg, err)
 	}
@@ -207,11 +408,119 @@ func (a *Amazon) StartNode(name string, cfg *drivers.HostConfig) error {
 // StopNode removes the node from the load balancer.
 // ELB takes forever checking a stopped and started node,
 // so we have to remove it at stopping time, and re-register it start time.
-func (a *Amazon) StopNode(name string, cfg *drivers.HostConfig) error {
-	log.Infof("removing node %s from load balancer", name)
-	err := RemoveNodeFromELB(a.region, cfg.Driver.(*config).InstanceID)
+func (a *Amazon) StopNode(ctx context.Context, name string, cfg *drivers.HostConfig) error {
+	drivers.LogInfof(ctx, "removing node %s from load balancer", name)
+	err := RemoveNodeFromELB(ctx, a.apiOptions, a.region, a.elbName(), cfg.Driver.(*config).InstanceID)
 	if err != nil {
 		return util.Errorf("failed to remove node %s (%+v) from load balancer: %v", name, cfg, err)
 	}
 	return nil
 }
+
+// IsNodeInService returns true if the load balancer reports the node as "InService".
+func (a *Amazon) IsNodeInService(ctx context.Context, name string, cfg *drivers.HostConfig) (bool, error) {
+	return IsNodeInServiceInELB(ctx, a.apiOptions, a.region, a.elbName(), cfg.Driver.(*config).InstanceID)
+}
+
+// Teardown deletes the lock table and the load balancer, and removes the
+// cockroach port from the security group. The security group itself belongs to
+// docker-machine and is left alone.
+func (a *Amazon) Teardown(ctx context.Context) error {
+	deleted, err := DeleteLockTable(ctx, a.apiOptions, a.region, a.lockTableName())
+	if err != nil {
+		return util.Errorf("failed to delete lock table: %v", err)
+	}
+	if deleted {
+		drivers.LogInfof(ctx, "deleted lock table %s", a.lockTableName())
+	} else {
+		drivers.LogInfof(ctx, "lock table %s not found, skipping", a.lockTableName())
+	}
+
+	deleted, err = DeleteCockroachELB(ctx, a.apiOptions, a.region, a.elbName())
+	if err != nil {
+		return util.Errorf("failed to delete load balancer: %v", err)
+	}
+	if deleted {
+		drivers.LogInfof(ctx, "deleted load balancer %s", a.elbName())
+	} else {
+		drivers.LogInfof(ctx, "load balancer %s not found, skipping", a.elbName())
+	}
+
+	securityGroupID, err := FindSecurityGroup(ctx, a.apiOptions, a.region, a.securityGroupName())
+	if IsAWSErrorCode(err, awsSecurityGroupNotFound) {
+		drivers.LogInfof(ctx, "security group %s not found, skipping", a.securityGroupName())
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	// Remove all cockroach port rules, not just the currently allowed CIDRs:
+	// the list may have changed since they were added.
+	cidrs, err := ListCockroachSecurityGroupIngress(ctx, a.apiOptions, a.region, a.context.Port, securityGroupID)
+	if err != nil {
+		return util.Errorf("failed to list security group rules: %v", err)
+	}
+	for _, cidr := range cidrs {
+		if err := a.revokeCockroachIngress(ctx, securityGroupID, cidr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// revokeCockroachIngress removes the cockroach port rule for 'cidr' from the security group.
+func (a *Amazon) revokeCockroachIngress(ctx context.Context, securityGroupID, cidr string) error {
+	removed, err := RemoveCockroachSecurityGroupIngress(ctx, a.apiOptions, a.region, a.context.Port,
+		securityGroupID, cidr)
+	if err != nil {
+		return util.Errorf("failed to remove security group rule for %s: %v", cidr, err)
+	}
+	if removed {
+		drivers.LogInfof(ctx, "removed port %d rule for %s from security group %s", a.context.Port, cidr, securityGroupID)
+	} else {
+		drivers.LogInfof(ctx, "port %d rule for %s not found in security group %s, skipping",
+			a.context.Port, cidr, securityGroupID)
+	}
+	return nil
+}
+
+// ReadLock returns the cluster lock stored in the DynamoDB lock table.
+func (a *Amazon) ReadLock() (*drivers.Lock, string, error) {
+	value, version, found, err := GetLockItem(context.Background(), a.apiOptions, a.region, a.lockTableName())
+	if err != nil {
+		return nil, "", err
+	}
+	if !found {
+		return nil, "", drivers.ErrNoLockStore
+	}
+	if value == "" {
+		return nil, version, nil
+	}
+	lock, err := drivers.DecodeLock(value)
+	return lock, version, err
+}
+
+// WriteLock stores the cluster lock in the DynamoDB lock table if it is
+// still at 'version'.
+func (a *Amazon) WriteLock(lock *drivers.Lock, version string) error {
+	var value string
+	if lock != nil {
+		var err error
+		if value, err = drivers.EncodeLock(lock); err != nil {
+			return err
+		}
+	}
+	found, err := PutLockItem(context.Background(), a.apiOptions, a.region, a.lockTableName(), value, version,
+		strconv.FormatInt(time.Now().UnixNano(), 10))
+	if IsAWSErrorCode(err, dynamoDBConditionFailedError) {
+		return drivers.ErrLockChanged
+	}
+	if err != nil {
+		return err
+	}
+	if !found {
+		return drivers.ErrNoLockStore
+	}
+	return nil
+}
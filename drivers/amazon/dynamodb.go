@@ -0,0 +1,184 @@
+// Copyright 2015 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+//
+// Author: Marc Berhault (marc@cockroachlabs.com)
+
+package amazon
+
+import (
+	"github.com/awslabs/aws-sdk-go/aws"
+	"github.com/awslabs/aws-sdk-go/service/dynamodb"
+	"github.com/cockroachdb/cockroach-prod/drivers"
+	"golang.org/x/net/context"
+)
+
+// The cluster lock is stored in a DynamoDB table, which supports conditional
+// writes. The table holds a single item: its key is lockItemName, the lock
+// value and a version changed on every write are stored as attributes.
+const (
+	lockTableKey         = "name"
+	lockItemName         = "lock"
+	lockValueAttribute   = "lock"
+	lockVersionAttribute = "version"
+	// The table is tiny and rarely accessed.
+	lockTableCapacity = 1
+
+	dynamoDBTableActive          = "ACTIVE"
+	dynamoDBNotFoundError        = "ResourceNotFoundException"
+	dynamoDBInUseError           = "ResourceInUseException"
+	dynamoDBConditionFailedError = "ConditionalCheckFailedException"
+)
+
+// lockItemKey returns the key of the lock item.
+func lockItemKey() map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		lockTableKey: {S: aws.String(lockItemName)},
+	}
+}
+
+// CreateLockTable creates the DynamoDB table holding the cluster lock if it
+// does not exist, and waits for it to be active.
+func CreateLockTable(ctx context.Context, opts APIOptions, region, tableName string) error {
+	dbService := dynamodb.New(&aws.Config{Region: region})
+	err := opts.retry(ctx, "creating lock table", func() error {
+		_, err := dbService.CreateTable(&dynamodb.CreateTableInput{
+			TableName: aws.String(tableName),
+			AttributeDefinitions: []*dynamodb.AttributeDefinition{
+				{AttributeName: aws.String(lockTableKey), AttributeType: aws.String("S")},
+			},
+			KeySchema: []*dynamodb.KeySchemaElement{
+				{AttributeName: aws.String(lockTableKey), KeyType: aws.String("HASH")},
+			},
+			ProvisionedThroughput: &dynamodb.ProvisionedThroughput{
+				ReadCapacityUnits:  aws.Long(lockTableCapacity),
+				WriteCapacityUnits: aws.Long(lockTableCapacity),
+			},
+		})
+		return err
+	})
+	if IsAWSErrorCode(err, dynamoDBInUseError) {
+		drivers.LogInfof(ctx, "found lock table %s", tableName)
+	} else if err != nil {
+		return err
+	} else {
+		drivers.LogInfof(ctx, "created lock table %s", tableName)
+	}
+
+	return drivers.Poll(ctx, opts.Poll, "waiting for lock table "+tableName, func() (bool, error) {
+		resp, err := dbService.DescribeTable(&dynamodb.DescribeTableInput{TableName: aws.String(tableName)})
+		if err != nil {
+			return false, err
+		}
+		return *resp.Table.TableStatus == dynamoDBTableActive, nil
+	})
+}
+
+// DeleteLockTable deletes the DynamoDB table holding the cluster lock.
+// Returns false if it did not exist.
+func DeleteLockTable(ctx context.Context, opts APIOptions, region, tableName string) (bool, error) {
+	dbService := dynamodb.New(&aws.Config{Region: region})
+	err := opts.retry(ctx, "deleting lock table", func() error {
+		_, err := dbService.DeleteTable(&dynamodb.DeleteTableInput{TableName: aws.String(tableName)})
+		return err
+	})
+	if IsAWSErrorCode(err, dynamoDBNotFoundError) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// GetLockItem returns the lock value and version stored in the table, or
+// empty strings if the lock is not set. 'found' is false if the table does
+// not exist.
+func GetLockItem(ctx context.Context, opts APIOptions, region, tableName string) (
+	value, version string, found bool, err error) {
+	dbService := dynamodb.New(&aws.Config{Region: region})
+	var resp *dynamodb.GetItemOutput
+	err = opts.retry(ctx, "reading lock", func() (err error) {
+		resp, err = dbService.GetItem(&dynamodb.GetItemInput{
+			TableName:      aws.String(tableName),
+			Key:            lockItemKey(),
+			ConsistentRead: aws.Boolean(true),
+		})
+		return err
+	})
+	if IsAWSErrorCode(err, dynamoDBNotFoundError) {
+		return "", "", false, nil
+	}
+	if err != nil {
+		return "", "", false, err
+	}
+	if v := resp.Item[lockValueAttribute]; v != nil && v.S != nil {
+		value = *v.S
+	}
+	if v := resp.Item[lockVersionAttribute]; v != nil && v.S != nil {
+		version = *v.S
+	}
+	return value, version, true, nil
+}
+
+// PutLockItem stores the lock value with a new version, or deletes the lock
+// if value is empty. The write only happens if the stored version is still
+// 'version' (empty if the lock is not set), it fails with a
+// ConditionalCheckFailedException otherwise.
+// 'found' is false if the table does not exist.
+func PutLockItem(ctx context.Context, opts APIOptions, region, tableName, value, version,
+	newVersion string) (found bool, err error) {
+	dbService := dynamodb.New(&aws.Config{Region: region})
+	condition := "attribute_not_exists(#v)"
+	var values map[string]*dynamodb.AttributeValue
+	if version != "" {
+		condition = "#v = :v"
+		values = map[string]*dynamodb.AttributeValue{":v": {S: aws.String(version)}}
+	}
+	names := map[string]*string{"#v": aws.String(lockVersionAttribute)}
+
+	if value == "" {
+		err = opts.retry(ctx, "deleting lock", func() error {
+			_, err := dbService.DeleteItem(&dynamodb.DeleteItemInput{
+				TableName:                 aws.String(tableName),
+				Key:                       lockItemKey(),
+				ConditionExpression:       aws.String(condition),
+				ExpressionAttributeNames:  names,
+				ExpressionAttributeValues: values,
+			})
+			return err
+		})
+	} else {
+		item := lockItemKey()
+		item[lockValueAttribute] = &dynamodb.AttributeValue{S: aws.String(value)}
+		item[lockVersionAttribute] = &dynamodb.AttributeValue{S: aws.String(newVersion)}
+		err = opts.retry(ctx, "writing lock", func() error {
+			_, err := dbService.PutItem(&dynamodb.PutItemInput{
+				TableName:                 aws.String(tableName),
+				Item:                      item,
+				ConditionExpression:       aws.String(condition),
+				ExpressionAttributeNames:  names,
+				ExpressionAttributeValues: values,
+			})
+			return err
+		})
+	}
+	if IsAWSErrorCode(err, dynamoDBNotFoundError) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
@@ -20,24 +20,43 @@ package amazon
 import (
 	"github.com/awslabs/aws-sdk-go/aws"
 	"github.com/awslabs/aws-sdk-go/service/elb"
+	"github.com/cockroachdb/cockroach-prod/drivers"
 	"github.com/cockroachdb/cockroach/util"
-	"github.com/cockroachdb/cockroach/util/log"
+	"golang.org/x/net/context"
 )
 
 const (
-	cockroachELBName    = "cockroach-db"
+	// The ELB is named <cluster name><elbNameSuffix>.
+	elbNameSuffix       = "-db"
 	awsELBNotFoundError = "LoadBalancerNotFound"
+	elbInServiceState   = "InService"
 )
 
-// FindCockroachELB looks for the cockroach ELB in the given region
+// elbExists returns false if err is the ELB "not found" error, true if err is nil.
+// Other errors are returned as-is.
+func elbExists(err error) (bool, error) {
+	if IsAWSErrorCode(err, awsELBNotFoundError) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// FindCockroachELB looks for the ELB named elbName in the given region
 // and returns its external DNS name if found.
 // If not found, err=nil and dnsName="".
-func FindCockroachELB(region string) (string, error) {
+func FindCockroachELB(ctx context.Context, opts APIOptions, region, elbName string) (string, error) {
 	elbService := elb.New(&aws.Config{Region: region})
-	elbs, err := elbService.DescribeLoadBalancers(&elb.DescribeLoadBalancersInput{
-		LoadBalancerNames: []*string{
-			aws.String(cockroachELBName),
-		},
+	var elbs *elb.DescribeLoadBalancersOutput
+	err := opts.retry(ctx, "describing load balancer", func() (err error) {
+		elbs, err = elbService.DescribeLoadBalancers(&elb.DescribeLoadBalancersInput{
+			LoadBalancerNames: []*string{
+				aws.String(elbName),
+			},
+		})
+		return err
 	})
 
 	if IsAWSErrorCode(err, awsELBNotFoundError) {
@@ -51,7 +70,7 @@ func FindCockroachELB(region string) (string, error) {
 		return "", nil
 	}
 	if len(elbs.LoadBalancerDescriptions) > 1 {
-		return "", util.Errorf("found %d ELBs named %s", len(elbs.LoadBalancerDescriptions), cockroachELBName)
+		return "", util.Errorf("found %d ELBs named %s", len(elbs.LoadBalancerDescriptions), elbName)
 	}
 
 	return *elbs.LoadBalancerDescriptions[0].DNSName, nil
@@ -67,69 +86,161 @@ func FindCockroachELB(region string) (string, error) {
 // interval: 30s
 // thresholds: unhealthy:2, heathy:10
 // TODO(marc): we should call ConfigureHealthCheck
-func CreateCockroachELB(region string, cockroachPort int64, zone string, securityGroupID string) (string, error) {
+func CreateCockroachELB(ctx context.Context, opts APIOptions, region, elbName string, cockroachPort int64,
+	zone, securityGroupID string) (string, error) {
 	elbService := elb.New(&aws.Config{Region: region})
-	resp, err := elbService.CreateLoadBalancer(&elb.CreateLoadBalancerInput{
-		LoadBalancerName: aws.String(cockroachELBName),
-		SecurityGroups:   []*string{aws.String(securityGroupID)},
-		Listeners: []*elb.Listener{
-			{
-				InstancePort:     aws.Long(cockroachPort),
-				InstanceProtocol: aws.String(cockroachProtocol),
-				LoadBalancerPort: aws.Long(cockroachPort),
-				Protocol:         aws.String(cockroachProtocol),
+	// Creating a load balancer with the name and settings of an existing one
+	// succeeds, so retries are safe.
+	var resp *elb.CreateLoadBalancerOutput
+	err := opts.retry(ctx, "creating load balancer", func() (err error) {
+		resp, err = elbService.CreateLoadBalancer(&elb.CreateLoadBalancerInput{
+			LoadBalancerName: aws.String(elbName),
+			SecurityGroups:   []*string{aws.String(securityGroupID)},
+			Listeners: []*elb.Listener{
+				{
+					InstancePort:     aws.Long(cockroachPort),
+					InstanceProtocol: aws.String(cockroachProtocol),
+					LoadBalancerPort: aws.Long(cockroachPort),
+					Protocol:         aws.String(cockroachProtocol),
+				},
+			},
+			AvailabilityZones: []*string{
+				aws.String(region + zone),
 			},
-		},
-		AvailabilityZones: []*string{
-			aws.String(region + zone),
-		},
+		})
+		return err
 	})
-	return *resp.DNSName, err
+	if err != nil {
+		return "", err
+	}
+	return *resp.DNSName, nil
 }
 
 // FindOrCreateLoadBalancer looks for the cockroach load balancer
 // and creates it if it does not exist.
 // Returns the external DNS name of the load balancer.
-func FindOrCreateLoadBalancer(region string, cockroachPort int64, zone string,
-	securityGroupID string) (string, error) {
-	log.Infof("looking for load balancer")
-	dnsName, err := FindCockroachELB(region)
+func FindOrCreateLoadBalancer(ctx context.Context, opts APIOptions, region, elbName string, cockroachPort int64,
+	zone, securityGroupID string) (string, error) {
+	drivers.LogInfof(ctx, "looking for load balancer")
+	dnsName, err := FindCockroachELB(ctx, opts, region, elbName)
 	if err != nil {
 		return "", util.Errorf("failed to lookup existing load balancer: %v", err)
 	}
 
 	if dnsName != "" {
-		log.Info("found load balancer")
+		drivers.LogInfof(ctx, "found load balancer")
 		return dnsName, nil
 	}
 
-	log.Infof("no existing load balancer, creating one")
-	dnsName, err = CreateCockroachELB(region, cockroachPort, zone, securityGroupID)
+	drivers.LogInfof(ctx, "no existing load balancer, creating one")
+	dnsName, err = CreateCockroachELB(ctx, opts, region, elbName, cockroachPort, zone, securityGroupID)
 	if err != nil {
 		return "", util.Errorf("failed to create load balancer: %v", err)
 	}
-	log.Info("created load balancer")
+	drivers.LogInfof(ctx, "created load balancer")
 	return dnsName, nil
 }
 
 // AddNodeToELB adds the specified node to the cockroach load balancer.
 // This can only succeed if the cockroach ELB exists.
-func AddNodeToELB(region string, instanceID string) error {
+func AddNodeToELB(ctx context.Context, opts APIOptions, region, elbName string, instanceID string) error {
 	elbService := elb.New(&aws.Config{Region: region})
-	_, err := elbService.RegisterInstancesWithLoadBalancer(&elb.RegisterInstancesWithLoadBalancerInput{
-		LoadBalancerName: aws.String(cockroachELBName),
-		Instances:        []*elb.Instance{{InstanceID: aws.String(instanceID)}},
+	return opts.retry(ctx, "registering instance with load balancer", func() error {
+		_, err := elbService.RegisterInstancesWithLoadBalancer(&elb.RegisterInstancesWithLoadBalancerInput{
+			LoadBalancerName: aws.String(elbName),
+			Instances:        []*elb.Instance{{InstanceID: aws.String(instanceID)}},
+		})
+		return err
 	})
-	return err
 }
 
 // RemoveNodeFromELB removes the specified node from the cockroach load balancer.
 // This can only succeed if the cockroach ELB exists.
-func RemoveNodeFromELB(region string, instanceID string) error {
+func RemoveNodeFromELB(ctx context.Context, opts APIOptions, region, elbName string, instanceID string) error {
+	elbService := elb.New(&aws.Config{Region: region})
+	return opts.retry(ctx, "deregistering instance from load balancer", func() error {
+		_, err := elbService.DeregisterInstancesFromLoadBalancer(&elb.DeregisterInstancesFromLoadBalancerInput{
+			LoadBalancerName: aws.String(elbName),
+			Instances:        []*elb.Instance{{InstanceID: aws.String(instanceID)}},
+		})
+		return err
+	})
+}
+
+// IsNodeInELB returns true if the specified node is registered with the
+// cockroach load balancer.
+func IsNodeInELB(ctx context.Context, opts APIOptions, region, elbName string, instanceID string) (bool, error) {
+	elbService := elb.New(&aws.Config{Region: region})
+	var elbs *elb.DescribeLoadBalancersOutput
+	err := opts.retry(ctx, "describing load balancer", func() (err error) {
+		elbs, err = elbService.DescribeLoadBalancers(&elb.DescribeLoadBalancersInput{
+			LoadBalancerNames: []*string{
+				aws.String(elbName),
+			},
+		})
+		return err
+	})
+	if err != nil {
+		return false, err
+	}
+	for _, desc := range elbs.LoadBalancerDescriptions {
+		for _, instance := range desc.Instances {
+			if *instance.InstanceID == instanceID {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// IsNodeInServiceInELB returns true if the cockroach load balancer reports
+// the specified node as "InService".
+func IsNodeInServiceInELB(ctx context.Context, opts APIOptions, region, elbName string,
+	instanceID string) (bool, error) {
 	elbService := elb.New(&aws.Config{Region: region})
-	_, err := elbService.DeregisterInstancesFromLoadBalancer(&elb.DeregisterInstancesFromLoadBalancerInput{
-		LoadBalancerName: aws.String(cockroachELBName),
-		Instances:        []*elb.Instance{{InstanceID: aws.String(instanceID)}},
+	var resp *elb.DescribeInstanceHealthOutput
+	err := opts.retry(ctx, "describing instance health", func() (err error) {
+		resp, err = elbService.DescribeInstanceHealth(&elb.DescribeInstanceHealthInput{
+			LoadBalancerName: aws.String(elbName),
+			Instances:        []*elb.Instance{{InstanceID: aws.String(instanceID)}},
+		})
+		return err
 	})
-	return err
+	if err != nil {
+		return false, err
+	}
+	for _, state := range resp.InstanceStates {
+		if *state.InstanceID == instanceID {
+			return *state.State == elbInServiceState, nil
+		}
+	}
+	return false, nil
+}
+
+// DeleteCockroachELB deletes the cockroach load balancer in the given region.
+// Returns true if a load balancer was found and deleted, false if
+// it did not exist.
+func DeleteCockroachELB(ctx context.Context, opts APIOptions, region, elbName string) (bool, error) {
+	dnsName, err := FindCockroachELB(ctx, opts, region, elbName)
+	if err != nil {
+		return false, util.Errorf("failed to lookup existing load balancer: %v", err)
+	}
+	if dnsName == "" {
+		return false, nil
+	}
+
+	elbService := elb.New(&aws.Config{Region: region})
+	err = opts.retry(ctx, "deleting load balancer", func() error {
+		_, err := elbService.DeleteLoadBalancer(&elb.DeleteLoadBalancerInput{
+			LoadBalancerName: aws.String(elbName),
+		})
+		return err
+	})
+	if IsAWSErrorCode(err, awsELBNotFoundError) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
 }
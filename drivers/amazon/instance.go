@@ -0,0 +1,57 @@
+// Copyright 2015 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+//
+// Author: Marc Berhault (marc@cockroachlabs.com)
+
+package amazon
+
+import (
+	"github.com/awslabs/aws-sdk-go/aws"
+	"github.com/awslabs/aws-sdk-go/service/ec2"
+	"github.com/cockroachdb/cockroach/util"
+	"golang.org/x/net/context"
+)
+
+// DescribeInstance looks up the given instance.
+func DescribeInstance(ctx context.Context, opts APIOptions, region string, instanceID string) (*ec2.Instance, error) {
+	ec2Service := ec2.New(&aws.Config{Region: region})
+	var resp *ec2.DescribeInstancesOutput
+	err := opts.retry(ctx, "describing instance", func() (err error) {
+		resp, err = ec2Service.DescribeInstances(&ec2.DescribeInstancesInput{
+			InstanceIDs: []*string{aws.String(instanceID)},
+		})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, reservation := range resp.Reservations {
+		for _, instance := range reservation.Instances {
+			if *instance.InstanceID == instanceID {
+				return instance, nil
+			}
+		}
+	}
+	return nil, util.Errorf("instance %s not found", instanceID)
+}
+
+// stringValue returns the value of a string pointer, or "" if nil.
+func stringValue(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
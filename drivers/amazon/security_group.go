@@ -21,23 +21,29 @@ import (
 	"github.com/awslabs/aws-sdk-go/aws"
 	"github.com/awslabs/aws-sdk-go/service/ec2"
 	"github.com/cockroachdb/cockroach/util"
+	"golang.org/x/net/context"
 )
 
 const (
-	securityGroupName             = "docker-machine"
-	allIPAddresses                = "0.0.0.0/0"
+	// Security group created by docker-machine for the default cluster.
+	defaultSecurityGroupName      = "docker-machine"
 	cockroachProtocol             = "tcp"
 	awsSecurityRuleDuplicateError = "InvalidPermission.Duplicate"
+	awsSecurityRuleNotFoundError  = "InvalidPermission.NotFound"
 	awsSecurityGroupNotFound      = "InvalidGroup.NotFound"
 )
 
-// FindSecurityGroup looks for the security group created by docker-machine.
+// FindSecurityGroup looks for the named security group created by docker-machine.
 // We needs its ID for other EC2 tasks (eg: create load balancer).
 // Not finding the security group is an error.
-func FindSecurityGroup(region string) (string, error) {
+func FindSecurityGroup(ctx context.Context, opts APIOptions, region, securityGroupName string) (string, error) {
 	ec2Service := ec2.New(&aws.Config{Region: region})
-	resp, err := ec2Service.DescribeSecurityGroups(&ec2.DescribeSecurityGroupsInput{
-		GroupNames: []*string{aws.String(securityGroupName)},
+	var resp *ec2.DescribeSecurityGroupsOutput
+	err := opts.retry(ctx, "describing security group", func() (err error) {
+		resp, err = ec2Service.DescribeSecurityGroups(&ec2.DescribeSecurityGroupsInput{
+			GroupNames: []*string{aws.String(securityGroupName)},
+		})
+		return err
 	})
 	if err != nil {
 		return "", err
@@ -50,20 +56,24 @@ func FindSecurityGroup(region string) (string, error) {
 	return *resp.SecurityGroups[0].GroupID, nil
 }
 
-// AddCockroachSecurityGroupIngress takes in a nodeInfo and
-// adds the cockroach port ingress rules to the security group.
+// AddCockroachSecurityGroupIngress adds the cockroach port ingress rule
+// for 'cidr' to the security group.
 // The To and From ports are set to 'cockroachPort'.
 // Duplicates are technically errors according to the AWS API, but we check for
 // the duplicate error code and return ok.
-func AddCockroachSecurityGroupIngress(region string, cockroachPort int64, securityGroupID string) error {
+func AddCockroachSecurityGroupIngress(ctx context.Context, opts APIOptions, region string, cockroachPort int64,
+	securityGroupID string, cidr string) error {
 	ec2Service := ec2.New(&aws.Config{Region: region})
 
-	_, err := ec2Service.AuthorizeSecurityGroupIngress(&ec2.AuthorizeSecurityGroupIngressInput{
-		CIDRIP:     aws.String(allIPAddresses),
-		FromPort:   aws.Long(cockroachPort),
-		ToPort:     aws.Long(cockroachPort),
-		IPProtocol: aws.String(cockroachProtocol),
-		GroupID:    aws.String(securityGroupID),
+	err := opts.retry(ctx, "authorizing security group ingress", func() error {
+		_, err := ec2Service.AuthorizeSecurityGroupIngress(&ec2.AuthorizeSecurityGroupIngressInput{
+			CIDRIP:     aws.String(cidr),
+			FromPort:   aws.Long(cockroachPort),
+			ToPort:     aws.Long(cockroachPort),
+			IPProtocol: aws.String(cockroachProtocol),
+			GroupID:    aws.String(securityGroupID),
+		})
+		return err
 	})
 
 	if IsAWSErrorCode(err, awsSecurityRuleDuplicateError) {
@@ -71,3 +81,66 @@ func AddCockroachSecurityGroupIngress(region string, cockroachPort int64, securi
 	}
 	return err
 }
+
+// RemoveCockroachSecurityGroupIngress removes the cockroach port ingress rule
+// added by AddCockroachSecurityGroupIngress.
+// Returns true if the rule was removed, false if it did not exist.
+func RemoveCockroachSecurityGroupIngress(ctx context.Context, opts APIOptions, region string, cockroachPort int64,
+	securityGroupID string, cidr string) (bool, error) {
+	ec2Service := ec2.New(&aws.Config{Region: region})
+
+	err := opts.retry(ctx, "revoking security group ingress", func() error {
+		_, err := ec2Service.RevokeSecurityGroupIngress(&ec2.RevokeSecurityGroupIngressInput{
+			CIDRIP:     aws.String(cidr),
+			FromPort:   aws.Long(cockroachPort),
+			ToPort:     aws.Long(cockroachPort),
+			IPProtocol: aws.String(cockroachProtocol),
+			GroupID:    aws.String(securityGroupID),
+		})
+		return err
+	})
+
+	if IsAWSErrorCode(err, awsSecurityRuleNotFoundError) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// ListCockroachSecurityGroupIngress returns the CIDRs of all cockroach port
+// ingress rules in the security group, including those added with a
+// different list of allowed CIDRs.
+func ListCockroachSecurityGroupIngress(ctx context.Context, opts APIOptions, region string, cockroachPort int64,
+	securityGroupID string) ([]string, error) {
+	ec2Service := ec2.New(&aws.Config{Region: region})
+	var resp *ec2.DescribeSecurityGroupsOutput
+	err := opts.retry(ctx, "describing security group", func() (err error) {
+		resp, err = ec2Service.DescribeSecurityGroups(&ec2.DescribeSecurityGroupsInput{
+			GroupIDs: []*string{aws.String(securityGroupID)},
+		})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.SecurityGroups) == 0 {
+		return nil, util.Errorf("security group %s not found", securityGroupID)
+	}
+
+	cidrs := []string{}
+	for _, perm := range resp.SecurityGroups[0].IPPermissions {
+		if perm.IPProtocol == nil || *perm.IPProtocol != cockroachProtocol ||
+			perm.FromPort == nil || *perm.FromPort != cockroachPort ||
+			perm.ToPort == nil || *perm.ToPort != cockroachPort {
+			continue
+		}
+		for _, ipRange := range perm.IPRanges {
+			if ipRange.CIDRIP != nil {
+				cidrs = append(cidrs, *ipRange.CIDRIP)
+			}
+		}
+	}
+	return cidrs, nil
+}
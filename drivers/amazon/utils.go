@@ -18,10 +18,29 @@
 package amazon
 
 import (
+	"net/http"
+
 	"github.com/awslabs/aws-sdk-go/aws"
 	"github.com/awslabs/aws-sdk-go/aws/awserr"
+	"github.com/cockroachdb/cockroach-prod/drivers"
+	"golang.org/x/net/context"
 )
 
+// AWS error codes returned when requests are throttled.
+var throttlingErrorCodes = map[string]bool{
+	"Throttling":           true,
+	"ThrottlingException":  true,
+	"RequestLimitExceeded": true,
+	"RequestThrottled":     true,
+}
+
+// APIOptions are the options for retrying AWS API calls and polling
+// resources. Each driver sets them from its context.
+type APIOptions struct {
+	Retry drivers.RetryOptions
+	Poll  drivers.RetryOptions
+}
+
 // LoadAWSCredentials loads the credentials using the AWS api. This automatically
 // loads from ENV, or from the .aws/credentials file.
 // Returns the key-id and secret-key.
@@ -51,3 +70,31 @@ func IsAWSErrorCode(err error, code string) bool {
 
 	return awsErr.Code() == code
 }
+
+// isRetryable returns true if err is a throttling or server error.
+func isRetryable(err error) bool {
+	if reqErr, ok := err.(awserr.RequestFailure); ok && reqErr.StatusCode() >= http.StatusInternalServerError {
+		return true
+	}
+	return isThrottled(err)
+}
+
+// isThrottled returns true if err is a throttling error. Throttled requests
+// were not executed, so they can be retried even if they are not idempotent.
+func isThrottled(err error) bool {
+	awsErr, ok := err.(awserr.Error)
+	return ok && throttlingErrorCodes[awsErr.Code()]
+}
+
+// retry calls fn, retrying throttling and server errors.
+func (opts APIOptions) retry(ctx context.Context, desc string, fn func() error) error {
+	return drivers.Retry(ctx, opts.Retry, desc, fn)
+}
+
+// retryThrottled calls fn, retrying throttling errors only. It is used for
+// calls that are not idempotent.
+func (opts APIOptions) retryThrottled(ctx context.Context, desc string, fn func() error) error {
+	retryOpts := opts.Retry
+	retryOpts.Retryable = isThrottled
+	return drivers.Retry(ctx, retryOpts, desc, fn)
+}
@@ -0,0 +1,212 @@
+// Copyright 2015 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+//
+// Author: Marc Berhault (marc@cockroachlabs.com)
+
+package amazon
+
+import (
+	"fmt"
+
+	"github.com/awslabs/aws-sdk-go/aws"
+	"github.com/awslabs/aws-sdk-go/service/ec2"
+	"github.com/cockroachdb/cockroach-prod/drivers"
+	"github.com/cockroachdb/cockroach/util"
+	"github.com/cockroachdb/cockroach/util/log"
+	"golang.org/x/net/context"
+)
+
+const (
+	defaultVolumeType = "gp2"
+	// Devices attached as /dev/sdX show up as /dev/xvdX on HVM instances.
+	volumeAttachDevice  = "/dev/sdf"
+	volumeLocalDevice   = "/dev/xvdf"
+	volumeAvailable     = "available"
+	volumeInUse         = "in-use"
+	volumeNameTagKey    = "Name"
+	volumeNameSuffix    = "-data"
+	awsVolumeNotFound   = "InvalidVolume.NotFound"
+	volumeAttachedState = "attached"
+)
+
+// volumeName returns the name of the data volume for the given node.
+func volumeName(nodeName string) string {
+	return nodeName + volumeNameSuffix
+}
+
+// FindVolume looks for the data volume of the given node (by its "Name" tag).
+// If not found, err=nil and volume=nil.
+func FindVolume(ctx context.Context, opts APIOptions, region string, nodeName string) (*ec2.Volume, error) {
+	ec2Service := ec2.New(&aws.Config{Region: region})
+	var resp *ec2.DescribeVolumesOutput
+	err := opts.retry(ctx, "describing volumes", func() (err error) {
+		resp, err = ec2Service.DescribeVolumes(&ec2.DescribeVolumesInput{
+			Filters: []*ec2.Filter{
+				{
+					Name:   aws.String("tag:" + volumeNameTagKey),
+					Values: []*string{aws.String(volumeName(nodeName))},
+				},
+			},
+		})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(resp.Volumes) == 0 {
+		return nil, nil
+	}
+	if len(resp.Volumes) > 1 {
+		return nil, util.Errorf("found %d volumes named %s", len(resp.Volumes), volumeName(nodeName))
+	}
+	return resp.Volumes[0], nil
+}
+
+// CreateVolume creates and tags a data volume for the given node
+// and waits for it to be available. Volumes are found by their tag, so the
+// volume is deleted if it cannot be tagged.
+func CreateVolume(ctx context.Context, opts APIOptions, region, zone, nodeName string, sizeGB int64,
+	volumeType string) (*ec2.Volume, error) {
+	if volumeType == "" {
+		volumeType = defaultVolumeType
+	}
+	ec2Service := ec2.New(&aws.Config{Region: region})
+	// Retrying after a server error could create a second volume.
+	var volume *ec2.Volume
+	err := opts.retryThrottled(ctx, "creating volume", func() (err error) {
+		volume, err = ec2Service.CreateVolume(&ec2.CreateVolumeInput{
+			AvailabilityZone: aws.String(region + zone),
+			Size:             aws.Long(sizeGB),
+			VolumeType:       aws.String(volumeType),
+		})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = opts.retry(ctx, "tagging volume", func() error {
+		_, err := ec2Service.CreateTags(&ec2.CreateTagsInput{
+			Resources: []*string{volume.VolumeID},
+			Tags: []*ec2.Tag{
+				{Key: aws.String(volumeNameTagKey), Value: aws.String(volumeName(nodeName))},
+			},
+		})
+		return err
+	})
+	if err != nil {
+		if delErr := deleteVolumeByID(ctx, opts, region, *volume.VolumeID); delErr != nil {
+			return nil, util.Errorf("could not tag volume %s: %v, and could not delete it: %v",
+				*volume.VolumeID, err, delErr)
+		}
+		return nil, util.Errorf("could not tag volume %s, deleted it: %v", *volume.VolumeID, err)
+	}
+
+	return waitForVolumeState(ctx, opts, region, *volume.VolumeID, volumeAvailable)
+}
+
+// AttachVolume attaches the volume to the given instance and waits for it
+// to be in use.
+func AttachVolume(ctx context.Context, opts APIOptions, region, volumeID, instanceID string) error {
+	ec2Service := ec2.New(&aws.Config{Region: region})
+	// Attaching an attached volume fails, so server errors are not retried.
+	err := opts.retryThrottled(ctx, "attaching volume", func() error {
+		_, err := ec2Service.AttachVolume(&ec2.AttachVolumeInput{
+			Device:     aws.String(volumeAttachDevice),
+			InstanceID: aws.String(instanceID),
+			VolumeID:   aws.String(volumeID),
+		})
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	_, err = waitForVolumeState(ctx, opts, region, volumeID, volumeInUse)
+	return err
+}
+
+// DeleteVolume deletes the data volume of the given node. The volume may still
+// be attached to a terminating instance, so we wait for it to be available.
+// Returns true if the volume was found and deleted, false if it did not exist.
+func DeleteVolume(ctx context.Context, opts APIOptions, region, nodeName string) (bool, error) {
+	volume, err := FindVolume(ctx, opts, region, nodeName)
+	if err != nil {
+		return false, err
+	}
+	if volume == nil {
+		return false, nil
+	}
+
+	err = deleteVolumeByID(ctx, opts, region, *volume.VolumeID)
+	if IsAWSErrorCode(err, awsVolumeNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// deleteVolumeByID waits for the volume to be available and deletes it.
+func deleteVolumeByID(ctx context.Context, opts APIOptions, region, volumeID string) error {
+	if _, err := waitForVolumeState(ctx, opts, region, volumeID, volumeAvailable); err != nil {
+		return err
+	}
+	ec2Service := ec2.New(&aws.Config{Region: region})
+	return opts.retry(ctx, "deleting volume", func() error {
+		_, err := ec2Service.DeleteVolume(&ec2.DeleteVolumeInput{
+			VolumeID: aws.String(volumeID),
+		})
+		return err
+	})
+}
+
+// isAttachedTo returns true if the volume is attached to the given instance.
+func isAttachedTo(volume *ec2.Volume, instanceID string) bool {
+	for _, attachment := range volume.Attachments {
+		if *attachment.InstanceID == instanceID && *attachment.State == volumeAttachedState {
+			return true
+		}
+	}
+	return false
+}
+
+// waitForVolumeState polls the volume until it reaches the desired state.
+func waitForVolumeState(ctx context.Context, opts APIOptions, region, volumeID, state string) (*ec2.Volume, error) {
+	ec2Service := ec2.New(&aws.Config{Region: region})
+	var volume *ec2.Volume
+	err := drivers.Poll(ctx, opts.Poll, fmt.Sprintf("waiting for volume %s to be %s", volumeID, state),
+		func() (bool, error) {
+			resp, err := ec2Service.DescribeVolumes(&ec2.DescribeVolumesInput{
+				VolumeIDs: []*string{aws.String(volumeID)},
+			})
+			if err != nil {
+				return false, err
+			}
+			if len(resp.Volumes) != 1 {
+				return false, util.Errorf("expected one volume with ID %s, found %d", volumeID, len(resp.Volumes))
+			}
+			volume = resp.Volumes[0]
+			if log.V(1) {
+				drivers.LogInfof(ctx, "volume %s: %s", volumeID, *volume.State)
+			}
+			return *volume.State == state, nil
+		})
+	if err != nil {
+		return nil, err
+	}
+	return volume, nil
+}
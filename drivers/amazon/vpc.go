@@ -21,21 +21,25 @@ import (
 	"github.com/awslabs/aws-sdk-go/aws"
 	"github.com/awslabs/aws-sdk-go/service/ec2"
 	"github.com/cockroachdb/cockroach/util"
+	"golang.org/x/net/context"
 )
 
 // FindDefaultVPC looks for the default VPC in a given region
 // and returns its ID if found.
-func FindDefaultVPC(region string) (string, error) {
+func FindDefaultVPC(ctx context.Context, opts APIOptions, region string) (string, error) {
 	ec2Service := ec2.New(&aws.Config{Region: region})
 
-	// Call the DescribeInstances Operation
-	resp, err := ec2Service.DescribeVPCs(&ec2.DescribeVPCsInput{
-		Filters: []*ec2.Filter{
-			{
-				Name:   aws.String("isDefault"),
-				Values: []*string{aws.String("true")},
+	var resp *ec2.DescribeVPCsOutput
+	err := opts.retry(ctx, "describing VPCs", func() (err error) {
+		resp, err = ec2Service.DescribeVPCs(&ec2.DescribeVPCsInput{
+			Filters: []*ec2.Filter{
+				{
+					Name:   aws.String("isDefault"),
+					Values: []*string{aws.String("true")},
+				},
 			},
-		},
+		})
+		return err
 	})
 	if err != nil {
 		return "", err
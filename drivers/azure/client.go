@@ -0,0 +1,283 @@
+// Copyright 2015 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+//
+// Author: Marc Berhault (marc@cockroachlabs.com)
+
+package azure
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/cockroach-prod/drivers"
+	"github.com/cockroachdb/cockroach/util"
+	"golang.org/x/net/context"
+)
+
+const (
+	managementEndpoint = "https://management.azure.com"
+	tokenEndpoint      = "https://login.microsoftonline.com/%s/oauth2/token"
+	networkAPIVersion  = "2016-03-30"
+	computeAPIVersion  = "2016-03-30"
+	// Tokens are refreshed this long before they expire.
+	tokenExpiryMargin = time.Minute
+	// Provisioning states of resources.
+	provisioningSucceeded = "Succeeded"
+	provisioningFailed    = "Failed"
+)
+
+// apiError is an error returned by the Azure Resource Manager API.
+type apiError struct {
+	StatusCode int
+	Code       string
+	Message    string
+}
+
+func (err *apiError) Error() string {
+	return fmt.Sprintf("%d %s: %s", err.StatusCode, err.Code, err.Message)
+}
+
+// isNotFound returns true if the error is a 404 returned by the API.
+func isNotFound(err error) bool {
+	apiErr, ok := err.(*apiError)
+	return ok && apiErr.StatusCode == http.StatusNotFound
+}
+
+// isPreconditionFailed returns true if the error is a 412 returned by the API:
+// the resource etag did not match If-Match.
+func isPreconditionFailed(err error) bool {
+	apiErr, ok := err.(*apiError)
+	return ok && apiErr.StatusCode == http.StatusPreconditionFailed
+}
+
+// isRetryable returns true if err is a throttling or server error.
+func isRetryable(err error) bool {
+	apiErr, ok := err.(*apiError)
+	return ok && (apiErr.StatusCode == http.StatusTooManyRequests ||
+		apiErr.StatusCode >= http.StatusInternalServerError)
+}
+
+// client calls the Azure Resource Manager REST API as a service principal.
+// It is safe for concurrent use.
+type client struct {
+	creds *credentials
+	// Options for retrying API calls and polling resources, from the driver.
+	apiRetryOptions drivers.RetryOptions
+	pollOptions     drivers.RetryOptions
+
+	// mu protects the token.
+	mu          sync.Mutex
+	token       string
+	tokenExpiry time.Time
+}
+
+// getToken returns a valid access token, requesting a new one if needed.
+func (c *client) getToken() (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.token != "" && time.Now().Add(tokenExpiryMargin).Before(c.tokenExpiry) {
+		return c.token, nil
+	}
+
+	resp, err := http.PostForm(fmt.Sprintf(tokenEndpoint, c.creds.TenantID), url.Values{
+		"grant_type":    {"client_credentials"},
+		"client_id":     {c.creds.ClientID},
+		"client_secret": {c.creds.ClientSecret},
+		"resource":      {managementEndpoint + "/"},
+	})
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", util.Errorf("token request failed with %s: %s", resp.Status, body)
+	}
+
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresOn   string `json:"expires_on"`
+	}
+	if err := json.Unmarshal(body, &token); err != nil {
+		return "", util.Errorf("invalid token response: %v", err)
+	}
+	expiresOn, err := strconv.ParseInt(token.ExpiresOn, 10, 64)
+	if err != nil {
+		return "", util.Errorf("invalid token expiry %q: %v", token.ExpiresOn, err)
+	}
+	c.token = token.AccessToken
+	c.tokenExpiry = time.Unix(expiresOn, 0)
+	return c.token, nil
+}
+
+// do sends a request to the API, retrying throttling and server errors.
+// 'path' is relative to the subscription, in and out are JSON encoded and
+// decoded if not nil.
+func (c *client) do(ctx context.Context, method, path, apiVersion string, in, out interface{}) error {
+	return c.doWithHeaders(ctx, method, path, apiVersion, nil, in, out)
+}
+
+// doWithHeaders is like do, with additional request headers.
+func (c *client) doWithHeaders(ctx context.Context, method, path, apiVersion string, headers map[string]string,
+	in, out interface{}) error {
+	var payload []byte
+	if in != nil {
+		var err error
+		if payload, err = json.Marshal(in); err != nil {
+			return err
+		}
+	}
+	return drivers.Retry(ctx, c.apiRetryOptions, fmt.Sprintf("%s %s", method, path), func() error {
+		token, err := c.getToken()
+		if err != nil {
+			return err
+		}
+		var body io.Reader
+		if payload != nil {
+			body = bytes.NewReader(payload)
+		}
+		req, err := http.NewRequest(method, c.url(path, apiVersion), body)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		if payload != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		respBody, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode >= http.StatusBadRequest {
+			return newAPIError(resp.StatusCode, respBody)
+		}
+		if out == nil || len(respBody) == 0 {
+			return nil
+		}
+		return json.Unmarshal(respBody, out)
+	})
+}
+
+// url returns the full URL of a path relative to the subscription.
+func (c *client) url(path, apiVersion string) string {
+	return fmt.Sprintf("%s/subscriptions/%s%s?api-version=%s", managementEndpoint, c.creds.SubscriptionID,
+		path, apiVersion)
+}
+
+// newAPIError parses the error returned by the API.
+func newAPIError(statusCode int, body []byte) error {
+	var resp struct {
+		Error struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil || resp.Error.Code == "" {
+		return &apiError{StatusCode: statusCode, Code: http.StatusText(statusCode), Message: string(body)}
+	}
+	return &apiError{StatusCode: statusCode, Code: resp.Error.Code, Message: resp.Error.Message}
+}
+
+// resourceID returns the full ID of a resource, for references between resources.
+func (c *client) resourceID(path string) string {
+	return "/subscriptions/" + c.creds.SubscriptionID + path
+}
+
+// sameID returns true if both resource IDs are the same. The API does not
+// preserve the case of resource IDs.
+func sameID(a, b string) bool {
+	return strings.EqualFold(a, b)
+}
+
+// provisionedResource is the part of a resource describing its provisioning.
+type provisionedResource struct {
+	Properties struct {
+		ProvisioningState string `json:"provisioningState"`
+	} `json:"properties"`
+}
+
+// put creates or updates a resource and waits for its provisioning to complete.
+func (c *client) put(ctx context.Context, path, apiVersion string, resource interface{}) error {
+	return c.putIfMatch(ctx, path, apiVersion, resource, "")
+}
+
+// putIfMatch is like put, but only updates the resource if its etag is still
+// 'etag'. The API fails with 412 Precondition Failed otherwise.
+// An empty etag makes the update unconditional.
+func (c *client) putIfMatch(ctx context.Context, path, apiVersion string, resource interface{}, etag string) error {
+	var headers map[string]string
+	if etag != "" {
+		headers = map[string]string{"If-Match": etag}
+	}
+	if err := c.doWithHeaders(ctx, "PUT", path, apiVersion, headers, resource, nil); err != nil {
+		return err
+	}
+	return drivers.Poll(ctx, c.pollOptions, "waiting for "+path, func() (bool, error) {
+		var r provisionedResource
+		if err := c.do(ctx, "GET", path, apiVersion, nil, &r); err != nil {
+			return false, err
+		}
+		switch r.Properties.ProvisioningState {
+		case provisioningSucceeded:
+			return true, nil
+		case provisioningFailed:
+			return false, util.Errorf("provisioning of %s failed", path)
+		}
+		return false, nil
+	})
+}
+
+// delete deletes a resource and waits for it to be gone. Returns false if the
+// resource did not exist. Deleting a missing resource succeeds, so we look it up first.
+func (c *client) delete(ctx context.Context, path, apiVersion string) (bool, error) {
+	err := c.do(ctx, "GET", path, apiVersion, nil, nil)
+	if isNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if err := c.do(ctx, "DELETE", path, apiVersion, nil, nil); err != nil {
+		return false, err
+	}
+	return true, drivers.Poll(ctx, c.pollOptions, "waiting for deletion of "+path, func() (bool, error) {
+		err := c.do(ctx, "GET", path, apiVersion, nil, nil)
+		if isNotFound(err) {
+			return true, nil
+		}
+		return false, err
+	})
+}
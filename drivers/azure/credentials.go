@@ -0,0 +1,128 @@
+// Copyright 2015 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+//
+// Author: Marc Berhault (marc@cockroachlabs.com)
+
+package azure
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/cockroachdb/cockroach/util"
+)
+
+const (
+	// Credentials file, in the same format as the AWS credentials file.
+	defaultCredentialsFile = "${HOME}/.azure/credentials"
+	credentialsProfile     = "default"
+)
+
+// Environment variables holding the credentials. They take precedence over
+// the credentials file.
+const (
+	envSubscriptionID = "AZURE_SUBSCRIPTION_ID"
+	envTenantID       = "AZURE_TENANT_ID"
+	envClientID       = "AZURE_CLIENT_ID"
+	envClientSecret   = "AZURE_CLIENT_SECRET"
+)
+
+// credentials are the service principal used to call the Azure Resource
+// Manager API. They are shared with docker-machine.
+type credentials struct {
+	SubscriptionID string
+	TenantID       string
+	ClientID       string
+	ClientSecret   string
+}
+
+// loadCredentials loads the service principal credentials from the
+// environment, or from the [default] section of ~/.azure/credentials:
+//
+//	[default]
+//	subscription_id = ...
+//	tenant_id = ...
+//	client_id = ...
+//	client_secret = ...
+func loadCredentials() (*credentials, error) {
+	creds := &credentials{
+		SubscriptionID: os.Getenv(envSubscriptionID),
+		TenantID:       os.Getenv(envTenantID),
+		ClientID:       os.Getenv(envClientID),
+		ClientSecret:   os.Getenv(envClientSecret),
+	}
+	if creds.complete() {
+		return creds, nil
+	}
+
+	path := os.ExpandEnv(defaultCredentialsFile)
+	values, err := readCredentialsFile(path)
+	if os.IsNotExist(err) {
+		return nil, util.Errorf("%s, %s, %s and %s must be set, or %s must exist",
+			envSubscriptionID, envTenantID, envClientID, envClientSecret, path)
+	}
+	if err != nil {
+		return nil, util.Errorf("could not read %s: %v", path, err)
+	}
+	creds = &credentials{
+		SubscriptionID: values["subscription_id"],
+		TenantID:       values["tenant_id"],
+		ClientID:       values["client_id"],
+		ClientSecret:   values["client_secret"],
+	}
+	if !creds.complete() {
+		return nil, util.Errorf("%s: subscription_id, tenant_id, client_id and client_secret must be set "+
+			"in section [%s]", path, credentialsProfile)
+	}
+	return creds, nil
+}
+
+func (c *credentials) complete() bool {
+	return c.SubscriptionID != "" && c.TenantID != "" && c.ClientID != "" && c.ClientSecret != ""
+}
+
+// readCredentialsFile returns the key/value pairs of the default profile.
+func readCredentialsFile(path string) (map[string]string, error) {
+	f, err := os.Open(filepath.Clean(path))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	values := map[string]string{}
+	section := ""
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		}
+		if section != credentialsProfile {
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			return nil, util.Errorf("invalid line %q", line)
+		}
+		values[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+	return values, scanner.Err()
+}
@@ -0,0 +1,441 @@
+// Copyright 2015 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+//
+// Author: Marc Berhault (marc@cockroachlabs.com)
+
+package azure
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/cockroachdb/cockroach-prod/base"
+	"github.com/cockroachdb/cockroach-prod/docker"
+	"github.com/cockroachdb/cockroach-prod/drivers"
+	"github.com/cockroachdb/cockroach/util"
+	"github.com/cockroachdb/cockroach/util/log"
+	"golang.org/x/net/context"
+)
+
+const (
+	dockerMachineDriverName = "azure"
+	azureCertsDir           = "/home/docker-user/certs"
+	azureDataDir            = "/home/docker-user/data"
+	subscriptionAPIVersion  = "2016-06-01"
+	// Tag on the load balancer holding the cluster lock.
+	lockTagKey = "cockroach-prod-lock"
+)
+
+// Azure implements a driver for Microsoft Azure.
+// Each cluster lives in its own resource group, created by docker-machine.
+type Azure struct {
+	context *base.Context
+	region  string
+	// Options for retrying API calls and polling resources.
+	apiRetryOptions drivers.RetryOptions
+	pollOptions     drivers.RetryOptions
+
+	// Created at Init() time.
+	// Methods for network resources can be found in network.go
+	client *client
+}
+
+// config contains the azure-specific fields of the docker-machine config.
+// Not all are specified, only those used here.
+// Implements drivers.DriverConfig.
+type config struct {
+	MachineName     string
+	PublicIPAddress string `json:"IPAddress"`
+
+	// Fields not saved by docker-machine. We look them up.
+	privateIPAddress    string
+	loadBalancerAddress string
+}
+
+// DataDir returns the data directory.
+func (cfg *config) DataDir() string {
+	return azureDataDir
+}
+
+// CertsDir returns the certificates directory.
+func (cfg *config) CertsDir() string {
+	return azureCertsDir
+}
+
+// IPAddress returns the IP address we will listen on.
+func (cfg *config) IPAddress() string {
+	return cfg.privateIPAddress
+}
+
+// GossipAddress returns the address for the gossip network.
+func (cfg *config) GossipAddress() string {
+	return cfg.loadBalancerAddress
+}
+
+// NewDriver returns an initialized Azure driver.
+// The region is an Azure location, eg: westus.
+func NewDriver(context *base.Context, region string) *Azure {
+	return &Azure{
+		context:         context,
+		region:          region,
+		apiRetryOptions: drivers.APIRetryOptions(context, isRetryable),
+		pollOptions:     drivers.OperationPollOptions(context, isRetryable),
+	}
+}
+
+// Context returns the base context.
+func (a *Azure) Context() *base.Context {
+	return a.context
+}
+
+// DockerMachineDriver returns the name of the docker-machine driver.
+func (a *Azure) DockerMachineDriver() string {
+	return dockerMachineDriverName
+}
+
+// Init looks for Azure credentials and checks that they grant access to
+// the subscription.
+func (a *Azure) Init() error {
+	if a.context.Zone != "" {
+		return base.ValidationErrorf("zones are not supported on Azure, got --zone=%s", a.context.Zone)
+	}
+
+	creds, err := loadCredentials()
+	if err != nil {
+		return base.NewError(base.CredentialsError, err, "loading Azure credentials")
+	}
+	a.client = &client{creds: creds, apiRetryOptions: a.apiRetryOptions, pollOptions: a.pollOptions}
+	log.Infof("loaded Azure service principal: %s", creds.ClientID)
+
+	err = a.client.do(context.Background(), "GET", "", subscriptionAPIVersion, nil, nil)
+	if err != nil {
+		return base.NewError(base.CredentialsError, err, "accessing subscription %s", creds.SubscriptionID)
+	}
+	log.Infof("validated subscription: %s", creds.SubscriptionID)
+	return nil
+}
+
+// DockerMachineCreateArgs returns the list of driver-specific arguments
+// to pass to 'docker-machine create'
+// All nodes are in the same availability set: the load balancer requires it.
+func (a *Azure) DockerMachineCreateArgs(name string) ([]string, error) {
+	creds := a.client.creds
+	return []string{
+		"--azure-subscription-id", creds.SubscriptionID,
+		"--azure-client-id", creds.ClientID,
+		"--azure-client-secret", creds.ClientSecret,
+		"--azure-location", a.region,
+		"--azure-resource-group", a.resourceGroupName(),
+		"--azure-availability-set", a.availabilitySetName(),
+	}, nil
+}
+
+// GetStatus looks up the load balancer. Security rules are per node: the
+// rules found on any node are reported by name.
+func (a *Azure) GetStatus() *drivers.ClusterStatus {
+	status := &drivers.ClusterStatus{
+		Driver: dockerMachineDriverName,
+		Region: a.region,
+	}
+
+	found, err := a.findLoadBalancer(context.Background())
+	if err != nil {
+		status.Errors = append(status.Errors, fmt.Sprintf("load balancer: %v", err))
+	} else if found {
+		address, err := a.findPublicIPAddress(context.Background())
+		if err != nil {
+			status.Errors = append(status.Errors, fmt.Sprintf("public IP: %v", err))
+		} else if address != "" {
+			status.LoadBalancerAddress = fmt.Sprintf("%s:%d", address, a.context.Port)
+		}
+	}
+
+	nodes, err := docker.ListCockroachNodes(a.context.Cluster)
+	if err != nil {
+		status.Errors = append(status.Errors, fmt.Sprintf("listing nodes: %v", err))
+		return status
+	}
+	perNode := map[string][]string{}
+	var rules []string
+	status.AllowedCIDRs = []string{}
+	for _, name := range nodes {
+		cidrs, err := a.listCockroachSecurityRules(context.Background(), name)
+		if err != nil {
+			status.Errors = append(status.Errors, fmt.Sprintf("security rules of node %s: %v", name, err))
+			continue
+		}
+		perNode[name] = cidrs
+		for _, cidr := range cidrs {
+			if !containsString(status.AllowedCIDRs, cidr) {
+				status.AllowedCIDRs = append(status.AllowedCIDRs, cidr)
+				rules = append(rules, securityRuleName(cidr))
+			}
+		}
+	}
+	for _, name := range nodes {
+		cidrs, ok := perNode[name]
+		if !ok {
+			continue
+		}
+		for _, cidr := range status.AllowedCIDRs {
+			if !containsString(cidrs, cidr) {
+				status.Errors = append(status.Errors, fmt.Sprintf("node %s has no security rule for %s", name, cidr))
+			}
+		}
+	}
+	status.Firewall = strings.Join(rules, ",")
+	return status
+}
+
+func containsString(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
+
+// GetNodeStatus looks up the virtual machine and its backend pool membership.
+func (a *Azure) GetNodeStatus(name string, cfg *drivers.HostConfig, status *drivers.NodeStatus) {
+	driverCfg := cfg.Driver.(*config)
+	status.InstanceID = driverCfg.MachineName
+	status.ExternalIP = driverCfg.PublicIPAddress
+	status.Zone = a.region
+
+	powerState, err := a.getPowerState(driverCfg.MachineName)
+	if err != nil {
+		status.Errors = append(status.Errors, fmt.Sprintf("instance: %v", err))
+	} else {
+		status.InstanceState = powerState
+	}
+
+	nic, err := a.getNIC(context.Background(), name)
+	if err != nil {
+		status.Errors = append(status.Errors, fmt.Sprintf("network interface: %v", err))
+		return
+	}
+	status.InternalIP = nic.privateIPAddress()
+	status.InLoadBalancer = nic.inPool(a.backendPoolID())
+	if status.InLoadBalancer {
+		status.InService, err = a.IsNodeInService(context.Background(), name, cfg)
+		if err != nil {
+			status.Errors = append(status.Errors, fmt.Sprintf("load balancer health: %v", err))
+		}
+	}
+}
+
+// GetInstanceState looks up the power state of the virtual machine.
+func (a *Azure) GetInstanceState(name string, cfg *drivers.HostConfig) (drivers.InstanceState, error) {
+	powerState, err := a.getPowerState(cfg.Driver.(*config).MachineName)
+	if isNotFound(err) {
+		return drivers.InstanceMissing, nil
+	}
+	if err != nil {
+		return drivers.InstanceUnknown, err
+	}
+	switch powerState {
+	case "running":
+		return drivers.InstanceRunning, nil
+	case "stopped", "deallocated":
+		return drivers.InstanceStopped, nil
+	case "starting", "stopping", "deallocating":
+		return drivers.InstancePending, nil
+	}
+	return drivers.InstanceUnknown, nil
+}
+
+// LoadBalancerAddress returns the public IP address of the load balancer.
+func (a *Azure) LoadBalancerAddress() (string, error) {
+	address, err := a.findPublicIPAddress(context.Background())
+	if err != nil {
+		return "", err
+	}
+	if address == "" {
+		return "", util.Errorf("public IP %s not found", a.publicIPName())
+	}
+	return address, nil
+}
+
+// GetNodeConfig takes a node name and reads its docker-machine config.
+// The private IP address and load balancer address are looked up and filled in.
+func (a *Azure) GetNodeConfig(name string) (*drivers.HostConfig, error) {
+	cfg := &drivers.HostConfig{
+		Driver: &config{},
+	}
+
+	// Parse the config file.
+	err := docker.GetHostConfig(name, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	// docker-machine saves the public IP address only.
+	nic, err := a.getNIC(context.Background(), name)
+	if err != nil {
+		return nil, util.Errorf("could not lookup network interface: %v", err)
+	}
+	cfg.Driver.(*config).privateIPAddress = nic.privateIPAddress()
+
+	address, err := a.LoadBalancerAddress()
+	if err != nil {
+		return nil, util.Errorf("could not find load balancer: %v", err)
+	}
+	cfg.Driver.(*config).loadBalancerAddress = address
+	return cfg, nil
+}
+
+// AfterFirstNode runs any steps needed after the first node was created.
+// docker-machine creates a network security group per node: the cockroach
+// port is opened in those of the existing nodes, PrepareNode takes care of
+// later ones. The load balancer is then created.
+func (a *Azure) AfterFirstNode(ctx context.Context) error {
+	nodes, err := docker.ListCockroachNodes(a.context.Cluster)
+	if err != nil {
+		return util.Errorf("failed to list nodes: %v", err)
+	}
+	for _, name := range nodes {
+		if err := a.allowCockroachPort(ctx, name); err != nil {
+			return err
+		}
+	}
+
+	return a.findOrCreateLoadBalancer(ctx)
+}
+
+// PrepareNode opens the cockroach port in the node's network security group.
+func (a *Azure) PrepareNode(ctx context.Context, name string, cfg *drivers.HostConfig, created bool) error {
+	return a.allowCockroachPort(ctx, name)
+}
+
+// AfterNodeRemoved does nothing: docker-machine deletes the node's resources.
+func (a *Azure) AfterNodeRemoved(ctx context.Context, name string) error {
+	return nil
+}
+
+// StartNode adds the node to the load balancer backend pool.
+func (a *Azure) StartNode(ctx context.Context, name string, cfg *drivers.HostConfig) error {
+	drivers.LogInfof(ctx, "adding node %s to load balancer", name)
+	if err := a.setNodeInBackendPool(ctx, name, true); err != nil {
+		return util.Errorf("failed to add node %s to load balancer: %v", name, err)
+	}
+	return nil
+}
+
+// StopNode removes the node from the load balancer backend pool.
+func (a *Azure) StopNode(ctx context.Context, name string, cfg *drivers.HostConfig) error {
+	drivers.LogInfof(ctx, "removing node %s from load balancer", name)
+	if err := a.setNodeInBackendPool(ctx, name, false); err != nil {
+		return util.Errorf("failed to remove node %s from load balancer: %v", name, err)
+	}
+	return nil
+}
+
+// IsNodeInService returns true if the node is in the backend pool and answers
+// on /_status/. The API does not expose the health probe results.
+func (a *Azure) IsNodeInService(ctx context.Context, name string, cfg *drivers.HostConfig) (bool, error) {
+	nic, err := a.getNIC(ctx, name)
+	if err != nil {
+		return false, err
+	}
+	if !nic.inPool(a.backendPoolID()) {
+		return false, nil
+	}
+	return docker.CheckNodeStatus(ctx, a, name, cfg) == nil, nil
+}
+
+// Teardown removes the nodes from the backend pool, deletes the load balancer
+// and its public IP, and removes the cockroach port from the security groups
+// of the remaining nodes. The resource group and everything else belongs to
+// docker-machine and is left alone.
+func (a *Azure) Teardown(ctx context.Context) error {
+	nodes, err := docker.ListCockroachNodes(a.context.Cluster)
+	if err != nil {
+		return util.Errorf("failed to list nodes: %v", err)
+	}
+	// The load balancer cannot be deleted while NICs reference its backend pool.
+	for _, name := range nodes {
+		err := a.setNodeInBackendPool(ctx, name, false)
+		if err != nil && !isNotFound(err) {
+			return util.Errorf("failed to remove node %s from the load balancer: %v", name, err)
+		}
+	}
+
+	deleted, err := a.client.delete(ctx, a.loadBalancerPath(), networkAPIVersion)
+	if err != nil {
+		return util.Errorf("failed to delete load balancer: %v", err)
+	}
+	if deleted {
+		drivers.LogInfof(ctx, "deleted load balancer %s", a.loadBalancerName())
+	} else {
+		drivers.LogInfof(ctx, "load balancer %s not found, skipping", a.loadBalancerName())
+	}
+
+	deleted, err = a.client.delete(ctx, a.publicIPPath(), networkAPIVersion)
+	if err != nil {
+		return util.Errorf("failed to delete public IP: %v", err)
+	}
+	if deleted {
+		drivers.LogInfof(ctx, "deleted public IP %s", a.publicIPName())
+	} else {
+		drivers.LogInfof(ctx, "public IP %s not found, skipping", a.publicIPName())
+	}
+
+	// Remove all cockroach port rules, not just the currently allowed CIDRs:
+	// the list may have changed since they were added.
+	for _, name := range nodes {
+		if err := a.revokeCockroachPort(ctx, name, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReadLock returns the cluster lock stored in a tag on the load balancer.
+// The version is the load balancer etag.
+func (a *Azure) ReadLock() (*drivers.Lock, string, error) {
+	value, etag, found, err := a.getLoadBalancerTag(context.Background(), lockTagKey)
+	if err != nil {
+		return nil, "", err
+	}
+	if !found {
+		return nil, "", drivers.ErrNoLockStore
+	}
+	if value == "" {
+		return nil, etag, nil
+	}
+	lock, err := drivers.DecodeLock(value)
+	return lock, etag, err
+}
+
+// WriteLock stores the cluster lock in a tag on the load balancer if the
+// load balancer etag is still 'version'.
+func (a *Azure) WriteLock(lock *drivers.Lock, version string) error {
+	var value string
+	if lock != nil {
+		var err error
+		if value, err = drivers.EncodeLock(lock); err != nil {
+			return err
+		}
+	}
+	found, err := a.setLoadBalancerTag(context.Background(), lockTagKey, value, version)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return drivers.ErrNoLockStore
+	}
+	return nil
+}
@@ -0,0 +1,459 @@
+// Copyright 2015 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+//
+// Author: Marc Berhault (marc@cockroachlabs.com)
+
+package azure
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/cockroachdb/cockroach-prod/drivers"
+	"github.com/cockroachdb/cockroach/util"
+	"golang.org/x/net/context"
+)
+
+const (
+	cockroachProtocol = "Tcp"
+	// Cluster resources are named <cluster name><suffix>.
+	resourceGroupSuffix   = "-rg"
+	availabilitySetSuffix = "-as"
+	loadBalancerSuffix    = "-lb"
+	publicIPSuffix        = "-lb-ip"
+	// Node resources created by docker-machine are named <node name><suffix>.
+	nicSuffix = "-nic"
+	nsgSuffix = "-firewall"
+	// Child resources of the load balancer.
+	frontendName = "frontend"
+	backendName  = "nodes"
+	probeName    = "cockroach"
+	ruleName     = "cockroach"
+	// Path polled by the load balancer probe.
+	healthCheckPath = "/_status/"
+	// Security rules for the cockroach port are named <prefix><cidr> and
+	// take priorities after the docker-machine rules.
+	securityRulePrefix   = "cockroach-"
+	securityRulePriority = 2000
+	// Virtual machine statuses are <prefix><state>.
+	powerStatePrefix = "PowerState/"
+)
+
+// Names of the cluster resources.
+func (a *Azure) resourceGroupName() string   { return a.context.Cluster + resourceGroupSuffix }
+func (a *Azure) availabilitySetName() string { return a.context.Cluster + availabilitySetSuffix }
+func (a *Azure) loadBalancerName() string    { return a.context.Cluster + loadBalancerSuffix }
+func (a *Azure) publicIPName() string        { return a.context.Cluster + publicIPSuffix }
+
+// networkPath returns the path of a network resource, relative to the subscription.
+func (a *Azure) networkPath(kind, name string) string {
+	return fmt.Sprintf("/resourceGroups/%s/providers/Microsoft.Network/%s/%s", a.resourceGroupName(), kind, name)
+}
+
+// vmPath returns the path of a node's virtual machine, relative to the subscription.
+func (a *Azure) vmPath(name string) string {
+	return fmt.Sprintf("/resourceGroups/%s/providers/Microsoft.Compute/virtualMachines/%s",
+		a.resourceGroupName(), name)
+}
+
+// Paths of the cluster and node resources, relative to the subscription.
+func (a *Azure) loadBalancerPath() string {
+	return a.networkPath("loadBalancers", a.loadBalancerName())
+}
+
+func (a *Azure) publicIPPath() string {
+	return a.networkPath("publicIPAddresses", a.publicIPName())
+}
+
+func (a *Azure) nicPath(name string) string {
+	return a.networkPath("networkInterfaces", name+nicSuffix)
+}
+
+func (a *Azure) securityRulesPath(name string) string {
+	return a.networkPath("networkSecurityGroups", name+nsgSuffix) + "/securityRules"
+}
+
+func (a *Azure) securityRulePath(name, cidr string) string {
+	return a.securityRulesPath(name) + "/" + securityRuleName(cidr)
+}
+
+// backendPoolID returns the ID of the load balancer backend pool.
+func (a *Azure) backendPoolID() string {
+	return a.client.resourceID(a.loadBalancerPath()) + "/backendAddressPools/" + backendName
+}
+
+// securityRuleName returns the name of the security rule for the given CIDR.
+// Rule names cannot contain '/'.
+func securityRuleName(cidr string) string {
+	return securityRulePrefix + strings.Replace(cidr, "/", "_", -1)
+}
+
+// subResource is a reference to another resource.
+type subResource struct {
+	ID string `json:"id"`
+}
+
+// networkInterface describes the fields of a node's NIC used here.
+type networkInterface struct {
+	Properties struct {
+		IPConfigurations []struct {
+			Properties struct {
+				PrivateIPAddress                string        `json:"privateIPAddress"`
+				LoadBalancerBackendAddressPools []subResource `json:"loadBalancerBackendAddressPools"`
+			} `json:"properties"`
+		} `json:"ipConfigurations"`
+	} `json:"properties"`
+}
+
+// getNIC looks up the network interface of a node.
+func (a *Azure) getNIC(ctx context.Context, name string) (*networkInterface, error) {
+	nic := &networkInterface{}
+	if err := a.client.do(ctx, "GET", a.nicPath(name), networkAPIVersion, nil, nic); err != nil {
+		return nil, err
+	}
+	if len(nic.Properties.IPConfigurations) == 0 {
+		return nil, util.Errorf("network interface %s%s has no IP configuration", name, nicSuffix)
+	}
+	return nic, nil
+}
+
+// privateIPAddress returns the private IP address of the NIC.
+func (nic *networkInterface) privateIPAddress() string {
+	return nic.Properties.IPConfigurations[0].Properties.PrivateIPAddress
+}
+
+// inPool returns true if the NIC is in the given backend pool.
+func (nic *networkInterface) inPool(poolID string) bool {
+	for _, pool := range nic.Properties.IPConfigurations[0].Properties.LoadBalancerBackendAddressPools {
+		if sameID(pool.ID, poolID) {
+			return true
+		}
+	}
+	return false
+}
+
+// setNodeInBackendPool adds the node's NIC to the load balancer backend pool,
+// or removes it. Backend pool membership is a property of the NIC.
+// We edit the NIC as a generic JSON object: the whole resource is sent back.
+func (a *Azure) setNodeInBackendPool(ctx context.Context, name string, in bool) error {
+	var nic map[string]interface{}
+	if err := a.client.do(ctx, "GET", a.nicPath(name), networkAPIVersion, nil, &nic); err != nil {
+		return err
+	}
+	props, _ := nic["properties"].(map[string]interface{})
+	ipConfigs, _ := props["ipConfigurations"].([]interface{})
+	if len(ipConfigs) == 0 {
+		return util.Errorf("network interface %s%s has no IP configuration", name, nicSuffix)
+	}
+	ipConfig, _ := ipConfigs[0].(map[string]interface{})
+	ipProps, _ := ipConfig["properties"].(map[string]interface{})
+	if ipProps == nil {
+		return util.Errorf("network interface %s%s has an invalid IP configuration", name, nicSuffix)
+	}
+
+	poolID := a.backendPoolID()
+	pools, _ := ipProps["loadBalancerBackendAddressPools"].([]interface{})
+	found := false
+	newPools := []interface{}{}
+	for _, p := range pools {
+		pool, _ := p.(map[string]interface{})
+		if id, _ := pool["id"].(string); sameID(id, poolID) {
+			found = true
+			if !in {
+				continue
+			}
+		}
+		newPools = append(newPools, p)
+	}
+	if found == in {
+		return nil
+	}
+	if in {
+		newPools = append(newPools, subResource{ID: poolID})
+	}
+	ipProps["loadBalancerBackendAddressPools"] = newPools
+	return a.client.put(ctx, a.nicPath(name), networkAPIVersion, nic)
+}
+
+// addCockroachSecurityRule allows the cockroach port from the given CIDR in
+// the node's network security group. docker-machine creates one per node.
+// Rules are created or updated in place, so this can be called repeatedly.
+func (a *Azure) addCockroachSecurityRule(ctx context.Context, name, cidr string, index int) error {
+	rule := map[string]interface{}{
+		"properties": map[string]interface{}{
+			"protocol":                 cockroachProtocol,
+			"sourceAddressPrefix":      cidr,
+			"sourcePortRange":          "*",
+			"destinationAddressPrefix": "*",
+			"destinationPortRange":     fmt.Sprintf("%d", a.context.Port),
+			"access":                   "Allow",
+			"direction":                "Inbound",
+			"priority":                 securityRulePriority + index,
+		},
+	}
+	return a.client.put(ctx, a.securityRulePath(name, cidr), networkAPIVersion, rule)
+}
+
+// removeCockroachSecurityRule removes the rule for the given CIDR from the
+// node's network security group. Returns false if it did not exist.
+func (a *Azure) removeCockroachSecurityRule(ctx context.Context, name, cidr string) (bool, error) {
+	return a.client.delete(ctx, a.securityRulePath(name, cidr), networkAPIVersion)
+}
+
+// listCockroachSecurityRules returns the CIDRs of all cockroach port rules in
+// the node's network security group, including those added with a different
+// list of allowed CIDRs.
+func (a *Azure) listCockroachSecurityRules(ctx context.Context, name string) ([]string, error) {
+	var rules struct {
+		Value []struct {
+			Name       string `json:"name"`
+			Properties struct {
+				SourceAddressPrefix  string `json:"sourceAddressPrefix"`
+				DestinationPortRange string `json:"destinationPortRange"`
+			} `json:"properties"`
+		} `json:"value"`
+	}
+	if err := a.client.do(ctx, "GET", a.securityRulesPath(name), networkAPIVersion, nil, &rules); err != nil {
+		return nil, err
+	}
+
+	port := fmt.Sprintf("%d", a.context.Port)
+	cidrs := []string{}
+	for _, rule := range rules.Value {
+		if strings.HasPrefix(rule.Name, securityRulePrefix) && rule.Properties.DestinationPortRange == port {
+			cidrs = append(cidrs, rule.Properties.SourceAddressPrefix)
+		}
+	}
+	return cidrs, nil
+}
+
+// revokeCockroachPort removes all cockroach port rules from the node's
+// network security group. If 'keep' is not nil, rules for CIDRs in it are
+// left alone.
+func (a *Azure) revokeCockroachPort(ctx context.Context, name string, keep map[string]bool) error {
+	cidrs, err := a.listCockroachSecurityRules(ctx, name)
+	if err != nil {
+		return util.Errorf("failed to list security rules of node %s: %v", name, err)
+	}
+	for _, cidr := range cidrs {
+		if keep[cidr] {
+			continue
+		}
+		removed, err := a.removeCockroachSecurityRule(ctx, name, cidr)
+		if err != nil {
+			return util.Errorf("failed to remove security rule for %s from node %s: %v", cidr, name, err)
+		}
+		if removed {
+			drivers.LogInfof(ctx, "removed port %d rule for %s from node %s", a.context.Port, cidr, name)
+		} else {
+			drivers.LogInfof(ctx, "port %d rule for %s not found on node %s, skipping", a.context.Port, cidr, name)
+		}
+	}
+	return nil
+}
+
+// allowCockroachPort adds the security rules for all allowed CIDRs to the
+// node's network security group, and removes rules for other CIDRs. Stale
+// rules are removed first as they may hold the priorities of the new ones.
+func (a *Azure) allowCockroachPort(ctx context.Context, name string) error {
+	allowed := map[string]bool{}
+	for _, cidr := range a.context.AllowedCIDRList() {
+		allowed[cidr] = true
+	}
+	if err := a.revokeCockroachPort(ctx, name, allowed); err != nil {
+		return err
+	}
+
+	for i, cidr := range a.context.AllowedCIDRList() {
+		drivers.LogInfof(ctx, "adding security rule for %s to node %s", cidr, name)
+		if err := a.addCockroachSecurityRule(ctx, name, cidr, i); err != nil {
+			return util.Errorf("failed to add security rule for %s to node %s: %v", cidr, name, err)
+		}
+	}
+	return nil
+}
+
+// findPublicIPAddress returns the address of the load balancer public IP,
+// or "" if it does not exist.
+func (a *Azure) findPublicIPAddress(ctx context.Context) (string, error) {
+	var ip struct {
+		Properties struct {
+			IPAddress string `json:"ipAddress"`
+		} `json:"properties"`
+	}
+	err := a.client.do(ctx, "GET", a.publicIPPath(), networkAPIVersion, nil, &ip)
+	if isNotFound(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return ip.Properties.IPAddress, nil
+}
+
+// findLoadBalancer returns true if the load balancer exists.
+func (a *Azure) findLoadBalancer(ctx context.Context) (bool, error) {
+	err := a.client.do(ctx, "GET", a.loadBalancerPath(), networkAPIVersion, nil, nil)
+	if isNotFound(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// findOrCreateLoadBalancer creates the load balancer and its public IP if
+// they do not exist. The health probe requests the status endpoint in
+// insecure mode: HTTPS probes are not supported, so secure nodes are probed
+// on the TCP port.
+func (a *Azure) findOrCreateLoadBalancer(ctx context.Context) error {
+	found, err := a.findLoadBalancer(ctx)
+	if err != nil {
+		return err
+	}
+	if found {
+		drivers.LogInfof(ctx, "found load balancer %s", a.loadBalancerName())
+		return nil
+	}
+
+	drivers.LogInfof(ctx, "creating public IP %s", a.publicIPName())
+	err = a.client.put(ctx, a.publicIPPath(), networkAPIVersion, map[string]interface{}{
+		"location": a.region,
+		"properties": map[string]interface{}{
+			"publicIPAllocationMethod": "Static",
+		},
+	})
+	if err != nil {
+		return util.Errorf("failed to create public IP: %v", err)
+	}
+
+	lbID := a.client.resourceID(a.loadBalancerPath())
+	probe := map[string]interface{}{
+		"protocol":          cockroachProtocol,
+		"port":              a.context.Port,
+		"intervalInSeconds": 5,
+		"numberOfProbes":    2,
+	}
+	if a.context.Insecure {
+		probe["protocol"] = "Http"
+		probe["requestPath"] = healthCheckPath
+	}
+
+	drivers.LogInfof(ctx, "creating load balancer %s", a.loadBalancerName())
+	err = a.client.put(ctx, a.loadBalancerPath(), networkAPIVersion, map[string]interface{}{
+		"location": a.region,
+		"properties": map[string]interface{}{
+			"frontendIPConfigurations": []interface{}{
+				map[string]interface{}{
+					"name": frontendName,
+					"properties": map[string]interface{}{
+						"publicIPAddress": subResource{ID: a.client.resourceID(a.publicIPPath())},
+					},
+				},
+			},
+			"backendAddressPools": []interface{}{
+				map[string]interface{}{"name": backendName},
+			},
+			"probes": []interface{}{
+				map[string]interface{}{"name": probeName, "properties": probe},
+			},
+			"loadBalancingRules": []interface{}{
+				map[string]interface{}{
+					"name": ruleName,
+					"properties": map[string]interface{}{
+						"frontendIPConfiguration": subResource{ID: lbID + "/frontendIPConfigurations/" + frontendName},
+						"backendAddressPool":      subResource{ID: a.backendPoolID()},
+						"probe":                   subResource{ID: lbID + "/probes/" + probeName},
+						"protocol":                cockroachProtocol,
+						"frontendPort":            a.context.Port,
+						"backendPort":             a.context.Port,
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		return util.Errorf("failed to create load balancer: %v", err)
+	}
+	return nil
+}
+
+// getLoadBalancerTag returns the value of a tag on the load balancer and the
+// load balancer etag. found is false if the load balancer does not exist.
+func (a *Azure) getLoadBalancerTag(ctx context.Context, key string) (value, etag string, found bool, err error) {
+	var lb struct {
+		Etag string            `json:"etag"`
+		Tags map[string]string `json:"tags"`
+	}
+	err = a.client.do(ctx, "GET", a.loadBalancerPath(), networkAPIVersion, nil, &lb)
+	if isNotFound(err) {
+		return "", "", false, nil
+	}
+	if err != nil {
+		return "", "", false, err
+	}
+	return lb.Tags[key], lb.Etag, true, nil
+}
+
+// setLoadBalancerTag sets a tag on the load balancer, or removes it if value
+// is empty. The update only happens if the load balancer etag is still
+// 'etag', as returned by getLoadBalancerTag: drivers.ErrLockChanged is
+// returned otherwise. Returns false if the load balancer does not exist.
+func (a *Azure) setLoadBalancerTag(ctx context.Context, key, value, etag string) (bool, error) {
+	var lb map[string]interface{}
+	err := a.client.do(ctx, "GET", a.loadBalancerPath(), networkAPIVersion, nil, &lb)
+	if isNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if current, _ := lb["etag"].(string); current != etag {
+		return true, drivers.ErrLockChanged
+	}
+	tags, _ := lb["tags"].(map[string]interface{})
+	if tags == nil {
+		tags = map[string]interface{}{}
+	}
+	if value == "" {
+		delete(tags, key)
+	} else {
+		tags[key] = value
+	}
+	lb["tags"] = tags
+	err = a.client.putIfMatch(ctx, a.loadBalancerPath(), networkAPIVersion, lb, etag)
+	if isPreconditionFailed(err) {
+		return true, drivers.ErrLockChanged
+	}
+	return true, err
+}
+
+// getPowerState returns the power state of a node's virtual machine, eg:
+// "running" or "deallocated".
+func (a *Azure) getPowerState(name string) (string, error) {
+	var view struct {
+		Statuses []struct {
+			Code string `json:"code"`
+		} `json:"statuses"`
+	}
+	err := a.client.do(context.Background(), "GET", a.vmPath(name)+"/instanceView", computeAPIVersion, nil, &view)
+	if err != nil {
+		return "", err
+	}
+	for _, status := range view.Statuses {
+		if strings.HasPrefix(status.Code, powerStatePrefix) {
+			return strings.TrimPrefix(status.Code, powerStatePrefix), nil
+		}
+	}
+	return "", nil
+}
@@ -0,0 +1,120 @@
+// Copyright 2015 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+//
+// Author: Marc Berhault (marc@cockroachlabs.com)
+
+package digitalocean
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/cockroachdb/cockroach-prod/drivers"
+	"golang.org/x/net/context"
+)
+
+const apiEndpoint = "https://api.digitalocean.com/v2"
+
+// apiError is an error returned by the DigitalOcean API.
+type apiError struct {
+	StatusCode int
+	ID         string
+	Message    string
+}
+
+func (err *apiError) Error() string {
+	return fmt.Sprintf("%d %s: %s", err.StatusCode, err.ID, err.Message)
+}
+
+// isNotFound returns true if the error is a 404 returned by the API.
+func isNotFound(err error) bool {
+	apiErr, ok := err.(*apiError)
+	return ok && apiErr.StatusCode == http.StatusNotFound
+}
+
+// isRetryable returns true if err is a rate-limit or server error.
+func isRetryable(err error) bool {
+	apiErr, ok := err.(*apiError)
+	return ok && (apiErr.StatusCode == http.StatusTooManyRequests ||
+		apiErr.StatusCode >= http.StatusInternalServerError)
+}
+
+// client calls the DigitalOcean API with an access token.
+type client struct {
+	token string
+	// Options for retrying API calls and polling resources, from the driver.
+	apiRetryOptions drivers.RetryOptions
+	pollOptions     drivers.RetryOptions
+}
+
+// do sends a request to the API, retrying rate-limit and server errors.
+// 'path' is relative to the API endpoint, in and out are JSON encoded and
+// decoded if not nil.
+func (c *client) do(ctx context.Context, method, path string, in, out interface{}) error {
+	var payload []byte
+	if in != nil {
+		var err error
+		if payload, err = json.Marshal(in); err != nil {
+			return err
+		}
+	}
+	return drivers.Retry(ctx, c.apiRetryOptions, fmt.Sprintf("%s %s", method, path), func() error {
+		var body io.Reader
+		if payload != nil {
+			body = bytes.NewReader(payload)
+		}
+		req, err := http.NewRequest(method, apiEndpoint+path, body)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+c.token)
+		if payload != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		respBody, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode >= http.StatusBadRequest {
+			return newAPIError(resp.StatusCode, respBody)
+		}
+		if out == nil || len(respBody) == 0 {
+			return nil
+		}
+		return json.Unmarshal(respBody, out)
+	})
+}
+
+// newAPIError parses the error returned by the API.
+func newAPIError(statusCode int, body []byte) error {
+	var resp struct {
+		ID      string `json:"id"`
+		Message string `json:"message"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil || resp.ID == "" {
+		return &apiError{StatusCode: statusCode, ID: http.StatusText(statusCode), Message: string(body)}
+	}
+	return &apiError{StatusCode: statusCode, ID: resp.ID, Message: resp.Message}
+}
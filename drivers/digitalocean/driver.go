@@ -0,0 +1,362 @@
+// Copyright 2015 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+//
+// Author: Marc Berhault (marc@cockroachlabs.com)
+
+package digitalocean
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/cockroachdb/cockroach-prod/base"
+	"github.com/cockroachdb/cockroach-prod/docker"
+	"github.com/cockroachdb/cockroach-prod/drivers"
+	"github.com/cockroachdb/cockroach/util"
+	"github.com/cockroachdb/cockroach/util/log"
+	"golang.org/x/net/context"
+)
+
+const (
+	dockerMachineDriverName = "digitalocean"
+	digitalOceanCertsDir    = "/root/certs"
+	digitalOceanDataDir     = "/root/data"
+	// Environment variable holding the access token, also used by docker-machine.
+	accessTokenEnv = "DIGITALOCEAN_ACCESS_TOKEN"
+)
+
+// DigitalOcean implements a driver for DigitalOcean.
+type DigitalOcean struct {
+	context *base.Context
+	region  string
+	// Options for retrying API calls and polling resources.
+	apiRetryOptions drivers.RetryOptions
+	pollOptions     drivers.RetryOptions
+
+	// Created at Init() time.
+	// Methods for droplets, the load balancer and the firewall can be found in resources.go
+	client *client
+}
+
+// config contains the digitalocean-specific fields of the docker-machine config.
+// Not all are specified, only those used here.
+// Implements drivers.DriverConfig.
+type config struct {
+	DropletID       int
+	PublicIPAddress string `json:"IPAddress"`
+
+	// Fields not saved by docker-machine. We look them up.
+	privateIPAddress    string
+	loadBalancerAddress string
+}
+
+// DataDir returns the data directory.
+func (cfg *config) DataDir() string {
+	return digitalOceanDataDir
+}
+
+// CertsDir returns the certificates directory.
+func (cfg *config) CertsDir() string {
+	return digitalOceanCertsDir
+}
+
+// IPAddress returns the private networking IP address we will listen on.
+func (cfg *config) IPAddress() string {
+	return cfg.privateIPAddress
+}
+
+// GossipAddress returns the address for the gossip network.
+func (cfg *config) GossipAddress() string {
+	return cfg.loadBalancerAddress
+}
+
+// NewDriver returns an initialized DigitalOcean driver.
+// The region is a DigitalOcean region slug, eg: nyc3.
+func NewDriver(context *base.Context, region string) *DigitalOcean {
+	return &DigitalOcean{
+		context:         context,
+		region:          region,
+		apiRetryOptions: drivers.APIRetryOptions(context, isRetryable),
+		pollOptions:     drivers.OperationPollOptions(context, isRetryable),
+	}
+}
+
+// Context returns the base context.
+func (d *DigitalOcean) Context() *base.Context {
+	return d.context
+}
+
+// DockerMachineDriver returns the name of the docker-machine driver.
+func (d *DigitalOcean) DockerMachineDriver() string {
+	return dockerMachineDriverName
+}
+
+// Init looks for the access token and checks that it is valid.
+func (d *DigitalOcean) Init() error {
+	if d.context.Zone != "" {
+		return base.ValidationErrorf("zones are not supported on DigitalOcean, got --zone=%s", d.context.Zone)
+	}
+
+	token := d.context.DOAccessToken
+	if token == "" {
+		token = os.Getenv(accessTokenEnv)
+	}
+	if token == "" {
+		return base.ValidationErrorf("--do-access-token or %s must be set", accessTokenEnv)
+	}
+	// docker-machine reads the token from the environment: on its command
+	// line, the token would be visible to other local users and in our logs.
+	if err := os.Setenv(accessTokenEnv, token); err != nil {
+		return base.NewError(base.UnknownError, err, "setting %s", accessTokenEnv)
+	}
+	d.client = &client{token: token, apiRetryOptions: d.apiRetryOptions, pollOptions: d.pollOptions}
+
+	var resp struct {
+		Account struct {
+			Email string `json:"email"`
+		} `json:"account"`
+	}
+	if err := d.client.do(context.Background(), "GET", "/account", nil, &resp); err != nil {
+		return base.NewError(base.CredentialsError, err, "checking DigitalOcean access token")
+	}
+	log.Infof("validated DigitalOcean account: %s", resp.Account.Email)
+	return nil
+}
+
+// DockerMachineCreateArgs returns the list of driver-specific arguments
+// to pass to 'docker-machine create'. The access token is passed in the
+// environment, see Init.
+func (d *DigitalOcean) DockerMachineCreateArgs(name string) ([]string, error) {
+	return []string{
+		"--digitalocean-region", d.region,
+		"--digitalocean-private-networking",
+	}, nil
+}
+
+// GetStatus looks up the load balancer and the firewall.
+func (d *DigitalOcean) GetStatus() *drivers.ClusterStatus {
+	status := &drivers.ClusterStatus{
+		Driver: dockerMachineDriverName,
+		Region: d.region,
+	}
+
+	lb, err := d.findLoadBalancer(context.Background())
+	if err != nil {
+		status.Errors = append(status.Errors, fmt.Sprintf("load balancer: %v", err))
+	} else if lb != nil && lb.IP != "" {
+		status.LoadBalancerAddress = fmt.Sprintf("%s:%d", lb.IP, d.context.Port)
+	}
+
+	fw, err := d.findFirewall(context.Background())
+	if err != nil {
+		status.Errors = append(status.Errors, fmt.Sprintf("firewall: %v", err))
+	} else if fw != nil {
+		status.Firewall = fw.Name
+		status.AllowedCIDRs = fw.allowedCIDRs(d.context.Port)
+	}
+	return status
+}
+
+// GetNodeStatus looks up the droplet and its load balancer membership.
+func (d *DigitalOcean) GetNodeStatus(name string, cfg *drivers.HostConfig, status *drivers.NodeStatus) {
+	dropletID := cfg.Driver.(*config).DropletID
+	status.InstanceID = fmt.Sprintf("%d", dropletID)
+
+	dr, err := d.getDroplet(context.Background(), dropletID)
+	if err != nil {
+		status.Errors = append(status.Errors, fmt.Sprintf("droplet: %v", err))
+	} else {
+		status.InstanceState = dr.Status
+		status.InternalIP = dr.ipAddress("private")
+		status.ExternalIP = dr.ipAddress("public")
+		status.Zone = dr.Region.Slug
+	}
+
+	lb, err := d.getLoadBalancer(context.Background())
+	if err != nil {
+		status.Errors = append(status.Errors, fmt.Sprintf("load balancer: %v", err))
+		return
+	}
+	status.InLoadBalancer = lb.hasDroplet(dropletID)
+	if status.InLoadBalancer {
+		status.InService, err = d.IsNodeInService(context.Background(), name, cfg)
+		if err != nil {
+			status.Errors = append(status.Errors, fmt.Sprintf("load balancer health: %v", err))
+		}
+	}
+}
+
+// GetInstanceState looks up the droplet status.
+func (d *DigitalOcean) GetInstanceState(name string, cfg *drivers.HostConfig) (drivers.InstanceState, error) {
+	dr, err := d.getDroplet(context.Background(), cfg.Driver.(*config).DropletID)
+	if isNotFound(err) {
+		return drivers.InstanceMissing, nil
+	}
+	if err != nil {
+		return drivers.InstanceUnknown, err
+	}
+	switch dr.Status {
+	case "active":
+		return drivers.InstanceRunning, nil
+	case "off":
+		return drivers.InstanceStopped, nil
+	case "new":
+		return drivers.InstancePending, nil
+	case "archive":
+		return drivers.InstanceMissing, nil
+	}
+	return drivers.InstanceUnknown, nil
+}
+
+// LoadBalancerAddress returns the IP address of the load balancer.
+func (d *DigitalOcean) LoadBalancerAddress() (string, error) {
+	lb, err := d.getLoadBalancer(context.Background())
+	if err != nil {
+		return "", err
+	}
+	if lb.IP == "" {
+		return "", util.Errorf("load balancer %s has no IP address yet", d.loadBalancerName())
+	}
+	return lb.IP, nil
+}
+
+// GetNodeConfig takes a node name and reads its docker-machine config.
+// The private IP address and load balancer address are looked up and filled in.
+func (d *DigitalOcean) GetNodeConfig(name string) (*drivers.HostConfig, error) {
+	cfg := &drivers.HostConfig{
+		Driver: &config{},
+	}
+
+	// Parse the config file.
+	err := docker.GetHostConfig(name, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	// docker-machine saves the public IP address only.
+	driverCfg := cfg.Driver.(*config)
+	dr, err := d.getDroplet(context.Background(), driverCfg.DropletID)
+	if err != nil {
+		return nil, util.Errorf("could not lookup droplet %d: %v", driverCfg.DropletID, err)
+	}
+	driverCfg.privateIPAddress = dr.ipAddress("private")
+	if driverCfg.privateIPAddress == "" {
+		return nil, util.Errorf("droplet %d does not have private networking enabled", driverCfg.DropletID)
+	}
+
+	address, err := d.LoadBalancerAddress()
+	if err != nil {
+		return nil, util.Errorf("could not find load balancer: %v", err)
+	}
+	driverCfg.loadBalancerAddress = address
+	return cfg, nil
+}
+
+// AfterFirstNode creates the load balancer and waits for it to be active,
+// then sets up the firewall and applies it to the existing droplets.
+// It is also used to converge the firewall rules on the allowed CIDRs.
+func (d *DigitalOcean) AfterFirstNode(ctx context.Context) error {
+	lb, err := d.findOrCreateLoadBalancer(ctx)
+	if err != nil {
+		return util.Errorf("failed to create load balancer: %v", err)
+	}
+	if err := d.setupFirewall(ctx, lb.ID); err != nil {
+		return util.Errorf("failed to set up firewall: %v", err)
+	}
+	return d.tagAllDroplets(ctx)
+}
+
+// PrepareNode tags the droplet, applying the firewall to it. Data is stored
+// on the droplet disk.
+func (d *DigitalOcean) PrepareNode(ctx context.Context, name string, cfg *drivers.HostConfig, created bool) error {
+	if err := d.tagDroplet(ctx, cfg.Driver.(*config).DropletID); err != nil {
+		return util.Errorf("failed to tag droplet of node %s: %v", name, err)
+	}
+	return nil
+}
+
+// AfterNodeRemoved does nothing: the load balancer drops deleted droplets.
+func (d *DigitalOcean) AfterNodeRemoved(ctx context.Context, name string) error {
+	return nil
+}
+
+// StartNode adds the droplet to the load balancer.
+func (d *DigitalOcean) StartNode(ctx context.Context, name string, cfg *drivers.HostConfig) error {
+	drivers.LogInfof(ctx, "adding node %s to load balancer", name)
+	err := d.addDropletToLoadBalancer(ctx, cfg.Driver.(*config).DropletID)
+	if err != nil {
+		return util.Errorf("failed to add node %s (%+v) to load balancer: %v", name, cfg, err)
+	}
+	return nil
+}
+
+// StopNode removes the droplet from the load balancer.
+func (d *DigitalOcean) StopNode(ctx context.Context, name string, cfg *drivers.HostConfig) error {
+	drivers.LogInfof(ctx, "removing node %s from load balancer", name)
+	err := d.removeDropletFromLoadBalancer(ctx, cfg.Driver.(*config).DropletID)
+	if err != nil {
+		return util.Errorf("failed to remove node %s (%+v) from load balancer: %v", name, cfg, err)
+	}
+	return nil
+}
+
+// IsNodeInService returns true if the droplet is a load balancer target and
+// answers on /_status/. The API does not expose the health check results.
+func (d *DigitalOcean) IsNodeInService(ctx context.Context, name string, cfg *drivers.HostConfig) (bool, error) {
+	lb, err := d.getLoadBalancer(ctx)
+	if err != nil {
+		return false, err
+	}
+	if !lb.hasDroplet(cfg.Driver.(*config).DropletID) {
+		return false, nil
+	}
+	return docker.CheckNodeStatus(ctx, d, name, cfg) == nil, nil
+}
+
+// Teardown deletes the firewall and the load balancer.
+func (d *DigitalOcean) Teardown(ctx context.Context) error {
+	deleted, err := d.deleteFirewall(ctx)
+	if err != nil {
+		return util.Errorf("failed to delete firewall: %v", err)
+	}
+	if deleted {
+		drivers.LogInfof(ctx, "deleted firewall %s", d.firewallName())
+	} else {
+		drivers.LogInfof(ctx, "firewall %s not found, skipping", d.firewallName())
+	}
+
+	deleted, err = d.deleteLoadBalancer(ctx)
+	if err != nil {
+		return util.Errorf("failed to delete load balancer: %v", err)
+	}
+	if deleted {
+		drivers.LogInfof(ctx, "deleted load balancer %s", d.loadBalancerName())
+	} else {
+		drivers.LogInfof(ctx, "load balancer %s not found, skipping", d.loadBalancerName())
+	}
+	return nil
+}
+
+// ReadLock returns ErrNoLockStore: load balancers cannot be tagged, the
+// cluster lock is kept in the local state directory.
+func (d *DigitalOcean) ReadLock() (*drivers.Lock, string, error) {
+	return nil, "", drivers.ErrNoLockStore
+}
+
+// WriteLock returns ErrNoLockStore: load balancers cannot be tagged, the
+// cluster lock is kept in the local state directory.
+func (d *DigitalOcean) WriteLock(lock *drivers.Lock, version string) error {
+	return drivers.ErrNoLockStore
+}
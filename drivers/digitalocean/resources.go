@@ -0,0 +1,468 @@
+// Copyright 2015 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+//
+// Author: Marc Berhault (marc@cockroachlabs.com)
+
+package digitalocean
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+
+	"github.com/cockroachdb/cockroach-prod/docker"
+	"github.com/cockroachdb/cockroach-prod/drivers"
+	"github.com/cockroachdb/cockroach/util"
+	"golang.org/x/net/context"
+)
+
+const (
+	cockroachProtocol = "tcp"
+	// Cluster resources are named <cluster name><suffix>.
+	loadBalancerSuffix = "-lb"
+	firewallSuffix     = "-firewall"
+	// The firewall applies to droplets with the <cluster name><suffix> tag.
+	tagSuffix = "-nodes"
+	// Path polled by the load balancer health check.
+	healthCheckPath = "/_status/"
+	// Ports used by docker-machine: SSH and the docker daemon (TLS authenticated).
+	sshPort          = 22
+	dockerDaemonPort = 2376
+	// Status of a load balancer ready to serve traffic.
+	loadBalancerActive = "active"
+	// Number of resources per page when listing.
+	listPageSize = 200
+)
+
+// anywhere lists the IPv4 and IPv6 addresses of firewall rules open to all.
+var anywhere = []string{"0.0.0.0/0", "::/0"}
+
+// Names of the cluster resources.
+func (d *DigitalOcean) loadBalancerName() string { return d.context.Cluster + loadBalancerSuffix }
+func (d *DigitalOcean) firewallName() string     { return d.context.Cluster + firewallSuffix }
+func (d *DigitalOcean) tagName() string          { return d.context.Cluster + tagSuffix }
+
+// findInList requests the pages of 'collection' (eg: "/load_balancers") until
+// 'found' returns true. 'found' decodes the page.
+func (d *DigitalOcean) findInList(ctx context.Context, collection string,
+	found func(page json.RawMessage) (bool, error)) error {
+	path := fmt.Sprintf("%s?per_page=%d", collection, listPageSize)
+	for path != "" {
+		var page json.RawMessage
+		if err := d.client.do(ctx, "GET", path, nil, &page); err != nil {
+			return err
+		}
+		if ok, err := found(page); ok || err != nil {
+			return err
+		}
+
+		var resp struct {
+			Links struct {
+				Pages struct {
+					Next string `json:"next"`
+				} `json:"pages"`
+			} `json:"links"`
+		}
+		if err := json.Unmarshal(page, &resp); err != nil {
+			return err
+		}
+		path = ""
+		if next := resp.Links.Pages.Next; next != "" {
+			// The next page is given as a full URL.
+			u, err := url.Parse(next)
+			if err != nil {
+				return util.Errorf("invalid next page %q: %v", next, err)
+			}
+			path = collection + "?" + u.RawQuery
+		}
+	}
+	return nil
+}
+
+// droplet describes the fields of a droplet used here.
+type droplet struct {
+	ID       int    `json:"id"`
+	Name     string `json:"name"`
+	Status   string `json:"status"`
+	Networks struct {
+		V4 []struct {
+			IPAddress string `json:"ip_address"`
+			Type      string `json:"type"`
+		} `json:"v4"`
+	} `json:"networks"`
+	Region struct {
+		Slug string `json:"slug"`
+	} `json:"region"`
+}
+
+// ipAddress returns the droplet's IPv4 address of the given type: "public"
+// or "private". Returns "" if it has none.
+func (dr *droplet) ipAddress(networkType string) string {
+	for _, network := range dr.Networks.V4 {
+		if network.Type == networkType {
+			return network.IPAddress
+		}
+	}
+	return ""
+}
+
+// getDroplet looks up a droplet by ID.
+func (d *DigitalOcean) getDroplet(ctx context.Context, dropletID int) (*droplet, error) {
+	var resp struct {
+		Droplet *droplet `json:"droplet"`
+	}
+	if err := d.client.do(ctx, "GET", fmt.Sprintf("/droplets/%d", dropletID), nil, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Droplet, nil
+}
+
+// loadBalancer describes the fields of a load balancer used here.
+type loadBalancer struct {
+	ID         string `json:"id"`
+	Name       string `json:"name"`
+	IP         string `json:"ip"`
+	Status     string `json:"status"`
+	DropletIDs []int  `json:"droplet_ids"`
+}
+
+// hasDroplet returns true if the droplet is a target of the load balancer.
+func (lb *loadBalancer) hasDroplet(dropletID int) bool {
+	for _, id := range lb.DropletIDs {
+		if id == dropletID {
+			return true
+		}
+	}
+	return false
+}
+
+// findLoadBalancer looks up the cluster's load balancer by name. Returns nil
+// if it does not exist.
+func (d *DigitalOcean) findLoadBalancer(ctx context.Context) (*loadBalancer, error) {
+	var found *loadBalancer
+	err := d.findInList(ctx, "/load_balancers", func(page json.RawMessage) (bool, error) {
+		var resp struct {
+			LoadBalancers []*loadBalancer `json:"load_balancers"`
+		}
+		if err := json.Unmarshal(page, &resp); err != nil {
+			return false, err
+		}
+		for _, lb := range resp.LoadBalancers {
+			if lb.Name == d.loadBalancerName() {
+				found = lb
+				return true, nil
+			}
+		}
+		return false, nil
+	})
+	return found, err
+}
+
+// getLoadBalancer looks up the cluster's load balancer and fails if it does
+// not exist.
+func (d *DigitalOcean) getLoadBalancer(ctx context.Context) (*loadBalancer, error) {
+	lb, err := d.findLoadBalancer(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if lb == nil {
+		return nil, util.Errorf("load balancer %s not found", d.loadBalancerName())
+	}
+	return lb, nil
+}
+
+// findOrCreateLoadBalancer creates the load balancer if it does not exist,
+// and waits for it to be active. The health check requests the status
+// endpoint in insecure mode: HTTPS health checks are not supported, so secure
+// nodes are checked on the TCP port.
+func (d *DigitalOcean) findOrCreateLoadBalancer(ctx context.Context) (*loadBalancer, error) {
+	lb, err := d.findLoadBalancer(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if lb != nil {
+		drivers.LogInfof(ctx, "found load balancer %s: %s", d.loadBalancerName(), lb.ID)
+	} else {
+		healthCheck := map[string]interface{}{
+			"protocol":                 cockroachProtocol,
+			"port":                     d.context.Port,
+			"check_interval_seconds":   10,
+			"response_timeout_seconds": 5,
+			"healthy_threshold":        2,
+			"unhealthy_threshold":      2,
+		}
+		if d.context.Insecure {
+			healthCheck["protocol"] = "http"
+			healthCheck["path"] = healthCheckPath
+		}
+
+		var resp struct {
+			LoadBalancer *loadBalancer `json:"load_balancer"`
+		}
+		err := d.client.do(ctx, "POST", "/load_balancers", map[string]interface{}{
+			"name":   d.loadBalancerName(),
+			"region": d.region,
+			"forwarding_rules": []interface{}{
+				map[string]interface{}{
+					"entry_protocol":  cockroachProtocol,
+					"entry_port":      d.context.Port,
+					"target_protocol": cockroachProtocol,
+					"target_port":     d.context.Port,
+				},
+			},
+			"health_check": healthCheck,
+		}, &resp)
+		if err != nil {
+			return nil, err
+		}
+		lb = resp.LoadBalancer
+		drivers.LogInfof(ctx, "created load balancer %s: %s", d.loadBalancerName(), lb.ID)
+	}
+
+	// The IP address is assigned once the load balancer is active.
+	path := "/load_balancers/" + lb.ID
+	err = drivers.Poll(ctx, d.pollOptions, "waiting for load balancer "+d.loadBalancerName(), func() (bool, error) {
+		var resp struct {
+			LoadBalancer *loadBalancer `json:"load_balancer"`
+		}
+		if err := d.client.do(ctx, "GET", path, nil, &resp); err != nil {
+			return false, err
+		}
+		lb = resp.LoadBalancer
+		return lb.Status == loadBalancerActive, nil
+	})
+	return lb, err
+}
+
+// addDropletToLoadBalancer adds the droplet to the load balancer targets,
+// unless it is already there.
+func (d *DigitalOcean) addDropletToLoadBalancer(ctx context.Context, dropletID int) error {
+	lb, err := d.getLoadBalancer(ctx)
+	if err != nil {
+		return err
+	}
+	if lb.hasDroplet(dropletID) {
+		return nil
+	}
+	return d.client.do(ctx, "POST", "/load_balancers/"+lb.ID+"/droplets",
+		map[string]interface{}{"droplet_ids": []int{dropletID}}, nil)
+}
+
+// removeDropletFromLoadBalancer removes the droplet from the load balancer
+// targets, if it is there.
+func (d *DigitalOcean) removeDropletFromLoadBalancer(ctx context.Context, dropletID int) error {
+	lb, err := d.getLoadBalancer(ctx)
+	if err != nil {
+		return err
+	}
+	if !lb.hasDroplet(dropletID) {
+		return nil
+	}
+	return d.client.do(ctx, "DELETE", "/load_balancers/"+lb.ID+"/droplets",
+		map[string]interface{}{"droplet_ids": []int{dropletID}}, nil)
+}
+
+// deleteLoadBalancer deletes the load balancer. Returns false if it did not exist.
+func (d *DigitalOcean) deleteLoadBalancer(ctx context.Context) (bool, error) {
+	lb, err := d.findLoadBalancer(ctx)
+	if err != nil || lb == nil {
+		return false, err
+	}
+	err = d.client.do(ctx, "DELETE", "/load_balancers/"+lb.ID, nil, nil)
+	if isNotFound(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// firewall describes the fields of a firewall used here.
+type firewall struct {
+	ID            string         `json:"id,omitempty"`
+	Name          string         `json:"name"`
+	InboundRules  []firewallRule `json:"inbound_rules"`
+	OutboundRules []firewallRule `json:"outbound_rules"`
+	Tags          []string       `json:"tags"`
+}
+
+// firewallRule allows traffic on the given ports. Inbound rules have sources,
+// outbound rules have destinations.
+type firewallRule struct {
+	Protocol     string           `json:"protocol"`
+	Ports        string           `json:"ports,omitempty"`
+	Sources      *firewallTargets `json:"sources,omitempty"`
+	Destinations *firewallTargets `json:"destinations,omitempty"`
+}
+
+type firewallTargets struct {
+	Addresses        []string `json:"addresses,omitempty"`
+	Tags             []string `json:"tags,omitempty"`
+	LoadBalancerUIDs []string `json:"load_balancer_uids,omitempty"`
+}
+
+// cockroachRule returns the inbound rule for the cockroach port, or nil.
+func (fw *firewall) cockroachRule(port int64) *firewallRule {
+	for i, rule := range fw.InboundRules {
+		if rule.Protocol == cockroachProtocol && rule.Ports == strconv.FormatInt(port, 10) && rule.Sources != nil {
+			return &fw.InboundRules[i]
+		}
+	}
+	return nil
+}
+
+// allowedCIDRs returns the addresses allowed on the cockroach port.
+func (fw *firewall) allowedCIDRs(port int64) []string {
+	rule := fw.cockroachRule(port)
+	if rule == nil {
+		return []string{}
+	}
+	return append([]string{}, rule.Sources.Addresses...)
+}
+
+// desiredFirewall returns the cluster firewall: SSH and the docker daemon are
+// open to docker-machine, the cockroach port to the allowed CIDRs, the load
+// balancer and the other nodes. Outbound traffic is not restricted.
+// A port of "0" opens all ports.
+func (d *DigitalOcean) desiredFirewall(loadBalancerID string) *firewall {
+	all := &firewallTargets{Addresses: anywhere}
+	return &firewall{
+		Name: d.firewallName(),
+		InboundRules: []firewallRule{
+			{Protocol: "tcp", Ports: strconv.Itoa(sshPort), Sources: all},
+			{Protocol: "tcp", Ports: strconv.Itoa(dockerDaemonPort), Sources: all},
+			{
+				Protocol: cockroachProtocol,
+				Ports:    strconv.FormatInt(d.context.Port, 10),
+				Sources: &firewallTargets{
+					Addresses:        d.context.AllowedCIDRList(),
+					Tags:             []string{d.tagName()},
+					LoadBalancerUIDs: []string{loadBalancerID},
+				},
+			},
+		},
+		OutboundRules: []firewallRule{
+			{Protocol: "tcp", Ports: "0", Destinations: all},
+			{Protocol: "udp", Ports: "0", Destinations: all},
+			{Protocol: "icmp", Destinations: all},
+		},
+		Tags: []string{d.tagName()},
+	}
+}
+
+// findFirewall looks up the cluster's firewall by name. Returns nil if it does
+// not exist.
+func (d *DigitalOcean) findFirewall(ctx context.Context) (*firewall, error) {
+	var found *firewall
+	err := d.findInList(ctx, "/firewalls", func(page json.RawMessage) (bool, error) {
+		var resp struct {
+			Firewalls []*firewall `json:"firewalls"`
+		}
+		if err := json.Unmarshal(page, &resp); err != nil {
+			return false, err
+		}
+		for _, fw := range resp.Firewalls {
+			if fw.Name == d.firewallName() {
+				found = fw
+				return true, nil
+			}
+		}
+		return false, nil
+	})
+	return found, err
+}
+
+// setupFirewall creates the firewall if it does not exist, or replaces its
+// rules if the allowed CIDRs or the load balancer changed.
+func (d *DigitalOcean) setupFirewall(ctx context.Context, loadBalancerID string) error {
+	// The firewall applies to the droplets with the cluster tag. Creating an
+	// existing tag succeeds.
+	err := d.client.do(ctx, "POST", "/tags", map[string]interface{}{"name": d.tagName()}, nil)
+	if err != nil {
+		return util.Errorf("failed to create tag %s: %v", d.tagName(), err)
+	}
+
+	desired := d.desiredFirewall(loadBalancerID)
+	fw, err := d.findFirewall(ctx)
+	if err != nil {
+		return err
+	}
+	if fw == nil {
+		var resp struct {
+			Firewall *firewall `json:"firewall"`
+		}
+		if err := d.client.do(ctx, "POST", "/firewalls", desired, &resp); err != nil {
+			return err
+		}
+		drivers.LogInfof(ctx, "created firewall %s: %s", d.firewallName(), resp.Firewall.ID)
+		return nil
+	}
+
+	rule := fw.cockroachRule(d.context.Port)
+	if rule != nil && drivers.SameCIDRs(rule.Sources.Addresses, d.context.AllowedCIDRList()) &&
+		len(rule.Sources.LoadBalancerUIDs) == 1 && rule.Sources.LoadBalancerUIDs[0] == loadBalancerID {
+		drivers.LogInfof(ctx, "found firewall %s: %s", d.firewallName(), fw.ID)
+		return nil
+	}
+	// Updates replace the whole firewall.
+	if err := d.client.do(ctx, "PUT", "/firewalls/"+fw.ID, desired, nil); err != nil {
+		return err
+	}
+	drivers.LogInfof(ctx, "updated firewall %s: allowing %v", d.firewallName(), d.context.AllowedCIDRList())
+	return nil
+}
+
+// tagDroplet adds the cluster tag to the droplet, applying the firewall to it.
+func (d *DigitalOcean) tagDroplet(ctx context.Context, dropletID int) error {
+	return d.client.do(ctx, "POST", "/tags/"+d.tagName()+"/resources", map[string]interface{}{
+		"resources": []interface{}{
+			map[string]interface{}{
+				"resource_id":   strconv.Itoa(dropletID),
+				"resource_type": "droplet",
+			},
+		},
+	}, nil)
+}
+
+// tagAllDroplets tags the droplets of all existing nodes, eg: nodes created
+// before the firewall.
+func (d *DigitalOcean) tagAllDroplets(ctx context.Context) error {
+	nodes, err := docker.ListCockroachNodes(d.context.Cluster)
+	if err != nil {
+		return util.Errorf("failed to list nodes: %v", err)
+	}
+	for _, name := range nodes {
+		cfg := &drivers.HostConfig{Driver: &config{}}
+		if err := docker.GetHostConfig(name, cfg); err != nil {
+			return err
+		}
+		if err := d.tagDroplet(ctx, cfg.Driver.(*config).DropletID); err != nil {
+			return util.Errorf("failed to tag droplet of node %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// deleteFirewall deletes the firewall. Returns false if it did not exist.
+func (d *DigitalOcean) deleteFirewall(ctx context.Context) (bool, error) {
+	fw, err := d.findFirewall(ctx)
+	if err != nil || fw == nil {
+		return false, err
+	}
+	err = d.client.do(ctx, "DELETE", "/firewalls/"+fw.ID, nil, nil)
+	if isNotFound(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
@@ -17,7 +17,10 @@
 
 package drivers
 
-import "github.com/cockroachdb/cockroach-prod/base"
+import (
+	"github.com/cockroachdb/cockroach-prod/base"
+	"golang.org/x/net/context"
+)
 
 // HostConfig describes the docker-machine host config.
 // Driver is the driver-specific config.
@@ -33,18 +36,32 @@ type HostConfig struct {
 type DriverConfig interface {
 	// DataDir is the directory used as the data directory.
 	DataDir() string
+	// CertsDir is the directory the node certificates are copied to.
+	CertsDir() string
 	// IPAddress is the node address cockroach should bind to.
 	IPAddress() string
 	// GossipAddress is the address to reach the gossip network.
 	GossipAddress() string
 }
 
+// GossipSeeder is implemented by DriverConfigs without a load balancer.
+// Nodes join the gossip network through the seed addresses instead of
+// GossipAddress.
+type GossipSeeder interface {
+	// GossipSeeds returns the seed addresses, without port.
+	GossipSeeds() []string
+}
+
 // Driver is the interface for all drivers.
+// Methods taking a context.Context stop at the next API call or poll once it
+// is cancelled. The others are short lookups, or must complete during cleanup
+// (eg: releasing the cluster lock).
 type Driver interface {
 	// Context returns the base context.
 	Context() *base.Context
 
-	// DockerMachineDriver returns the name of the docker-machine driver.
+	// DockerMachineDriver returns the name of the docker-machine driver, or
+	// an empty string if the driver manages its own machines.
 	DockerMachineDriver() string
 
 	// Init is called when creating the driver. This will typically
@@ -52,21 +69,66 @@ type Driver interface {
 	Init() error
 
 	// DockerMachineCreateArgs returns the list of driver-specific arguments
-	// to pass to 'docker-machine create'
-	DockerMachineCreateArgs() []string
+	// to pass to 'docker-machine create' for the named machine.
+	DockerMachineCreateArgs(name string) ([]string, error)
+
+	// GetStatus looks up the cluster-wide resources. Nodes are not filled in.
+	// Problems are recorded in the status.
+	GetStatus() *ClusterStatus
 
-	// PrintStatus asks the driver to print some basic status to stdout.
-	PrintStatus()
+	// GetNodeStatus fills in the driver-specific fields of the node status:
+	// instance details and load balancer membership.
+	// Problems are recorded in the status.
+	GetNodeStatus(name string, config *HostConfig, status *NodeStatus)
+
+	// GetInstanceState looks up the state of the node's cloud instance.
+	GetInstanceState(name string, config *HostConfig) (InstanceState, error)
+
+	// LoadBalancerAddress returns the host name or IP address of the load
+	// balancer, for clients to connect to.
+	LoadBalancerAddress() (string, error)
 
 	// GetNodeConfig takes a node name and reads its docker-machine config.
 	GetNodeConfig(name string) (*HostConfig, error)
 
 	// AfterFirstNode runs any steps needed after the first node was created.
-	AfterFirstNode() error
+	AfterFirstNode(ctx context.Context) error
+
+	// PrepareNode runs any steps needed before cockroach can run on a node,
+	// eg: attaching and mounting its data volume. It is called every time
+	// cockroach is started on a freshly created or started machine and may
+	// update the config. created is true for freshly created machines: new
+	// data volumes must only be created for those, existing nodes keep their
+	// data where it is.
+	PrepareNode(ctx context.Context, name string, config *HostConfig, created bool) error
+
+	// AfterNodeRemoved runs any steps needed after a node's machine was
+	// removed, eg: deleting its data volume.
+	AfterNodeRemoved(ctx context.Context, name string) error
 
 	// StartNode runs any steps needed when starting an existing node.
-	StartNode(name string, config *HostConfig) error
+	StartNode(ctx context.Context, name string, config *HostConfig) error
 
 	// StopNode runs any steps needed when stopping a node.
-	StopNode(name string, config *HostConfig) error
+	StopNode(ctx context.Context, name string, config *HostConfig) error
+
+	// IsNodeInService returns true if the load balancer considers the
+	// node healthy and is sending it traffic.
+	IsNodeInService(ctx context.Context, name string, config *HostConfig) (bool, error)
+
+	// Teardown deletes everything created by AfterFirstNode, in reverse
+	// dependency order. Resources that no longer exist are skipped.
+	Teardown(ctx context.Context) error
+
+	// ReadLock returns the cluster lock stored in the cloud, or nil if it is
+	// not held, and the version of the stored value to pass to WriteLock.
+	// Returns ErrNoLockStore if the resource holding the lock does not
+	// exist (eg: before init).
+	ReadLock() (*Lock, string, error)
+
+	// WriteLock stores the cluster lock in the cloud, or clears it if nil.
+	// The write only happens if the stored value is still at 'version', as
+	// returned by ReadLock. Returns ErrLockChanged otherwise, and
+	// ErrNoLockStore if the resource holding the lock does not exist.
+	WriteLock(lock *Lock, version string) error
 }
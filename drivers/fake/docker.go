@@ -0,0 +1,315 @@
+// Copyright 2015 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+//
+// Author: Marc Berhault (marc@cockroachlabs.com)
+
+package fake
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/cockroachdb/cockroach-prod/drivers"
+	"github.com/cockroachdb/cockroach/util"
+	"golang.org/x/net/context"
+)
+
+// Machine states, as reported by docker-machine.
+const (
+	machineRunning = "Running"
+	machineStopped = "Stopped"
+)
+
+// Machines is an in-memory implementation of docker.Machines. New machines
+// are running and get consecutive addresses.
+type Machines struct {
+	*Recorder
+
+	// RunFunc, if set, handles commands run on machines. By default commands
+	// succeed without output.
+	RunFunc func(name, command string) ([]string, error)
+
+	mu       sync.Mutex
+	machines map[string]*machine
+	nextIP   int
+}
+
+type machine struct {
+	state string
+	ip    string
+	// Files copied to the machine, by directory.
+	files map[string][]string
+}
+
+// NewMachines returns an empty set of machines recording to r.
+func NewMachines(r *Recorder) *Machines {
+	return &Machines{
+		Recorder: r,
+		machines: map[string]*machine{},
+		nextIP:   1,
+	}
+}
+
+func (m *Machines) get(name string) (*machine, error) {
+	mach, ok := m.machines[name]
+	if !ok {
+		return nil, util.Errorf("machine %s does not exist", name)
+	}
+	return mach, nil
+}
+
+// List returns the sorted machine names.
+func (m *Machines) List() ([]string, error) {
+	if err := m.record("Machines.List", ""); err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ret := []string{}
+	for name := range m.machines {
+		ret = append(ret, name)
+	}
+	sort.Strings(ret)
+	return ret, nil
+}
+
+// Inspect fills in config, whose Driver must be a *fake.config as returned by
+// Driver.GetNodeConfig.
+func (m *Machines) Inspect(name string, cfg *drivers.HostConfig) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	mach, err := m.get(name)
+	if err != nil {
+		return err
+	}
+	cfg.DriverName = driverName
+	cfg.Driver.(*config).ip = mach.ip
+	return nil
+}
+
+func (m *Machines) State(name string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	mach, err := m.get(name)
+	if err != nil {
+		return "", err
+	}
+	return mach.state, nil
+}
+
+func (m *Machines) DockerFlags(name string) ([]string, error) {
+	return []string{}, nil
+}
+
+func (m *Machines) Create(ctx context.Context, driver drivers.Driver, name string) error {
+	if err := m.record("Machines.Create", name); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.machines[name]; ok {
+		return util.Errorf("machine %s already exists", name)
+	}
+	m.machines[name] = &machine{
+		state: machineRunning,
+		ip:    fmt.Sprintf("10.0.0.%d", m.nextIP),
+		files: map[string][]string{},
+	}
+	m.nextIP++
+	return nil
+}
+
+func (m *Machines) Start(ctx context.Context, name string) error {
+	return m.setState("Machines.Start", name, machineRunning)
+}
+
+func (m *Machines) Stop(ctx context.Context, name string) error {
+	return m.setState("Machines.Stop", name, machineStopped)
+}
+
+func (m *Machines) setState(method, name, state string) error {
+	if err := m.record(method, name); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	mach, err := m.get(name)
+	if err != nil {
+		return err
+	}
+	mach.state = state
+	return nil
+}
+
+func (m *Machines) Remove(ctx context.Context, name string) error {
+	if err := m.record("Machines.Remove", name); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, err := m.get(name); err != nil {
+		return err
+	}
+	delete(m.machines, name)
+	return nil
+}
+
+// Run calls RunFunc if set. The command is not recorded: checks run in polling
+// loops would make the calls hard to compare.
+func (m *Machines) Run(ctx context.Context, name string, command string) ([]string, error) {
+	m.mu.Lock()
+	_, err := m.get(name)
+	m.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	if m.RunFunc != nil {
+		return m.RunFunc(name, command)
+	}
+	return []string{}, nil
+}
+
+func (m *Machines) Copy(ctx context.Context, name string, files []string, remoteDir string) error {
+	if err := m.record("Machines.Copy", name); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	mach, err := m.get(name)
+	if err != nil {
+		return err
+	}
+	mach.files[remoteDir] = append(mach.files[remoteDir], files...)
+	return nil
+}
+
+// Files returns the files copied to remoteDir on the machine.
+func (m *Machines) Files(name, remoteDir string) []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if mach, ok := m.machines[name]; ok {
+		return append([]string(nil), mach.files[remoteDir]...)
+	}
+	return nil
+}
+
+func (m *Machines) ContainerName(name string) string {
+	return "cockroach"
+}
+
+func (m *Machines) NetworkArgs(name string, settings *drivers.HostConfig, port int64) []string {
+	return nil
+}
+
+// Containers is an in-memory implementation of docker.Containers.
+type Containers struct {
+	*Recorder
+
+	mu          sync.Mutex
+	containers  map[string]*container
+	initialized map[string]bool
+}
+
+type container struct {
+	image, previousImage string
+	running              bool
+}
+
+// NewContainers returns an empty set of containers recording to r.
+func NewContainers(r *Recorder) *Containers {
+	return &Containers{
+		Recorder:    r,
+		containers:  map[string]*container{},
+		initialized: map[string]bool{},
+	}
+}
+
+func (c *Containers) Init(ctx context.Context, driver drivers.Driver, nodeName string,
+	settings *drivers.HostConfig) error {
+	if err := c.record("Containers.Init", nodeName); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.initialized[nodeName] = true
+	return nil
+}
+
+func (c *Containers) Start(ctx context.Context, driver drivers.Driver, nodeName string,
+	settings *drivers.HostConfig, image, previousImage string) error {
+	if err := c.record("Containers.Start", nodeName); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.containers[nodeName] = &container{image: image, previousImage: previousImage, running: true}
+	return nil
+}
+
+func (c *Containers) Image(nodeName string) (string, string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if cont, ok := c.containers[nodeName]; ok {
+		return cont.image, cont.previousImage, nil
+	}
+	return "", "", nil
+}
+
+func (c *Containers) Pull(ctx context.Context, nodeName string, image string) error {
+	return c.record("Containers.Pull", nodeName)
+}
+
+func (c *Containers) Stop(ctx context.Context, nodeName string) error {
+	if err := c.record("Containers.Stop", nodeName); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if cont, ok := c.containers[nodeName]; ok {
+		cont.running = false
+	}
+	return nil
+}
+
+func (c *Containers) Logs(ctx context.Context, nodeName string) error {
+	return c.record("Containers.Logs", nodeName)
+}
+
+// Exited returns true if the container exists and is not running.
+func (c *Containers) Exited(nodeName string) (bool, error) {
+	if err := c.record("Containers.Exited", nodeName); err != nil {
+		return false, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cont, ok := c.containers[nodeName]
+	return ok && !cont.running, nil
+}
+
+// IsRunning returns true if the cockroach container on the node is running.
+func (c *Containers) IsRunning(nodeName string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cont, ok := c.containers[nodeName]
+	return ok && cont.running
+}
+
+// IsInitialized returns true if the store on the node was initialized.
+func (c *Containers) IsInitialized(nodeName string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.initialized[nodeName]
+}
@@ -0,0 +1,309 @@
+// Copyright 2015 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+//
+// Author: Marc Berhault (marc@cockroachlabs.com)
+
+package fake
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+
+	"github.com/cockroachdb/cockroach-prod/base"
+	"github.com/cockroachdb/cockroach-prod/docker"
+	"github.com/cockroachdb/cockroach-prod/drivers"
+	"github.com/cockroachdb/cockroach/util"
+	"golang.org/x/net/context"
+)
+
+const (
+	driverName          = "fake"
+	loadBalancerAddress = "lb.fake"
+	firewallName        = "fake-firewall"
+)
+
+// Driver is an in-memory driver recording its calls, for tests. It installs
+// in-memory machines and containers in the docker package, so that cli
+// commands can run without docker-machine, docker or a cloud account.
+// Failures can be injected at any step with FailOn.
+type Driver struct {
+	*Recorder
+	Machines   *Machines
+	Containers *Containers
+
+	context *base.Context
+	region  string
+
+	mu           sync.Mutex
+	loadBalancer bool
+	allowedCIDRs []string
+	backends     map[string]bool
+	lock         *drivers.Lock
+	lockVersion  int
+}
+
+// config implements drivers.DriverConfig.
+type config struct {
+	ip string
+}
+
+// DataDir returns the data directory.
+func (cfg *config) DataDir() string {
+	return "/data"
+}
+
+// CertsDir returns the certificates directory.
+func (cfg *config) CertsDir() string {
+	return "/certs"
+}
+
+// IPAddress returns the machine address.
+func (cfg *config) IPAddress() string {
+	return cfg.ip
+}
+
+// GossipAddress returns the load balancer address.
+func (cfg *config) GossipAddress() string {
+	return loadBalancerAddress
+}
+
+// NewDriver returns a fake driver with no machines, and installs its machines
+// and containers in the docker package.
+func NewDriver(context *base.Context, region string) *Driver {
+	r := &Recorder{}
+	d := &Driver{
+		Recorder:   r,
+		Machines:   NewMachines(r),
+		Containers: NewContainers(r),
+		context:    context,
+		region:     region,
+		backends:   map[string]bool{},
+	}
+	docker.SetMachines(d.Machines)
+	docker.SetContainers(d.Containers)
+	return d
+}
+
+// Context returns the base context.
+func (d *Driver) Context() *base.Context {
+	return d.context
+}
+
+// DockerMachineDriver returns an empty name: docker-machine is not used.
+func (d *Driver) DockerMachineDriver() string {
+	return ""
+}
+
+// Init records the call.
+func (d *Driver) Init() error {
+	return d.record("Init", "")
+}
+
+// DockerMachineCreateArgs returns nothing.
+func (d *Driver) DockerMachineCreateArgs(name string) ([]string, error) {
+	return nil, nil
+}
+
+// GetStatus returns the load balancer and firewall once AfterFirstNode ran.
+func (d *Driver) GetStatus() *drivers.ClusterStatus {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	status := &drivers.ClusterStatus{
+		Driver: driverName,
+		Region: d.region,
+	}
+	if d.loadBalancer {
+		status.LoadBalancerAddress = fmt.Sprintf("%s:%d", loadBalancerAddress, d.context.Port)
+		status.Firewall = firewallName
+		status.AllowedCIDRs = append([]string{}, d.allowedCIDRs...)
+	}
+	return status
+}
+
+// GetNodeStatus fills in the instance state and load balancer membership.
+func (d *Driver) GetNodeStatus(name string, cfg *drivers.HostConfig, status *drivers.NodeStatus) {
+	state, err := d.GetInstanceState(name, cfg)
+	if err != nil {
+		status.Errors = append(status.Errors, fmt.Sprintf("instance: %v", err))
+	}
+	status.InstanceID = name
+	status.InstanceState = string(state)
+	status.InternalIP = cfg.Driver.IPAddress()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	status.InLoadBalancer = d.backends[name]
+	status.InService = d.backends[name]
+}
+
+// GetInstanceState returns the machine state.
+func (d *Driver) GetInstanceState(name string, cfg *drivers.HostConfig) (drivers.InstanceState, error) {
+	if err := d.record("GetInstanceState", name); err != nil {
+		return drivers.InstanceUnknown, err
+	}
+	state, err := d.Machines.State(name)
+	if err != nil {
+		return drivers.InstanceMissing, nil
+	}
+	switch state {
+	case machineRunning:
+		return drivers.InstanceRunning, nil
+	case machineStopped:
+		return drivers.InstanceStopped, nil
+	}
+	return drivers.InstanceUnknown, nil
+}
+
+// LoadBalancerAddress returns the load balancer address once AfterFirstNode ran.
+func (d *Driver) LoadBalancerAddress() (string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.loadBalancer {
+		return "", util.Errorf("load balancer not found")
+	}
+	return loadBalancerAddress, nil
+}
+
+// GetNodeConfig returns the machine config. Like the cloud drivers, it fails
+// until the load balancer exists.
+func (d *Driver) GetNodeConfig(name string) (*drivers.HostConfig, error) {
+	if err := d.record("GetNodeConfig", name); err != nil {
+		return nil, err
+	}
+	cfg := &drivers.HostConfig{
+		Driver: &config{},
+	}
+	if err := docker.GetHostConfig(name, cfg); err != nil {
+		return nil, err
+	}
+	if _, err := d.LoadBalancerAddress(); err != nil {
+		return nil, util.Errorf("could not find load balancer: %v", err)
+	}
+	return cfg, nil
+}
+
+// AfterFirstNode creates the load balancer and sets the allowed CIDRs.
+func (d *Driver) AfterFirstNode(ctx context.Context) error {
+	if err := d.record("AfterFirstNode", ""); err != nil {
+		return err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.loadBalancer = true
+	d.allowedCIDRs = d.context.AllowedCIDRList()
+	return nil
+}
+
+// PrepareNode records the call.
+func (d *Driver) PrepareNode(ctx context.Context, name string, cfg *drivers.HostConfig, created bool) error {
+	return d.record("PrepareNode", name)
+}
+
+// AfterNodeRemoved removes the node from the load balancer.
+func (d *Driver) AfterNodeRemoved(ctx context.Context, name string) error {
+	return d.setBackend("AfterNodeRemoved", name, false)
+}
+
+// StartNode adds the node to the load balancer.
+func (d *Driver) StartNode(ctx context.Context, name string, cfg *drivers.HostConfig) error {
+	return d.setBackend("StartNode", name, true)
+}
+
+// StopNode removes the node from the load balancer.
+func (d *Driver) StopNode(ctx context.Context, name string, cfg *drivers.HostConfig) error {
+	return d.setBackend("StopNode", name, false)
+}
+
+func (d *Driver) setBackend(method, name string, inService bool) error {
+	if err := d.record(method, name); err != nil {
+		return err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if inService {
+		d.backends[name] = true
+	} else {
+		delete(d.backends, name)
+	}
+	return nil
+}
+
+// IsNodeInService returns true if the node is in the load balancer.
+func (d *Driver) IsNodeInService(ctx context.Context, name string, cfg *drivers.HostConfig) (bool, error) {
+	if err := d.record("IsNodeInService", name); err != nil {
+		return false, err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.backends[name], nil
+}
+
+// Teardown deletes the load balancer.
+func (d *Driver) Teardown(ctx context.Context) error {
+	if err := d.record("Teardown", ""); err != nil {
+		return err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.loadBalancer = false
+	d.allowedCIDRs = nil
+	d.backends = map[string]bool{}
+	d.lock = nil
+	return nil
+}
+
+// ReadLock returns the cluster lock. Like the cloud drivers, the lock is
+// stored with the load balancer. The version is the number of lock writes.
+func (d *Driver) ReadLock() (*drivers.Lock, string, error) {
+	if err := d.record("ReadLock", ""); err != nil {
+		return nil, "", err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.loadBalancer {
+		return nil, "", drivers.ErrNoLockStore
+	}
+	version := strconv.Itoa(d.lockVersion)
+	if d.lock == nil {
+		return nil, version, nil
+	}
+	lock := *d.lock
+	return &lock, version, nil
+}
+
+// WriteLock stores the cluster lock, or clears it if nil, if it was not
+// written since 'version'.
+func (d *Driver) WriteLock(lock *drivers.Lock, version string) error {
+	if err := d.record("WriteLock", ""); err != nil {
+		return err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.loadBalancer {
+		return drivers.ErrNoLockStore
+	}
+	if version != strconv.Itoa(d.lockVersion) {
+		return drivers.ErrLockChanged
+	}
+	d.lockVersion++
+	if lock == nil {
+		d.lock = nil
+		return nil
+	}
+	l := *lock
+	d.lock = &l
+	return nil
+}
@@ -0,0 +1,82 @@
+// Copyright 2015 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+//
+// Author: Marc Berhault (marc@cockroachlabs.com)
+
+package fake
+
+import (
+	"sync"
+)
+
+// Recorder records the calls made to the fakes and returns the errors
+// injected with FailOn. It is safe for concurrent use.
+type Recorder struct {
+	mu       sync.Mutex
+	calls    []string
+	failures map[string]error
+}
+
+// key identifies a call: the method, followed by the node name if any.
+func key(method, node string) string {
+	if node == "" {
+		return method
+	}
+	return method + " " + node
+}
+
+// FailOn makes calls to method fail with err, for the given node or for all
+// nodes if node is empty. Driver methods are named as in drivers.Driver (eg:
+// "StartNode"), machine and container methods are prefixed with "Machines."
+// and "Containers." (eg: "Machines.Create", "Containers.Start").
+// A nil err clears the failure.
+func (r *Recorder) FailOn(method, node string, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.failures == nil {
+		r.failures = map[string]error{}
+	}
+	if err == nil {
+		delete(r.failures, key(method, node))
+		return
+	}
+	r.failures[key(method, node)] = err
+}
+
+// Calls returns the calls made so far, formatted as "<method> <node>".
+func (r *Recorder) Calls() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.calls...)
+}
+
+// Reset forgets the recorded calls and injected failures.
+func (r *Recorder) Reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.calls = nil
+	r.failures = nil
+}
+
+// record records a call and returns the injected failure, if any.
+func (r *Recorder) record(method, node string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.calls = append(r.calls, key(method, node))
+	if err, ok := r.failures[key(method, node)]; ok {
+		return err
+	}
+	return r.failures[method]
+}
@@ -116,7 +116,7 @@ func (f gobCache) PutToken(tok *oauth.Token) error {
 	return nil
 }
 
-func newOauthClient(authTokenPath string) (*http.Client, error) {
+func newOauthClient(authTokenPath string, baseTransport http.RoundTripper) (*http.Client, error) {
 	config := &oauth.Config{
 		ClientId:     clientID,
 		ClientSecret: clientSecret,
@@ -132,7 +132,7 @@ func newOauthClient(authTokenPath string) (*http.Client, error) {
 
 	transport := &oauth.Transport{
 		Config:    config,
-		Transport: http.DefaultTransport,
+		Transport: baseTransport,
 	}
 
 	err := initTransport(transport)
@@ -19,29 +19,42 @@ package google
 
 import (
 	"fmt"
+	"net/http"
 	"strings"
-	"time"
 
 	// The package is called "compute" but is in v1. Specify import name for clarify.
 	compute "google.golang.org/api/compute/v1"
+	"google.golang.org/api/googleapi"
 
+	"github.com/cockroachdb/cockroach-prod/drivers"
 	"github.com/cockroachdb/cockroach/util"
 	"github.com/cockroachdb/cockroach/util/log"
+	"golang.org/x/net/context"
 )
 
 const (
-	cockroachProtocol  = "tcp"
-	allIPAddresses     = "0.0.0.0/0"
-	firewallRuleName   = "cockroach-firewall"
-	forwardingRuleName = "cockroach-forward-rule"
-	healthCheckName    = "cockroach-health-check"
-	backendServiceName = "cockroach-backend"
-	urlMapName         = "cockroach-url-map"
-	httpProxyName      = "cockroach-proxy"
+	cockroachProtocol = "tcp"
+	// Resources are named <cluster name><suffix>.
+	firewallRuleSuffix   = "-firewall"
+	forwardingRuleSuffix = "-forward-rule"
+	healthCheckSuffix    = "-health-check"
+	backendServiceSuffix = "-backend"
+	urlMapSuffix         = "-url-map"
+	httpProxySuffix      = "-proxy"
 	// TODO(marc): some of these should be pulled from cockroach/base/Context or similar.
 	healthCheckPath = "/_status/"
+	healthyState    = "HEALTHY"
 )
 
+// Names of the cluster resources.
+func (g *Google) firewallRuleName() string   { return g.context.Cluster + firewallRuleSuffix }
+func (g *Google) forwardingRuleName() string { return g.context.Cluster + forwardingRuleSuffix }
+func (g *Google) healthCheckName() string    { return g.context.Cluster + healthCheckSuffix }
+func (g *Google) backendServiceName() string { return g.context.Cluster + backendServiceSuffix }
+func (g *Google) urlMapName() string         { return g.context.Cluster + urlMapSuffix }
+func (g *Google) httpProxyName() string      { return g.context.Cluster + httpProxySuffix }
+func (g *Google) instanceGroupName() string  { return g.context.Cluster + instanceGroupSuffix }
+
 // computeOpError wraps a compute.OperationErrorErrors to implement error.
 type computeOpError struct {
 	compute.OperationErrorErrors
@@ -66,12 +79,77 @@ func zoneBasePath(service *compute.Service, project, zone string) string {
 	return fmt.Sprintf("%s%s/zones/%s/", service.BasePath, project, zone)
 }
 
+// isNotFound returns true if the error is a 404 returned by the API.
+func isNotFound(err error) bool {
+	apiErr, ok := err.(*googleapi.Error)
+	return ok && apiErr.Code == http.StatusNotFound
+}
+
 // Check whether the named project exists. Returns nil if it does.
 func (g *Google) checkProjectExists() error {
 	_, err := g.computeService.Projects.Get(g.project).Do()
 	return err
 }
 
+// getProjectMetadata returns the value of the project-wide metadata item with
+// the given key, or "" if not set, and the metadata fingerprint.
+func (g *Google) getProjectMetadata(key string) (string, string, error) {
+	project, err := g.computeService.Projects.Get(g.project).Do()
+	if err != nil {
+		return "", "", err
+	}
+	if project.CommonInstanceMetadata == nil {
+		return "", "", nil
+	}
+	for _, item := range project.CommonInstanceMetadata.Items {
+		if item.Key == key {
+			return item.Value, project.CommonInstanceMetadata.Fingerprint, nil
+		}
+	}
+	return "", project.CommonInstanceMetadata.Fingerprint, nil
+}
+
+// setProjectMetadata sets the project-wide metadata item with the given key,
+// or removes it if value is empty. The update only happens if the metadata
+// still has the given fingerprint, as returned by getProjectMetadata:
+// drivers.ErrLockChanged is returned if it was modified since.
+func (g *Google) setProjectMetadata(ctx context.Context, key, value, fingerprint string) error {
+	project, err := g.computeService.Projects.Get(g.project).Do()
+	if err != nil {
+		return err
+	}
+	metadata := project.CommonInstanceMetadata
+	if metadata == nil {
+		metadata = &compute.Metadata{}
+	}
+	if metadata.Fingerprint != fingerprint {
+		return drivers.ErrLockChanged
+	}
+
+	items := []*compute.MetadataItems{}
+	for _, item := range metadata.Items {
+		if item.Key != key {
+			items = append(items, item)
+		}
+	}
+	if value != "" {
+		items = append(items, &compute.MetadataItems{Key: key, Value: value})
+	}
+
+	// The API rejects the update if the fingerprint changed since the Get above.
+	op, err := g.computeService.Projects.SetCommonInstanceMetadata(g.project, &compute.Metadata{
+		Fingerprint: fingerprint,
+		Items:       items,
+	}).Do()
+	if apiErr, ok := err.(*googleapi.Error); ok && apiErr.Code == http.StatusPreconditionFailed {
+		return drivers.ErrLockChanged
+	}
+	if err != nil {
+		return err
+	}
+	return g.waitForOperation(ctx, op)
+}
+
 // Lookup and return the instance details.
 func (g *Google) getInstanceDetails(machine string) (*compute.Instance, error) {
 	return g.computeService.Instances.Get(g.project, g.zone, machine).Do()
@@ -79,20 +157,33 @@ func (g *Google) getInstanceDetails(machine string) (*compute.Instance, error) {
 
 // getFirewallRule looks for the cockroach firewall rule and returns it.
 func (g *Google) getFirewallRule() (*compute.Firewall, error) {
-	return g.computeService.Firewalls.Get(g.project, firewallRuleName).Do()
+	return g.computeService.Firewalls.Get(g.project, g.firewallRuleName()).Do()
 }
 
-// createFirewallRule creates the cockroach firewall if it does not exist.
+// createFirewallRule creates the cockroach firewall if it does not exist,
+// or updates its source ranges to the allowed CIDRs.
 // It returns its resource link.
-func (g *Google) createFirewallRule() (string, error) {
+func (g *Google) createFirewallRule(ctx context.Context) (string, error) {
 	if rule, err := g.getFirewallRule(); err == nil {
-		log.Infof("found FirewallRule %s: %s", firewallRuleName, rule.SelfLink)
+		drivers.LogInfof(ctx, "found FirewallRule %s: %s", g.firewallRuleName(), rule.SelfLink)
+		if drivers.SameCIDRs(rule.SourceRanges, g.context.AllowedCIDRList()) {
+			return rule.SelfLink, nil
+		}
+		op, err := g.computeService.Firewalls.Patch(g.project, g.firewallRuleName(),
+			&compute.Firewall{SourceRanges: g.context.AllowedCIDRList()}).Do()
+		if err != nil {
+			return "", err
+		}
+		if err = g.waitForOperation(ctx, op); err != nil {
+			return "", err
+		}
+		drivers.LogInfof(ctx, "updated FirewallRule %s source ranges to %s", g.firewallRuleName(), g.context.AllowedCIDRs)
 		return rule.SelfLink, nil
 	}
 
 	op, err := g.computeService.Firewalls.Insert(g.project,
 		&compute.Firewall{
-			Name: firewallRuleName,
+			Name: g.firewallRuleName(),
 			Allowed: []*compute.FirewallAllowed{
 				{
 					IPProtocol: cockroachProtocol,
@@ -101,37 +192,48 @@ func (g *Google) createFirewallRule() (string, error) {
 					},
 				},
 			},
-			SourceRanges: []string{
-				allIPAddresses,
-			},
+			SourceRanges: g.context.AllowedCIDRList(),
 		}).Do()
 	if err != nil {
 		return "", err
 	}
-	if err = g.waitForOperation(op); err != nil {
+	if err = g.waitForOperation(ctx, op); err != nil {
 		return "", err
 	}
-	log.Infof("created FirewallRule %s: %s", firewallRuleName, op.TargetLink)
+	drivers.LogInfof(ctx, "created FirewallRule %s: %s", g.firewallRuleName(), op.TargetLink)
 	return op.TargetLink, nil
 }
 
+// deleteFirewallRule deletes the cockroach firewall rule.
+// Returns false if it did not exist.
+func (g *Google) deleteFirewallRule(ctx context.Context) (bool, error) {
+	op, err := g.computeService.Firewalls.Delete(g.project, g.firewallRuleName()).Do()
+	if isNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, g.waitForOperation(ctx, op)
+}
+
 // getForwardingRule looks for the cockroach forwarding rule.
 func (g *Google) getForwardingRule() (*compute.ForwardingRule, error) {
-	return g.computeService.GlobalForwardingRules.Get(g.project, forwardingRuleName).Do()
+	return g.computeService.GlobalForwardingRules.Get(g.project, g.forwardingRuleName()).Do()
 }
 
 // createForwardingRule creates the cockroach forwarding rule if it does not exist.
 // Requires a resolvable target link. It should be a HTTP Proxy.
 // Returns the forwarding rule resource link.
-func (g *Google) createForwardingRule(targetLink string) (string, error) {
+func (g *Google) createForwardingRule(ctx context.Context, targetLink string) (string, error) {
 	if rule, err := g.getForwardingRule(); err == nil {
-		log.Infof("found ForwardingRule %s: %s", forwardingRuleName, rule.SelfLink)
+		drivers.LogInfof(ctx, "found ForwardingRule %s: %s", g.forwardingRuleName(), rule.SelfLink)
 		return rule.SelfLink, nil
 	}
 
 	op, err := g.computeService.GlobalForwardingRules.Insert(g.project,
 		&compute.ForwardingRule{
-			Name:       forwardingRuleName,
+			Name:       g.forwardingRuleName(),
 			IPProtocol: cockroachProtocol,
 			PortRange:  fmt.Sprintf("%d", g.context.Port),
 			Target:     targetLink,
@@ -139,30 +241,43 @@ func (g *Google) createForwardingRule(targetLink string) (string, error) {
 	if err != nil {
 		return "", err
 	}
-	if err = g.waitForOperation(op); err != nil {
+	if err = g.waitForOperation(ctx, op); err != nil {
 		return "", err
 	}
 
-	log.Infof("created ForwardingRule %s: %s", forwardingRuleName, op.TargetLink)
+	drivers.LogInfof(ctx, "created ForwardingRule %s: %s", g.forwardingRuleName(), op.TargetLink)
 	return op.TargetLink, nil
 }
 
+// deleteForwardingRule deletes the cockroach forwarding rule.
+// Returns false if it did not exist.
+func (g *Google) deleteForwardingRule(ctx context.Context) (bool, error) {
+	op, err := g.computeService.GlobalForwardingRules.Delete(g.project, g.forwardingRuleName()).Do()
+	if isNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, g.waitForOperation(ctx, op)
+}
+
 // getHealthCheck looks for the cockroach health check.
 func (g *Google) getHealthCheck() (*compute.HttpHealthCheck, error) {
-	return g.computeService.HttpHealthChecks.Get(g.project, healthCheckName).Do()
+	return g.computeService.HttpHealthChecks.Get(g.project, g.healthCheckName()).Do()
 }
 
 // createHealthCheck creates the cockroach health check if it does not exist.
 // Returns its resource link.
-func (g *Google) createHealthCheck() (string, error) {
+func (g *Google) createHealthCheck(ctx context.Context) (string, error) {
 	if check, err := g.getHealthCheck(); err == nil {
-		log.Infof("found HealthCheck %s: %s", healthCheckName, check.SelfLink)
+		drivers.LogInfof(ctx, "found HealthCheck %s: %s", g.healthCheckName(), check.SelfLink)
 		return check.SelfLink, nil
 	}
 
 	op, err := g.computeService.HttpHealthChecks.Insert(g.project,
 		&compute.HttpHealthCheck{
-			Name:               healthCheckName,
+			Name:               g.healthCheckName(),
 			Port:               g.context.Port,
 			RequestPath:        healthCheckPath,
 			CheckIntervalSec:   2,
@@ -173,31 +288,45 @@ func (g *Google) createHealthCheck() (string, error) {
 	if err != nil {
 		return "", err
 	}
-	if err = g.waitForOperation(op); err != nil {
+	if err = g.waitForOperation(ctx, op); err != nil {
 		return "", err
 	}
 
-	log.Infof("created HealthCheck %s: %s", healthCheckName, op.TargetLink)
+	drivers.LogInfof(ctx, "created HealthCheck %s: %s", g.healthCheckName(), op.TargetLink)
 	return op.TargetLink, nil
 }
 
+// deleteHealthCheck deletes the cockroach health check.
+// Returns false if it did not exist.
+func (g *Google) deleteHealthCheck(ctx context.Context) (bool, error) {
+	op, err := g.computeService.HttpHealthChecks.Delete(g.project, g.healthCheckName()).Do()
+	if isNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, g.waitForOperation(ctx, op)
+}
+
 // getBackendService looks for the cockroach backend service.
 func (g *Google) getBackendService() (*compute.BackendService, error) {
-	return g.computeService.BackendServices.Get(g.project, backendServiceName).Do()
+	return g.computeService.BackendServices.Get(g.project, g.backendServiceName()).Do()
 }
 
 // createBackendService creates the cockroach backend service if it does not exist.
 // Requires a resolvable health check and instance group.
 // Returns the backend service resource link.
-func (g *Google) createBackendService(healthCheckLink, instanceGroupLink string) (string, error) {
+func (g *Google) createBackendService(ctx context.Context, healthCheckLink,
+	instanceGroupLink string) (string, error) {
 	if backend, err := g.getBackendService(); err == nil {
-		log.Infof("found BackendService %s: %s", backendServiceName, backend.SelfLink)
+		drivers.LogInfof(ctx, "found BackendService %s: %s", g.backendServiceName(), backend.SelfLink)
 		return backend.SelfLink, nil
 	}
 
 	op, err := g.computeService.BackendServices.Insert(g.project,
 		&compute.BackendService{
-			Name:         backendServiceName,
+			Name:         g.backendServiceName(),
 			HealthChecks: []string{healthCheckLink},
 			Backends: []*compute.Backend{
 				{Group: instanceGroupLink},
@@ -206,74 +335,129 @@ func (g *Google) createBackendService(healthCheckLink, instanceGroupLink string)
 	if err != nil {
 		return "", err
 	}
-	if err = g.waitForOperation(op); err != nil {
+	if err = g.waitForOperation(ctx, op); err != nil {
 		return "", err
 	}
 
-	log.Infof("created BackendService %s: %s", backendServiceName, op.TargetLink)
+	drivers.LogInfof(ctx, "created BackendService %s: %s", g.backendServiceName(), op.TargetLink)
 	return op.TargetLink, nil
 }
 
+// isInstanceHealthy returns true if the cockroach backend service reports the
+// instance (specified by resource link) in the instance group as healthy.
+func (g *Google) isInstanceHealthy(instanceGroupLink, instanceLink string) (bool, error) {
+	health, err := g.computeService.BackendServices.GetHealth(g.project, g.backendServiceName(),
+		&compute.ResourceGroupReference{Group: instanceGroupLink}).Do()
+	if err != nil {
+		return false, err
+	}
+	for _, status := range health.HealthStatus {
+		if status.Instance == instanceLink {
+			return status.HealthState == healthyState, nil
+		}
+	}
+	return false, nil
+}
+
+// deleteBackendService deletes the cockroach backend service.
+// Returns false if it did not exist.
+func (g *Google) deleteBackendService(ctx context.Context) (bool, error) {
+	op, err := g.computeService.BackendServices.Delete(g.project, g.backendServiceName()).Do()
+	if isNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, g.waitForOperation(ctx, op)
+}
+
 // getURLMap looks for the cockroach backend service.
 func (g *Google) getURLMap() (*compute.UrlMap, error) {
-	return g.computeService.UrlMaps.Get(g.project, urlMapName).Do()
+	return g.computeService.UrlMaps.Get(g.project, g.urlMapName()).Do()
 }
 
 // createURLMap creates the cockroach url map if it does not exist.
 // Requires a resolvable backend service.
 // Returns the url map resource link.
-func (g *Google) createURLMap(backendServiceLink string) (string, error) {
+func (g *Google) createURLMap(ctx context.Context, backendServiceLink string) (string, error) {
 	if urlMap, err := g.getURLMap(); err == nil {
-		log.Infof("found URLMap %s: %s", urlMapName, urlMap.SelfLink)
+		drivers.LogInfof(ctx, "found URLMap %s: %s", g.urlMapName(), urlMap.SelfLink)
 		return urlMap.SelfLink, nil
 	}
 
 	op, err := g.computeService.UrlMaps.Insert(g.project,
 		&compute.UrlMap{
-			Name:           urlMapName,
+			Name:           g.urlMapName(),
 			DefaultService: backendServiceLink,
 		}).Do()
 	if err != nil {
 		return "", err
 	}
-	if err = g.waitForOperation(op); err != nil {
+	if err = g.waitForOperation(ctx, op); err != nil {
 		return "", err
 	}
 
-	log.Infof("created URLMap %s: %s", urlMapName, op.TargetLink)
+	drivers.LogInfof(ctx, "created URLMap %s: %s", g.urlMapName(), op.TargetLink)
 	return op.TargetLink, nil
 }
 
+// deleteURLMap deletes the cockroach url map.
+// Returns false if it did not exist.
+func (g *Google) deleteURLMap(ctx context.Context) (bool, error) {
+	op, err := g.computeService.UrlMaps.Delete(g.project, g.urlMapName()).Do()
+	if isNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, g.waitForOperation(ctx, op)
+}
+
 // getHTTPProxy looks for the cockroach http proxy.
 func (g *Google) getHTTPProxy() (*compute.TargetHttpProxy, error) {
-	return g.computeService.TargetHttpProxies.Get(g.project, httpProxyName).Do()
+	return g.computeService.TargetHttpProxies.Get(g.project, g.httpProxyName()).Do()
 }
 
 // createHTTPProxy creates the cockroach http proxy if it does not exist.
 // Requires a resolvable url map.
 // Returns the http proxy resource link.
-func (g *Google) createHTTPProxy(urlMapLink string) (string, error) {
+func (g *Google) createHTTPProxy(ctx context.Context, urlMapLink string) (string, error) {
 	if proxy, err := g.getHTTPProxy(); err == nil {
-		log.Infof("found HTTPProxy %s: %s", httpProxyName, proxy.SelfLink)
+		drivers.LogInfof(ctx, "found HTTPProxy %s: %s", g.httpProxyName(), proxy.SelfLink)
 		return proxy.SelfLink, nil
 	}
 
 	op, err := g.computeService.TargetHttpProxies.Insert(g.project,
 		&compute.TargetHttpProxy{
-			Name:   httpProxyName,
+			Name:   g.httpProxyName(),
 			UrlMap: urlMapLink,
 		}).Do()
 	if err != nil {
 		return "", err
 	}
-	if err = g.waitForOperation(op); err != nil {
+	if err = g.waitForOperation(ctx, op); err != nil {
 		return "", err
 	}
 
-	log.Infof("create HTTPProxy %s: %s", httpProxyName, op.TargetLink)
+	drivers.LogInfof(ctx, "create HTTPProxy %s: %s", g.httpProxyName(), op.TargetLink)
 	return op.TargetLink, nil
 }
 
+// deleteHTTPProxy deletes the cockroach http proxy.
+// Returns false if it did not exist.
+func (g *Google) deleteHTTPProxy(ctx context.Context) (bool, error) {
+	op, err := g.computeService.TargetHttpProxies.Delete(g.project, g.httpProxyName()).Do()
+	if isNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, g.waitForOperation(ctx, op)
+}
+
 func errorFromOperationError(opError *compute.OperationError) error {
 	if opError == nil {
 		return nil
@@ -286,12 +470,12 @@ func errorFromOperationError(opError *compute.OperationError) error {
 
 // Repeatedly poll the given operation until its status is DONE, then return its Error.
 // We determine whether it's a zone or global operation by parsing its resource link.
-// TODO(marc): give up after a while.
-func (g *Google) waitForOperation(op *compute.Operation) error {
+// Polling gives up after --operation-timeout.
+func (g *Google) waitForOperation(ctx context.Context, op *compute.Operation) error {
 	// Early out for finished ops.
 	if op.Status == "DONE" {
 		if log.V(1) {
-			log.Infof("Operation %s %s: DONE, err=%v", op.OperationType, op.TargetLink,
+			drivers.LogInfof(ctx, "Operation %s %s: DONE, err=%v", op.OperationType, op.TargetLink,
 				errorFromOperationError(op.Error))
 		}
 		return errorFromOperationError(op.Error)
@@ -307,27 +491,36 @@ func (g *Google) waitForOperation(op *compute.Operation) error {
 		log.Fatalf("unsupported operation (expect global, region, or zone): %+v", op)
 	}
 
-	for {
-		var liveOp *compute.Operation
-		var err error
-		if isGlobal {
-			liveOp, err = g.computeService.GlobalOperations.Get(g.project, op.Name).Do()
-		} else if isRegion {
-			liveOp, err = g.computeService.RegionOperations.Get(g.project, g.region, op.Name).Do()
-		} else {
-			liveOp, err = g.computeService.ZoneOperations.Get(g.project, g.zone, op.Name).Do()
-		}
-		// This usually indicates a bad operation object.
-		if err != nil {
-			return util.Errorf("could not lookup operation %+v: %s", op, err)
-		}
-		if log.V(1) {
-			log.Infof("Operation %s %s: %s, err=%v", liveOp.OperationType, liveOp.TargetLink,
-				liveOp.Status, errorFromOperationError(liveOp.Error))
-		}
-		if liveOp.Status == "DONE" {
-			return errorFromOperationError(liveOp.Error)
-		}
-		time.Sleep(time.Second)
+	// API errors are retried by the transport, so any error here ends polling.
+	var opErr error
+	err := drivers.Poll(ctx, drivers.OperationPollOptions(g.context, nil),
+		fmt.Sprintf("waiting for operation %s %s", op.OperationType, op.TargetLink),
+		func() (bool, error) {
+			var liveOp *compute.Operation
+			var err error
+			if isGlobal {
+				liveOp, err = g.computeService.GlobalOperations.Get(g.project, op.Name).Do()
+			} else if isRegion {
+				liveOp, err = g.computeService.RegionOperations.Get(g.project, g.region, op.Name).Do()
+			} else {
+				liveOp, err = g.computeService.ZoneOperations.Get(g.project, g.zone, op.Name).Do()
+			}
+			// This usually indicates a bad operation object.
+			if err != nil {
+				return false, util.Errorf("could not lookup operation %+v: %s", op, err)
+			}
+			if log.V(1) {
+				drivers.LogInfof(ctx, "Operation %s %s: %s, err=%v", liveOp.OperationType, liveOp.TargetLink,
+					liveOp.Status, errorFromOperationError(liveOp.Error))
+			}
+			if liveOp.Status != "DONE" {
+				return false, nil
+			}
+			opErr = errorFromOperationError(liveOp.Error)
+			return true, nil
+		})
+	if err != nil {
+		return err
 	}
+	return opErr
 }
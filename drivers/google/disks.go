@@ -0,0 +1,106 @@
+// Copyright 2015 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+//
+// Author: Marc Berhault (marc@cockroachlabs.com)
+
+package google
+
+import (
+	compute "google.golang.org/api/compute/v1"
+
+	"github.com/cockroachdb/cockroach-prod/drivers"
+	"golang.org/x/net/context"
+)
+
+const (
+	defaultDiskType = "pd-standard"
+	diskNameSuffix  = "-data"
+	// The disk shows up as /dev/disk/by-id/google-<device name> on the instance.
+	diskDeviceName = "cockroach-data"
+	diskDevicePath = "/dev/disk/by-id/google-" + diskDeviceName
+	diskAttachMode = "READ_WRITE"
+	diskMountPoint = "/mnt/data"
+)
+
+// diskName returns the name of the persistent disk for the given node.
+func diskName(nodeName string) string {
+	return nodeName + diskNameSuffix
+}
+
+// getDisk looks for the persistent disk of the given node.
+func (g *Google) getDisk(nodeName string) (*compute.Disk, error) {
+	return g.computeService.Disks.Get(g.project, g.zone, diskName(nodeName)).Do()
+}
+
+// createDisk creates the persistent disk for the given node.
+func (g *Google) createDisk(ctx context.Context, nodeName string) (*compute.Disk, error) {
+	diskType := g.context.VolumeType
+	if diskType == "" {
+		diskType = defaultDiskType
+	}
+
+	op, err := g.computeService.Disks.Insert(g.project, g.zone,
+		&compute.Disk{
+			Name:   diskName(nodeName),
+			SizeGb: g.context.VolumeSize,
+			Type:   zoneBasePath(g.computeService, g.project, g.zone) + "diskTypes/" + diskType,
+		}).Do()
+	if err != nil {
+		return nil, err
+	}
+	if err = g.waitForOperation(ctx, op); err != nil {
+		return nil, err
+	}
+	drivers.LogInfof(ctx, "created Disk %s: %s", diskName(nodeName), op.TargetLink)
+	return g.getDisk(nodeName)
+}
+
+// attachDisk attaches the disk (specified by resource link) to the instance.
+func (g *Google) attachDisk(ctx context.Context, instanceName, diskLink string) error {
+	op, err := g.computeService.Instances.AttachDisk(g.project, g.zone, instanceName,
+		&compute.AttachedDisk{
+			Source:     diskLink,
+			DeviceName: diskDeviceName,
+			Mode:       diskAttachMode,
+		}).Do()
+	if err != nil {
+		return err
+	}
+	return g.waitForOperation(ctx, op)
+}
+
+// deleteDisk deletes the persistent disk of the given node.
+// Returns false if it did not exist.
+func (g *Google) deleteDisk(ctx context.Context, nodeName string) (bool, error) {
+	op, err := g.computeService.Disks.Delete(g.project, g.zone, diskName(nodeName)).Do()
+	if isNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, g.waitForOperation(ctx, op)
+}
+
+// isDiskAttachedTo returns true if the disk is attached to the instance
+// (specified by resource link).
+func isDiskAttachedTo(disk *compute.Disk, instanceLink string) bool {
+	for _, user := range disk.Users {
+		if user == instanceLink {
+			return true
+		}
+	}
+	return false
+}
@@ -19,6 +19,9 @@ package google
 
 import (
 	"fmt"
+	"net/http"
+	"path"
+	"strings"
 
 	// The package names are "compute", "resourceviews", etc... but we specify them
 	// for clarify.
@@ -30,14 +33,19 @@ import (
 	"github.com/cockroachdb/cockroach-prod/drivers"
 	"github.com/cockroachdb/cockroach/util"
 	"github.com/cockroachdb/cockroach/util/log"
+	"golang.org/x/net/context"
 )
 
 const (
 	dockerMachineDriverName = "google"
+	googleCertsDir          = "/home/docker-user/certs"
 	googleDataDir           = "/home/docker-user/data"
-	// for now, we always run in zone <region>-a.
-	// TODO(marc): allow custom value.
-	zoneSuffix = "-a"
+	// Unless --zone is specified, we run in zone <region>-a.
+	defaultZoneSuffix = "-a"
+	// Project metadata key holding the cluster lock is <prefix><cluster name>.
+	// Compute resources do not support labels, and project metadata updates
+	// can be made conditional on the metadata fingerprint.
+	lockMetadataKeyPrefix = "cockroach-prod-lock-"
 )
 
 // Google implements a driver for Google Compute Engine.
@@ -66,13 +74,24 @@ type config struct {
 	internalIPAddress     string
 	link                  string
 	forwardingRuleAddress string
+	// Set if the node has a persistent disk.
+	volumeMountPoint string
 }
 
-// DataDir returns the data directory.
+// DataDir returns the data directory: the persistent disk if the node has one,
+// the instance disk otherwise.
 func (cfg *config) DataDir() string {
+	if cfg.volumeMountPoint != "" {
+		return cfg.volumeMountPoint
+	}
 	return googleDataDir
 }
 
+// CertsDir returns the certificates directory.
+func (cfg *config) CertsDir() string {
+	return googleCertsDir
+}
+
 // IPAddress returns the IP address we will listen on.
 func (cfg *config) IPAddress() string {
 	return cfg.internalIPAddress
@@ -85,11 +104,15 @@ func (cfg *config) GossipAddress() string {
 
 // NewDriver returns an initialized Google driver.
 func NewDriver(context *base.Context, region string) *Google {
+	zone := context.Zone
+	if zone == "" {
+		zone = region + defaultZoneSuffix
+	}
 	return &Google{
 		context: context,
 		region:  region,
 		project: context.GCEProject,
-		zone:    region + zoneSuffix,
+		zone:    zone,
 	}
 }
 
@@ -105,10 +128,23 @@ func (g *Google) DockerMachineDriver() string {
 
 // Init creates and and initializes the compute client.
 func (g *Google) Init() error {
+	if !strings.HasPrefix(g.zone, g.region+"-") {
+		return base.ValidationErrorf("zone %s is not in region %s", g.zone, g.region)
+	}
+	if !g.context.Insecure {
+		return base.ValidationErrorf("secure mode is not supported on Google Compute Engine: the load " +
+			"balancer cannot health-check secure nodes, run with --insecure")
+	}
+
 	// Initialize auth: we re-use the code from docker-machine.
-	oauthClient, err := newOauthClient(g.context.GCETokenPath)
+	// API calls failing with rate-limit or server errors are retried by the transport.
+	transport := &retryTransport{
+		base: http.DefaultTransport,
+		opts: drivers.APIRetryOptions(g.context, nil),
+	}
+	oauthClient, err := newOauthClient(g.context.GCETokenPath, transport)
 	if err != nil {
-		return util.Errorf("could not get OAuth client: %v", err)
+		return base.NewError(base.CredentialsError, err, "getting OAuth client")
 	}
 
 	cSvc, err := compute.New(oauthClient)
@@ -134,21 +170,96 @@ func (g *Google) Init() error {
 // DockerMachineCreateArgs returns the list of driver-specific arguments
 // to pass to 'docker-machine create'
 // TODO(marc): there are many other flags, see 'docker-machine help create'
-func (g *Google) DockerMachineCreateArgs() []string {
+func (g *Google) DockerMachineCreateArgs(name string) ([]string, error) {
 	return []string{
 		"--google-project", g.project,
 		"--google-auth-token", g.context.GCETokenPath,
-	}
+		"--google-zone", g.zone,
+	}, nil
 }
 
-// PrintStatus prints the load balancer address to stdout.
-func (g *Google) PrintStatus() {
+// GetStatus looks up the forwarding rule and firewall rule.
+func (g *Google) GetStatus() *drivers.ClusterStatus {
+	status := &drivers.ClusterStatus{
+		Driver: dockerMachineDriverName,
+		Region: g.region,
+	}
+
 	rule, err := g.getForwardingRule()
 	if err != nil {
-		fmt.Println("Forwarding Rule: not found:", err)
+		status.Errors = append(status.Errors, fmt.Sprintf("forwarding rule: %v", err))
+	} else {
+		status.LoadBalancerAddress = fmt.Sprintf("%s:%d", rule.IPAddress, g.context.Port)
+	}
+
+	firewall, err := g.getFirewallRule()
+	if err != nil {
+		status.Errors = append(status.Errors, fmt.Sprintf("firewall rule: %v", err))
+	} else {
+		status.Firewall = firewall.Name
+		status.AllowedCIDRs = firewall.SourceRanges
+	}
+	return status
+}
+
+// GetNodeStatus looks up the instance and its instance group membership.
+func (g *Google) GetNodeStatus(name string, cfg *drivers.HostConfig, status *drivers.NodeStatus) {
+	instance, err := g.getInstanceDetails(cfg.Driver.(*config).MachineName)
+	if err != nil {
+		status.Errors = append(status.Errors, fmt.Sprintf("instance: %v", err))
 		return
 	}
-	fmt.Printf("Forwarding Rule: %s:%d\n", rule.IPAddress, g.context.Port)
+	status.InstanceID = fmt.Sprintf("%d", instance.Id)
+	status.InstanceState = instance.Status
+	status.Zone = path.Base(instance.Zone)
+	if len(instance.NetworkInterfaces) > 0 {
+		iface := instance.NetworkInterfaces[0]
+		status.InternalIP = iface.NetworkIP
+		if len(iface.AccessConfigs) > 0 {
+			status.ExternalIP = iface.AccessConfigs[0].NatIP
+		}
+	}
+
+	status.InLoadBalancer, err = g.isInstanceInGroup(instance.SelfLink)
+	if err != nil {
+		status.Errors = append(status.Errors, fmt.Sprintf("instance group: %v", err))
+	}
+	if status.InLoadBalancer {
+		status.InService, err = g.IsNodeInService(context.Background(), name, cfg)
+		if err != nil {
+			status.Errors = append(status.Errors, fmt.Sprintf("backend service health: %v", err))
+		}
+	}
+}
+
+// GetInstanceState looks up the GCE instance status.
+func (g *Google) GetInstanceState(name string, cfg *drivers.HostConfig) (drivers.InstanceState, error) {
+	instance, err := g.getInstanceDetails(cfg.Driver.(*config).MachineName)
+	if isNotFound(err) {
+		return drivers.InstanceMissing, nil
+	}
+	if err != nil {
+		return drivers.InstanceUnknown, err
+	}
+	switch instance.Status {
+	case "RUNNING":
+		return drivers.InstanceRunning, nil
+	case "TERMINATED":
+		// Stopped GCE instances are reported as TERMINATED.
+		return drivers.InstanceStopped, nil
+	case "PROVISIONING", "STAGING", "STOPPING":
+		return drivers.InstancePending, nil
+	}
+	return drivers.InstanceUnknown, nil
+}
+
+// LoadBalancerAddress returns the IP address of the forwarding rule.
+func (g *Google) LoadBalancerAddress() (string, error) {
+	rule, err := g.getForwardingRule()
+	if err != nil {
+		return "", err
+	}
+	return rule.IPAddress, nil
 }
 
 // GetNodeConfig takes a node name and reads its docker-machine config.
@@ -182,10 +293,20 @@ func (g *Google) GetNodeConfig(name string) (*drivers.HostConfig, error) {
 	}
 	cfg.Driver.(*config).forwardingRuleAddress = rule.IPAddress
 
-	return cfg, err
+	// Use the persistent disk if there is one.
+	_, err = g.getDisk(name)
+	if err == nil {
+		driverCfg.volumeMountPoint = diskMountPoint
+	} else if !isNotFound(err) {
+		return nil, err
+	}
+
+	return cfg, nil
 }
 
 // AfterFirstNode runs any steps needed after the first node was created.
+// The HTTP health check and backend service cannot check nodes running in
+// secure mode: Init only allows insecure mode.
 // The cloud compute HTTP load balancer setup is really convoluted:
 // https://cloud.google.com/compute/docs/load-balancing/http/#fundamentals
 // Things we create (children must be created before their parents):
@@ -196,59 +317,173 @@ func (g *Google) GetNodeConfig(name string) (*drivers.HostConfig, error) {
 //       - backend service
 //         - health check
 //         - instance group
-func (g *Google) AfterFirstNode() error {
-	log.Info("creating firewall rule")
-	_, err := g.createFirewallRule()
+func (g *Google) AfterFirstNode(ctx context.Context) error {
+	drivers.LogInfof(ctx, "creating firewall rule")
+	_, err := g.createFirewallRule(ctx)
 	if err != nil {
 		return util.Errorf("failed to create firewall rule: %v", err)
 	}
 
-	log.Info("creating instance group")
-	instanceGroupLink, err := g.createInstanceGroup()
+	drivers.LogInfof(ctx, "creating instance group")
+	instanceGroupLink, err := g.createInstanceGroup(ctx)
 	if err != nil {
 		return util.Errorf("failed to create instance group: %v", err)
 	}
 
-	log.Info("creating health check")
-	healthCheckLink, err := g.createHealthCheck()
+	drivers.LogInfof(ctx, "creating health check")
+	healthCheckLink, err := g.createHealthCheck(ctx)
 	if err != nil {
 		return util.Errorf("failed to create health check: %v", err)
 	}
 
-	log.Info("creating backend service")
-	backendServiceLink, err := g.createBackendService(healthCheckLink, instanceGroupLink)
+	drivers.LogInfof(ctx, "creating backend service")
+	backendServiceLink, err := g.createBackendService(ctx, healthCheckLink, instanceGroupLink)
 	if err != nil {
 		return util.Errorf("failed to create backend service: %v", err)
 	}
 
-	log.Info("creating URL map")
-	urlMapLink, err := g.createURLMap(backendServiceLink)
+	drivers.LogInfof(ctx, "creating URL map")
+	urlMapLink, err := g.createURLMap(ctx, backendServiceLink)
 	if err != nil {
 		return util.Errorf("failed to create URL map: %v", err)
 	}
 
-	log.Info("creating HTTP proxy")
-	httpProxyLink, err := g.createHTTPProxy(urlMapLink)
+	drivers.LogInfof(ctx, "creating HTTP proxy")
+	httpProxyLink, err := g.createHTTPProxy(ctx, urlMapLink)
 	if err != nil {
 		return util.Errorf("failed to create HTTP proxy: %v", err)
 	}
 
-	log.Info("creating forwarding rule")
-	_, err = g.createForwardingRule(httpProxyLink)
+	drivers.LogInfof(ctx, "creating forwarding rule")
+	_, err = g.createForwardingRule(ctx, httpProxyLink)
 	if err != nil {
 		return util.Errorf("failed to create forwarding rule: %v", err)
 	}
 	return nil
 }
 
+// PrepareNode attaches and mounts the node's persistent disk. If a freshly
+// created node does not have one and a volume size is set, the disk is
+// created first. Otherwise, the node uses the instance disk.
+func (g *Google) PrepareNode(ctx context.Context, name string, cfg *drivers.HostConfig, created bool) error {
+	driverCfg := cfg.Driver.(*config)
+	disk, err := g.getDisk(name)
+	if isNotFound(err) {
+		if !created || g.context.VolumeSize == 0 {
+			return nil
+		}
+		drivers.LogInfof(ctx, "creating %dGB persistent disk for node %s", g.context.VolumeSize, name)
+		disk, err = g.createDisk(ctx, name)
+	}
+	if err != nil {
+		return util.Errorf("failed to get persistent disk: %v", err)
+	}
+
+	if !isDiskAttachedTo(disk, driverCfg.link) {
+		drivers.LogInfof(ctx, "attaching persistent disk %s to node %s", disk.Name, name)
+		err = g.attachDisk(ctx, driverCfg.MachineName, disk.SelfLink)
+		if err != nil {
+			return util.Errorf("failed to attach persistent disk %s: %v", disk.Name, err)
+		}
+	}
+
+	err = docker.MountVolume(ctx, name, diskDevicePath, diskMountPoint)
+	if err != nil {
+		return util.Errorf("failed to mount persistent disk %s: %v", disk.Name, err)
+	}
+	driverCfg.volumeMountPoint = diskMountPoint
+	return nil
+}
+
+// AfterNodeRemoved deletes the node's persistent disk, if any.
+func (g *Google) AfterNodeRemoved(ctx context.Context, name string) error {
+	deleted, err := g.deleteDisk(ctx, name)
+	if err != nil {
+		return util.Errorf("failed to delete persistent disk for %s: %v", name, err)
+	}
+	if deleted {
+		drivers.LogInfof(ctx, "deleted Disk %s", diskName(name))
+	}
+	return nil
+}
+
 // StartNode adds the node to the load balancer.
-func (g *Google) StartNode(name string, cfg *drivers.HostConfig) error {
-	log.Infof("Adding node %s to instance group", name)
-	return g.addInstanceToGroup(cfg.Driver.(*config).link)
+func (g *Google) StartNode(ctx context.Context, name string, cfg *drivers.HostConfig) error {
+	drivers.LogInfof(ctx, "Adding node %s to instance group", name)
+	return g.addInstanceToGroup(ctx, cfg.Driver.(*config).link)
 }
 
 // StopNode removes the node from the load balancer.
-func (g *Google) StopNode(name string, cfg *drivers.HostConfig) error {
-	log.Infof("Removing node %s from instance group", name)
-	return g.removeInstanceFromGroup(cfg.Driver.(*config).link)
+func (g *Google) StopNode(ctx context.Context, name string, cfg *drivers.HostConfig) error {
+	drivers.LogInfof(ctx, "Removing node %s from instance group", name)
+	return g.removeInstanceFromGroup(ctx, cfg.Driver.(*config).link)
+}
+
+// IsNodeInService returns true if the backend service reports the node as healthy.
+func (g *Google) IsNodeInService(ctx context.Context, name string, cfg *drivers.HostConfig) (bool, error) {
+	group, err := g.getInstanceGroup()
+	if err != nil {
+		return false, err
+	}
+	return g.isInstanceHealthy(group.SelfLink, cfg.Driver.(*config).link)
+}
+
+// Teardown deletes the load balancer setup created by AfterFirstNode.
+// Parents must be deleted before their children, so we go in the
+// reverse order of creation.
+func (g *Google) Teardown(ctx context.Context) error {
+	steps := []struct {
+		kind   string
+		name   string
+		delete func(context.Context) (bool, error)
+	}{
+		{"ForwardingRule", g.forwardingRuleName(), g.deleteForwardingRule},
+		{"HTTPProxy", g.httpProxyName(), g.deleteHTTPProxy},
+		{"URLMap", g.urlMapName(), g.deleteURLMap},
+		{"BackendService", g.backendServiceName(), g.deleteBackendService},
+		{"HealthCheck", g.healthCheckName(), g.deleteHealthCheck},
+		{"InstanceGroup", g.instanceGroupName(), g.deleteInstanceGroup},
+		{"FirewallRule", g.firewallRuleName(), g.deleteFirewallRule},
+	}
+
+	for _, step := range steps {
+		drivers.LogInfof(ctx, "deleting %s %s", step.kind, step.name)
+		deleted, err := step.delete(ctx)
+		if err != nil {
+			return util.Errorf("failed to delete %s %s: %v", step.kind, step.name, err)
+		}
+		if deleted {
+			drivers.LogInfof(ctx, "deleted %s %s", step.kind, step.name)
+		} else {
+			drivers.LogInfof(ctx, "%s %s not found, skipping", step.kind, step.name)
+		}
+	}
+	return nil
+}
+
+// ReadLock returns the cluster lock stored in the project metadata. The
+// version is the metadata fingerprint.
+func (g *Google) ReadLock() (*drivers.Lock, string, error) {
+	value, fingerprint, err := g.getProjectMetadata(lockMetadataKeyPrefix + g.context.Cluster)
+	if err != nil {
+		return nil, "", err
+	}
+	if value == "" {
+		return nil, fingerprint, nil
+	}
+	lock, err := drivers.DecodeLock(value)
+	return lock, fingerprint, err
+}
+
+// WriteLock stores the cluster lock in the project metadata if the metadata
+// fingerprint is still 'version'.
+func (g *Google) WriteLock(lock *drivers.Lock, version string) error {
+	var value string
+	if lock != nil {
+		var err error
+		if value, err = drivers.EncodeLock(lock); err != nil {
+			return err
+		}
+	}
+	return g.setProjectMetadata(context.Background(), lockMetadataKeyPrefix+g.context.Cluster, value, version)
 }
@@ -24,33 +24,35 @@ import
 // We follow the same naming. Our API calls mention "resource views", but our comments,
 // logs, and method names say "instance groups".
 (
-	"time"
+	"fmt"
 
+	"github.com/cockroachdb/cockroach-prod/drivers"
 	"github.com/cockroachdb/cockroach/util"
 	"github.com/cockroachdb/cockroach/util/log"
+	"golang.org/x/net/context"
 	resourceviews "google.golang.org/api/resourceviews/v1beta2"
 )
 
 const (
-	instanceGroupName = "cockroach-group"
+	instanceGroupSuffix = "-group"
 )
 
 // getInstanceGroup looks for the cockroach instance group.
 func (g *Google) getInstanceGroup() (*resourceviews.ResourceView, error) {
-	return g.instanceGroupsService.ZoneViews.Get(g.project, g.zone, instanceGroupName).Do()
+	return g.instanceGroupsService.ZoneViews.Get(g.project, g.zone, g.instanceGroupName()).Do()
 }
 
 // createInstanceGroup creates the cockroach instance group if it does not exist.
 // It returns its resource link,
-func (g *Google) createInstanceGroup() (string, error) {
+func (g *Google) createInstanceGroup(ctx context.Context) (string, error) {
 	if group, err := g.getInstanceGroup(); err == nil {
-		log.Infof("found InstanceGroup %s: %s", instanceGroupName, group.SelfLink)
+		drivers.LogInfof(ctx, "found InstanceGroup %s: %s", g.instanceGroupName(), group.SelfLink)
 		return group.SelfLink, nil
 	}
 
 	op, err := g.instanceGroupsService.ZoneViews.Insert(g.project, g.zone,
 		&resourceviews.ResourceView{
-			Name: instanceGroupName,
+			Name: g.instanceGroupName(),
 			Endpoints: []*resourceviews.ServiceEndpoint{
 				{
 					Name: "http",
@@ -61,38 +63,72 @@ func (g *Google) createInstanceGroup() (string, error) {
 	if err != nil {
 		return "", err
 	}
-	err = g.waitForInstanceGroupOperation(op)
+	err = g.waitForInstanceGroupOperation(ctx, op)
 	if err != nil {
 		return "", err
 	}
-	log.Infof("created InstanceGroup %s: %s", instanceGroupName, op.TargetLink)
+	drivers.LogInfof(ctx, "created InstanceGroup %s: %s", g.instanceGroupName(), op.TargetLink)
 	return op.TargetLink, nil
 }
 
+// deleteInstanceGroup deletes the cockroach instance group.
+// Returns false if it did not exist.
+func (g *Google) deleteInstanceGroup(ctx context.Context) (bool, error) {
+	op, err := g.instanceGroupsService.ZoneViews.Delete(g.project, g.zone, g.instanceGroupName()).Do()
+	if isNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, g.waitForInstanceGroupOperation(ctx, op)
+}
+
 // addInstanceToGroup adds the instance (specified by resource link) to the
 // cockroach instance group.
-func (g *Google) addInstanceToGroup(instanceLink string) error {
-	op, err := g.instanceGroupsService.ZoneViews.AddResources(g.project, g.zone, instanceGroupName,
+func (g *Google) addInstanceToGroup(ctx context.Context, instanceLink string) error {
+	op, err := g.instanceGroupsService.ZoneViews.AddResources(g.project, g.zone, g.instanceGroupName(),
 		&resourceviews.ZoneViewsAddResourcesRequest{
 			Resources: []string{instanceLink},
 		}).Do()
 	if err != nil {
 		return err
 	}
-	return g.waitForInstanceGroupOperation(op)
+	return g.waitForInstanceGroupOperation(ctx, op)
 }
 
 // removeInstanceFromGroup removes the instance (specified by resource link) from the
 // cockroach instance group.
-func (g *Google) removeInstanceFromGroup(instanceLink string) error {
-	op, err := g.instanceGroupsService.ZoneViews.RemoveResources(g.project, g.zone, instanceGroupName,
+func (g *Google) removeInstanceFromGroup(ctx context.Context, instanceLink string) error {
+	op, err := g.instanceGroupsService.ZoneViews.RemoveResources(g.project, g.zone, g.instanceGroupName(),
 		&resourceviews.ZoneViewsRemoveResourcesRequest{
 			Resources: []string{instanceLink},
 		}).Do()
 	if err != nil {
 		return err
 	}
-	return g.waitForInstanceGroupOperation(op)
+	return g.waitForInstanceGroupOperation(ctx, op)
+}
+
+// isInstanceInGroup returns true if the instance (specified by resource link)
+// is a member of the cockroach instance group.
+func (g *Google) isInstanceInGroup(instanceLink string) (bool, error) {
+	call := g.instanceGroupsService.ZoneViews.ListResources(g.project, g.zone, g.instanceGroupName())
+	for {
+		resp, err := call.Do()
+		if err != nil {
+			return false, err
+		}
+		for _, item := range resp.Items {
+			if item.Resource == instanceLink {
+				return true, nil
+			}
+		}
+		if resp.NextPageToken == "" {
+			return false, nil
+		}
+		call = call.PageToken(resp.NextPageToken)
+	}
 }
 
 func errorFromInstanceGroupOperationError(opError *resourceviews.OperationError) error {
@@ -107,30 +143,39 @@ func errorFromInstanceGroupOperationError(opError *resourceviews.OperationError)
 
 // Repeatedly poll the given operation until its status is DONE, then return its Error.
 // We determine whether it's a zone or global operation by parsing its resource link.
-// TODO(marc): give up after a while.
-func (g *Google) waitForInstanceGroupOperation(op *resourceviews.Operation) error {
+// Polling gives up after --operation-timeout.
+func (g *Google) waitForInstanceGroupOperation(ctx context.Context, op *resourceviews.Operation) error {
 	// Early out for finished ops.
 	if op.Status == "DONE" {
 		if log.V(1) {
-			log.Infof("Operation %s %s: DONE, err=%v", op.OperationType, op.TargetLink,
+			drivers.LogInfof(ctx, "Operation %s %s: DONE, err=%v", op.OperationType, op.TargetLink,
 				errorFromInstanceGroupOperationError(op.Error))
 		}
 		return errorFromInstanceGroupOperationError(op.Error)
 	}
 
-	for {
-		liveOp, err := g.instanceGroupsService.ZoneOperations.Get(g.project, g.zone, op.Name).Do()
-		// This usually indicates a bad operation object.
-		if err != nil {
-			return util.Errorf("could not lookup operation %+v: %s", op, err)
-		}
-		if log.V(1) {
-			log.Infof("Operation %s %s: %s, err=%v", liveOp.OperationType, liveOp.TargetLink,
-				liveOp.Status, errorFromInstanceGroupOperationError(liveOp.Error))
-		}
-		if liveOp.Status == "DONE" {
-			return errorFromInstanceGroupOperationError(liveOp.Error)
-		}
-		time.Sleep(time.Second)
+	// API errors are retried by the transport, so any error here ends polling.
+	var opErr error
+	err := drivers.Poll(ctx, drivers.OperationPollOptions(g.context, nil),
+		fmt.Sprintf("waiting for operation %s %s", op.OperationType, op.TargetLink),
+		func() (bool, error) {
+			liveOp, err := g.instanceGroupsService.ZoneOperations.Get(g.project, g.zone, op.Name).Do()
+			// This usually indicates a bad operation object.
+			if err != nil {
+				return false, util.Errorf("could not lookup operation %+v: %s", op, err)
+			}
+			if log.V(1) {
+				drivers.LogInfof(ctx, "Operation %s %s: %s, err=%v", liveOp.OperationType, liveOp.TargetLink,
+					liveOp.Status, errorFromInstanceGroupOperationError(liveOp.Error))
+			}
+			if liveOp.Status != "DONE" {
+				return false, nil
+			}
+			opErr = errorFromInstanceGroupOperationError(liveOp.Error)
+			return true, nil
+		})
+	if err != nil {
+		return err
 	}
+	return opErr
 }
@@ -0,0 +1,143 @@
+// Copyright 2015 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+//
+// Author: Marc Berhault (marc@cockroachlabs.com)
+
+package google
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+
+	"github.com/cockroachdb/cockroach-prod/drivers"
+	"golang.org/x/net/context"
+)
+
+// Returned by the API when requests are rate-limited.
+const statusTooManyRequests = 429
+
+// retryTransport is an http.RoundTripper retrying API requests failing with
+// rate-limit or server errors, or temporary network errors.
+// It is used for all compute and instance group API calls. Rate-limited and
+// unavailable requests were not applied and are retried for all methods.
+// Other errors are only retried for idempotent requests: a failed insert may
+// have been applied.
+// The API client does not take a context, so retries are not interrupted by
+// cancellation. They are bounded by --api-retry-timeout instead.
+type retryTransport struct {
+	base http.RoundTripper
+	// opts.Retryable is ignored: it is set for each request by RoundTrip.
+	opts drivers.RetryOptions
+}
+
+// retryableStatusError is returned by attempts receiving a retryable HTTP status.
+type retryableStatusError struct {
+	code   int
+	status string
+}
+
+func (err retryableStatusError) Error() string {
+	return err.status
+}
+
+// isRetryableStatus returns true for rate-limit and server errors.
+func isRetryableStatus(code int) bool {
+	return code == statusTooManyRequests || code >= http.StatusInternalServerError
+}
+
+// isNotAppliedStatus returns true for statuses returned by requests that were
+// not applied.
+func isNotAppliedStatus(code int) bool {
+	return code == statusTooManyRequests || code == http.StatusServiceUnavailable
+}
+
+// isIdempotent returns true for HTTP methods that can be sent again.
+func isIdempotent(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS", "PUT", "DELETE":
+		return true
+	}
+	return false
+}
+
+// isRetryable returns true for errors returned by retryTransport attempts
+// that should be retried. Only requests that were not applied are retried if
+// the request is not idempotent.
+func isRetryable(err error, idempotent bool) bool {
+	if statusErr, ok := err.(retryableStatusError); ok {
+		return idempotent || isNotAppliedStatus(statusErr.code)
+	}
+	netErr, ok := err.(net.Error)
+	return idempotent && ok && netErr.Temporary()
+}
+
+// RoundTrip implements http.RoundTripper. The request body is buffered and
+// each attempt sends a copy of the request, leaving the original untouched.
+// If the last attempt received an error status, that response is returned
+// so that the API client reports the API error.
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	opts := t.opts
+	idempotent := isIdempotent(req.Method)
+	opts.Retryable = func(err error) bool {
+		return isRetryable(err, idempotent)
+	}
+
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// statusResp is the response of the last attempt if it received a
+	// retryable status, with its body buffered.
+	var resp, statusResp *http.Response
+	err := drivers.Retry(context.Background(), opts, fmt.Sprintf("%s %s", req.Method, req.URL.Path), func() error {
+		attempt := *req
+		if body != nil {
+			attempt.Body = ioutil.NopCloser(bytes.NewReader(body))
+		}
+		var err error
+		statusResp = nil
+		resp, err = t.base.RoundTrip(&attempt)
+		if err != nil {
+			return err
+		}
+		if isRetryableStatus(resp.StatusCode) {
+			respBody, err := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			if err != nil {
+				return err
+			}
+			resp.Body = ioutil.NopCloser(bytes.NewReader(respBody))
+			statusResp = resp
+			return retryableStatusError{resp.StatusCode, resp.Status}
+		}
+		return nil
+	})
+	if err != nil && statusResp != nil {
+		return statusResp, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
@@ -0,0 +1,343 @@
+// Copyright 2015 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+//
+// Author: Marc Berhault (marc@cockroachlabs.com)
+
+package local
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/cockroach-prod/base"
+	"github.com/cockroachdb/cockroach-prod/docker"
+	"github.com/cockroachdb/cockroach-prod/drivers"
+	"github.com/cockroachdb/cockroach/util"
+	"golang.org/x/net/context"
+)
+
+const (
+	driverName = "local"
+	// Subnet of the docker network, if we create it.
+	defaultSubnet = "10.77.0.0/16"
+	// Timeout when checking that a node accepts connections.
+	dialTimeout = 2 * time.Second
+)
+
+// Local implements a driver running nodes as containers on the local docker
+// daemon, attached to a user-defined bridge network named after the region.
+// A haproxy container stands in for the load balancer.
+// Container addresses are only reachable from the host on Linux.
+type Local struct {
+	context *base.Context
+	network string
+
+	// mu serializes address allocation and proxy config updates, and
+	// protects reserved.
+	mu sync.Mutex
+	// reserved holds the addresses allocated by this process whose config
+	// is not written yet.
+	reserved map[string]bool
+}
+
+// config contains the local machine config.
+// Implements drivers.DriverConfig.
+type config struct {
+	MachineName string
+	Network     string
+	IP          string
+	// Dir is the machine directory on the host.
+	Dir string
+
+	// Not saved in the machine config, we look it up.
+	proxyAddress string
+}
+
+// DataDir returns the data directory on the host.
+func (cfg *config) DataDir() string {
+	return filepath.Join(cfg.Dir, "data")
+}
+
+// CertsDir returns the certificates directory on the host.
+func (cfg *config) CertsDir() string {
+	return filepath.Join(cfg.Dir, "certs")
+}
+
+// IPAddress returns the container address on the docker network.
+func (cfg *config) IPAddress() string {
+	return cfg.IP
+}
+
+// GossipAddress returns the address of the proxy.
+func (cfg *config) GossipAddress() string {
+	return cfg.proxyAddress
+}
+
+// NewDriver returns an initialized local driver. The region is the name of
+// the docker network. Machines are managed by the driver instead of
+// docker-machine.
+func NewDriver(context *base.Context, region string) *Local {
+	l := &Local{
+		context:  context,
+		network:  region,
+		reserved: map[string]bool{},
+	}
+	docker.SetMachines(&machines{driver: l})
+	return l
+}
+
+// rootDir is the directory holding local machines and proxies.
+func (l *Local) rootDir() string {
+	return filepath.Join(l.context.StateDir, driverName)
+}
+
+// Context returns the base context.
+func (l *Local) Context() *base.Context {
+	return l.context
+}
+
+// DockerMachineDriver returns an empty name: docker-machine is not used.
+func (l *Local) DockerMachineDriver() string {
+	return ""
+}
+
+// Init checks that docker is installed.
+func (l *Local) Init() error {
+	if runtime.GOOS != "linux" {
+		return base.ValidationErrorf("the local driver requires Linux, container addresses are not "+
+			"reachable from the host on %s", runtime.GOOS)
+	}
+	if l.network == "" {
+		return base.ValidationErrorf("expected a docker network name, eg: --region=local:cockroach")
+	}
+	if err := docker.CheckDocker(); err != nil {
+		return base.NewError(base.DockerError, err, "checking docker installation")
+	}
+	return nil
+}
+
+// DockerMachineCreateArgs returns nothing: docker-machine is not used.
+func (l *Local) DockerMachineCreateArgs(name string) ([]string, error) {
+	return nil, nil
+}
+
+// GetStatus looks up the proxy and the docker network, reported as the firewall.
+func (l *Local) GetStatus() *drivers.ClusterStatus {
+	status := &drivers.ClusterStatus{
+		Driver: driverName,
+		Region: l.network,
+	}
+
+	proxy, err := l.readProxyConfig()
+	if err != nil {
+		status.Errors = append(status.Errors, fmt.Sprintf("proxy: %v", err))
+	} else if proxy != nil {
+		status.LoadBalancerAddress = fmt.Sprintf("%s:%d", proxy.IP, l.context.Port)
+	}
+
+	if _, err := docker.RunDocker(context.Background(), "network", "inspect", l.network); err != nil {
+		if !strings.Contains(err.Error(), "No such") {
+			status.Errors = append(status.Errors, fmt.Sprintf("network: %v", err))
+		}
+	} else {
+		status.Firewall = l.network
+	}
+	return status
+}
+
+// GetNodeStatus looks up the cockroach container and its proxy membership.
+func (l *Local) GetNodeStatus(name string, cfg *drivers.HostConfig, status *drivers.NodeStatus) {
+	out, err := docker.RunDocker(context.Background(), "inspect", "--format", "{{.Id}} {{.State.Status}}", name)
+	if isNoSuchContainer(err) {
+		status.InstanceState = "none"
+	} else if err != nil {
+		status.Errors = append(status.Errors, fmt.Sprintf("container: %v", err))
+	} else if fields := strings.Fields(strings.Join(out, " ")); len(fields) == 2 {
+		status.InstanceID = fields[0]
+		if len(status.InstanceID) > 12 {
+			status.InstanceID = status.InstanceID[:12]
+		}
+		status.InstanceState = fields[1]
+	}
+	status.InternalIP = cfg.Driver.IPAddress()
+
+	status.InLoadBalancer, err = l.isBackend(name)
+	if err != nil {
+		status.Errors = append(status.Errors, fmt.Sprintf("proxy: %v", err))
+	}
+	if status.InLoadBalancer {
+		status.InService, _ = l.IsNodeInService(context.Background(), name, cfg)
+	}
+}
+
+// GetInstanceState looks up the cockroach container state.
+func (l *Local) GetInstanceState(name string, cfg *drivers.HostConfig) (drivers.InstanceState, error) {
+	if _, err := os.Stat(cfg.Driver.(*config).Dir); os.IsNotExist(err) {
+		return drivers.InstanceMissing, nil
+	}
+	running, err := containerRunning(context.Background(), name)
+	if err != nil {
+		return drivers.InstanceUnknown, err
+	}
+	if running {
+		return drivers.InstanceRunning, nil
+	}
+	return drivers.InstanceStopped, nil
+}
+
+// LoadBalancerAddress returns the address of the proxy.
+func (l *Local) LoadBalancerAddress() (string, error) {
+	proxy, err := l.readProxyConfig()
+	if err != nil {
+		return "", err
+	}
+	if proxy == nil {
+		return "", util.Errorf("proxy %s not found", l.proxyName())
+	}
+	return proxy.IP, nil
+}
+
+// GetNodeConfig takes a node name and reads its machine config.
+// The proxy address is looked up and filled in.
+func (l *Local) GetNodeConfig(name string) (*drivers.HostConfig, error) {
+	cfg := &drivers.HostConfig{
+		Driver: &config{},
+	}
+
+	err := docker.GetHostConfig(name, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	address, err := l.LoadBalancerAddress()
+	if err != nil {
+		return nil, util.Errorf("could not find load balancer: %v", err)
+	}
+	cfg.Driver.(*config).proxyAddress = address
+	return cfg, nil
+}
+
+// AfterFirstNode starts the proxy, with an address on the docker network.
+func (l *Local) AfterFirstNode(ctx context.Context) error {
+	proxy, err := l.readProxyConfig()
+	if err != nil {
+		return err
+	}
+	if proxy == nil {
+		ip, err := l.allocateIP(ctx)
+		if err != nil {
+			return err
+		}
+		defer l.releaseIP(ip)
+		proxy = &proxyConfig{IP: ip, Backends: map[string]string{}}
+	}
+	if err := l.writeProxyConfig(proxy); err != nil {
+		return err
+	}
+	return l.startProxy(ctx, proxy)
+}
+
+// PrepareNode does nothing: the data directory is created with the machine.
+func (l *Local) PrepareNode(ctx context.Context, name string, cfg *drivers.HostConfig, created bool) error {
+	return nil
+}
+
+// AfterNodeRemoved removes the node from the proxy backends.
+func (l *Local) AfterNodeRemoved(ctx context.Context, name string) error {
+	proxy, err := l.readProxyConfig()
+	if err != nil || proxy == nil {
+		return err
+	}
+	drivers.LogInfof(ctx, "removing %s from proxy %s", name, l.proxyName())
+	return l.updateBackends(ctx, func(backends map[string]string) {
+		delete(backends, name)
+	})
+}
+
+// StartNode adds the node to the proxy backends.
+func (l *Local) StartNode(ctx context.Context, name string, cfg *drivers.HostConfig) error {
+	drivers.LogInfof(ctx, "adding %s to proxy %s", name, l.proxyName())
+	return l.updateBackends(ctx, func(backends map[string]string) {
+		backends[name] = cfg.Driver.IPAddress()
+	})
+}
+
+// StopNode removes the node from the proxy backends.
+func (l *Local) StopNode(ctx context.Context, name string, cfg *drivers.HostConfig) error {
+	drivers.LogInfof(ctx, "removing %s from proxy %s", name, l.proxyName())
+	return l.updateBackends(ctx, func(backends map[string]string) {
+		delete(backends, name)
+	})
+}
+
+// IsNodeInService returns true if the node is a proxy backend and accepts
+// connections.
+func (l *Local) IsNodeInService(ctx context.Context, name string, cfg *drivers.HostConfig) (bool, error) {
+	inProxy, err := l.isBackend(name)
+	if err != nil || !inProxy {
+		return false, err
+	}
+	conn, err := net.DialTimeout("tcp", fmt.Sprintf("%s:%d", cfg.Driver.IPAddress(), l.context.Port), dialTimeout)
+	if err != nil {
+		return false, nil
+	}
+	_ = conn.Close()
+	return true, nil
+}
+
+// isBackend returns true if the node is a proxy backend.
+func (l *Local) isBackend(name string) (bool, error) {
+	proxy, err := l.readProxyConfig()
+	if err != nil || proxy == nil {
+		return false, err
+	}
+	_, ok := proxy.Backends[name]
+	return ok, nil
+}
+
+// Teardown removes the proxy, then the docker network unless it is still in
+// use by another cluster.
+func (l *Local) Teardown(ctx context.Context) error {
+	if _, err := docker.RunDocker(ctx, "rm", "-f", l.proxyName()); err != nil && !isNoSuchContainer(err) {
+		return err
+	}
+	if err := os.RemoveAll(l.proxyDir()); err != nil {
+		return err
+	}
+	drivers.LogInfof(ctx, "removed proxy %s", l.proxyName())
+
+	if _, err := docker.RunDocker(ctx, "network", "rm", l.network); err != nil {
+		drivers.LogInfof(ctx, "not removing docker network %s: %v", l.network, err)
+	}
+	return nil
+}
+
+// ReadLock returns ErrNoLockStore: the cluster lock is kept in the local
+// state directory.
+func (l *Local) ReadLock() (*drivers.Lock, string, error) {
+	return nil, "", drivers.ErrNoLockStore
+}
+
+// WriteLock returns ErrNoLockStore: the cluster lock is kept in the local
+// state directory.
+func (l *Local) WriteLock(lock *drivers.Lock, version string) error {
+	return drivers.ErrNoLockStore
+}
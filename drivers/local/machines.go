@@ -0,0 +1,336 @@
+// Copyright 2015 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+//
+// Author: Marc Berhault (marc@cockroachlabs.com)
+
+package local
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/cockroachdb/cockroach-prod/docker"
+	"github.com/cockroachdb/cockroach-prod/drivers"
+	"github.com/cockroachdb/cockroach/util"
+	"golang.org/x/net/context"
+)
+
+const (
+	machineConfigFile = "machine.json"
+	// Node addresses are allocated from this offset in the network subnet,
+	// leaving the first addresses to the gateway.
+	firstHostOffset = 10
+	// Image used to delete files written by containers as root.
+	cleanupImage = "busybox"
+	// Commands run on local machines run as the current user, who owns the
+	// node directories: sudo is not needed.
+	sudoShim = `sudo() { "$@"; }; `
+)
+
+// machines implements docker.Machines for nodes running as containers on the
+// local docker daemon. A machine is a directory holding the node config, data
+// and certificates. The cockroach container is named after the machine, and
+// the machine is running if the container is.
+type machines struct {
+	driver *Local
+}
+
+func (m *machines) dir(name string) string {
+	return filepath.Join(m.driver.rootDir(), "machines", name)
+}
+
+func (m *machines) List() ([]string, error) {
+	infos, err := ioutil.ReadDir(filepath.Join(m.driver.rootDir(), "machines"))
+	if os.IsNotExist(err) {
+		return []string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	ret := []string{}
+	for _, info := range infos {
+		if info.IsDir() {
+			ret = append(ret, info.Name())
+		}
+	}
+	return ret, nil
+}
+
+func (m *machines) Inspect(name string, config *drivers.HostConfig) error {
+	contents, err := ioutil.ReadFile(filepath.Join(m.dir(name), machineConfigFile))
+	if os.IsNotExist(err) {
+		return util.Errorf("machine %s does not exist", name)
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(contents, config)
+}
+
+func (m *machines) State(name string) (string, error) {
+	if _, err := os.Stat(m.dir(name)); err != nil {
+		if os.IsNotExist(err) {
+			return "", util.Errorf("machine %s does not exist", name)
+		}
+		return "", err
+	}
+	running, err := containerRunning(context.Background(), name)
+	if err != nil {
+		return "", err
+	}
+	if running {
+		return "Running", nil
+	}
+	return "Stopped", nil
+}
+
+// DockerFlags is empty: all machines use the local docker daemon.
+func (m *machines) DockerFlags(name string) ([]string, error) {
+	return []string{}, nil
+}
+
+// Create allocates an address on the docker network and creates the machine
+// directory.
+func (m *machines) Create(ctx context.Context, driver drivers.Driver, name string) error {
+	drivers.LogInfof(ctx, "creating local machine %s", name)
+	dir := m.dir(name)
+	if _, err := os.Stat(dir); err == nil {
+		return util.Errorf("machine %s already exists", name)
+	}
+
+	ip, err := m.driver.allocateIP(ctx)
+	if err != nil {
+		return err
+	}
+	defer m.driver.releaseIP(ip)
+	cfg := &drivers.HostConfig{
+		DriverName: driverName,
+		Driver: &config{
+			MachineName: name,
+			Network:     m.driver.network,
+			IP:          ip,
+			Dir:         dir,
+		},
+	}
+	if err := os.MkdirAll(cfg.Driver.DataDir(), 0700); err != nil {
+		return err
+	}
+	contents, err := json.MarshalIndent(cfg, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, machineConfigFile), contents, 0600); err != nil {
+		return err
+	}
+	drivers.LogInfof(ctx, "created local machine %s with address %s", name, ip)
+	return nil
+}
+
+// Start only checks that the machine exists: the cockroach container is
+// started separately.
+func (m *machines) Start(ctx context.Context, name string) error {
+	if _, err := os.Stat(m.dir(name)); err != nil {
+		return util.Errorf("machine %s does not exist", name)
+	}
+	return nil
+}
+
+// Stop stops the cockroach container.
+func (m *machines) Stop(ctx context.Context, name string) error {
+	drivers.LogInfof(ctx, "stopping local machine %s", name)
+	_, err := docker.RunDocker(ctx, "stop", name)
+	if err != nil && !isNoSuchContainer(err) {
+		return err
+	}
+	return nil
+}
+
+// Remove removes the cockroach container and the machine directory. The data
+// directory is written to by cockroach as root, so it is emptied from a
+// container.
+func (m *machines) Remove(ctx context.Context, name string) error {
+	drivers.LogInfof(ctx, "removing local machine %s", name)
+	if _, err := docker.RunDocker(ctx, "rm", "-f", name); err != nil && !isNoSuchContainer(err) {
+		return err
+	}
+	dir := m.dir(name)
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		return nil
+	}
+	if _, err := docker.RunDocker(ctx, "run", "--rm", "-v", fmt.Sprintf("%s:/machine", dir),
+		cleanupImage, "rm", "-rf", "/machine/data"); err != nil {
+		return util.Errorf("could not delete data directory: %v", err)
+	}
+	return os.RemoveAll(dir)
+}
+
+// Run runs the command on the local host.
+func (m *machines) Run(ctx context.Context, name string, command string) ([]string, error) {
+	return docker.RunOutput(ctx, exec.Command("sh", "-c", sudoShim+command))
+}
+
+func (m *machines) Copy(ctx context.Context, name string, files []string, remoteDir string) error {
+	for _, f := range files {
+		drivers.LogInfof(ctx, "copying %s to %s:%s", f, name, remoteDir)
+		contents, err := ioutil.ReadFile(f)
+		if err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(filepath.Join(remoteDir, filepath.Base(f)), contents, 0600); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ContainerName returns the machine name: all cockroach containers share the
+// local docker daemon.
+func (m *machines) ContainerName(name string) string {
+	return name
+}
+
+// NetworkArgs attaches the cockroach container to the docker network with
+// the machine address.
+func (m *machines) NetworkArgs(name string, settings *drivers.HostConfig, port int64) []string {
+	cfg := settings.Driver.(*config)
+	return []string{
+		"--net", cfg.Network,
+		"--ip", cfg.IP,
+	}
+}
+
+// usedIPs returns the addresses of all local machines and proxies.
+func (l *Local) usedIPs() (map[string]bool, error) {
+	used := map[string]bool{}
+	for _, pattern := range []string{
+		filepath.Join(l.rootDir(), "machines", "*", machineConfigFile),
+		filepath.Join(l.rootDir(), "proxies", "*", proxyConfigFile),
+	} {
+		paths, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, err
+		}
+		for _, path := range paths {
+			contents, err := ioutil.ReadFile(path)
+			if err != nil {
+				return nil, err
+			}
+			// Machine and proxy configs both have an IP field.
+			var cfg struct {
+				Driver struct{ IP string }
+				IP     string
+			}
+			if err := json.Unmarshal(contents, &cfg); err != nil {
+				return nil, util.Errorf("could not parse %s: %v", path, err)
+			}
+			used[cfg.Driver.IP] = true
+			used[cfg.IP] = true
+		}
+	}
+	return used, nil
+}
+
+// allocateIP returns the first free address in the docker network subnet,
+// creating the network if needed. The address is reserved until releaseIP is
+// called, which must happen after the config holding it is written: parallel
+// allocations only see addresses in written configs.
+func (l *Local) allocateIP(ctx context.Context) (string, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	subnet, err := l.ensureNetwork(ctx)
+	if err != nil {
+		return "", err
+	}
+	used, err := l.usedIPs()
+	if err != nil {
+		return "", err
+	}
+
+	base := subnet.IP.To4()
+	if base == nil {
+		return "", util.Errorf("network %s subnet %s is not IPv4", l.network, subnet)
+	}
+	start := binary.BigEndian.Uint32(base)
+	for i := uint32(firstHostOffset); ; i++ {
+		ip := make(net.IP, 4)
+		binary.BigEndian.PutUint32(ip, start+i)
+		if !subnet.Contains(ip) {
+			return "", util.Errorf("no free address left in network %s subnet %s", l.network, subnet)
+		}
+		if !used[ip.String()] && !l.reserved[ip.String()] {
+			l.reserved[ip.String()] = true
+			return ip.String(), nil
+		}
+	}
+}
+
+// releaseIP drops the reservation made by allocateIP.
+func (l *Local) releaseIP(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.reserved, ip)
+}
+
+// ensureNetwork creates the docker network if it does not exist, and returns
+// its subnet.
+func (l *Local) ensureNetwork(ctx context.Context) (*net.IPNet, error) {
+	out, err := docker.RunDocker(ctx, "network", "inspect",
+		"--format", "{{range .IPAM.Config}}{{.Subnet}} {{end}}", l.network)
+	if err != nil {
+		drivers.LogInfof(ctx, "creating docker network %s with subnet %s", l.network, defaultSubnet)
+		if _, err := docker.RunDocker(ctx, "network", "create", "--driver", "bridge",
+			"--subnet", defaultSubnet, l.network); err != nil {
+			return nil, util.Errorf("could not create docker network %s: %v", l.network, err)
+		}
+		out = []string{defaultSubnet}
+	}
+
+	subnets := strings.Fields(strings.Join(out, " "))
+	if len(subnets) == 0 {
+		return nil, util.Errorf("docker network %s has no configured subnet, node addresses "+
+			"cannot be assigned", l.network)
+	}
+	_, subnet, err := net.ParseCIDR(subnets[0])
+	if err != nil {
+		return nil, util.Errorf("could not parse docker network %s subnet: %v", l.network, err)
+	}
+	return subnet, nil
+}
+
+// containerRunning returns true if the container exists and is running.
+func containerRunning(ctx context.Context, name string) (bool, error) {
+	out, err := docker.RunDocker(ctx, "inspect", "--format", "{{.State.Running}}", name)
+	if isNoSuchContainer(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return len(out) == 1 && strings.TrimSpace(out[0]) == "true", nil
+}
+
+// isNoSuchContainer returns true if the docker command failed because the
+// container does not exist.
+func isNoSuchContainer(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "No such")
+}
@@ -0,0 +1,141 @@
+// Copyright 2015 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+//
+// Author: Marc Berhault (marc@cockroachlabs.com)
+
+package local
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/cockroachdb/cockroach-prod/docker"
+	"github.com/cockroachdb/cockroach-prod/drivers"
+	"github.com/cockroachdb/cockroach/util"
+	"golang.org/x/net/context"
+)
+
+const (
+	proxyConfigFile  = "proxy.json"
+	haproxyConfig    = "haproxy.cfg"
+	proxyImage       = "haproxy:1.5"
+	proxyConfigMount = "/usr/local/etc/haproxy/haproxy.cfg"
+)
+
+// proxyConfig describes the TCP proxy standing in for the load balancer.
+type proxyConfig struct {
+	IP string
+	// Backends maps node names to addresses.
+	Backends map[string]string
+}
+
+func (l *Local) proxyName() string {
+	return l.context.Cluster + "-lb"
+}
+
+func (l *Local) proxyDir() string {
+	return filepath.Join(l.rootDir(), "proxies", l.context.Cluster)
+}
+
+// readProxyConfig returns the proxy config, or nil if there is no proxy.
+func (l *Local) readProxyConfig() (*proxyConfig, error) {
+	contents, err := ioutil.ReadFile(filepath.Join(l.proxyDir(), proxyConfigFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	cfg := &proxyConfig{}
+	if err := json.Unmarshal(contents, cfg); err != nil {
+		return nil, err
+	}
+	if cfg.Backends == nil {
+		cfg.Backends = map[string]string{}
+	}
+	return cfg, nil
+}
+
+// writeProxyConfig saves the proxy config and generates the haproxy config
+// from it.
+func (l *Local) writeProxyConfig(cfg *proxyConfig) error {
+	if err := os.MkdirAll(l.proxyDir(), 0700); err != nil {
+		return err
+	}
+	contents, err := json.MarshalIndent(cfg, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(l.proxyDir(), proxyConfigFile), contents, 0600); err != nil {
+		return err
+	}
+
+	names := make([]string, 0, len(cfg.Backends))
+	for name := range cfg.Backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "global\n  maxconn 4096\n\n")
+	fmt.Fprintf(&buf, "defaults\n  mode tcp\n  timeout connect 5s\n  timeout client 1m\n  timeout server 1m\n\n")
+	fmt.Fprintf(&buf, "listen cockroach\n  bind :%d\n  balance roundrobin\n", l.context.Port)
+	for _, name := range names {
+		fmt.Fprintf(&buf, "  server %s %s:%d check\n", name, cfg.Backends[name], l.context.Port)
+	}
+	// The file is bind-mounted in the proxy container: rewrite it in place.
+	return ioutil.WriteFile(filepath.Join(l.proxyDir(), haproxyConfig), buf.Bytes(), 0644)
+}
+
+// startProxy (re)creates the proxy container.
+func (l *Local) startProxy(ctx context.Context, cfg *proxyConfig) error {
+	if _, err := docker.RunDocker(ctx, "rm", "-f", l.proxyName()); err != nil && !isNoSuchContainer(err) {
+		return err
+	}
+	drivers.LogInfof(ctx, "starting proxy %s at %s:%d", l.proxyName(), cfg.IP, l.context.Port)
+	_, err := docker.RunDocker(ctx, "run", "-d",
+		"--name", l.proxyName(),
+		"--net", l.network,
+		"--ip", cfg.IP,
+		"-v", fmt.Sprintf("%s:%s:ro", filepath.Join(l.proxyDir(), haproxyConfig), proxyConfigMount),
+		proxyImage)
+	return err
+}
+
+// updateBackends applies fn to the proxy backends and restarts the proxy to
+// pick up the change.
+func (l *Local) updateBackends(ctx context.Context, fn func(backends map[string]string)) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	cfg, err := l.readProxyConfig()
+	if err != nil {
+		return err
+	}
+	if cfg == nil {
+		return util.Errorf("proxy %s not found", l.proxyName())
+	}
+	fn(cfg.Backends)
+	if err := l.writeProxyConfig(cfg); err != nil {
+		return err
+	}
+	_, err = docker.RunDocker(ctx, "restart", l.proxyName())
+	return err
+}
@@ -0,0 +1,98 @@
+// Copyright 2015 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+//
+// Author: Marc Berhault (marc@cockroachlabs.com)
+
+package drivers
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// MaxEncodedLockLength is the maximum length of an encoded lock. Cloud tags
+// limit values to 256 characters.
+const MaxEncodedLockLength = 256
+
+// ErrNoLockStore is returned by lock methods when the cloud resource holding
+// the lock does not exist.
+var ErrNoLockStore = errors.New("no cloud resource to store the lock")
+
+// ErrLockChanged is returned by WriteLock when the stored lock was modified
+// since it was read.
+var ErrLockChanged = errors.New("cluster lock was modified concurrently")
+
+// Lock describes the holder of the cluster lock. It is held for the
+// duration of mutating commands and expires unless renewed.
+type Lock struct {
+	// Holder identifies the process holding the lock: user@host:pid.
+	Holder  string    `json:"holder"`
+	Command string    `json:"command"`
+	Expires time.Time `json:"expires"`
+}
+
+// IsExpired returns true if the lock lease has run out.
+func (l *Lock) IsExpired() bool {
+	return time.Now().After(l.Expires)
+}
+
+func (l *Lock) String() string {
+	return fmt.Sprintf("%s running %q until %s", l.Holder, l.Command, l.Expires.Format(time.RFC3339))
+}
+
+// EncodeLock returns the serialized lock, for storage in cloud tags or
+// metadata. The JSON lock is base64-encoded, which only uses characters
+// allowed in tag values. The command is truncated to fit in
+// MaxEncodedLockLength, the holder is never truncated.
+func EncodeLock(lock *Lock) (string, error) {
+	l := *lock
+	l.Expires = l.Expires.UTC().Truncate(time.Second)
+	for {
+		b, err := json.Marshal(&l)
+		if err != nil {
+			return "", err
+		}
+		value := base64.StdEncoding.EncodeToString(b)
+		if len(value) <= MaxEncodedLockLength {
+			return value, nil
+		}
+		if l.Command == "" {
+			return "", fmt.Errorf("lock held by %q is longer than %d characters when encoded",
+				l.Holder, MaxEncodedLockLength)
+		}
+		// Every 4 encoded characters hold 3 bytes.
+		trim := (len(value)-MaxEncodedLockLength)*3/4 + 1
+		if trim > len(l.Command) {
+			trim = len(l.Command)
+		}
+		l.Command = l.Command[:len(l.Command)-trim]
+	}
+}
+
+// DecodeLock parses a lock serialized by EncodeLock.
+func DecodeLock(value string) (*Lock, error) {
+	b, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid lock %q: %v", value, err)
+	}
+	lock := &Lock{}
+	if err := json.Unmarshal(b, lock); err != nil {
+		return nil, fmt.Errorf("invalid lock %q: %v", value, err)
+	}
+	return lock, nil
+}
@@ -0,0 +1,108 @@
+// Copyright 2015 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+//
+// Author: Marc Berhault (marc@cockroachlabs.com)
+
+package drivers
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEncodeDecodeLock(t *testing.T) {
+	expires := time.Date(2015, 9, 1, 12, 30, 15, 0, time.UTC)
+	testCases := []struct {
+		lock Lock
+		// Expected decoded command, if truncated.
+		command string
+		valid   bool
+	}{
+		{Lock{"marc@laptop:123", "add-nodes 3", expires}, "add-nodes 3", true},
+		{Lock{"marc@laptop:123", "", expires}, "", true},
+		// Sub-second expirations are truncated.
+		{Lock{"marc@laptop:123", "start", expires.Add(500 * time.Millisecond)}, "start", true},
+		// Long commands are truncated to fit.
+		{Lock{"marc@laptop:123", "start " + strings.Repeat("node-", 100), expires}, "", true},
+		// The holder is never truncated.
+		{Lock{strings.Repeat("h", 200), "start", expires}, "", false},
+	}
+
+	for i, tc := range testCases {
+		value, err := EncodeLock(&tc.lock)
+		if !tc.valid {
+			if err == nil {
+				t.Errorf("%d: expected an error encoding lock", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%d: could not encode lock: %v", i, err)
+			continue
+		}
+		if len(value) > MaxEncodedLockLength {
+			t.Errorf("%d: encoded lock is %d characters, expected at most %d", i, len(value), MaxEncodedLockLength)
+		}
+
+		lock, err := DecodeLock(value)
+		if err != nil {
+			t.Errorf("%d: could not decode lock %q: %v", i, value, err)
+			continue
+		}
+		if lock.Holder != tc.lock.Holder {
+			t.Errorf("%d: expected holder %q, got %q", i, tc.lock.Holder, lock.Holder)
+		}
+		if !lock.Expires.Equal(expires) {
+			t.Errorf("%d: expected expiration %s, got %s", i, expires, lock.Expires)
+		}
+		if tc.command != "" && lock.Command != tc.command {
+			t.Errorf("%d: expected command %q, got %q", i, tc.command, lock.Command)
+		} else if !strings.HasPrefix(tc.lock.Command, lock.Command) {
+			t.Errorf("%d: expected a prefix of command %q, got %q", i, tc.lock.Command, lock.Command)
+		}
+	}
+}
+
+func TestDecodeLock(t *testing.T) {
+	testCases := []struct {
+		value  string
+		holder string
+		valid  bool
+	}{
+		{"eyJob2xkZXIiOiJtYXJjQGxhcHRvcDoxMjMifQ==", "marc@laptop:123", true},
+		{"", "", false},
+		{"not base64!", "", false},
+		// Valid base64, invalid JSON.
+		{"bm90IGpzb24=", "", false},
+		// Plain JSON is not base64.
+		{`{"holder":"marc@laptop:123"}`, "", false},
+	}
+
+	for i, tc := range testCases {
+		lock, err := DecodeLock(tc.value)
+		if !tc.valid {
+			if err == nil {
+				t.Errorf("%d: expected an error decoding %q", i, tc.value)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%d: could not decode %q: %v", i, tc.value, err)
+		} else if lock.Holder != tc.holder {
+			t.Errorf("%d: expected holder %q, got %q", i, tc.holder, lock.Holder)
+		}
+	}
+}
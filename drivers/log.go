@@ -0,0 +1,57 @@
+// Copyright 2015 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+//
+// Author: Marc Berhault (marc@cockroachlabs.com)
+
+package drivers
+
+import (
+	"fmt"
+
+	"github.com/cockroachdb/cockroach/util/log"
+	"golang.org/x/net/context"
+)
+
+// logPrefixKey is the context key for the prefix set by WithLogPrefix.
+type logPrefixKey struct{}
+
+// WithLogPrefix returns a context whose log lines, when logged through
+// LogInfof, LogWarningf and LogErrorf, start with 'prefix'. It is used to
+// tell nodes apart when operating on several nodes at the same time.
+func WithLogPrefix(ctx context.Context, prefix string) context.Context {
+	return context.WithValue(ctx, logPrefixKey{}, prefix)
+}
+
+// logPrefix returns the prefix set by WithLogPrefix, or "".
+func logPrefix(ctx context.Context) string {
+	prefix, _ := ctx.Value(logPrefixKey{}).(string)
+	return prefix
+}
+
+// LogInfof logs to the INFO log, with the prefix of the context.
+func LogInfof(ctx context.Context, format string, args ...interface{}) {
+	log.Info(logPrefix(ctx) + fmt.Sprintf(format, args...))
+}
+
+// LogWarningf logs to the WARNING and INFO logs, with the prefix of the context.
+func LogWarningf(ctx context.Context, format string, args ...interface{}) {
+	log.Warning(logPrefix(ctx) + fmt.Sprintf(format, args...))
+}
+
+// LogErrorf logs to the ERROR, WARNING and INFO logs, with the prefix of the
+// context.
+func LogErrorf(ctx context.Context, format string, args ...interface{}) {
+	log.Error(logPrefix(ctx) + fmt.Sprintf(format, args...))
+}
@@ -0,0 +1,136 @@
+// Copyright 2015 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+//
+// Author: Marc Berhault (marc@cockroachlabs.com)
+
+package drivers
+
+import (
+	"math/rand"
+	"time"
+
+	"github.com/cockroachdb/cockroach-prod/base"
+	"github.com/cockroachdb/cockroach/util"
+	"github.com/cockroachdb/cockroach/util/log"
+	"golang.org/x/net/context"
+)
+
+const (
+	defaultInitialBackoff = time.Second
+	defaultMaxBackoff     = 10 * time.Second
+	backoffMultiplier     = 2
+	// Each backoff is randomized by up to this fraction in either direction.
+	backoffJitter = 0.25
+)
+
+// RetryOptions configures Retry and Poll.
+type RetryOptions struct {
+	// Backoff before the second attempt, multiplied after each attempt up to MaxBackoff.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	// Overall deadline for all attempts. Zero means no deadline.
+	Timeout time.Duration
+	// Retryable returns true if the error returned by an attempt should be
+	// retried. If nil, errors are never retried.
+	Retryable func(error) bool
+}
+
+// APIRetryOptions returns the options for retrying cloud API calls failing with
+// errors classified as retryable by the driver (eg: throttling).
+func APIRetryOptions(context *base.Context, retryable func(error) bool) RetryOptions {
+	return RetryOptions{
+		InitialBackoff: 500 * time.Millisecond,
+		MaxBackoff:     defaultMaxBackoff,
+		Timeout:        context.APIRetryTimeout,
+		Retryable:      retryable,
+	}
+}
+
+// OperationPollOptions returns the options for polling long-running cloud
+// operations. Errors classified as retryable by the driver do not interrupt polling.
+func OperationPollOptions(context *base.Context, retryable func(error) bool) RetryOptions {
+	return RetryOptions{
+		InitialBackoff: defaultInitialBackoff,
+		MaxBackoff:     defaultMaxBackoff,
+		Timeout:        context.OperationTimeout,
+		Retryable:      retryable,
+	}
+}
+
+// Retry calls fn until it succeeds, returns a non-retryable error, the
+// timeout expires, or ctx is cancelled. 'desc' describes the call in logs and errors.
+func Retry(ctx context.Context, opts RetryOptions, desc string, fn func() error) error {
+	return Poll(ctx, opts, desc, func() (bool, error) {
+		return true, fn()
+	})
+}
+
+// Poll calls fn with exponential backoff until it returns done, returns a
+// non-retryable error, the timeout expires, or ctx is cancelled.
+// 'desc' describes the polled condition in logs and errors.
+func Poll(ctx context.Context, opts RetryOptions, desc string, fn func() (done bool, err error)) error {
+	backoff := opts.InitialBackoff
+	if backoff <= 0 {
+		backoff = defaultInitialBackoff
+	}
+	maxBackoff := opts.MaxBackoff
+	if maxBackoff <= 0 {
+		maxBackoff = defaultMaxBackoff
+	}
+	var deadline time.Time
+	if opts.Timeout > 0 {
+		deadline = time.Now().Add(opts.Timeout)
+	}
+
+	for attempt := 1; ; attempt++ {
+		if err := ctx.Err(); err != nil {
+			return util.Errorf("%s: %v", desc, err)
+		}
+		done, err := fn()
+		if err != nil {
+			if opts.Retryable == nil || !opts.Retryable(err) {
+				return err
+			}
+			log.Infof("%s: retryable error on attempt %d: %v", desc, attempt, err)
+		} else if done {
+			return nil
+		}
+
+		wait := jitter(backoff)
+		if !deadline.IsZero() && time.Now().Add(wait).After(deadline) {
+			if err != nil {
+				return util.Errorf("%s: giving up after %s: %v", desc, opts.Timeout, err)
+			}
+			return util.Errorf("%s: not done after %s", desc, opts.Timeout)
+		}
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return util.Errorf("%s: %v", desc, ctx.Err())
+		}
+
+		backoff *= backoffMultiplier
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// jitter randomizes the backoff by up to backoffJitter in either direction, so
+// that concurrent callers do not retry in lockstep.
+func jitter(backoff time.Duration) time.Duration {
+	delta := backoffJitter * float64(backoff)
+	return backoff + time.Duration(delta*(2*rand.Float64()-1))
+}
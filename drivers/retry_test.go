@@ -0,0 +1,104 @@
+// Copyright 2015 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+//
+// Author: Marc Berhault (marc@cockroachlabs.com)
+
+package drivers
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestPoll(t *testing.T) {
+	errRetryable := errors.New("retryable")
+	errFatal := errors.New("fatal")
+	retryable := func(err error) bool { return err == errRetryable }
+
+	testCases := []struct {
+		// Results of successive attempts. The last one is repeated.
+		results   []error
+		done      []bool
+		retryable func(error) bool
+		timeout   time.Duration
+		cancelled bool
+		// Expected number of attempts, and whether Poll succeeds.
+		attempts int
+		success  bool
+	}{
+		// Done at once.
+		{[]error{nil}, []bool{true}, nil, 0, false, 1, true},
+		// Not done, then done.
+		{[]error{nil, nil, nil}, []bool{false, false, true}, nil, 0, false, 3, true},
+		// Retryable errors, then done.
+		{[]error{errRetryable, errRetryable, nil}, []bool{false, false, true}, retryable, 0, false, 3, true},
+		// Errors are not retried without Retryable.
+		{[]error{errRetryable, nil}, []bool{false, true}, nil, 0, false, 1, false},
+		// Non-retryable errors stop polling.
+		{[]error{errRetryable, errFatal, nil}, []bool{false, false, true}, retryable, 0, false, 2, false},
+		// Never done: the timeout expires.
+		{[]error{nil}, []bool{false}, nil, 50 * time.Millisecond, false, -1, false},
+		{[]error{errRetryable}, []bool{false}, retryable, 50 * time.Millisecond, false, -1, false},
+		// A cancelled context stops polling before the first attempt.
+		{[]error{nil}, []bool{true}, nil, 0, true, 0, false},
+	}
+
+	for i, tc := range testCases {
+		opts := RetryOptions{
+			InitialBackoff: time.Millisecond,
+			MaxBackoff:     4 * time.Millisecond,
+			Timeout:        tc.timeout,
+			Retryable:      tc.retryable,
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		if tc.cancelled {
+			cancel()
+		}
+		attempts := 0
+		err := Poll(ctx, opts, "test", func() (bool, error) {
+			j := attempts
+			if j >= len(tc.results) {
+				j = len(tc.results) - 1
+			}
+			attempts++
+			return tc.done[j], tc.results[j]
+		})
+		cancel()
+
+		if tc.success && err != nil {
+			t.Errorf("%d: expected success, got %v", i, err)
+		} else if !tc.success && err == nil {
+			t.Errorf("%d: expected an error", i)
+		}
+		if tc.attempts >= 0 && attempts != tc.attempts {
+			t.Errorf("%d: expected %d attempts, got %d", i, tc.attempts, attempts)
+		} else if tc.attempts < 0 && attempts < 2 {
+			t.Errorf("%d: expected several attempts before the timeout, got %d", i, attempts)
+		}
+	}
+}
+
+func TestJitter(t *testing.T) {
+	backoff := time.Second
+	for i := 0; i < 100; i++ {
+		wait := jitter(backoff)
+		if wait < 750*time.Millisecond || wait > 1250*time.Millisecond {
+			t.Fatalf("jitter(%s) = %s, expected within %.0f%%", backoff, wait, backoffJitter*100)
+		}
+	}
+}
@@ -0,0 +1,317 @@
+// Copyright 2015 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+//
+// Author: Marc Berhault (marc@cockroachlabs.com)
+
+package ssh
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/cockroachdb/cockroach-prod/base"
+	"github.com/cockroachdb/cockroach-prod/docker"
+	"github.com/cockroachdb/cockroach-prod/drivers"
+	"github.com/cockroachdb/cockroach/util"
+	"github.com/cockroachdb/cockroach/util/log"
+	"golang.org/x/net/context"
+)
+
+const (
+	dockerMachineDriverName = "generic"
+	// Nobody manages a firewall for pre-provisioned hosts.
+	unmanagedFirewall = "unmanaged"
+)
+
+// SSH implements a driver for pre-provisioned hosts listed in an inventory.
+// Hosts are provisioned with the docker-machine generic driver. There is no
+// cloud load balancer: nodes join the gossip network through an HAProxy host
+// or a list of seeds, both managed outside of cockroach-prod.
+type SSH struct {
+	context *base.Context
+	region  string
+
+	// Loaded at Init() time.
+	inventory *inventory
+
+	// mu protects reserved.
+	mu sync.Mutex
+	// reserved maps machine names to the hosts picked for them by this process.
+	reserved map[string]string
+}
+
+// config contains the generic-specific fields of the docker-machine config.
+// Not all are specified, only those used here.
+// Implements drivers.DriverConfig and drivers.GossipSeeder.
+type config struct {
+	MachineName string
+	Address     string `json:"IPAddress"`
+
+	// Fields not saved by docker-machine. We look them up in the inventory.
+	inventory *inventory
+	host      *host
+}
+
+// DataDir returns the data directory of the host.
+func (cfg *config) DataDir() string {
+	if cfg.host.DataDir != "" {
+		return cfg.host.DataDir
+	}
+	if cfg.inventory.DataDir != "" {
+		return cfg.inventory.DataDir
+	}
+	return cfg.inventory.homeDir() + "/data"
+}
+
+// CertsDir returns the certificates directory.
+func (cfg *config) CertsDir() string {
+	return cfg.inventory.homeDir() + "/certs"
+}
+
+// IPAddress returns the internal address of the host.
+func (cfg *config) IPAddress() string {
+	if cfg.host.InternalAddress != "" {
+		return cfg.host.InternalAddress
+	}
+	return cfg.host.Address
+}
+
+// GossipAddress returns the HAProxy host, or the first seed.
+func (cfg *config) GossipAddress() string {
+	if cfg.inventory.HAProxy != "" {
+		return cfg.inventory.HAProxy
+	}
+	return cfg.inventory.Seeds[0]
+}
+
+// GossipSeeds returns the seeds, if there is no HAProxy host.
+func (cfg *config) GossipSeeds() []string {
+	return cfg.inventory.Seeds
+}
+
+// NewDriver returns an initialized SSH driver. The region is a name for the
+// set of hosts, the hosts themselves are read from --ssh-inventory.
+func NewDriver(context *base.Context, region string) *SSH {
+	s := &SSH{
+		context:  context,
+		region:   region,
+		reserved: map[string]string{},
+	}
+	docker.SetMachines(machines{docker.DockerMachines(), s})
+	return s
+}
+
+// Context returns the base context.
+func (s *SSH) Context() *base.Context {
+	return s.context
+}
+
+// DockerMachineDriver returns the name of the docker-machine driver.
+func (s *SSH) DockerMachineDriver() string {
+	return dockerMachineDriverName
+}
+
+// Init loads the inventory.
+func (s *SSH) Init() error {
+	if s.context.SSHInventory == "" {
+		return base.ValidationErrorf("--ssh-inventory must be specified for the ssh driver")
+	}
+	inv, err := loadInventory(s.context.SSHInventory)
+	if err != nil {
+		return base.NewError(base.ValidationError, err, "loading inventory")
+	}
+	s.inventory = inv
+	log.Infof("loaded inventory %s: %d hosts", s.context.SSHInventory, len(inv.Hosts))
+	return nil
+}
+
+// DockerMachineCreateArgs picks a host not used by any machine and returns
+// the arguments to provision it.
+func (s *SSH) DockerMachineCreateArgs(name string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	used := map[string]bool{}
+	for _, address := range s.reserved {
+		used[address] = true
+	}
+	machineNames, err := docker.ListMachines()
+	if err != nil {
+		return nil, util.Errorf("could not list machines: %v", err)
+	}
+	for _, machineName := range machineNames {
+		cfg := &drivers.HostConfig{Driver: &config{}}
+		if err := docker.GetHostConfig(machineName, cfg); err != nil {
+			return nil, util.Errorf("could not read config of machine %s: %v", machineName, err)
+		}
+		used[cfg.Driver.(*config).Address] = true
+	}
+
+	for _, h := range s.inventory.Hosts {
+		if used[h.Address] {
+			continue
+		}
+		s.reserved[name] = h.Address
+		log.Infof("using host %s for %s", h.Address, name)
+		return []string{
+			"--generic-ip-address", h.Address,
+			"--generic-ssh-user", s.inventory.User,
+			"--generic-ssh-key", s.inventory.Key,
+			"--generic-ssh-port", strconv.Itoa(s.inventory.Port),
+		}, nil
+	}
+	return nil, util.Errorf("all %d hosts in %s are in use", len(s.inventory.Hosts), s.context.SSHInventory)
+}
+
+// GetStatus returns the HAProxy host or the seeds.
+func (s *SSH) GetStatus() *drivers.ClusterStatus {
+	status := &drivers.ClusterStatus{
+		Driver:   dockerMachineDriverName,
+		Region:   s.region,
+		Firewall: unmanagedFirewall,
+	}
+	if s.inventory.HAProxy != "" {
+		status.LoadBalancerAddress = fmt.Sprintf("%s:%d", s.inventory.HAProxy, s.context.Port)
+	} else {
+		status.LoadBalancerAddress = "seeds " + strings.Join(s.inventory.Seeds, ",")
+	}
+	return status
+}
+
+// GetNodeStatus fills in the host addresses and the cockroach container state.
+// Load balancer membership is not known.
+func (s *SSH) GetNodeStatus(name string, cfg *drivers.HostConfig, status *drivers.NodeStatus) {
+	c := cfg.Driver.(*config)
+	status.InstanceID = c.host.Address
+	status.ExternalIP = c.host.Address
+	status.InternalIP = c.IPAddress()
+
+	state, err := s.GetInstanceState(name, cfg)
+	if err != nil {
+		status.Errors = append(status.Errors, fmt.Sprintf("host: %v", err))
+	}
+	status.InstanceState = string(state)
+}
+
+// GetInstanceState returns the state of the cockroach container: hosts are
+// never stopped.
+func (s *SSH) GetInstanceState(name string, cfg *drivers.HostConfig) (drivers.InstanceState, error) {
+	running, err := machines{docker.DockerMachines(), s}.cockroachRunning(context.Background(), name)
+	if err != nil {
+		return drivers.InstanceUnknown, err
+	}
+	if running {
+		return drivers.InstanceRunning, nil
+	}
+	return drivers.InstanceStopped, nil
+}
+
+// LoadBalancerAddress returns the HAProxy host, or the first seed.
+func (s *SSH) LoadBalancerAddress() (string, error) {
+	if s.inventory.HAProxy != "" {
+		return s.inventory.HAProxy, nil
+	}
+	return s.inventory.Seeds[0], nil
+}
+
+// GetNodeConfig takes a node name and reads its docker-machine config.
+// The host is looked up in the inventory.
+func (s *SSH) GetNodeConfig(name string) (*drivers.HostConfig, error) {
+	cfg := &drivers.HostConfig{
+		Driver: &config{},
+	}
+
+	// Parse the config file.
+	err := docker.GetHostConfig(name, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	c := cfg.Driver.(*config)
+	c.inventory = s.inventory
+	c.host = s.inventory.findHost(c.Address)
+	if c.host == nil {
+		return nil, util.Errorf("host %s of machine %s is not in inventory %s", c.Address, name,
+			s.context.SSHInventory)
+	}
+	return cfg, nil
+}
+
+// AfterFirstNode does nothing: the HAProxy host or seeds are managed outside
+// of cockroach-prod.
+func (s *SSH) AfterFirstNode(ctx context.Context) error {
+	return nil
+}
+
+// PrepareNode creates the data directory. Hosts are reused after their node
+// is removed: new nodes refuse a data directory already holding a store, eg:
+// if it could not be wiped.
+func (s *SSH) PrepareNode(ctx context.Context, name string, cfg *drivers.HostConfig, created bool) error {
+	if created {
+		initialized, err := docker.IsStoreInitialized(ctx, name, cfg)
+		if err != nil {
+			return err
+		}
+		if initialized {
+			return util.Errorf("data directory %s on host %s already holds a cockroach store, "+
+				"wipe it before reusing the host", cfg.Driver.DataDir(), cfg.Driver.(*config).host.Address)
+		}
+	}
+	_, err := docker.RunOnMachine(ctx, name, "sudo mkdir -p "+cfg.Driver.DataDir())
+	return err
+}
+
+// AfterNodeRemoved releases the host picked for the node by this process.
+func (s *SSH) AfterNodeRemoved(ctx context.Context, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.reserved, name)
+	return nil
+}
+
+// StartNode does nothing: HAProxy health checks detect the node.
+func (s *SSH) StartNode(ctx context.Context, name string, cfg *drivers.HostConfig) error {
+	return nil
+}
+
+// StopNode does nothing: HAProxy health checks detect the node.
+func (s *SSH) StopNode(ctx context.Context, name string, cfg *drivers.HostConfig) error {
+	return nil
+}
+
+// IsNodeInService returns true if the node answers on /_status/: there is no
+// load balancer to ask.
+func (s *SSH) IsNodeInService(ctx context.Context, name string, cfg *drivers.HostConfig) (bool, error) {
+	return docker.CheckNodeStatus(ctx, s, name, cfg) == nil, nil
+}
+
+// Teardown does nothing: no cluster-wide resources are created.
+func (s *SSH) Teardown(ctx context.Context) error {
+	return nil
+}
+
+// ReadLock returns ErrNoLockStore: the cluster lock is kept in the local
+// state directory.
+func (s *SSH) ReadLock() (*drivers.Lock, string, error) {
+	return nil, "", drivers.ErrNoLockStore
+}
+
+// WriteLock returns ErrNoLockStore: the cluster lock is kept in the local
+// state directory.
+func (s *SSH) WriteLock(lock *drivers.Lock, version string) error {
+	return drivers.ErrNoLockStore
+}
@@ -0,0 +1,136 @@
+// Copyright 2015 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+//
+// Author: Marc Berhault (marc@cockroachlabs.com)
+
+package ssh
+
+import (
+	"io/ioutil"
+	"os"
+
+	"github.com/cockroachdb/cockroach/util"
+	"gopkg.in/yaml.v1"
+)
+
+const defaultSSHPort = 22
+
+// inventory describes the pre-provisioned hosts, read from a YAML file:
+//
+//	user: ubuntu
+//	key: ~/.ssh/id_rsa
+//	data_dir: /mnt/data
+//	haproxy: 10.0.0.2
+//	hosts:
+//	  - address: 10.0.0.10
+//	  - address: 203.0.113.11
+//	    internal_address: 10.0.0.11
+//	    data_dir: /mnt/ssd
+//
+// Exactly one of haproxy and seeds must be set.
+type inventory struct {
+	// SSH user and private key path for all hosts.
+	User string `yaml:"user"`
+	Key  string `yaml:"key"`
+	Port int    `yaml:"port"`
+	// DataDir is the default data directory. Defaults to the user home.
+	DataDir string `yaml:"data_dir"`
+	// HAProxy is the address of a load balancer in front of all hosts, used
+	// to join the gossip network.
+	HAProxy string `yaml:"haproxy"`
+	// Seeds are addresses of nodes used to join the gossip network when there
+	// is no load balancer.
+	Seeds []string `yaml:"seeds"`
+	Hosts []*host  `yaml:"hosts"`
+}
+
+// host is a single host in the inventory.
+type host struct {
+	// Address is used to reach the host over SSH.
+	Address string `yaml:"address"`
+	// InternalAddress is the address cockroach listens on. Defaults to Address.
+	InternalAddress string `yaml:"internal_address"`
+	// DataDir overrides the inventory data directory.
+	DataDir string `yaml:"data_dir"`
+}
+
+// loadInventory reads and validates the inventory file.
+func loadInventory(path string) (*inventory, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	inv := &inventory{}
+	if err := yaml.Unmarshal(contents, inv); err != nil {
+		return nil, util.Errorf("could not parse %s: %v", path, err)
+	}
+	if err := inv.validate(); err != nil {
+		return nil, util.Errorf("invalid inventory %s: %v", path, err)
+	}
+	return inv, nil
+}
+
+func (inv *inventory) validate() error {
+	if inv.User == "" || inv.Key == "" {
+		return util.Errorf("user and key must be specified")
+	}
+	inv.Key = expandHome(inv.Key)
+	if inv.Port == 0 {
+		inv.Port = defaultSSHPort
+	}
+	if (inv.HAProxy == "") == (len(inv.Seeds) == 0) {
+		return util.Errorf("exactly one of haproxy and seeds must be specified")
+	}
+	if len(inv.Hosts) == 0 {
+		return util.Errorf("no hosts specified")
+	}
+	seen := map[string]bool{}
+	for _, h := range inv.Hosts {
+		if h.Address == "" {
+			return util.Errorf("host without address")
+		}
+		if seen[h.Address] {
+			return util.Errorf("duplicate host %s", h.Address)
+		}
+		seen[h.Address] = true
+	}
+	return nil
+}
+
+// homeDir returns the home directory of the SSH user.
+func (inv *inventory) homeDir() string {
+	if inv.User == "root" {
+		return "/root"
+	}
+	return "/home/" + inv.User
+}
+
+// findHost returns the host with the given SSH address, or nil.
+func (inv *inventory) findHost(address string) *host {
+	for _, h := range inv.Hosts {
+		if h.Address == address {
+			return h
+		}
+	}
+	return nil
+}
+
+// expandHome replaces a leading "~/" with the local home directory.
+func expandHome(path string) string {
+	if len(path) > 1 && path[:2] == "~/" {
+		return os.ExpandEnv("${HOME}") + path[1:]
+	}
+	return path
+}
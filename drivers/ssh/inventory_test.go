@@ -0,0 +1,80 @@
+// Copyright 2015 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+//
+// Author: Marc Berhault (marc@cockroachlabs.com)
+
+package ssh
+
+import (
+	"os"
+	"testing"
+)
+
+// hosts returns inventory hosts with the given addresses.
+func hosts(addresses ...string) []*host {
+	var ret []*host
+	for _, a := range addresses {
+		ret = append(ret, &host{Address: a})
+	}
+	return ret
+}
+
+func TestInventoryValidate(t *testing.T) {
+	testCases := []struct {
+		inv   inventory
+		valid bool
+	}{
+		{inventory{User: "ubuntu", Key: "/key", HAProxy: "10.0.0.2", Hosts: hosts("10.0.0.10")}, true},
+		{inventory{User: "ubuntu", Key: "/key", Seeds: []string{"10.0.0.10"},
+			Hosts: hosts("10.0.0.10", "10.0.0.11")}, true},
+		{inventory{Key: "/key", HAProxy: "10.0.0.2", Hosts: hosts("10.0.0.10")}, false},
+		{inventory{User: "ubuntu", HAProxy: "10.0.0.2", Hosts: hosts("10.0.0.10")}, false},
+		// Exactly one of haproxy and seeds.
+		{inventory{User: "ubuntu", Key: "/key", Hosts: hosts("10.0.0.10")}, false},
+		{inventory{User: "ubuntu", Key: "/key", HAProxy: "10.0.0.2", Seeds: []string{"10.0.0.10"},
+			Hosts: hosts("10.0.0.10")}, false},
+		{inventory{User: "ubuntu", Key: "/key", HAProxy: "10.0.0.2"}, false},
+		{inventory{User: "ubuntu", Key: "/key", HAProxy: "10.0.0.2", Hosts: hosts("")}, false},
+		{inventory{User: "ubuntu", Key: "/key", HAProxy: "10.0.0.2", Hosts: hosts("10.0.0.10", "10.0.0.10")}, false},
+	}
+
+	for i, tc := range testCases {
+		err := tc.inv.validate()
+		if tc.valid && err != nil {
+			t.Errorf("%d: expected valid inventory, got %v", i, err)
+		} else if !tc.valid && err == nil {
+			t.Errorf("%d: expected invalid inventory", i)
+		}
+	}
+}
+
+func TestInventoryDefaults(t *testing.T) {
+	inv := &inventory{User: "root", Key: "~/.ssh/id_rsa", HAProxy: "10.0.0.2", Hosts: hosts("10.0.0.10")}
+	if err := inv.validate(); err != nil {
+		t.Fatal(err)
+	}
+	if inv.Port != defaultSSHPort {
+		t.Errorf("expected default port %d, got %d", defaultSSHPort, inv.Port)
+	}
+	if expected := os.ExpandEnv("${HOME}/.ssh/id_rsa"); inv.Key != expected {
+		t.Errorf("expected key %s, got %s", expected, inv.Key)
+	}
+	if dir := inv.homeDir(); dir != "/root" {
+		t.Errorf("expected home directory /root, got %s", dir)
+	}
+	if inv.findHost("10.0.0.10") == nil || inv.findHost("10.0.0.11") != nil {
+		t.Errorf("unexpected findHost results")
+	}
+}
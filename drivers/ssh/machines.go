@@ -0,0 +1,111 @@
+// Copyright 2015 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+//
+// Author: Marc Berhault (marc@cockroachlabs.com)
+
+package ssh
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/cockroachdb/cockroach-prod/docker"
+	"github.com/cockroachdb/cockroach-prod/drivers"
+	"github.com/cockroachdb/cockroach/util"
+	"golang.org/x/net/context"
+)
+
+// machines changes the docker-machine based Machines for hosts provisioned
+// with the generic driver, which cannot be started or stopped: a node is
+// stopped by stopping its cockroach container, and is running if the container
+// is.
+type machines struct {
+	docker.Machines
+	driver *SSH
+}
+
+// Start does nothing: hosts are always on, and the cockroach container is
+// started separately.
+func (m machines) Start(ctx context.Context, name string) error {
+	drivers.LogInfof(ctx, "host %s is pre-provisioned, nothing to start", name)
+	return nil
+}
+
+// Stop stops the cockroach container.
+func (m machines) Stop(ctx context.Context, name string) error {
+	return docker.StopDockerCockroach(ctx, name)
+}
+
+// Remove removes the cockroach container and wipes the data directory so that
+// the host can be reused by a new node, then removes the docker-machine config.
+// The host itself is left alone.
+func (m machines) Remove(ctx context.Context, name string) error {
+	_, err := m.Run(ctx, name, "sudo docker rm -f "+m.ContainerName(name))
+	if err != nil && !strings.Contains(err.Error(), "No such") {
+		drivers.LogErrorf(ctx, "could not remove cockroach container on %s: %v", name, err)
+	}
+	if err := m.wipeDataDir(ctx, name); err != nil {
+		drivers.LogErrorf(ctx, "could not wipe the data directory on %s, wipe it before reusing the host: %v",
+			name, err)
+	}
+	return m.Machines.Remove(ctx, name)
+}
+
+// wipeDataDir deletes the contents of the node's data directory. The root and
+// home directories are never wiped.
+func (m machines) wipeDataDir(ctx context.Context, name string) error {
+	cfg, err := m.driver.GetNodeConfig(name)
+	if err != nil {
+		return err
+	}
+	dataDir := strings.TrimRight(cfg.Driver.DataDir(), "/")
+	if dataDir == "" || dataDir == m.driver.inventory.homeDir() {
+		return util.Errorf("refusing to wipe %q", cfg.Driver.DataDir())
+	}
+	drivers.LogInfof(ctx, "wiping data directory %s on %s", dataDir, name)
+	_, err = m.Run(ctx, name, fmt.Sprintf("sudo find %s -mindepth 1 -delete", dataDir))
+	return err
+}
+
+// State returns "Stopped" for reachable hosts whose cockroach container is
+// not running.
+func (m machines) State(name string) (string, error) {
+	state, err := m.Machines.State(name)
+	if err != nil || state != "Running" {
+		return state, err
+	}
+	running, err := m.cockroachRunning(context.Background(), name)
+	if err != nil {
+		return "", err
+	}
+	if !running {
+		return "Stopped", nil
+	}
+	return state, nil
+}
+
+// cockroachRunning returns true if the cockroach container on the host is
+// running.
+func (m machines) cockroachRunning(ctx context.Context, name string) (bool, error) {
+	out, err := m.Run(ctx, name, fmt.Sprintf("sudo docker inspect --format '{{.State.Running}}' %s",
+		m.ContainerName(name)))
+	if err != nil {
+		if strings.Contains(err.Error(), "No such") {
+			return false, nil
+		}
+		return false, err
+	}
+	return len(out) == 1 && strings.TrimSpace(out[0]) == "true", nil
+}
@@ -0,0 +1,95 @@
+// Copyright 2015 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+//
+// Author: Marc Berhault (marc@cockroachlabs.com)
+
+package drivers
+
+// ClusterStatus describes the cluster-wide resources and all nodes.
+type ClusterStatus struct {
+	Driver string `json:"driver" yaml:"driver"`
+	Region string `json:"region" yaml:"region"`
+	// LoadBalancerAddress is <host>:<port>, empty if not found.
+	LoadBalancerAddress string `json:"load_balancer_address" yaml:"load_balancer_address"`
+	// Firewall is the security group or firewall rule opening the cockroach port,
+	// empty if not found.
+	Firewall string `json:"firewall" yaml:"firewall"`
+	// AllowedCIDRs are the sources allowed by the firewall rules on the
+	// cockroach port, nil if the driver does not manage them.
+	AllowedCIDRs []string      `json:"allowed_cidrs,omitempty" yaml:"allowed_cidrs,omitempty"`
+	Nodes        []*NodeStatus `json:"nodes" yaml:"nodes"`
+	// Problems encountered while looking up cluster-wide resources.
+	Errors []string `json:"errors,omitempty" yaml:"errors,omitempty"`
+}
+
+// NodeStatus describes a single node.
+type NodeStatus struct {
+	Name       string `json:"name" yaml:"name"`
+	InstanceID string `json:"instance_id" yaml:"instance_id"`
+	InternalIP string `json:"internal_ip" yaml:"internal_ip"`
+	ExternalIP string `json:"external_ip" yaml:"external_ip"`
+	Zone       string `json:"zone" yaml:"zone"`
+	// MachineState is the state reported by docker-machine (eg: Running, Stopped).
+	MachineState string `json:"machine_state" yaml:"machine_state"`
+	// InstanceState is the state reported by the cloud provider.
+	InstanceState string `json:"instance_state" yaml:"instance_state"`
+	// InLoadBalancer is true if the node is registered with the load balancer.
+	InLoadBalancer bool `json:"in_load_balancer" yaml:"in_load_balancer"`
+	// InService is true if the load balancer considers the node healthy.
+	InService bool `json:"in_service" yaml:"in_service"`
+	// Healthy is true if cockroach answers on /_status/.
+	Healthy bool `json:"healthy" yaml:"healthy"`
+	// Problems encountered while looking up the node.
+	Errors []string `json:"errors,omitempty" yaml:"errors,omitempty"`
+}
+
+// InstanceState is the state of a node's cloud instance, normalized across
+// drivers.
+type InstanceState string
+
+const (
+	// InstanceRunning is a running instance.
+	InstanceRunning InstanceState = "running"
+	// InstanceStopped is a stopped instance that can be started again.
+	InstanceStopped InstanceState = "stopped"
+	// InstancePending is an instance being started or stopped.
+	InstancePending InstanceState = "pending"
+	// InstanceMissing is an instance that was deleted or terminated.
+	InstanceMissing InstanceState = "missing"
+	// InstanceUnknown is any other state.
+	InstanceUnknown InstanceState = "unknown"
+)
+
+// SameCIDRs returns true if both lists hold the same CIDRs, ignoring order
+// and duplicates.
+func SameCIDRs(a, b []string) bool {
+	toSet := func(list []string) map[string]bool {
+		set := map[string]bool{}
+		for _, cidr := range list {
+			set[cidr] = true
+		}
+		return set
+	}
+	setA, setB := toSet(a), toSet(b)
+	if len(setA) != len(setB) {
+		return false
+	}
+	for cidr := range setA {
+		if !setB[cidr] {
+			return false
+		}
+	}
+	return true
+}
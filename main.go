@@ -21,6 +21,7 @@ import (
 	"fmt"
 	"os"
 
+	"github.com/cockroachdb/cockroach-prod/base"
 	"github.com/cockroachdb/cockroach-prod/cli"
 )
 
@@ -29,7 +30,8 @@ func main() {
 		os.Args = append(os.Args, "help")
 	}
 	if err := cli.Run(os.Args[1:]); err != nil {
-		fmt.Fprintf(os.Stderr, "Failed running command %q: %v\n", os.Args[1:], err)
-		os.Exit(1)
+		kind := base.GetErrorKind(err)
+		fmt.Fprintf(os.Stderr, "Failed running command %q: %s error: %v\n", os.Args[1:], kind, err)
+		os.Exit(kind.ExitCode())
 	}
 }
@@ -0,0 +1,440 @@
+// Copyright 2015 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+//
+// Author: Marc Berhault (marc@cockroachlabs.com)
+
+package security
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/cockroachdb/cockroach/util"
+)
+
+// File names follow the cockroach conventions: the cockroach binary expects
+// ca.crt, node.server.{crt,key} and node.client.{crt,key} in its --certs directory.
+const (
+	caCertFile = "ca.crt"
+	nodeUser   = "node"
+	clientsDir = "clients"
+
+	// CA file prefixes. During a CA rollover, the next CA is created alongside
+	// the current one and, once promoted, the current one becomes the old CA.
+	caPrefix     = "ca"
+	nextCAPrefix = "ca.next"
+	oldCAPrefix  = "ca.old"
+
+	keySize      = 2048
+	caValidity   = 5 * 365 * 24 * time.Hour
+	certValidity = 365 * 24 * time.Hour
+	// Allow for clock skew between the local machine and the nodes.
+	validFromOffset = -time.Hour
+
+	certPermissions = 0644
+	keyPermissions  = 0600
+	dirPermissions  = 0700
+)
+
+// CA is a certificate authority used to sign node and client certificates.
+type CA struct {
+	Cert *x509.Certificate
+	Key  *rsa.PrivateKey
+	// Other CA certificates nodes must trust. Only set during a CA rollover.
+	Trusted []*x509.Certificate
+}
+
+// CACertPath returns the path of the CA certificate in the certs directory.
+func CACertPath(certsDir string) string {
+	return filepath.Join(certsDir, caCertFile)
+}
+
+// NodeCertsDir returns the directory holding the certificates for the given node.
+func NodeCertsDir(certsDir, nodeName string) string {
+	return filepath.Join(certsDir, nodeName)
+}
+
+// CACertFiles returns the paths of the existing CA certificates: the current
+// CA, and the next or old CA during a rollover.
+func CACertFiles(certsDir string) []string {
+	var files []string
+	for _, prefix := range []string{caPrefix, nextCAPrefix, oldCAPrefix} {
+		path := filepath.Join(certsDir, prefix+".crt")
+		if _, err := os.Stat(path); err == nil {
+			files = append(files, path)
+		}
+	}
+	return files
+}
+
+// NodeCertFiles returns the paths of all files in the node's certs directory.
+// These must be copied to the node.
+func NodeCertFiles(certsDir, nodeName string) []string {
+	nodeDir := NodeCertsDir(certsDir, nodeName)
+	var files []string
+	for _, name := range []string{caCertFile, "node.server.crt", "node.server.key", "node.client.crt",
+		"node.client.key"} {
+		files = append(files, filepath.Join(nodeDir, name))
+	}
+	return files
+}
+
+// ClientCertsDir returns the directory holding the certificates for the given
+// client user.
+func ClientCertsDir(certsDir, user string) string {
+	return filepath.Join(certsDir, clientsDir, user)
+}
+
+// LoadOrCreateCA loads the CA from the certs directory, creating it first
+// if it does not exist.
+func LoadOrCreateCA(certsDir string) (*CA, error) {
+	if _, err := os.Stat(CACertPath(certsDir)); err == nil {
+		return LoadCA(certsDir)
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	return CreateCA(certsDir)
+}
+
+// LoadCA loads the CA certificate and key from the certs directory.
+// If a CA rollover is in progress, the other CA certificate is added to the
+// trusted certificates.
+func LoadCA(certsDir string) (*CA, error) {
+	ca, err := loadCA(certsDir, caPrefix)
+	if err != nil {
+		return nil, err
+	}
+	for _, prefix := range []string{nextCAPrefix, oldCAPrefix} {
+		path := filepath.Join(certsDir, prefix+".crt")
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			continue
+		}
+		cert, err := readCertificate(path)
+		if err != nil {
+			return nil, util.Errorf("could not read CA certificate: %v", err)
+		}
+		ca.Trusted = append(ca.Trusted, cert)
+	}
+	return ca, nil
+}
+
+func loadCA(certsDir, prefix string) (*CA, error) {
+	cert, err := readCertificate(filepath.Join(certsDir, prefix+".crt"))
+	if err != nil {
+		return nil, util.Errorf("could not read CA certificate: %v", err)
+	}
+	key, err := readKey(filepath.Join(certsDir, prefix+".key"))
+	if err != nil {
+		return nil, util.Errorf("could not read CA key: %v", err)
+	}
+	return &CA{Cert: cert, Key: key}, nil
+}
+
+// CreateCA generates a new CA certificate and key and writes them to the
+// certs directory.
+func CreateCA(certsDir string) (*CA, error) {
+	return createCA(certsDir, caPrefix)
+}
+
+func createCA(certsDir, prefix string) (*CA, error) {
+	key, err := rsa.GenerateKey(rand.Reader, keySize)
+	if err != nil {
+		return nil, err
+	}
+
+	template, err := newTemplate("Cockroach CA", caValidity)
+	if err != nil {
+		return nil, err
+	}
+	template.IsCA = true
+	template.BasicConstraintsValid = true
+	template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(certsDir, dirPermissions); err != nil {
+		return nil, err
+	}
+	if err := writeCertificateAndKey(certsDir, prefix, der, key); err != nil {
+		return nil, err
+	}
+	return &CA{Cert: cert, Key: key}, nil
+}
+
+// CARolloverState describes the progress of a CA rollover.
+type CARolloverState int
+
+// CA rollover states, in order.
+const (
+	// No rollover in progress.
+	NoCARollover CARolloverState = iota
+	// The next CA exists but is not signing certificates yet.
+	NextCACreated
+	// The promotion of the next CA was interrupted: PromoteNextCA must be run
+	// again before the CA can be loaded.
+	NextCAPromoting
+	// The next CA was promoted, the old CA is still trusted.
+	OldCARetiring
+)
+
+// GetCARolloverState looks at the CA files in the certs directory to figure out
+// whether a CA rollover is in progress.
+func GetCARolloverState(certsDir string) (CARolloverState, error) {
+	hasNext, err := fileExists(filepath.Join(certsDir, nextCAPrefix+".crt"))
+	if err != nil {
+		return NoCARollover, err
+	}
+	hasOld, err := fileExists(filepath.Join(certsDir, oldCAPrefix+".crt"))
+	if err != nil {
+		return NoCARollover, err
+	}
+	switch {
+	case hasNext && hasOld:
+		return NextCAPromoting, nil
+	case hasNext:
+		return NextCACreated, nil
+	case hasOld:
+		return OldCARetiring, nil
+	}
+	return NoCARollover, nil
+}
+
+// fileExists returns true if the file exists.
+func fileExists(path string) (bool, error) {
+	_, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// CreateNextCA starts a CA rollover by creating the next CA. It is trusted
+// alongside the current CA, but does not sign certificates until promoted.
+func CreateNextCA(certsDir string) error {
+	_, err := createCA(certsDir, nextCAPrefix)
+	return err
+}
+
+// PromoteNextCA makes the next CA the current CA. The previous CA certificate
+// is kept as the old CA and is still trusted. Its key is discarded.
+// The next CA certificate is moved last, so an interrupted promotion is in the
+// NextCAPromoting state. Running PromoteNextCA again skips the completed steps.
+func PromoteNextCA(certsDir string) error {
+	path := func(name string) string {
+		return filepath.Join(certsDir, name)
+	}
+
+	retired, err := fileExists(path(oldCAPrefix + ".crt"))
+	if err != nil {
+		return err
+	}
+	if !retired {
+		if err := os.Rename(path(caPrefix+".crt"), path(oldCAPrefix+".crt")); err != nil {
+			return err
+		}
+	}
+
+	hasNextKey, err := fileExists(path(nextCAPrefix + ".key"))
+	if err != nil {
+		return err
+	}
+	if hasNextKey {
+		if err := os.Rename(path(nextCAPrefix+".key"), path(caPrefix+".key")); err != nil {
+			return err
+		}
+	}
+
+	return os.Rename(path(nextCAPrefix+".crt"), path(caPrefix+".crt"))
+}
+
+// RemoveOldCA ends a CA rollover by removing the old CA certificate.
+func RemoveOldCA(certsDir string) error {
+	return os.Remove(filepath.Join(certsDir, oldCAPrefix+".crt"))
+}
+
+// CreateNodeCerts generates the server and client certificates for a node and
+// writes them, along with the CA certificate, to the node's certs directory.
+// 'hosts' are the IP addresses and DNS names the node can be reached at.
+func (ca *CA) CreateNodeCerts(certsDir, nodeName string, hosts []string) error {
+	nodeDir := NodeCertsDir(certsDir, nodeName)
+	if err := os.MkdirAll(nodeDir, dirPermissions); err != nil {
+		return err
+	}
+
+	serverTemplate, err := newTemplate(nodeUser, certValidity)
+	if err != nil {
+		return err
+	}
+	serverTemplate.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			serverTemplate.IPAddresses = append(serverTemplate.IPAddresses, ip)
+		} else {
+			serverTemplate.DNSNames = append(serverTemplate.DNSNames, h)
+		}
+	}
+	if err := ca.signAndWrite(nodeDir, "node.server", serverTemplate); err != nil {
+		return err
+	}
+
+	if err := ca.CreateClientCert(nodeDir, nodeUser); err != nil {
+		return err
+	}
+	return writeFile(filepath.Join(nodeDir, caCertFile), ca.EncodeTrusted(), certPermissions)
+}
+
+// EncodeTrusted returns the PEM-encoded CA certificate followed by the other
+// trusted CA certificates, if any.
+func (ca *CA) EncodeTrusted() []byte {
+	bundle := encodeCertificate(ca.Cert.Raw)
+	for _, cert := range ca.Trusted {
+		bundle = append(bundle, encodeCertificate(cert.Raw)...)
+	}
+	return bundle
+}
+
+// CreateClientCert generates a client certificate and key for the given user
+// and writes them to 'dir' as <user>.client.crt and <user>.client.key.
+func (ca *CA) CreateClientCert(dir, user string) error {
+	template, err := newTemplate(user, certValidity)
+	if err != nil {
+		return err
+	}
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	return ca.signAndWrite(dir, user+".client", template)
+}
+
+// CreateClientBundle writes a client certificate and key for the user along
+// with the CA certificates to the user's directory, ready to be handed to
+// applications. Returns the directory.
+func (ca *CA) CreateClientBundle(certsDir, user string) (string, error) {
+	dir := ClientCertsDir(certsDir, user)
+	if err := os.MkdirAll(dir, dirPermissions); err != nil {
+		return "", err
+	}
+	if err := ca.CreateClientCert(dir, user); err != nil {
+		return "", err
+	}
+	if err := writeFile(filepath.Join(dir, caCertFile), ca.EncodeTrusted(), certPermissions); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+// signAndWrite generates a key, signs the certificate template with the CA,
+// and writes <prefix>.crt and <prefix>.key to 'dir'.
+func (ca *CA) signAndWrite(dir, prefix string, template *x509.Certificate) error {
+	key, err := rsa.GenerateKey(rand.Reader, keySize)
+	if err != nil {
+		return err
+	}
+	template.KeyUsage = x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.Cert, key.Public(), ca.Key)
+	if err != nil {
+		return err
+	}
+	return writeCertificateAndKey(dir, prefix, der, key)
+}
+
+// newTemplate returns a certificate template with a random serial number.
+func newTemplate(commonName string, validity time.Duration) (*x509.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	notBefore := time.Now().Add(validFromOffset)
+	return &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			Organization: []string{"Cockroach"},
+			CommonName:   commonName,
+		},
+		NotBefore: notBefore,
+		NotAfter:  notBefore.Add(validity),
+	}, nil
+}
+
+func encodeCertificate(der []byte) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+func writeCertificateAndKey(dir, prefix string, der []byte, key *rsa.PrivateKey) error {
+	err := writeFile(filepath.Join(dir, prefix+".crt"), encodeCertificate(der), certPermissions)
+	if err != nil {
+		return err
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	return writeFile(filepath.Join(dir, prefix+".key"), keyPEM, keyPermissions)
+}
+
+// writeFile writes to a temporary file and renames it so we never leave
+// partially written certificates behind.
+func writeFile(path string, contents []byte, perm os.FileMode) error {
+	tmpPath := path + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, contents, perm); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// CertificateExpiry returns the expiration time of the first certificate in
+// the given file.
+func CertificateExpiry(path string) (time.Time, error) {
+	cert, err := readCertificate(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return cert.NotAfter, nil
+}
+
+func readCertificate(path string) (*x509.Certificate, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(contents)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, util.Errorf("no certificate found in %s", path)
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+func readKey(path string) (*rsa.PrivateKey, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(contents)
+	if block == nil || block.Type != "RSA PRIVATE KEY" {
+		return nil, util.Errorf("no RSA private key found in %s", path)
+	}
+	return x509.ParsePKCS1PrivateKey(block.Bytes)
+}
@@ -0,0 +1,272 @@
+// Copyright 2015 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+//
+// Author: Marc Berhault (marc@cockroachlabs.com)
+
+package security
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// tempCertsDir creates a temporary certs directory. The returned function
+// removes it.
+func tempCertsDir(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "cockroach-prod-certs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir, func() {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+// readBundle returns a pool of the certificates in the PEM file.
+func readBundle(t *testing.T, path string) (*x509.CertPool, int) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	count := 0
+	for {
+		var block *pem.Block
+		block, contents = pem.Decode(contents)
+		if block == nil {
+			return pool, count
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pool.AddCert(cert)
+		count++
+	}
+}
+
+// verifyNodeCert checks that the node server certificate is signed by one of
+// the certificates in 'roots'.
+func verifyNodeCert(t *testing.T, certsDir, nodeName string, roots *x509.CertPool) error {
+	cert, err := readCertificate(filepath.Join(NodeCertsDir(certsDir, nodeName), "node.server.crt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = cert.Verify(x509.VerifyOptions{
+		Roots:     roots,
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+	return err
+}
+
+func TestLoadOrCreateCA(t *testing.T) {
+	certsDir, cleanup := tempCertsDir(t)
+	defer cleanup()
+
+	created, err := LoadOrCreateCA(certsDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !created.Cert.IsCA {
+		t.Errorf("CA certificate is not a CA")
+	}
+	loaded, err := LoadOrCreateCA(certsDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !loaded.Cert.Equal(created.Cert) {
+		t.Errorf("expected the existing CA to be loaded, got a new one")
+	}
+	if len(loaded.Trusted) != 0 {
+		t.Errorf("expected no other trusted CA, got %d", len(loaded.Trusted))
+	}
+	if info, err := os.Stat(filepath.Join(certsDir, "ca.key")); err != nil {
+		t.Error(err)
+	} else if perm := info.Mode().Perm(); perm != keyPermissions {
+		t.Errorf("expected CA key permissions %o, got %o", keyPermissions, perm)
+	}
+}
+
+func TestCreateNodeCerts(t *testing.T) {
+	certsDir, cleanup := tempCertsDir(t)
+	defer cleanup()
+	ca, err := CreateCA(certsDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		hosts    []string
+		ips, dns int
+	}{
+		{[]string{"10.0.0.1"}, 1, 0},
+		{[]string{"10.0.0.1", "cockroach-1", "lb.example.com", "localhost", "127.0.0.1"}, 2, 3},
+		{[]string{"::1", "fe80::1"}, 2, 0},
+	}
+
+	for i, tc := range testCases {
+		nodeName := "node-" + string('a'+rune(i))
+		if err := ca.CreateNodeCerts(certsDir, nodeName, tc.hosts); err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+		for _, path := range NodeCertFiles(certsDir, nodeName) {
+			if _, err := os.Stat(path); err != nil {
+				t.Errorf("%d: %v", i, err)
+			}
+		}
+		cert, err := readCertificate(filepath.Join(NodeCertsDir(certsDir, nodeName), "node.server.crt"))
+		if err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+		if len(cert.IPAddresses) != tc.ips || len(cert.DNSNames) != tc.dns {
+			t.Errorf("%d: expected %d IP addresses and %d names, got %v and %v",
+				i, tc.ips, tc.dns, cert.IPAddresses, cert.DNSNames)
+		}
+		roots, _ := readBundle(t, filepath.Join(NodeCertsDir(certsDir, nodeName), caCertFile))
+		if err := verifyNodeCert(t, certsDir, nodeName, roots); err != nil {
+			t.Errorf("%d: node certificate does not verify: %v", i, err)
+		}
+	}
+}
+
+// TestCARollover walks through a CA rollover, checking at each step which CAs
+// are trusted, and that certificates issued before the rollover are trusted
+// until it completes.
+func TestCARollover(t *testing.T) {
+	certsDir, cleanup := tempCertsDir(t)
+	defer cleanup()
+	ca, err := CreateCA(certsDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ca.CreateNodeCerts(certsDir, "before", []string{"10.0.0.1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		desc  string
+		step  func(string) error
+		state CARolloverState
+		// Number of CA files and of certificates in the trusted bundle.
+		caFiles, trusted int
+		// Whether certificates issued before the rollover are still trusted.
+		trustsBefore bool
+	}{
+		{"initial", func(string) error { return nil }, NoCARollover, 1, 1, true},
+		{"create next", CreateNextCA, NextCACreated, 2, 2, true},
+		{"promote next", PromoteNextCA, OldCARetiring, 2, 2, true},
+		{"remove old", RemoveOldCA, NoCARollover, 1, 1, false},
+	}
+
+	for i, tc := range testCases {
+		if err := tc.step(certsDir); err != nil {
+			t.Fatalf("%s: %v", tc.desc, err)
+		}
+		state, err := GetCARolloverState(certsDir)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.desc, err)
+		}
+		if state != tc.state {
+			t.Errorf("%s: expected rollover state %d, got %d", tc.desc, tc.state, state)
+		}
+		if files := CACertFiles(certsDir); len(files) != tc.caFiles {
+			t.Errorf("%s: expected %d CA files, got %v", tc.desc, tc.caFiles, files)
+		}
+
+		ca, err := LoadCA(certsDir)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.desc, err)
+		}
+		nodeName := "node-" + string('a'+rune(i))
+		if err := ca.CreateNodeCerts(certsDir, nodeName, []string{"10.0.0.2"}); err != nil {
+			t.Fatalf("%s: %v", tc.desc, err)
+		}
+		roots, count := readBundle(t, filepath.Join(NodeCertsDir(certsDir, nodeName), caCertFile))
+		if count != tc.trusted {
+			t.Errorf("%s: expected %d trusted CA certificates, got %d", tc.desc, tc.trusted, count)
+		}
+		if err := verifyNodeCert(t, certsDir, nodeName, roots); err != nil {
+			t.Errorf("%s: new node certificate does not verify: %v", tc.desc, err)
+		}
+		err = verifyNodeCert(t, certsDir, "before", roots)
+		if tc.trustsBefore && err != nil {
+			t.Errorf("%s: certificate issued before the rollover does not verify: %v", tc.desc, err)
+		} else if !tc.trustsBefore && err == nil {
+			t.Errorf("%s: certificate issued before the rollover is still trusted", tc.desc)
+		}
+	}
+}
+
+// TestPromoteNextCAResume interrupts the promotion of the next CA after each
+// file is moved, and checks that running it again completes it.
+func TestPromoteNextCAResume(t *testing.T) {
+	renames := [][2]string{
+		{caPrefix + ".crt", oldCAPrefix + ".crt"},
+		{nextCAPrefix + ".key", caPrefix + ".key"},
+	}
+
+	for done := 1; done <= len(renames); done++ {
+		func() {
+			certsDir, cleanup := tempCertsDir(t)
+			defer cleanup()
+			if _, err := CreateCA(certsDir); err != nil {
+				t.Fatal(err)
+			}
+			if err := CreateNextCA(certsDir); err != nil {
+				t.Fatal(err)
+			}
+			next, err := loadCA(certsDir, nextCAPrefix)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, r := range renames[:done] {
+				if err := os.Rename(filepath.Join(certsDir, r[0]), filepath.Join(certsDir, r[1])); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if state, err := GetCARolloverState(certsDir); err != nil {
+				t.Fatal(err)
+			} else if state != NextCAPromoting {
+				t.Errorf("%d: expected rollover state %d, got %d", done, NextCAPromoting, state)
+			}
+
+			if err := PromoteNextCA(certsDir); err != nil {
+				t.Fatalf("%d: resuming promotion failed: %v", done, err)
+			}
+			if state, err := GetCARolloverState(certsDir); err != nil {
+				t.Fatal(err)
+			} else if state != OldCARetiring {
+				t.Errorf("%d: expected rollover state %d, got %d", done, OldCARetiring, state)
+			}
+			ca, err := LoadCA(certsDir)
+			if err != nil {
+				t.Fatalf("%d: %v", done, err)
+			}
+			if !ca.Cert.Equal(next.Cert) || ca.Key.N.Cmp(next.Key.N) != 0 {
+				t.Errorf("%d: the next CA was not promoted", done)
+			}
+			if len(ca.Trusted) != 1 {
+				t.Errorf("%d: expected the old CA to be trusted, got %d trusted certificates", done, len(ca.Trusted))
+			}
+		}()
+	}
+}